@@ -3,12 +3,16 @@ package core
 import (
 	"errors"
 	ie "floo/catfs/errors"
+	"floo/catfs/mio"
+	"floo/catfs/mio/compress"
 	n "floo/catfs/nodes"
 	h "floo/util/hashlib"
 	"fmt"
 	e "github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -65,7 +69,8 @@ func Mkdir(lkr *Linker, repoPath string, createParents bool) (dir *n.Directory,
 		return
 	}
 
-	err = lkr.Atomic(func() (bool, error) {
+	args := []string{repoPath, strconv.FormatBool(createParents)}
+	err = lkr.atomicOp(OpMkdir, args, func() (bool, error) {
 		// If it's nil, we might need to create it:
 		if parent == nil {
 			if !createParents {
@@ -101,6 +106,10 @@ func Mkdir(lkr *Linker, repoPath string, createParents bool) (dir *n.Directory,
 			}
 		}
 
+		if err := checkIgnored(lkr, repoPath, true); err != nil {
+			return true, err
+		}
+
 		// Create it then!
 		dir, err = n.NewEmptyDirectory(lkr, parent, basename, lkr.owner, lkr.NextInode())
 		if err != nil {
@@ -112,6 +121,7 @@ func Mkdir(lkr *Linker, repoPath string, createParents bool) (dir *n.Directory,
 		}
 
 		log.Debugf("mkdir: %s", dirname)
+		lkr.notify(Event{Type: EventStaged, Path: dir.Path(), Hash: dir.TreeHash()})
 		return false, nil
 	})
 
@@ -211,15 +221,21 @@ func Move(lkr *Linker, nd n.ModNode, dstPath string) error {
 		)
 	}
 
-	return lkr.Atomic(func() (bool, error) {
+	args := []string{nd.Path(), dstPath}
+	return lkr.atomicOp(OpMove, args, func() (bool, error) {
 		parentDir, err := prepareParent(lkr, nd, dstPath)
 		if err != nil {
 			return true, err
 		}
 
+		oldUsage, err := quotaFilesIfNeeded(lkr, nd)
+		if err != nil {
+			return true, err
+		}
+
 		// Remove the old node:
 		oldPath := nd.Path()
-		_, ghost, err := Remove(lkr, nd, true, true)
+		_, ghost, err := remove(lkr, nd, true, true)
 		if err != nil {
 			return true, e.Wrapf(err, "remove old")
 		}
@@ -228,6 +244,17 @@ func Move(lkr *Linker, nd n.ModNode, dstPath string) error {
 			dstPath = path.Join(parentDir.Path(), path.Base(oldPath))
 		}
 
+		// The files only count for other directories now:
+		newUsage := make([]quotaFile, 0, len(oldUsage))
+		for _, file := range oldUsage {
+			file.path = dstPath + strings.TrimPrefix(file.path, oldPath)
+			newUsage = append(newUsage, file)
+		}
+
+		if err := updateUsage(lkr, oldUsage, newUsage); err != nil {
+			return true, err
+		}
+
 		// The node needs to be told that its path changed,
 		// since it might need to change its hash value now.
 		if err := nd.NotifyMove(lkr, parentDir, dstPath); err != nil {
@@ -246,24 +273,143 @@ func Move(lkr *Linker, nd n.ModNode, dstPath string) error {
 			return true, e.Wrapf(err, "add move mapping")
 		}
 
+		lkr.notify(Event{Type: EventMoved, Path: nd.Path(), OldPath: oldPath, Hash: nd.TreeHash()})
 		return false, nil
 	})
 }
 
+// fileKeys is the way the key of a staged file is stored; see n.File.
+type fileKeys struct {
+	key, salt, wrapped []byte
+}
+
 // StageFromFileNode is a convenient helper that will call Stage() with all necessary params from `f`.
 func StageFromFileNode(lkr *Linker, f *n.File) (*n.File, error) {
-	return Stage(lkr, f.Path(), f.ContentHash(), f.BackendHash(), f.Size(), f.Key())
+	keys := fileKeys{key: f.Key(), salt: f.KeySalt(), wrapped: f.WrappedKey()}
+	return stage(lkr, f.Path(), f.ContentHash(), f.BackendHash(), f.Size(), keys, f.Chunks())
 }
 
 // Stage adds a file to floo's DAG.
+// New files that match the ignore patterns are refused with an error
+// that can be checked with IsIgnoredError. Already existing files
+// can be modified, even if they are ignored. If a user or path quota
+// would be exceeded, an ErrQuotaExceeded is returned. If the linker has
+// a master key, `key` is stored wrapped with it.
 func Stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size uint64, key []byte) (file *n.File, err error) {
+	return stage(lkr, repoPath, contentHash, backendHash, size, fileKeys{key: key}, nil)
+}
+
+// StageWithKeySalt is like Stage, but for data encrypted with a key from
+// lkr.NewFileKey(). Only `keySalt` is stored; the key is derived again
+// from it and the master key by lkr.FileKey().
+func StageWithKeySalt(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size uint64, keySalt []byte) (*n.File, error) {
+	return stage(lkr, repoPath, contentHash, backendHash, size, fileKeys{salt: keySalt}, nil)
+}
+
+// StageChunked is like Stage, but for files whose data is stored as
+// content defined chunks (see mio.WriteChunked). The chunks have to be
+// written with lkr.ChunkSecret(). The backend hash of the file is
+// derived from the chunk list.
+func StageChunked(lkr *Linker, repoPath string, contentHash h.Hash, chunks []n.Chunk, size uint64) (*n.File, error) {
+	return stage(lkr, repoPath, contentHash, n.ChunksHash(chunks), size, fileKeys{}, chunks)
+}
+
+// StageFromReader reads the data of a file from `r`, compresses it with
+// `algo`, encrypts it with a fresh key (derived from the master key if one
+// is set, random otherwise) and puts it into `store`. The file is then staged like with Stage().
+// The data is read only once; its content hash and size are computed
+// while it is streamed to the store. The backend hash is the one
+// returned by `store`, since the store decides where the data is kept.
+//
+// Ignore patterns and quotas are checked before anything is uploaded;
+// the size is not known then, so quotas are checked again by stage.
+// If staging fails after the upload, the backend hash is returned along
+// with the error, so the caller can remove the unreferenced object.
+func StageFromReader(lkr *Linker, repoPath string, r io.Reader, store ObjectStore, algo compress.AlgorithmType) (*n.File, h.Hash, error) {
+	if err := checkStageable(lkr, repoPath); err != nil {
+		return nil, nil, err
+	}
+
+	key, keys, err := lkr.newDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream, err := mio.NewHashingInStream(r, key, algo, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backendHash, err := store.Put(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := stream.Result()
+	if err != nil {
+		return nil, backendHash, err
+	}
+
+	file, err := stage(lkr, repoPath, result.ContentHash, backendHash, result.Size, keys, nil)
+	return file, backendHash, err
+}
+
+// StageFromReaderAuto is like StageFromReader, but picks the compression
+// algorithm by looking at the data (see mio.GuessAlgorithm). Pass an
+// *os.File or another io.ReaderAt to base the guess on more than the header.
+func StageFromReaderAuto(lkr *Linker, repoPath string, r io.Reader, store ObjectStore) (*n.File, h.Hash, error) {
+	algo, r, err := mio.GuessAlgorithm(repoPath, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return StageFromReader(lkr, repoPath, r, store, algo)
+}
+
+// checkStageable checks if a file could be staged at `repoPath`, as far
+// as that is possible without knowing its size: it must not be ignored
+// and adding it must not exceed the file count of any quota.
+func checkStageable(lkr *Linker, repoPath string) error {
+	node, err := lkr.LookupNode(repoPath)
+	if err != nil && !ie.IsNoSuchFileError(err) {
+		return err
+	}
+
+	if node == nil || node.Type() == n.NodeTypeGhost {
+		if err := checkIgnored(lkr, repoPath, false); err != nil {
+			return err
+		}
+	}
+
+	var oldUsage []quotaFile
+	if file, ok := node.(*n.File); ok {
+		oldUsage = []quotaFile{{path: file.Path(), user: file.User(), size: file.Size()}}
+	}
+
+	return checkUsage(lkr, oldUsage, []quotaFile{{path: repoPath, user: lkr.owner}})
+}
+
+func stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size uint64, keys fileKeys, chunks []n.Chunk) (file *n.File, err error) {
 	node, lerr := lkr.LookupNode(repoPath)
 	if lerr != nil && !ie.IsNoSuchFileError(lerr) {
 		err = lerr
 		return
 	}
 
-	err = lkr.Atomic(func() (bool, error) {
+	if node == nil || node.Type() == n.NodeTypeGhost {
+		if err = checkIgnored(lkr, repoPath, false); err != nil {
+			return
+		}
+	}
+
+	args := []string{
+		repoPath,
+		contentHash.B58String(),
+		backendHash.B58String(),
+		strconv.FormatUint(size, 10),
+	}
+
+	err = lkr.atomicOp(OpStage, args, func() (bool, error) {
 		if node != nil {
 			if node.Type() == n.NodeTypeGhost {
 				ghostParent, err := n.ParentDirectory(lkr, node)
@@ -295,6 +441,7 @@ func Stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size u
 		}
 
 		needRemove := false
+		var oldUsage []quotaFile
 		if file != nil {
 			// We know this file already.
 			log.WithFields(log.Fields{"file": repoPath}).Info("File exists; modifying.")
@@ -304,6 +451,10 @@ func Stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size u
 				log.Debugf("Hash was not modified. Not doing any update.")
 				return false, nil
 			}
+
+			// The old size is counted for the user that modified it last,
+			// which is not necessarily the one that modifies it now:
+			oldUsage = []quotaFile{{path: file.Path(), user: file.User(), size: file.Size()}}
 		} else {
 			parent, err := mkdirParents(lkr, repoPath)
 			if err != nil {
@@ -314,6 +465,11 @@ func Stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size u
 			file = n.NewEmptyFile(parent, path.Base(repoPath), lkr.owner, lkr.NextInode())
 		}
 
+		newUsage := []quotaFile{{path: file.Path(), user: lkr.owner, size: size}}
+		if err := updateUsage(lkr, oldUsage, newUsage); err != nil {
+			return true, err
+		}
+
 		parentDir, err := n.ParentDirectory(lkr, file)
 		if err != nil {
 			return true, err
@@ -334,9 +490,18 @@ func Stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size u
 		file.SetModTime(time.Now())
 		file.SetContent(lkr, contentHash)
 		file.SetBackend(lkr, backendHash)
-		file.SetKey(key)
+		file.SetKey(keys.key)
+		file.SetKeySalt(keys.salt)
+		file.SetWrappedKey(keys.wrapped)
+		file.SetChunks(chunks)
 		file.SetUser(lkr.owner)
 
+		if lkr.masterKey != nil {
+			if _, err := lkr.migrateFileKey(file); err != nil {
+				return true, err
+			}
+		}
+
 		// Add it again when the hash was changed.
 		log.Debugf("adding %s (%v)", file.Path(), file.BackendHash())
 		if err := parentDir.Add(lkr, file); err != nil {
@@ -347,6 +512,7 @@ func Stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size u
 			return true, err
 		}
 
+		lkr.notify(Event{Type: EventStaged, Path: file.Path(), Hash: file.TreeHash()})
 		return false, nil
 	})
 
@@ -357,6 +523,33 @@ func Stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size u
 // `nd` is the node that shall be removed and may not be root.
 // The parent directory is returned.
 func Remove(lkr *Linker, nd n.ModNode, createGhost, force bool) (parentDir *n.Directory, ghost *n.Ghost, err error) {
+	nodePath := nd.Path()
+	args := []string{nodePath, strconv.FormatBool(createGhost)}
+	err = lkr.atomicOp(OpRemove, args, func() (bool, error) {
+		usage, err := quotaFilesIfNeeded(lkr, nd)
+		if err != nil {
+			return true, err
+		}
+
+		parentDir, ghost, err = remove(lkr, nd, createGhost, force)
+		if err != nil {
+			return true, err
+		}
+
+		if err := updateUsage(lkr, usage, nil); err != nil {
+			return true, err
+		}
+
+		lkr.notify(Event{Type: EventRemoved, Path: nodePath, Hash: nd.TreeHash()})
+		return false, nil
+	})
+
+	return
+}
+
+// remove is like Remove, but does not emit an event.
+// It is used by operations that emit an own event, like Move.
+func remove(lkr *Linker, nd n.ModNode, createGhost, force bool) (parentDir *n.Directory, ghost *n.Ghost, err error) {
 	if !force && nd.Type() == n.NodeTypeGhost {
 		err = ErrIsGhost
 		return
@@ -0,0 +1,247 @@
+package core
+
+import (
+	"floo/catfs/db"
+	n "floo/catfs/nodes"
+	h "floo/util/hashlib"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// crashScenario is a linker operation that is run with faults injected
+// at every possible point. `setup` is run without any faults before.
+type crashScenario struct {
+	name  string
+	setup func(t *testing.T, lkr *Linker)
+	run   func(t *testing.T, lkr *Linker) error
+}
+
+func setupCrashRepo(t *testing.T, lkr *Linker) {
+	require.Nil(t, lkr.SetOwner("alice"))
+	MustCommit(t, lkr, "init")
+
+	_, err := Mkdir(lkr, "/dir", true)
+	require.Nil(t, err)
+
+	MustTouchAndCommit(t, lkr, "/dir/a", 1)
+	MustTouchAndCommit(t, lkr, "/x", 2)
+
+	_, err = Stage(lkr, "/y", h.TestDummy(t, 3), h.TestDummy(t, 3), 3, nil)
+	require.Nil(t, err)
+}
+
+var crashScenarios = []crashScenario{
+	{
+		name:  "stage",
+		setup: setupCrashRepo,
+		run: func(t *testing.T, lkr *Linker) error {
+			_, err := Stage(lkr, "/dir/b", h.TestDummy(t, 4), h.TestDummy(t, 4), 4, nil)
+			return err
+		},
+	}, {
+		name:  "commit",
+		setup: setupCrashRepo,
+		run: func(t *testing.T, lkr *Linker) error {
+			return lkr.MakeCommit(n.AuthorOfStage, "crash")
+		},
+	}, {
+		name:  "move",
+		setup: setupCrashRepo,
+		run: func(t *testing.T, lkr *Linker) error {
+			nd, err := lkr.LookupModNode("/dir/a")
+			if err != nil {
+				return err
+			}
+
+			return Move(lkr, nd, "/dir/c")
+		},
+	}, {
+		name:  "checkout",
+		setup: setupCrashRepo,
+		run: func(t *testing.T, lkr *Linker) error {
+			head, err := lkr.Head()
+			if err != nil {
+				return err
+			}
+
+			parent, err := head.Parent(lkr)
+			if err != nil {
+				return err
+			}
+
+			return lkr.CheckoutCommit(parent.(*n.Commit), true)
+		},
+	},
+}
+
+// crashSignature describes the state of the linker in a way that does not
+// depend on timestamps, so states of different runs can be compared.
+func crashSignature(t *testing.T, lkr *Linker) string {
+	head, err := lkr.Head()
+	require.Nil(t, err)
+
+	root, err := lkr.Root()
+	require.Nil(t, err)
+
+	lines := []string{}
+	err = n.Walk(lkr, root, true, func(child n.Node) error {
+		line := fmt.Sprintf("%s %s %s", child.Type(), child.Path(), child.ContentHash().B58String())
+		lines = append(lines, line)
+		return nil
+	})
+
+	require.Nil(t, err)
+	sort.Strings(lines)
+	return head.Message() + "\n" + strings.Join(lines, "\n")
+}
+
+// assertConsistent checks that a freshly loaded linker can read everything
+// reachable from the stage and from HEAD.
+func assertConsistent(t *testing.T, lkr *Linker) {
+	head, err := lkr.Head()
+	require.Nil(t, err)
+
+	status, err := lkr.Status()
+	require.Nil(t, err)
+	require.NotNil(t, status)
+
+	stageRoot, err := lkr.Root()
+	require.Nil(t, err)
+
+	headRoot, err := lkr.DirectoryByHash(head.Root())
+	require.Nil(t, err)
+	require.NotNil(t, headRoot)
+
+	require.Nil(t, n.Walk(lkr, headRoot, true, func(child n.Node) error {
+		return nil
+	}))
+
+	require.Nil(t, n.Walk(lkr, stageRoot, true, func(child n.Node) error {
+		nd, err := lkr.LookupNode(child.Path())
+		if err != nil {
+			return err
+		}
+
+		if !nd.TreeHash().Equal(child.TreeHash()) {
+			return fmt.Errorf("lookup of %s yields a different node", child.Path())
+		}
+
+		byInode, err := lkr.NodeByInode(child.Inode())
+		if err != nil {
+			return err
+		}
+
+		if byInode == nil {
+			return fmt.Errorf("no inode entry for %s", child.Path())
+		}
+
+		return nil
+	}))
+}
+
+func withCrashEnv(t *testing.T, scenario crashScenario, fn func(fdb *db.FaultyDatabase, lkr *Linker)) {
+	fdb := db.NewFaultyDatabase(db.NewMemoryDatabase(), 42)
+	lkr := NewLinker(fdb)
+	scenario.setup(t, lkr)
+	fn(fdb, lkr)
+}
+
+var crashOps = []db.FaultOp{
+	db.FaultGet,
+	db.FaultIterate,
+	db.FaultPut,
+	db.FaultErase,
+	db.FaultClear,
+	db.FaultFlush,
+}
+
+// TestCrashConsistency runs every scenario with a fault or crash injected
+// at every call of every operation and checks that the store always ends up
+// either in the state before or after the operation.
+func TestCrashConsistency(t *testing.T) {
+	for _, scenario := range crashScenarios {
+		var before, after string
+		calls := make(map[db.FaultOp]int)
+
+		// Dry run to find out the states and the number of failure points:
+		withCrashEnv(t, scenario, func(fdb *db.FaultyDatabase, lkr *Linker) {
+			before = crashSignature(t, NewLinker(fdb))
+			for _, op := range crashOps {
+				calls[op] = fdb.Calls(op)
+			}
+
+			require.Nil(t, scenario.run(t, lkr))
+
+			for _, op := range crashOps {
+				calls[op] = fdb.Calls(op) - calls[op]
+			}
+
+			after = crashSignature(t, NewLinker(fdb))
+		})
+
+		require.NotEqual(t, before, after, scenario.name)
+
+		for _, op := range crashOps {
+			for _, crash := range []bool{false, true} {
+				for idx := 1; idx <= calls[op]; idx++ {
+					name := fmt.Sprintf("%s-%s-%d-crash=%t", scenario.name, op, idx, crash)
+					t.Run(name, func(t *testing.T) {
+						withCrashEnv(t, scenario, func(fdb *db.FaultyDatabase, lkr *Linker) {
+							if crash {
+								fdb.CrashAt(op, idx)
+							} else {
+								fdb.FailAt(op, idx)
+							}
+
+							err := scenario.run(t, lkr)
+							crashed := fdb.Crashed()
+							fdb.Recover()
+
+							fresh := NewLinker(fdb)
+							assertConsistent(t, fresh)
+
+							state := crashSignature(t, fresh)
+							if err == nil && !crashed {
+								require.Equal(t, after, state)
+								return
+							}
+
+							if state != before && state != after {
+								t.Fatalf("partial state after %v:\n%s", err, state)
+							}
+						})
+					})
+				}
+			}
+		}
+	}
+}
+
+// TestFaultyDatabaseRandom makes random operations fail during a longer
+// session and checks that the store stays readable.
+func TestFaultyDatabaseRandom(t *testing.T) {
+	fdb := db.NewFaultyDatabase(db.NewMemoryDatabase(), 23)
+	lkr := NewLinker(fdb)
+	setupCrashRepo(t, lkr)
+
+	fdb.FailRandomly(db.FaultPut, 0.01)
+	fdb.FailRandomly(db.FaultFlush, 0.05)
+
+	for idx := 0; idx < 50; idx++ {
+		repoPath := fmt.Sprintf("/dir/file-%d", idx%7)
+		if _, err := Stage(lkr, repoPath, h.TestDummy(t, byte(idx)), h.TestDummy(t, byte(idx)), uint64(idx), nil); err != nil {
+			continue
+		}
+
+		if idx%5 == 0 {
+			lkr.MakeCommit(n.AuthorOfStage, fmt.Sprintf("cmt %d", idx))
+		}
+	}
+
+	fdb.Reset()
+	assertConsistent(t, NewLinker(fdb))
+}
@@ -14,7 +14,19 @@
 // stage/moves/overlay/<INODE>           => MOVE_INFO
 //
 // stats/max-inode                       => UINT64
+// stats/max-oplog-seq                   => UINT64
 // refs/<REFNAME>                        => NODE_HASH
+// ignore/<FULL_DIR_PATH>                => IGNORE_PATTERNS
+// quota/user/<USER>                     => QUOTA
+// quota/path/<FULL_DIR_PATH>            => QUOTA
+// quota/usage/user/<USER>               => USAGE
+// quota/usage/path/<FULL_DIR_PATH>      => USAGE
+// oplog/<SEQ>                           => OP (JSON)
+// keys/master-check                     => MASTER_KEY_CHECK (HMAC)
+// keys/chunk-secret                     => CHUNK_SECRET (maybe wrapped)
+// rekey/done/<OLD_BACKEND_HASH>         => REKEYED_OBJECT (JSON)
+// rekey/new/<NEW_BACKEND_HASH>          => (empty)
+// rekeyed/<OLD_BACKEND_HASH>            => REKEYED_OBJECT (JSON)
 //
 // Defined by caller:
 //
@@ -29,18 +29,11 @@ func NewGarbageCollector(lkr *Linker, kv db.Database, kc func(nd n.Node) bool) *
 }
 
 func (gc *GarbageCollector) markMoveMap(key []string) error {
-	keys, err := gc.kv.Keys(key...)
-	if err != nil {
-		return err
-	}
-
-	for _, key := range keys {
-		data, err := gc.kv.Get(key...)
-		if err != nil {
-			return err
-		}
+	iter := gc.kv.Iterator(db.IterOptions{Prefix: key})
+	defer iter.Close()
 
-		node, _, err := gc.lkr.parseMoveMappingLine(string(data))
+	for iter.Next() {
+		node, _, err := gc.lkr.parseMoveMappingLine(string(iter.Value()))
 		if err != nil {
 			return err
 		}
@@ -50,7 +43,7 @@ func (gc *GarbageCollector) markMoveMap(key []string) error {
 		}
 	}
 
-	return nil
+	return iter.Err()
 }
 
 func (gc *GarbageCollector) mark(cmt *n.Commit, recursive bool) error {
@@ -94,12 +87,11 @@ func (gc *GarbageCollector) sweep(prefix []string) (int, error) {
 	removed := 0
 
 	return removed, gc.lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
-		keys, err := gc.kv.Keys(prefix...)
-		if err != nil {
-			return hintRollback(err)
-		}
+		iter := gc.kv.Iterator(db.IterOptions{Prefix: prefix, KeysOnly: true})
+		defer iter.Close()
 
-		for _, key := range keys {
+		for iter.Next() {
+			key := iter.Key()
 			b58Hash := key[len(key)-1]
 			if _, ok := gc.markMap[b58Hash]; ok {
 				continue
@@ -132,7 +124,7 @@ func (gc *GarbageCollector) sweep(prefix []string) (int, error) {
 			removed++
 		}
 
-		return false, nil
+		return hintRollback(iter.Err())
 	})
 }
 
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bytes"
+	"floo/catfs/db"
+	ie "floo/catfs/errors"
+	"floo/catfs/ignore"
+	"path"
+	"strings"
+)
+
+// SetIgnorePatterns stores the ignore patterns of the directory at `dirPath`.
+// `data` has the same format as a `.flooignore` file. Passing empty `data`
+// removes all patterns of this directory.
+//
+// The patterns are not versioned: they are not part of commits and
+// are neither changed by a checkout nor transferred by sync.
+func (lkr *Linker) SetIgnorePatterns(dirPath string, data []byte) error {
+	// Check if the patterns are valid before storing them:
+	if err := ignore.NewMatcher().Add(dirPath, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	key := appendDot(path.Clean("/" + dirPath))
+	err := lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		if len(data) == 0 {
+			batch.Erase("ignore", key)
+		} else {
+			batch.Put(data, "ignore", key)
+		}
+
+		return false, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Make sure the next call to IgnoreMatcher() picks up the change.
+	lkr.ignoreMatcher = nil
+	return nil
+}
+
+// IgnorePatterns returns the ignore patterns previously set for `dirPath`
+// with SetIgnorePatterns. If there are none, nil is returned.
+func (lkr *Linker) IgnorePatterns(dirPath string) ([]byte, error) {
+	data, err := lkr.kv.Get("ignore", appendDot(path.Clean("/"+dirPath)))
+	if err == db.ErrNoSuchKey {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+// IgnoreMatcher returns a matcher that knows about the ignore patterns
+// of all directories. The matcher is cached until the patterns change
+// or the database is rolled back (see MemIndexClear).
+func (lkr *Linker) IgnoreMatcher() (*ignore.Matcher, error) {
+	if lkr.ignoreMatcher != nil {
+		return lkr.ignoreMatcher, nil
+	}
+
+	iter := lkr.kv.Iterator(db.IterOptions{Prefix: []string{"ignore"}})
+	defer iter.Close()
+
+	matcher := ignore.NewMatcher()
+	for iter.Next() {
+		// Backends split the key at slashes, so glue the path together again.
+		dirPath := path.Clean("/" + strings.Join(iter.Key()[1:], "/"))
+		if err := matcher.Add(dirPath, bytes.NewReader(iter.Value())); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	// Inside a batch, the patterns might still change or be rolled back.
+	if lkr.atomicDepth == 0 {
+		lkr.ignoreMatcher = matcher
+	}
+
+	return matcher, nil
+}
+
+// checkIgnored returns an ignored error if `repoPath` matches
+// any of the stored ignore patterns.
+func checkIgnored(lkr *Linker, repoPath string, isDir bool) error {
+	matcher, err := lkr.IgnoreMatcher()
+	if err != nil {
+		return err
+	}
+
+	if matcher.Match(repoPath, isDir) {
+		return ie.Ignored(repoPath)
+	}
+
+	return nil
+}
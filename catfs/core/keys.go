@@ -0,0 +1,398 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"floo/catfs/db"
+	n "floo/catfs/nodes"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+const (
+	// Size of the keys handed out by FileKey().
+	fileKeySize = 32
+
+	// Size of the per-file salt the key is derived from.
+	keySaltSize = 32
+
+	// Prefixes of the stored chunk secret.
+	chunkSecretPlain   = 0
+	chunkSecretWrapped = 1
+)
+
+var (
+	// ErrNoMasterKey is returned when a file key needs the master key,
+	// but SetMasterKey() was not called.
+	ErrNoMasterKey = errors.New("no master key set")
+
+	// ErrWrongMasterKey is returned by SetMasterKey() when the key
+	// differs from the one the repository was used with before.
+	ErrWrongMasterKey = errors.New("master key does not match the repository")
+)
+
+// masterKeyCheck returns a value that identifies `master`
+// without allowing to derive anything from it.
+func masterKeyCheck(master []byte) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("floo master key check"))
+	return mac.Sum(nil)
+}
+
+// hkdfKey derives a fileKeySize long key from `master` for `purpose`.
+func hkdfKey(master, salt []byte, purpose string) ([]byte, error) {
+	key := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, salt, []byte(purpose)), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// wrapKey encrypts `key` with a key derived from `master`.
+// The random nonce is stored in front of the encrypted key.
+func wrapKey(master, key []byte) ([]byte, error) {
+	wrapping, err := hkdfKey(master, nil, "floo key wrapping")
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(wrapping)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(key)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// unwrapKey reverses wrapKey.
+func unwrapKey(master, wrapped []byte) ([]byte, error) {
+	wrapping, err := hkdfKey(master, nil, "floo key wrapping")
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(wrapping)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short: %d", len(wrapped))
+	}
+
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+// SetMasterKey sets the key that file keys are derived from or wrapped
+// with. The master key itself is never stored; only a check value that
+// detects when a different master key is used for the same repository.
+func (lkr *Linker) SetMasterKey(master []byte) error {
+	check := masterKeyCheck(master)
+	stored, err := lkr.kv.Get("keys", "master-check")
+	if err != nil && err != db.ErrNoSuchKey {
+		return err
+	}
+
+	if stored != nil && !hmac.Equal(stored, check) {
+		return ErrWrongMasterKey
+	}
+
+	if stored == nil {
+		err := lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+			batch.Put(check, "keys", "master-check")
+			return false, nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	lkr.masterKey = append([]byte(nil), master...)
+	return nil
+}
+
+// HasMasterKey returns true if SetMasterKey() was called successfully.
+func (lkr *Linker) HasMasterKey() bool {
+	return lkr.masterKey != nil
+}
+
+// NewFileKey returns a fresh key for encrypting a file and the salt it is
+// derived from. Only the salt should be stored, by passing it to
+// StageWithKeySalt(); FileKey() will derive the key again from it.
+func (lkr *Linker) NewFileKey() (key, salt []byte, err error) {
+	if lkr.masterKey == nil {
+		return nil, nil, ErrNoMasterKey
+	}
+
+	salt = make([]byte, keySaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, err
+	}
+
+	key, err = hkdfKey(lkr.masterKey, salt, "floo file key")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, salt, nil
+}
+
+// newDataKey returns a fresh key for encrypting data and how it is stored
+// in the file node: derived from the master key if one is set (only the
+// salt is stored), random and stored directly otherwise.
+func (lkr *Linker) newDataKey() ([]byte, fileKeys, error) {
+	if lkr.masterKey != nil {
+		key, salt, err := lkr.NewFileKey()
+		return key, fileKeys{salt: salt}, err
+	}
+
+	key := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fileKeys{}, err
+	}
+
+	return key, fileKeys{key: key}, nil
+}
+
+// FileKey returns the key the data of `file` is encrypted with.
+// Derived and wrapped keys need the master key; old files that still
+// store their key directly work without it. Files stored in chunks
+// have no key of their own and nil is returned for them. If the data
+// was re-encrypted by Rekey(), the key of the new object is returned
+// (see FileBackend).
+func (lkr *Linker) FileKey(file *n.File) ([]byte, error) {
+	obj, err := lkr.replacedObject(file.BackendHash())
+	if err != nil {
+		return nil, err
+	}
+
+	if obj != nil {
+		return lkr.dataKey(obj.Key, obj.KeySalt, obj.WrappedKey)
+	}
+
+	return lkr.dataKey(file.Key(), file.KeySalt(), file.WrappedKey())
+}
+
+// dataKey returns the key that is stored in one of the three ways.
+func (lkr *Linker) dataKey(key, salt, wrapped []byte) ([]byte, error) {
+	switch {
+	case salt != nil:
+		if lkr.masterKey == nil {
+			return nil, ErrNoMasterKey
+		}
+
+		return hkdfKey(lkr.masterKey, salt, "floo file key")
+	case wrapped != nil:
+		if lkr.masterKey == nil {
+			return nil, ErrNoMasterKey
+		}
+
+		return unwrapKey(lkr.masterKey, wrapped)
+	default:
+		return key, nil
+	}
+}
+
+// ChunkSecret returns the secret that the keys of chunks are derived from
+// (see mio.ChunkKey). It is created randomly on first use and is the same
+// for the whole repository, so identical chunks are stored only once.
+// Like file keys, it is stored wrapped with the master key if one is set
+// and directly otherwise; MigrateFileKeys() wraps it later on.
+func (lkr *Linker) ChunkSecret() ([]byte, error) {
+	stored, err := lkr.kv.Get("keys", "chunk-secret")
+	if err != nil && err != db.ErrNoSuchKey {
+		return nil, err
+	}
+
+	if err == nil {
+		return lkr.unwrapChunkSecret(stored)
+	}
+
+	secret := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+
+	stored = append([]byte{chunkSecretPlain}, secret...)
+	if lkr.masterKey != nil {
+		wrapped, err := wrapKey(lkr.masterKey, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		stored = append([]byte{chunkSecretWrapped}, wrapped...)
+	}
+
+	err = lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		batch.Put(stored, "keys", "chunk-secret")
+		return false, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func (lkr *Linker) unwrapChunkSecret(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("empty chunk secret")
+	}
+
+	switch stored[0] {
+	case chunkSecretPlain:
+		return stored[1:], nil
+	case chunkSecretWrapped:
+		if lkr.masterKey == nil {
+			return nil, ErrNoMasterKey
+		}
+
+		return unwrapKey(lkr.masterKey, stored[1:])
+	default:
+		return nil, fmt.Errorf("unknown chunk secret format: %d", stored[0])
+	}
+}
+
+// migrateReplacedKeys wraps the keys of objects that replaced
+// others (see Rekey) if they are stored directly.
+func (lkr *Linker) migrateReplacedKeys(batch db.Batch) error {
+	iter := lkr.kv.Iterator(db.IterOptions{Prefix: []string{"rekeyed"}})
+	defer iter.Close()
+
+	for iter.Next() {
+		obj := rekeyedObject{}
+		if err := json.Unmarshal(iter.Value(), &obj); err != nil {
+			return err
+		}
+
+		if obj.Key == nil {
+			continue
+		}
+
+		wrapped, err := wrapKey(lkr.masterKey, obj.Key)
+		if err != nil {
+			return err
+		}
+
+		obj.Key, obj.WrappedKey = nil, wrapped
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+
+		batch.Put(data, iter.Key()...)
+	}
+
+	return iter.Err()
+}
+
+// migrateChunkSecret wraps the chunk secret if it is stored directly.
+func (lkr *Linker) migrateChunkSecret(batch db.Batch) error {
+	stored, err := lkr.kv.Get("keys", "chunk-secret")
+	if err == db.ErrNoSuchKey {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(stored) == 0 || stored[0] != chunkSecretPlain {
+		return nil
+	}
+
+	wrapped, err := wrapKey(lkr.masterKey, stored[1:])
+	if err != nil {
+		return err
+	}
+
+	batch.Put(append([]byte{chunkSecretWrapped}, wrapped...), "keys", "chunk-secret")
+	return nil
+}
+
+// migrateFileKey wraps the key of `file` if it is stored directly.
+// It returns false if there was nothing to do.
+func (lkr *Linker) migrateFileKey(file *n.File) (bool, error) {
+	if file.Key() == nil {
+		return false, nil
+	}
+
+	wrapped, err := wrapKey(lkr.masterKey, file.Key())
+	if err != nil {
+		return false, err
+	}
+
+	file.SetWrappedKey(wrapped)
+	file.SetKey(nil)
+	return true, nil
+}
+
+// MigrateFileKeys replaces the keys that are stored directly in file nodes
+// (including ghosts and already committed nodes) by keys wrapped with the
+// master key. The data does not need to be re-encrypted and the hashes
+// of the nodes stay the same. It is safe to call it several times; only
+// nodes that were not migrated yet are touched. The number of migrated
+// nodes is returned. The chunk secret and the keys of objects
+// that replaced others in old versions are wrapped as well.
+func (lkr *Linker) MigrateFileKeys() (int, error) {
+	if lkr.masterKey == nil {
+		return 0, ErrNoMasterKey
+	}
+
+	migrated := 0
+	err := lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		if err := lkr.migrateChunkSecret(batch); err != nil {
+			return true, err
+		}
+
+		if err := lkr.migrateReplacedKeys(batch); err != nil {
+			return true, err
+		}
+
+		for _, prefix := range [][]string{{"objects"}, {"stage", "objects"}} {
+			err := lkr.forEachStoredFile(prefix, func(key []string, nd n.Node, file *n.File) error {
+				changed, err := lkr.migrateFileKey(file)
+				if err != nil || !changed {
+					return err
+				}
+
+				data, err := n.MarshalNode(nd)
+				if err != nil {
+					return err
+				}
+
+				batch.Put(data, key...)
+				migrated++
+				return nil
+			})
+
+			if err != nil {
+				return true, err
+			}
+		}
+
+		return false, nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Cached nodes still have the old keys:
+	lkr.MemIndexClear()
+	return migrated, nil
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"bytes"
+	"floo/catfs/db"
+	"floo/catfs/mio"
+	"floo/catfs/mio/compress"
+	n "floo/catfs/nodes"
+	h "floo/util/hashlib"
+	"floo/util/testutil"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+var testMasterKey = bytes.Repeat([]byte{0x23}, 32)
+
+func TestFileKeyDerived(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		_, _, err := lkr.NewFileKey()
+		require.Equal(t, ErrNoMasterKey, err)
+
+		require.Nil(t, lkr.SetMasterKey(testMasterKey))
+		key, salt, err := lkr.NewFileKey()
+		require.Nil(t, err)
+		require.Len(t, key, fileKeySize)
+
+		_, err = StageWithKeySalt(lkr, "/a", h.TestDummy(t, 1), h.TestDummy(t, 1), 10, salt)
+		require.Nil(t, err)
+
+		// Only the salt may end up in the database:
+		fresh := NewLinker(lkr.kv)
+		nd, err := fresh.LookupNode("/a")
+		require.Nil(t, err)
+
+		file := nd.(*n.File)
+		require.Nil(t, file.Key())
+		require.Equal(t, salt, file.KeySalt())
+
+		_, err = fresh.FileKey(file)
+		require.Equal(t, ErrNoMasterKey, err)
+
+		require.Equal(t, ErrWrongMasterKey, fresh.SetMasterKey(bytes.Repeat([]byte{0x42}, 32)))
+		require.Nil(t, fresh.SetMasterKey(testMasterKey))
+
+		freshKey, err := fresh.FileKey(file)
+		require.Nil(t, err)
+		require.Equal(t, key, freshKey)
+	})
+}
+
+func TestFileKeyWrappedOnStage(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		require.Nil(t, lkr.SetMasterKey(testMasterKey))
+
+		key := bytes.Repeat([]byte{0x01}, 32)
+		file, err := Stage(lkr, "/a", h.TestDummy(t, 1), h.TestDummy(t, 1), 10, key)
+		require.Nil(t, err)
+		require.Nil(t, file.Key())
+		require.NotNil(t, file.WrappedKey())
+
+		fileKey, err := lkr.FileKey(file)
+		require.Nil(t, err)
+		require.Equal(t, key, fileKey)
+	})
+}
+
+func TestMigrateFileKeys(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		keyA := bytes.Repeat([]byte{0x01}, 32)
+		keyB := bytes.Repeat([]byte{0x02}, 32)
+
+		_, err := Stage(lkr, "/a", h.TestDummy(t, 1), h.TestDummy(t, 1), 10, keyA)
+		require.Nil(t, err)
+
+		fileB, err := Stage(lkr, "/b", h.TestDummy(t, 2), h.TestDummy(t, 2), 10, keyB)
+		require.Nil(t, err)
+		require.Nil(t, lkr.MakeCommit(n.AuthorOfStage, "raw keys"))
+
+		// Moving leaves a ghost with the old file behind:
+		require.Nil(t, Move(lkr, fileB, "/c"))
+
+		_, err = lkr.MigrateFileKeys()
+		require.Equal(t, ErrNoMasterKey, err)
+
+		require.Nil(t, lkr.SetMasterKey(testMasterKey))
+		migrated, err := lkr.MigrateFileKeys()
+		require.Nil(t, err)
+		require.True(t, migrated > 0)
+
+		for _, prefix := range [][]string{{"objects"}, {"stage", "objects"}} {
+			iter := lkr.kv.Iterator(db.IterOptions{Prefix: prefix})
+			for iter.Next() {
+				nd, err := n.UnmarshalNode(iter.Value())
+				require.Nil(t, err)
+
+				var file *n.File
+				switch nd.Type() {
+				case n.NodeTypeFile:
+					file = nd.(*n.File)
+				case n.NodeTypeGhost:
+					file, _ = nd.(*n.Ghost).OldFile()
+				}
+
+				if file != nil {
+					require.Nil(t, file.Key(), "%v still has a raw key", file)
+				}
+			}
+
+			require.Nil(t, iter.Err())
+			iter.Close()
+		}
+
+		for path, key := range map[string][]byte{"/a": keyA, "/c": keyB} {
+			nd, err := lkr.LookupNode(path)
+			require.Nil(t, err)
+
+			fileKey, err := lkr.FileKey(nd.(*n.File))
+			require.Nil(t, err)
+			require.Equal(t, key, fileKey)
+		}
+
+		// Nothing left to do:
+		migrated, err = lkr.MigrateFileKeys()
+		require.Nil(t, err)
+		require.Equal(t, 0, migrated)
+	})
+}
+
+func TestChunkSecret(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		secret, err := lkr.ChunkSecret()
+		require.Nil(t, err)
+		require.Len(t, secret, fileKeySize)
+
+		again, err := NewLinker(lkr.kv).ChunkSecret()
+		require.Nil(t, err)
+		require.Equal(t, secret, again)
+
+		// Chunks written with the secret can be read by a fresh linker:
+		store := mio.NewMemoryChunkStore()
+		data := testutil.CreateDummyBuf(32 * 1024)
+		chunks, err := mio.WriteChunked(bytes.NewReader(data), store, secret, compress.AlgoNone)
+		require.Nil(t, err)
+
+		_, err = StageChunked(lkr, "/a", h.Sum(data), chunks, uint64(len(data)))
+		require.Nil(t, err)
+
+		// Wrapping it with the master key keeps the secret:
+		require.Nil(t, lkr.SetMasterKey(testMasterKey))
+		_, err = lkr.MigrateFileKeys()
+		require.Nil(t, err)
+
+		fresh := NewLinker(lkr.kv)
+		_, err = fresh.ChunkSecret()
+		require.Equal(t, ErrNoMasterKey, err)
+
+		require.Nil(t, fresh.SetMasterKey(testMasterKey))
+		freshSecret, err := fresh.ChunkSecret()
+		require.Nil(t, err)
+		require.Equal(t, secret, freshSecret)
+
+		nd, err := fresh.LookupNode("/a")
+		require.Nil(t, err)
+
+		read, err := io.ReadAll(mio.NewChunkedOutStream(nd.(*n.File).Chunks(), store, freshSecret))
+		require.Nil(t, err)
+		require.Equal(t, data, read)
+	})
+}
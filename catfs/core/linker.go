@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"floo/catfs/db"
 	ie "floo/catfs/errors"
+	"floo/catfs/ignore"
 	n "floo/catfs/nodes"
 	h "floo/util/hashlib"
 	"floo/util/trie"
@@ -39,28 +40,106 @@ type Linker struct {
 
 	// Cache for the linker owner.
 	owner string
+
+	// Cache for the ignore patterns; nil if not loaded yet.
+	ignoreMatcher *ignore.Matcher
+
+	// Cache for the quota definitions; nil if not loaded yet.
+	quotas *quotas
+
+	// Distributes change events to subscribers.
+	notifier *notifier
+
+	// Nesting level of AtomicWithBatch() and the events
+	// that will be published when the outermost call succeeds.
+	atomicDepth   int
+	pendingEvents []Event
+
+	// Entries of the memory index that were changed since the first active
+	// savepoint of AtomicWithSavepoint(); see trackMemIndex().
+	memTracking int
+	memTouched  []memIndexEntry
+
+	// Nesting level of logged operations; only the outermost is logged.
+	opDepth int
+
+	// Key that file keys are derived from or wrapped with;
+	// nil if not set. It is never written to the database.
+	masterKey []byte
 }
 
 // NewLinker returns a new lkr, ready to use. It assumes the key value store
 // is working and does no check on this.
 func NewLinker(kv db.Database) *Linker {
-	lkr := &Linker{kv: kv}
+	lkr := &Linker{kv: kv, notifier: newNotifier()}
 	lkr.MemIndexClear()
 	return lkr
 }
 
+// memIndexEntry names the entries of one node in the memory index.
+type memIndexEntry struct {
+	hash  string
+	inode uint64
+	path  string
+}
+
+// trackMemIndex remembers a change of the memory index, so it can be
+// undone by forgetting the entry when a savepoint is rolled back.
+func (lkr *Linker) trackMemIndex(entry memIndexEntry) {
+	if lkr.memTracking > 0 {
+		lkr.memTouched = append(lkr.memTouched, entry)
+	}
+}
+
+// memIndexForget drops all entries changed after the `start`-th change.
+// They are loaded freshly from the database on the next access.
+func (lkr *Linker) memIndexForget(start int) {
+	if start >= len(lkr.memTouched) {
+		return
+	}
+
+	for _, entry := range lkr.memTouched[start:] {
+		if entry.hash != "" {
+			delete(lkr.index, entry.hash)
+		}
+
+		if entry.inode != 0 {
+			delete(lkr.inodeIndex, entry.inode)
+		}
+
+		if entry.path != "" {
+			if trieNode := lkr.ptrie.Lookup(entry.path); trieNode != nil {
+				trieNode.Data = nil
+			}
+		}
+	}
+
+	// The root is changed by nearly every write, so load it again too.
+	// The same goes for the ignore patterns, which are cheap to reload.
+	lkr.root = nil
+	lkr.ignoreMatcher = nil
+	lkr.memTouched = lkr.memTouched[:start]
+}
+
 // MemIndexAdd adds `nd` to the in memory index.
 func (lkr *Linker) MemIndexAdd(nd n.Node, updatePathIndex bool) {
-	lkr.index[nd.TreeHash().B58String()] = nd
-	lkr.inodeIndex[nd.Inode()] = nd
+	entry := memIndexEntry{
+		hash:  nd.TreeHash().B58String(),
+		inode: nd.Inode(),
+	}
+
+	lkr.index[entry.hash] = nd
+	lkr.inodeIndex[entry.inode] = nd
 
 	if updatePathIndex {
-		path := nd.Path()
+		entry.path = nd.Path()
 		if nd.Type() == n.NodeTypeDirectory {
-			path = appendDot(path)
+			entry.path = appendDot(entry.path)
 		}
-		lkr.ptrie.InsertWithData(path, nd)
+		lkr.ptrie.InsertWithData(entry.path, nd)
 	}
+
+	lkr.trackMemIndex(entry)
 }
 
 // MemIndexSwap updates an entry of the in memory index, by deleting
@@ -71,6 +150,7 @@ func (lkr *Linker) MemIndexAdd(nd n.Node, updatePathIndex bool) {
 func (lkr *Linker) MemIndexSwap(nd n.Node, oldHash h.Hash, updatePathIndex bool) {
 	if oldHash != nil {
 		delete(lkr.index, oldHash.B58String())
+		lkr.trackMemIndex(memIndexEntry{hash: oldHash.B58String()})
 	}
 
 	lkr.MemIndexAdd(nd, updatePathIndex)
@@ -94,16 +174,27 @@ func (lkr *Linker) MemIndexPurge(nd n.Node) {
 	delete(lkr.inodeIndex, nd.Inode())
 	delete(lkr.index, nd.TreeHash().B58String())
 	lkr.ptrie.Lookup(nd.Path()).Remove()
+
+	lkr.trackMemIndex(memIndexEntry{
+		hash:  nd.TreeHash().B58String(),
+		inode: nd.Inode(),
+		path:  nd.Path(),
+	})
 }
 
 // MemIndexClear resets the memory index to zero.
 // This should not be called mid-flight in operations,
 // but should be okay to call between atomic operations.
+// It also drops the cached ignore patterns and quotas, so it has to be called
+// whenever the database was changed behind the linker's back (e.g. by Import).
 func (lkr *Linker) MemIndexClear() {
 	lkr.ptrie = trie.NewNode()
 	lkr.index = make(map[string]n.Node)
 	lkr.inodeIndex = make(map[uint64]n.Node)
 	lkr.root = nil
+	lkr.memTouched = nil
+	lkr.ignoreMatcher = nil
+	lkr.quotas = nil
 }
 
 //////////////////////////
@@ -143,28 +234,24 @@ func (lkr *Linker) NextInode() uint64 {
 // `contents`. It returns a map of content hash b58 to file. This method is
 // quite heavy and should not be used in loops. There is room for optimizations.
 func (lkr *Linker) FilesByContents(contents []h.Hash) (map[string]*n.File, error) {
-	keys, err := lkr.kv.Keys()
-	if err != nil {
-		return nil, err
-	}
-
 	result := make(map[string]*n.File)
-	for _, key := range keys {
-		// Filter non-node storage:
-		fullKey := strings.Join(key, "/")
-		if !strings.HasPrefix(fullKey, "objects") &&
-			!strings.HasPrefix(fullKey, "stage/objects") {
-			continue
-		}
-
-		data, err := lkr.kv.Get(key...)
-		if err != nil {
+	for _, prefix := range [][]string{{"objects"}, {"stage", "objects"}} {
+		if err := lkr.filesByContents(prefix, contents, result); err != nil {
 			return nil, err
 		}
+	}
+
+	return result, nil
+}
 
-		nd, err := n.UnmarshalNode(data)
+func (lkr *Linker) filesByContents(prefix []string, contents []h.Hash, result map[string]*n.File) error {
+	iter := lkr.kv.Iterator(db.IterOptions{Prefix: prefix})
+	defer iter.Close()
+
+	for iter.Next() {
+		nd, err := n.UnmarshalNode(iter.Value())
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if nd.Type() != n.NodeTypeFile {
@@ -173,7 +260,7 @@ func (lkr *Linker) FilesByContents(contents []h.Hash) (map[string]*n.File, error
 
 		file, ok := nd.(*n.File)
 		if !ok {
-			return nil, ie.ErrBadNode
+			return ie.ErrBadNode
 		}
 
 		for _, content := range contents {
@@ -183,7 +270,7 @@ func (lkr *Linker) FilesByContents(contents []h.Hash) (map[string]*n.File, error
 		}
 	}
 
-	return result, nil
+	return iter.Err()
 }
 
 // loadNode loads an individual object by its hash from the object store.
@@ -451,7 +538,8 @@ func (lkr *Linker) SetMergeMarker(with string, remoteHead h.Hash) error {
 // If nothing changed since the last call to MakeCommit, it will
 // return ErrNoChange, which can be reacted upon.
 func (lkr *Linker) MakeCommit(author string, message string) error {
-	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+	args := []string{author, message}
+	return lkr.atomicOpWithBatch(OpCommit, args, func(batch db.Batch) (bool, error) {
 		switch err := lkr.makeCommit(batch, author, message); err {
 		case ie.ErrNoChange:
 			return false, err
@@ -513,6 +601,7 @@ func (lkr *Linker) makeCommit(batch db.Batch, author string, message string) err
 
 	statusB58Hash := status.TreeHash().B58String()
 	batch.Put(statusData, "objects", statusB58Hash)
+	lkr.notify(Event{Type: EventCommitted, Hash: status.TreeHash()})
 
 	// Remember this commit under its index:
 	batch.Put([]byte(statusB58Hash), "index", strconv.FormatInt(status.Index(), 10))
@@ -752,6 +841,12 @@ func (lkr *Linker) SaveRef(refName string, nd n.Node) error {
 	refName = strings.ToLower(refName)
 	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
 		batch.Put([]byte(nd.TreeHash().B58String()), "refs", refName)
+
+		// CURR changes with every staged node; those are reported already.
+		if refName != "curr" {
+			lkr.notify(Event{Type: EventRefChanged, Ref: refName, Hash: nd.TreeHash()})
+		}
+
 		return false, nil
 	})
 }
@@ -779,6 +874,7 @@ func (lkr *Linker) ListRefs() ([]string, error) {
 func (lkr *Linker) RemoveRef(refName string) error {
 	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
 		batch.Erase("refs", refName)
+		lkr.notify(Event{Type: EventRefChanged, Ref: refName})
 		return false, nil
 	})
 }
@@ -1197,7 +1293,19 @@ func (lkr *Linker) CheckoutCommit(cmt *n.Commit, force bool) error {
 		return err
 	}
 
-	return lkr.Atomic(func() (bool, error) {
+	oldRoot, err := lkr.Root()
+	if err != nil {
+		return err
+	}
+
+	// Only the parts of the tree that differ need to be counted:
+	removed, added, err := quotaFilesChanged(lkr, oldRoot, root)
+	if err != nil {
+		return err
+	}
+
+	args := []string{cmt.TreeHash().B58String(), strconv.FormatBool(force)}
+	return lkr.atomicOp(OpCheckout, args, func() (bool, error) {
 		// Set the current virtual in-memory cached root
 		lkr.MemSetRoot(root)
 		status.SetRoot(cmt.Root())
@@ -1205,7 +1313,13 @@ func (lkr *Linker) CheckoutCommit(cmt *n.Commit, force bool) error {
 		// Invalidate the cache, causing NodeByHash and ResolveNode to load the
 		// file from the boltdb again:
 		lkr.MemIndexClear()
-		return hintRollback(lkr.saveStatus(status))
+		lkr.notify(Event{Type: EventCheckout, Hash: cmt.TreeHash()})
+		if err := lkr.saveStatus(status); err != nil {
+			return true, err
+		}
+
+		// The usage counters need to follow, even if that exceeds a quota:
+		return hintRollback(forceUsage(lkr, removed, added))
 	})
 }
 
@@ -1251,24 +1365,67 @@ func (lkr *Linker) Atomic(fn func() (bool, error)) (err error) {
 
 // AtomicWithBatch will execute `fn` in one transaction.
 // If anything goes wrong (i.e. `fn` returns an error)
+// the changes are rolled back. This is also true when called
+// inside another AtomicWithBatch: all changes of the outer call
+// are rolled back too, on every database backend, even if the outer
+// call ignores the error. Use AtomicWithSavepoint to undo only `fn`.
 func (lkr *Linker) AtomicWithBatch(fn func(batch db.Batch) (bool, error)) (err error) {
+	return lkr.atomicWithBatch(fn, false)
+}
+
+// AtomicWithSavepoint is like AtomicWithBatch, but when called inside another
+// AtomicWithBatch, a failing `fn` only undoes its own changes and events.
+// The caller can then decide to go on without them. Note that nodes the
+// caller still holds are not reset; only the memory index is.
+func (lkr *Linker) AtomicWithSavepoint(fn func(batch db.Batch) (bool, error)) (err error) {
+	return lkr.atomicWithBatch(fn, true)
+}
+
+func (lkr *Linker) atomicWithBatch(fn func(batch db.Batch) (bool, error), useSavepoint bool) (err error) {
 	batch := lkr.kv.Batch()
 
+	lkr.atomicDepth++
+	defer func() { lkr.atomicDepth-- }()
+
 	// A panicking program should not leave the persistent linker state
 	// inconsistent. This is really a last defence against all odds.
 	defer func() {
 		if r := recover(); r != nil {
 			batch.Rollback()
 			lkr.MemIndexClear()
+			lkr.flushEvents(false)
 			err = fmt.Errorf("panic rollback: %v; stack: %s", r, string(debug.Stack()))
 		}
 	}()
 
+	savepoint, eventCount, memStart := -1, len(lkr.pendingEvents), len(lkr.memTouched)
+	if useSavepoint && lkr.atomicDepth > 1 {
+		savepoint = batch.Savepoint()
+		lkr.memTracking++
+		defer func() { lkr.memTracking-- }()
+	}
+
 	needRollback, err := fn(batch)
 	if needRollback && err != nil {
 		hadWrites := batch.HaveWrites()
+		if savepoint >= 0 && batch.RollbackTo(savepoint) == nil {
+			// Only drop our own events, index entries and our reference
+			// to the batch. A nested flush does not write anything yet.
+			if eventCount <= len(lkr.pendingEvents) {
+				lkr.pendingEvents = lkr.pendingEvents[:eventCount]
+			}
+
+			lkr.memIndexForget(memStart)
+			log.Warningf("rolled back to savepoint due to error: %v", err)
+			batch.Flush()
+			return err
+		}
+
 		batch.Rollback()
 
+		// Nothing of what happened will be visible, so don't tell anyone.
+		lkr.flushEvents(false)
+
 		// Only clear the whole index if something was written.
 		// Also, this prevents the slightly misleading log message below
 		// in case of read-only operations.
@@ -1286,7 +1443,21 @@ func (lkr *Linker) AtomicWithBatch(fn func(batch db.Batch) (bool, error)) (err e
 	// so memory and disk is in sync.
 	if flushErr := batch.Flush(); flushErr != nil {
 		lkr.MemIndexClear()
+		lkr.flushEvents(false)
 		log.Warningf("flush to db failed, resetting mem index: %v", flushErr)
+
+		// The caller must not think that the changes were written.
+		if err == nil {
+			err = flushErr
+		}
+	} else if lkr.atomicDepth == 1 {
+		// Only the outermost call publishes, since only then
+		// the changes are really written.
+		lkr.flushEvents(true)
+	}
+
+	if lkr.memTracking == 0 {
+		lkr.memTouched = nil
 	}
 
 	return err
@@ -1294,18 +1465,20 @@ func (lkr *Linker) AtomicWithBatch(fn func(batch db.Batch) (bool, error)) (err e
 
 func (lkr *Linker) commitMoveMapping(status *n.Commit, exported map[uint64]bool) error {
 	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
-		keys, err := lkr.kv.Keys("stage", "moves")
-		if err != nil {
-			return hintRollback(err)
-		}
+		iter := lkr.kv.Iterator(db.IterOptions{
+			Prefix:   []string{"stage", "moves"},
+			KeysOnly: true,
+		})
 
-		for _, key := range keys {
-			if err := lkr.commitMoveMappingKey(batch, status, exported, key); err != nil {
+		defer iter.Close()
+
+		for iter.Next() {
+			if err := lkr.commitMoveMappingKey(batch, status, exported, iter.Key()); err != nil {
 				return hintRollback(err)
 			}
 		}
 
-		return false, nil
+		return hintRollback(iter.Err())
 	})
 }
 
@@ -1,9 +1,11 @@
 package core
 
 import (
+	"bytes"
 	"errors"
 	"floo/catfs/db"
 	ie "floo/catfs/errors"
+	"floo/catfs/mio/compress"
 	n "floo/catfs/nodes"
 	h "floo/util/hashlib"
 	"fmt"
@@ -442,6 +444,113 @@ func TestAtomic(t *testing.T) {
 	})
 }
 
+func TestAtomicNested(t *testing.T) {
+	withEachBackendLinker(t, func(t *testing.T, lkr *Linker) {
+		sub := lkr.Subscribe(SubscribeOptions{})
+		defer sub.Close()
+
+		err := lkr.Atomic(func() (bool, error) {
+			_, err := Stage(lkr, "/x", h.TestDummy(t, 1), h.TestDummy(t, 1), 1, nil)
+			require.Nil(t, err)
+
+			// A failing sub-operation only undoes its own changes:
+			err = lkr.AtomicWithSavepoint(func(batch db.Batch) (bool, error) {
+				MustTouch(t, lkr, "/y", 2)
+				return true, errors.New("artificial error")
+			})
+			require.NotNil(t, err)
+
+			_, err = Stage(lkr, "/z", h.TestDummy(t, 3), h.TestDummy(t, 3), 3, nil)
+			require.Nil(t, err)
+			return false, nil
+		})
+
+		require.Nil(t, err)
+
+		// Check with a fresh linker that it was written like that:
+		for _, check := range []*Linker{lkr, NewLinker(lkr.KV())} {
+			_, err = check.LookupFile("/x")
+			require.Nil(t, err)
+
+			_, err = check.LookupFile("/y")
+			require.True(t, ie.IsNoSuchFileError(err))
+
+			_, err = check.LookupFile("/z")
+			require.Nil(t, err)
+		}
+
+		for _, path := range []string{"/x", "/z"} {
+			ev := <-sub.Events()
+			require.Equal(t, EventStaged, ev.Type)
+			require.Equal(t, path, ev.Path)
+		}
+
+		require.Len(t, sub.Events(), 0)
+	})
+}
+
+// withEachBackendLinker is like WithDummyLinker,
+// but runs `fn` once for every database backend.
+func withEachBackendLinker(t *testing.T, fn func(t *testing.T, lkr *Linker)) {
+	for _, backend := range db.Backends {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			dbPath, err := os.MkdirTemp("", "floo-test")
+			require.Nil(t, err)
+			defer os.RemoveAll(dbPath)
+
+			kv, err := db.NewDatabase(backend, dbPath)
+			require.Nil(t, err)
+
+			lkr := NewLinker(kv)
+			require.Nil(t, lkr.SetOwner("alice"))
+			MustCommit(t, lkr, "init")
+
+			fn(t, lkr)
+			require.Nil(t, kv.Close())
+		})
+	}
+}
+
+func TestAtomicNestedRollsBackAll(t *testing.T) {
+	withEachBackendLinker(t, func(t *testing.T, lkr *Linker) {
+		err := lkr.Atomic(func() (bool, error) {
+			_, err := Stage(lkr, "/x", h.TestDummy(t, 1), h.TestDummy(t, 1), 1, nil)
+			require.Nil(t, err)
+
+			// Without a savepoint the outer changes are undone too:
+			err = lkr.Atomic(func() (bool, error) {
+				MustTouch(t, lkr, "/y", 2)
+				return true, errors.New("artificial error")
+			})
+			require.NotNil(t, err)
+			return true, err
+		})
+
+		require.NotNil(t, err)
+
+		// Also when the outer call goes on as if nothing happened:
+		err = lkr.Atomic(func() (bool, error) {
+			_, err := Stage(lkr, "/x", h.TestDummy(t, 1), h.TestDummy(t, 1), 1, nil)
+			require.Nil(t, err)
+
+			require.NotNil(t, lkr.Atomic(func() (bool, error) {
+				return true, errors.New("artificial error")
+			}))
+			return false, nil
+		})
+
+		require.Nil(t, err)
+
+		for _, check := range []*Linker{lkr, NewLinker(lkr.KV())} {
+			for _, path := range []string{"/x", "/y"} {
+				_, err = check.LookupFile(path)
+				require.True(t, ie.IsNoSuchFileError(err), "path: %s", path)
+			}
+		}
+	})
+}
+
 func TestCommitByIndex(t *testing.T) {
 	// Note: WithReloadingLinker creates an init commit.
 	WithDummyLinker(t, func(lkr *Linker) {
@@ -531,3 +640,437 @@ func TestLookupNodeAt(t *testing.T) {
 		require.Nil(t, last)
 	})
 }
+
+func TestStageIgnored(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		require.Nil(t, lkr.SetIgnorePatterns("/", []byte("*.swp\n")))
+		require.Nil(t, lkr.SetIgnorePatterns("/sub", []byte("build/\n")))
+
+		_, err := Stage(lkr, "/x.swp", h.TestDummy(t, 1), h.TestDummy(t, 1), 1, nil)
+		require.True(t, ie.IsIgnoredError(err))
+
+		_, err = Stage(lkr, "/sub/build/y", h.TestDummy(t, 2), h.TestDummy(t, 2), 2, nil)
+		require.True(t, ie.IsIgnoredError(err))
+
+		_, err = Stage(lkr, "/sub/y", h.TestDummy(t, 3), h.TestDummy(t, 3), 3, nil)
+		require.Nil(t, err)
+
+		// Directories are checked as well:
+		_, err = Mkdir(lkr, "/sub/build", false)
+		require.True(t, ie.IsIgnoredError(err))
+
+		_, err = Mkdir(lkr, "/sub/build/deep", true)
+		require.True(t, ie.IsIgnoredError(err))
+
+		_, err = lkr.LookupDirectory("/sub/build")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		data, err := lkr.IgnorePatterns("/sub")
+		require.Nil(t, err)
+		require.Equal(t, []byte("build/\n"), data)
+
+		// Removing the patterns should allow staging again:
+		require.Nil(t, lkr.SetIgnorePatterns("/", nil))
+		_, err = Stage(lkr, "/x.swp", h.TestDummy(t, 1), h.TestDummy(t, 1), 1, nil)
+		require.Nil(t, err)
+	})
+}
+
+func TestIgnorePatternsRollback(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		err := lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+			if err := lkr.SetIgnorePatterns("/", []byte("*.swp\n")); err != nil {
+				return hintRollback(err)
+			}
+
+			// Whatever is seen here must not be cached beyond the batch:
+			if err := checkIgnored(lkr, "/x.swp", false); err != nil && !ie.IsIgnoredError(err) {
+				return hintRollback(err)
+			}
+
+			return hintRollback(errors.New("fail"))
+		})
+		require.EqualError(t, err, "fail")
+		require.Nil(t, checkIgnored(lkr, "/x.swp", false))
+
+		err = lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+			if err := lkr.SetIgnorePatterns("/", []byte("*.swp\n")); err != nil {
+				return hintRollback(err)
+			}
+
+			if err := checkIgnored(lkr, "/x.swp", false); err != nil && !ie.IsIgnoredError(err) {
+				return hintRollback(err)
+			}
+
+			return false, nil
+		})
+		require.Nil(t, err)
+		require.True(t, ie.IsIgnoredError(checkIgnored(lkr, "/x.swp", false)))
+
+		// Same when the database is changed behind the linker's back:
+		dump := &bytes.Buffer{}
+		require.Nil(t, lkr.KV().Export(dump))
+		require.Nil(t, lkr.SetIgnorePatterns("/", nil))
+		require.Nil(t, checkIgnored(lkr, "/x.swp", false))
+
+		require.Nil(t, lkr.KV().Import(dump))
+		lkr.MemIndexClear()
+		require.True(t, ie.IsIgnoredError(checkIgnored(lkr, "/x.swp", false)))
+	})
+}
+
+func TestStageQuota(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		require.Nil(t, lkr.SetUserQuota("alice", Quota{MaxBytes: 100}))
+		require.Nil(t, lkr.SetPathQuota("/sub", Quota{MaxFiles: 1}))
+
+		_, err := Stage(lkr, "/a", h.TestDummy(t, 1), h.TestDummy(t, 1), 60, nil)
+		require.Nil(t, err)
+
+		_, err = Stage(lkr, "/b", h.TestDummy(t, 2), h.TestDummy(t, 2), 60, nil)
+		require.True(t, ie.IsErrQuotaExceeded(err))
+
+		_, err = Stage(lkr, "/sub/x", h.TestDummy(t, 3), h.TestDummy(t, 3), 10, nil)
+		require.Nil(t, err)
+
+		_, err = Stage(lkr, "/sub/y", h.TestDummy(t, 4), h.TestDummy(t, 4), 10, nil)
+		require.True(t, ie.IsErrQuotaExceeded(err))
+
+		// Shrinking a file is always possible:
+		_, err = Stage(lkr, "/a", h.TestDummy(t, 5), h.TestDummy(t, 5), 20, nil)
+		require.Nil(t, err)
+
+		report, err := lkr.UsageReport()
+		require.Nil(t, err)
+		require.Equal(t, Usage{Bytes: 30, Files: 2}, report.Total)
+		require.Equal(t, Usage{Bytes: 30, Files: 2}, report.ByUser["alice"])
+		require.Equal(t, Usage{Bytes: 10, Files: 1}, report.ByPath["/sub"])
+		requireUsageCounters(t, lkr)
+	})
+}
+
+// requireUsageCounters checks that the counters used for quota checks
+// match the usage of the tree.
+func requireUsageCounters(t *testing.T, lkr *Linker) {
+	report, err := lkr.UsageReport()
+	require.Nil(t, err)
+
+	qs, err := lkr.loadQuotas()
+	require.Nil(t, err)
+
+	for user := range qs.byUser {
+		usage, err := lkr.getUsage(userUsageKey(user)...)
+		require.Nil(t, err)
+		require.Equal(t, report.ByUser[user], usage, "user %s", user)
+	}
+
+	for dirPath := range qs.byPath {
+		usage, err := lkr.getUsage(pathUsageKey(dirPath)...)
+		require.Nil(t, err)
+		require.Equal(t, report.ByPath[dirPath], usage, "path %s", dirPath)
+	}
+}
+
+func TestQuotaOwnerChange(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		_, err := Stage(lkr, "/a", h.TestDummy(t, 1), h.TestDummy(t, 1), 80, nil)
+		require.Nil(t, err)
+
+		require.Nil(t, lkr.SetUserQuota("bob", Quota{MaxBytes: 100}))
+		require.Nil(t, lkr.SetOwner("bob"))
+
+		// The 80 bytes of alice do not count for bob;
+		// he is charged all 90 bytes when he overwrites the file:
+		_, err = Stage(lkr, "/a", h.TestDummy(t, 2), h.TestDummy(t, 2), 90, nil)
+		require.Nil(t, err)
+
+		_, err = Stage(lkr, "/b", h.TestDummy(t, 3), h.TestDummy(t, 3), 20, nil)
+		require.True(t, ie.IsErrQuotaExceeded(err))
+
+		report, err := lkr.UsageReport()
+		require.Nil(t, err)
+		require.Equal(t, Usage{Bytes: 90, Files: 1}, report.ByUser["bob"])
+		require.Equal(t, Usage{}, report.ByUser["alice"])
+		requireUsageCounters(t, lkr)
+	})
+}
+
+func TestQuotaMoveAndRemove(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		_, err := Stage(lkr, "/dir/a", h.TestDummy(t, 1), h.TestDummy(t, 1), 10, nil)
+		require.Nil(t, err)
+
+		_, err = Stage(lkr, "/full/b", h.TestDummy(t, 2), h.TestDummy(t, 2), 10, nil)
+		require.Nil(t, err)
+
+		// The counter starts with what is already there:
+		require.Nil(t, lkr.SetPathQuota("/full", Quota{MaxFiles: 1}))
+		requireUsageCounters(t, lkr)
+
+		dir, err := lkr.LookupDirectory("/dir")
+		require.Nil(t, err)
+		require.True(t, ie.IsErrQuotaExceeded(Move(lkr, dir, "/full/dir")))
+
+		// Nothing was moved:
+		_, err = lkr.LookupFile("/dir/a")
+		require.Nil(t, err)
+		requireUsageCounters(t, lkr)
+
+		// After removing b, there is space again:
+		b, err := lkr.LookupFile("/full/b")
+		require.Nil(t, err)
+		_, _, err = Remove(lkr, b, true, false)
+		require.Nil(t, err)
+		requireUsageCounters(t, lkr)
+
+		dir, err = lkr.LookupDirectory("/dir")
+		require.Nil(t, err)
+		require.Nil(t, Move(lkr, dir, "/full/dir"))
+		requireUsageCounters(t, lkr)
+
+		report, err := lkr.UsageReport()
+		require.Nil(t, err)
+		require.Equal(t, Usage{Bytes: 10, Files: 1}, report.ByPath["/full"])
+	})
+}
+
+func TestQuotaCheckout(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		_, err := Stage(lkr, "/dir/a", h.TestDummy(t, 1), h.TestDummy(t, 1), 10, nil)
+		require.Nil(t, err)
+
+		_, err = Stage(lkr, "/b", h.TestDummy(t, 2), h.TestDummy(t, 2), 20, nil)
+		require.Nil(t, err)
+
+		first := MustCommit(t, lkr, "first")
+
+		require.Nil(t, lkr.SetUserQuota("alice", Quota{MaxBytes: 1000}))
+		require.Nil(t, lkr.SetPathQuota("/dir", Quota{MaxFiles: 2}))
+
+		// The usage counters are no quotas:
+		qs, err := lkr.loadQuotas()
+		require.Nil(t, err)
+		require.Equal(t, map[string]Quota{"alice": {MaxBytes: 1000}}, qs.byUser)
+		require.Equal(t, map[string]Quota{"/dir": {MaxFiles: 2}}, qs.byPath)
+
+		_, err = Stage(lkr, "/dir/c", h.TestDummy(t, 3), h.TestDummy(t, 3), 30, nil)
+		require.Nil(t, err)
+
+		b, err := lkr.LookupFile("/b")
+		require.Nil(t, err)
+		_, _, err = Remove(lkr, b, true, false)
+		require.Nil(t, err)
+
+		second := MustCommit(t, lkr, "second")
+		requireUsageCounters(t, lkr)
+
+		require.Nil(t, lkr.CheckoutCommit(first, true))
+		requireUsageCounters(t, lkr)
+
+		// A checkout is never refused because of a quota:
+		require.Nil(t, lkr.SetPathQuota("/dir", Quota{MaxFiles: 1}))
+		require.Nil(t, lkr.CheckoutCommit(second, true))
+		requireUsageCounters(t, lkr)
+
+		usage, err := lkr.getUsage(pathUsageKey("/dir")...)
+		require.Nil(t, err)
+		require.Equal(t, Usage{Bytes: 40, Files: 2}, usage)
+	})
+}
+
+func TestStageChunked(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		chunks := []n.Chunk{
+			{Hash: h.TestDummy(t, 1), Size: 10},
+			{Hash: h.TestDummy(t, 2), Size: 20},
+		}
+
+		file, err := StageChunked(lkr, "/a", h.TestDummy(t, 3), chunks, 30)
+		require.Nil(t, err)
+		require.Equal(t, n.ChunksHash(chunks), file.BackendHash())
+
+		// Load it from the database, not from the cache:
+		fresh := NewLinker(lkr.kv)
+		nd, err := fresh.LookupNode("/a")
+		require.Nil(t, err)
+		require.Equal(t, chunks, nd.(*n.File).Chunks())
+		require.Equal(t, chunks, nd.(*n.File).Copy(42).(*n.File).Chunks())
+
+		// Staging a single object drops the chunks:
+		file, err = Stage(lkr, "/a", h.TestDummy(t, 4), h.TestDummy(t, 4), 30, nil)
+		require.Nil(t, err)
+		require.Empty(t, file.Chunks())
+	})
+}
+
+func TestStageFromReader(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		store := newMemObjectStore()
+		data := []byte("hello world")
+
+		file, backend, err := StageFromReader(lkr, "/a", bytes.NewReader(data), store, compress.AlgoSnappy)
+		require.Nil(t, err)
+		require.Equal(t, file.BackendHash(), backend)
+		require.Equal(t, h.Sum(data), file.ContentHash())
+		require.Equal(t, uint64(len(data)), file.Size())
+		require.Equal(t, data, readFileData(t, lkr, store, file))
+		require.NotNil(t, file.Key())
+
+		// With a master key, only the salt is stored:
+		require.Nil(t, lkr.SetMasterKey(testMasterKey))
+		file, _, err = StageFromReader(lkr, "/b", bytes.NewReader(data), store, compress.AlgoSnappy)
+		require.Nil(t, err)
+		require.Nil(t, file.Key())
+		require.NotNil(t, file.KeySalt())
+		require.Equal(t, data, readFileData(t, lkr, store, file))
+	})
+}
+
+func TestStageFromReaderAuto(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		store := newMemObjectStore()
+		data := bytes.Repeat([]byte("hello world\n"), 1024)
+
+		file, backend, err := StageFromReaderAuto(lkr, "/a.txt", bytes.NewReader(data), store)
+		require.Nil(t, err)
+		require.Equal(t, file.BackendHash(), backend)
+		require.Equal(t, h.Sum(data), file.ContentHash())
+		require.Equal(t, data, readFileData(t, lkr, store, file))
+
+		// The text must have been compressed:
+		require.Less(t, len(store.objects[backend.B58String()]), len(data)/2)
+	})
+}
+
+func TestStageFromReaderChecks(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		store := newMemObjectStore()
+		data := []byte("hello world")
+
+		owner, err := lkr.Owner()
+		require.Nil(t, err)
+
+		// Ignored files are not uploaded at all:
+		require.Nil(t, lkr.SetIgnorePatterns("/", []byte("*.swp\n")))
+		_, backend, err := StageFromReader(lkr, "/x.swp", bytes.NewReader(data), store, compress.AlgoSnappy)
+		require.True(t, ie.IsIgnoredError(err))
+		require.Nil(t, backend)
+		require.Empty(t, store.objects)
+
+		// Neither are files that exceed the file count:
+		require.Nil(t, lkr.SetUserQuota(owner, Quota{MaxFiles: 1, MaxBytes: 5}))
+		_, err = Stage(lkr, "/a", h.TestDummy(t, 1), h.TestDummy(t, 1), 1, nil)
+		require.Nil(t, err)
+
+		_, backend, err = StageFromReader(lkr, "/b", bytes.NewReader(data), store, compress.AlgoSnappy)
+		require.True(t, ie.IsErrQuotaExceeded(err))
+		require.Nil(t, backend)
+		require.Empty(t, store.objects)
+
+		// The size is only known after the upload; the caller
+		// gets the backend hash to remove the object again:
+		_, backend, err = StageFromReader(lkr, "/a", bytes.NewReader(data), store, compress.AlgoSnappy)
+		require.True(t, ie.IsErrQuotaExceeded(err))
+		require.NotNil(t, backend)
+		require.Contains(t, store.objects, backend.B58String())
+
+		nd, err := lkr.LookupNode("/a")
+		require.Nil(t, err)
+		require.Equal(t, h.TestDummy(t, 1), nd.BackendHash())
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		all := lkr.Subscribe(SubscribeOptions{})
+		sub := lkr.Subscribe(SubscribeOptions{Prefix: "/sub"})
+		slow := lkr.Subscribe(SubscribeOptions{BufferSize: 1})
+		defer all.Close()
+		defer sub.Close()
+		defer slow.Close()
+
+		file, err := Stage(lkr, "/sub/x", h.TestDummy(t, 1), h.TestDummy(t, 1), 1, nil)
+		require.Nil(t, err)
+		require.Nil(t, Move(lkr, file, "/y"))
+		MustCommit(t, lkr, "move")
+
+		// Rolled back operations should not emit anything:
+		_, err = Stage(lkr, "/y/z", h.TestDummy(t, 2), h.TestDummy(t, 2), 2, nil)
+		require.NotNil(t, err)
+
+		expect := []EventType{EventStaged, EventStaged, EventMoved, EventCommitted, EventRefChanged}
+		for _, typ := range expect {
+			ev := <-all.Events()
+			require.Equal(t, typ, ev.Type, ev.String())
+		}
+
+		ev := <-sub.Events()
+		require.Equal(t, EventStaged, ev.Type)
+		require.Equal(t, "/sub", ev.Path)
+
+		ev = <-sub.Events()
+		require.Equal(t, EventStaged, ev.Type)
+		require.Equal(t, "/sub/x", ev.Path)
+
+		ev = <-sub.Events()
+		require.Equal(t, EventMoved, ev.Type)
+		require.Equal(t, "/sub/x", ev.OldPath)
+		require.Equal(t, "/y", ev.Path)
+
+		require.Len(t, all.Events(), 0)
+		require.Equal(t, uint64(4), slow.Dropped())
+	})
+}
+
+func TestOplog(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		file, err := Stage(lkr, "/sub/x", h.TestDummy(t, 1), h.TestDummy(t, 1), 1, nil)
+		require.Nil(t, err)
+		require.Nil(t, Move(lkr, file, "/y"))
+
+		// Failing operations are not logged:
+		_, err = Mkdir(lkr, "/y/z", false)
+		require.NotNil(t, err)
+
+		MustCommit(t, lkr, "second")
+
+		ops := []Op{}
+		require.Nil(t, lkr.Oplog(0, func(op Op) error {
+			ops = append(ops, op)
+			return nil
+		}))
+
+		types := []OpType{}
+		for _, op := range ops {
+			types = append(types, op.Type)
+			require.Equal(t, "alice", op.User)
+		}
+
+		// The first commit is from WithDummyLinker.
+		require.Equal(t, []OpType{OpCommit, OpStage, OpMove, OpCommit}, types)
+		require.Equal(t, []string{"/sub/x", "/y"}, ops[2].Args)
+
+		lastSeq, err := lkr.LastOpSeq()
+		require.Nil(t, err)
+		require.Equal(t, ops[3].Seq, lastSeq)
+
+		tailed := 0
+		require.Nil(t, lkr.Oplog(ops[2].Seq, func(op Op) error {
+			tailed++
+			return nil
+		}))
+		require.Equal(t, 2, tailed)
+
+		removed, err := lkr.CompactOplog()
+		require.Nil(t, err)
+		require.Equal(t, 3, removed)
+
+		left := 0
+		require.Nil(t, lkr.Oplog(0, func(op Op) error {
+			require.Equal(t, OpCommit, op.Type)
+			left++
+			return nil
+		}))
+		require.Equal(t, 1, left)
+	})
+}
@@ -0,0 +1,247 @@
+package core
+
+import (
+	h "floo/util/hashlib"
+	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType tells what kind of change happened.
+type EventType int
+
+const (
+	// EventStaged is emitted when a file or directory was added or modified.
+	EventStaged = EventType(iota + 1)
+	// EventRemoved is emitted when a node was removed.
+	EventRemoved
+	// EventMoved is emitted when a node was moved; OldPath is set.
+	EventMoved
+	// EventCommitted is emitted when a new commit was made.
+	EventCommitted
+	// EventCheckout is emitted when the stage was reset to another commit.
+	EventCheckout
+	// EventRefChanged is emitted when a ref was saved or removed; Ref is set.
+	EventRefChanged
+)
+
+var eventTypeToString = map[EventType]string{
+	EventStaged:     "staged",
+	EventRemoved:    "removed",
+	EventMoved:      "moved",
+	EventCommitted:  "committed",
+	EventCheckout:   "checkout",
+	EventRefChanged: "ref-changed",
+}
+
+func (ev EventType) String() string {
+	if name, ok := eventTypeToString[ev]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// Event describes a single change of the linker's state.
+type Event struct {
+	Type EventType
+
+	// Path of the affected node. For moves this is the new path.
+	// Events that do not relate to a single node
+	// (commits, checkouts, refs) have an empty path.
+	Path string
+
+	// OldPath is the path before a move.
+	OldPath string
+
+	// Hash is the tree hash of the affected node or commit.
+	// It is nil for removed refs.
+	Hash h.Hash
+
+	// Ref is the name of the changed ref.
+	Ref string
+}
+
+func (ev Event) String() string {
+	if ev.Type == EventMoved {
+		return fmt.Sprintf("<%s %s -> %s>", ev.Type, ev.OldPath, ev.Path)
+	}
+
+	return fmt.Sprintf("<%s %s%s>", ev.Type, ev.Path, ev.Ref)
+}
+
+// SubscribeOptions configures what a Subscription receives.
+// The zero value receives all events and never blocks the linker.
+type SubscribeOptions struct {
+	// Prefix limits path events to nodes at or below this path.
+	// Events without a path are always delivered.
+	Prefix string
+
+	// Types limits the subscription to certain event types.
+	// If empty, all types are delivered.
+	Types []EventType
+
+	// BufferSize is the number of events that may be queued
+	// before the subscriber is considered slow. Defaults to 64.
+	BufferSize int
+
+	// BlockTimeout is how long the linker waits for a slow subscriber
+	// before dropping the event. If zero, events are dropped right away.
+	BlockTimeout time.Duration
+}
+
+// Subscription receives events from a Linker until it is closed.
+type Subscription struct {
+	opts    SubscribeOptions
+	types   map[EventType]bool
+	events  chan Event
+	done    chan struct{}
+	dropped uint64
+	hub     *notifier
+	once    sync.Once
+}
+
+// Events returns the channel where events are delivered.
+// It is closed once the subscription is closed.
+func (sub *Subscription) Events() <-chan Event {
+	return sub.events
+}
+
+// Dropped returns the number of events that were dropped because the
+// subscriber was too slow. If it is not zero, the subscriber should
+// assume that it missed changes and re-read the state it cares about.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Close stops the delivery of events. It is safe to call it more than once.
+func (sub *Subscription) Close() {
+	sub.once.Do(func() {
+		// Wake up publishers that wait on us first,
+		// otherwise we might not get the lock.
+		close(sub.done)
+
+		sub.hub.mu.Lock()
+		delete(sub.hub.subs, sub)
+		sub.hub.mu.Unlock()
+
+		close(sub.events)
+	})
+}
+
+func (sub *Subscription) wants(ev Event) bool {
+	if len(sub.types) > 0 && !sub.types[ev.Type] {
+		return false
+	}
+
+	if ev.Path == "" || sub.opts.Prefix == "" {
+		return true
+	}
+
+	return isAtOrBelow(sub.opts.Prefix, ev.Path) ||
+		(ev.OldPath != "" && isAtOrBelow(sub.opts.Prefix, ev.OldPath))
+}
+
+func isAtOrBelow(prefix, nodePath string) bool {
+	prefix = path.Clean("/" + prefix)
+	return prefix == nodePath || isBelowDir(prefix, nodePath)
+}
+
+func (sub *Subscription) deliver(ev Event) {
+	// Fast path: there's still room in the buffer.
+	select {
+	case sub.events <- ev:
+		return
+	default:
+	}
+
+	if sub.opts.BlockTimeout > 0 {
+		timer := time.NewTimer(sub.opts.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case sub.events <- ev:
+			return
+		case <-sub.done:
+			return
+		case <-timer.C:
+		}
+	}
+
+	atomic.AddUint64(&sub.dropped, 1)
+}
+
+// notifier distributes events to all subscriptions.
+type notifier struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+func (nt *notifier) publish(events []Event) {
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+
+	for _, ev := range events {
+		for sub := range nt.subs {
+			if sub.wants(ev) {
+				sub.deliver(ev)
+			}
+		}
+	}
+}
+
+// Subscribe returns a new Subscription that receives all changes
+// matching `opts`. Events are only delivered after the operation that
+// caused them was written successfully; rolled back operations do not
+// produce events. Call Close() on the subscription when done.
+func (lkr *Linker) Subscribe(opts SubscribeOptions) *Subscription {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 64
+	}
+
+	sub := &Subscription{
+		opts:   opts,
+		types:  make(map[EventType]bool),
+		events: make(chan Event, opts.BufferSize),
+		done:   make(chan struct{}),
+		hub:    lkr.notifier,
+	}
+
+	for _, typ := range opts.Types {
+		sub.types[typ] = true
+	}
+
+	lkr.notifier.mu.Lock()
+	lkr.notifier.subs[sub] = struct{}{}
+	lkr.notifier.mu.Unlock()
+	return sub
+}
+
+// notify remembers `ev` until the outermost atomic operation finished.
+// Outside of atomic operations the event is published right away.
+func (lkr *Linker) notify(ev Event) {
+	if lkr.atomicDepth > 0 {
+		lkr.pendingEvents = append(lkr.pendingEvents, ev)
+		return
+	}
+
+	lkr.notifier.publish([]Event{ev})
+}
+
+// flushEvents publishes or forgets all pending events.
+func (lkr *Linker) flushEvents(publish bool) {
+	events := lkr.pendingEvents
+	lkr.pendingEvents = nil
+
+	if publish && len(events) > 0 {
+		lkr.notifier.publish(events)
+	}
+}
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"floo/catfs/db"
+	"fmt"
+	"time"
+)
+
+// OpType is the kind of high-level operation stored in the oplog.
+type OpType string
+
+const (
+	// OpStage is logged by Stage(); args: path, content hash, backend hash, size.
+	OpStage = OpType("stage")
+	// OpMove is logged by Move(); args: source path, destination path.
+	OpMove = OpType("move")
+	// OpRemove is logged by Remove(); args: path, create ghost.
+	OpRemove = OpType("remove")
+	// OpMkdir is logged by Mkdir(); args: path, create parents.
+	OpMkdir = OpType("mkdir")
+	// OpCommit is logged by MakeCommit(); args: author, message.
+	OpCommit = OpType("commit")
+	// OpCheckout is logged by CheckoutCommit(); args: commit hash, force.
+	OpCheckout = OpType("checkout")
+	// OpRekey is logged by Rekey(); args: all history, cipher, number of objects.
+	OpRekey = OpType("rekey")
+)
+
+// Op is a single entry of the operation log.
+// Every high-level mutation of the linker produces exactly one Op,
+// written in the same batch as the mutation itself.
+type Op struct {
+	// Seq is the position in the log, starting at 1.
+	Seq uint64 `json:"seq"`
+
+	// Type of the operation.
+	Type OpType `json:"type"`
+
+	// User is the owner of the linker that did the operation.
+	User string `json:"user"`
+
+	// Time when the operation happened.
+	Time time.Time `json:"time"`
+
+	// Args are the arguments of the operation (see OpType).
+	// Secrets like file keys are never stored.
+	Args []string `json:"args"`
+}
+
+func (op Op) String() string {
+	return fmt.Sprintf("#%d %s %s %v", op.Seq, op.User, op.Type, op.Args)
+}
+
+// The seq is zero-padded so that keys are sorted in the order of the log.
+func oplogKey(seq uint64) []string {
+	return []string{"oplog", fmt.Sprintf("%020d", seq)}
+}
+
+// LastOpSeq returns the sequence number of the newest oplog entry,
+// or 0 if the log is empty.
+func (lkr *Linker) LastOpSeq() (uint64, error) {
+	data, err := lkr.kv.Get("stats", "max-oplog-seq")
+	if err == db.ErrNoSuchKey {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(data), nil
+}
+
+func (lkr *Linker) appendOp(batch db.Batch, typ OpType, args []string) error {
+	seq, err := lkr.LastOpSeq()
+	if err != nil {
+		return err
+	}
+
+	seq++
+
+	data, err := json.Marshal(Op{
+		Seq:  seq,
+		Type: typ,
+		User: lkr.owner,
+		Time: time.Now(),
+		Args: args,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	seqBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqBuf, seq)
+
+	batch.Put(data, oplogKey(seq)...)
+	batch.Put(seqBuf, "stats", "max-oplog-seq")
+	return nil
+}
+
+// atomicOpWithBatch works like AtomicWithBatch, but also logs the operation
+// if `fn` succeeded. Operations that are called by other operations
+// (like Mkdir() by Stage()) are not logged on their own.
+func (lkr *Linker) atomicOpWithBatch(typ OpType, args []string, fn func(batch db.Batch) (bool, error)) error {
+	lkr.opDepth++
+	defer func() { lkr.opDepth-- }()
+
+	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		needRollback, err := fn(batch)
+		if err != nil || lkr.opDepth > 1 {
+			return needRollback, err
+		}
+
+		return hintRollback(lkr.appendOp(batch, typ, args))
+	})
+}
+
+// atomicOp is atomicOpWithBatch without batch, like Atomic.
+func (lkr *Linker) atomicOp(typ OpType, args []string, fn func() (bool, error)) error {
+	return lkr.atomicOpWithBatch(typ, args, func(batch db.Batch) (bool, error) {
+		return fn()
+	})
+}
+
+// Oplog calls `fn` for every entry of the oplog with a sequence number
+// equal or greater than `fromSeq`, in the order they were written.
+// Entries that were compacted already are not visited.
+// Use LastOpSeq()+1 of a previous run to tail the log.
+func (lkr *Linker) Oplog(fromSeq uint64, fn func(op Op) error) error {
+	iter := lkr.kv.Iterator(db.IterOptions{
+		Prefix: []string{"oplog"},
+		Start:  oplogKey(fromSeq),
+	})
+
+	defer iter.Close()
+
+	for iter.Next() {
+		if len(iter.Key()) != 2 {
+			continue
+		}
+
+		op := Op{}
+		if err := json.Unmarshal(iter.Value(), &op); err != nil {
+			return err
+		}
+
+		if err := fn(op); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
+
+// CompactOplog removes all entries before the most recent commit entry.
+// The commit entry itself is kept, so peers can always see what the
+// log starts with. The number of removed entries is returned.
+func (lkr *Linker) CompactOplog() (int, error) {
+	lastCommitSeq := uint64(0)
+	err := lkr.Oplog(0, func(op Op) error {
+		if op.Type == OpCommit {
+			lastCommitSeq = op.Seq
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	err = lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		return hintRollback(lkr.Oplog(0, func(op Op) error {
+			if op.Seq < lastCommitSeq {
+				batch.Erase(oplogKey(op.Seq)...)
+				removed++
+			}
+
+			return nil
+		}))
+	})
+
+	return removed, err
+}
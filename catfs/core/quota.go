@@ -0,0 +1,601 @@
+package core
+
+import (
+	"encoding/binary"
+	"floo/catfs/db"
+	ie "floo/catfs/errors"
+	n "floo/catfs/nodes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Quota limits how much a user or a directory may store.
+// A zero value for any of the limits means "unlimited".
+type Quota struct {
+	// MaxBytes is the maximum accumulated size of all files.
+	MaxBytes uint64
+
+	// MaxFiles is the maximum number of files.
+	MaxFiles uint64
+}
+
+// IsUnlimited returns true if the quota does not limit anything.
+func (q Quota) IsUnlimited() bool {
+	return q.MaxBytes == 0 && q.MaxFiles == 0
+}
+
+// Usage is the accumulated size and number of files.
+type Usage struct {
+	Bytes uint64
+	Files uint64
+}
+
+// UsageReport lists the current usage of the staging tree.
+type UsageReport struct {
+	// Total is the usage of the whole tree.
+	Total Usage
+
+	// ByUser is the usage per user that last modified a file.
+	ByUser map[string]Usage
+
+	// ByPath is the usage of each directory that has a quota.
+	ByPath map[string]Usage
+}
+
+// quotas is the in-memory cache of all quota definitions.
+type quotas struct {
+	byUser map[string]Quota
+	byPath map[string]Quota
+}
+
+func quotaToBytes(q Quota) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:], q.MaxBytes)
+	binary.BigEndian.PutUint64(buf[8:], q.MaxFiles)
+	return buf
+}
+
+func quotaFromBytes(data []byte) (Quota, error) {
+	if len(data) != 16 {
+		return Quota{}, fmt.Errorf("bad quota length: %d", len(data))
+	}
+
+	return Quota{
+		MaxBytes: binary.BigEndian.Uint64(data[0:]),
+		MaxFiles: binary.BigEndian.Uint64(data[8:]),
+	}, nil
+}
+
+func usageToBytes(u Usage) []byte {
+	return quotaToBytes(Quota{MaxBytes: u.Bytes, MaxFiles: u.Files})
+}
+
+func usageFromBytes(data []byte) (Usage, error) {
+	q, err := quotaFromBytes(data)
+	return Usage{Bytes: q.MaxBytes, Files: q.MaxFiles}, err
+}
+
+func userQuotaKey(user string) []string {
+	return []string{"quota", "user", user}
+}
+
+func pathQuotaKey(dirPath string) []string {
+	return []string{"quota", "path", appendDot(dirPath)}
+}
+
+// The usage of every user and directory with a quota is kept in a counter
+// next to it, so checking a quota does not need to walk the tree.
+func userUsageKey(user string) []string {
+	return []string{"quota", "usage", "user", user}
+}
+
+func pathUsageKey(dirPath string) []string {
+	return []string{"quota", "usage", "path", appendDot(dirPath)}
+}
+
+// setQuota stores `q` under `key`. When the first quota is set, the usage
+// counter at `usageKey` is initialized with the usage of all files that
+// `counts` returns true for. The counter is removed together with the quota.
+func (lkr *Linker) setQuota(q Quota, key, usageKey []string, counts func(file quotaFile) bool) error {
+	var initial []byte
+	if !q.IsUnlimited() {
+		if _, err := lkr.kv.Get(usageKey...); err == db.ErrNoSuchKey {
+			root, err := lkr.Root()
+			if err != nil {
+				return err
+			}
+
+			files, err := quotaFilesBelow(lkr, root)
+			if err != nil {
+				return err
+			}
+
+			usage := Usage{}
+			for _, file := range files {
+				if counts(file) {
+					usage.Bytes += file.size
+					usage.Files++
+				}
+			}
+
+			initial = usageToBytes(usage)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	err := lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		if q.IsUnlimited() {
+			batch.Erase(key...)
+			batch.Erase(usageKey...)
+		} else {
+			batch.Put(quotaToBytes(q), key...)
+			if initial != nil {
+				batch.Put(initial, usageKey...)
+			}
+		}
+
+		return false, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Reload quotas on next use.
+	lkr.quotas = nil
+	return nil
+}
+
+func (lkr *Linker) getQuota(key ...string) (Quota, error) {
+	data, err := lkr.kv.Get(key...)
+	if err == db.ErrNoSuchKey {
+		return Quota{}, nil
+	}
+
+	if err != nil {
+		return Quota{}, err
+	}
+
+	return quotaFromBytes(data)
+}
+
+func (lkr *Linker) getUsage(key ...string) (Usage, error) {
+	data, err := lkr.kv.Get(key...)
+	if err == db.ErrNoSuchKey {
+		return Usage{}, nil
+	}
+
+	if err != nil {
+		return Usage{}, err
+	}
+
+	return usageFromBytes(data)
+}
+
+// SetUserQuota sets the quota of all files last modified by `user`.
+// Passing an unlimited quota removes it.
+func (lkr *Linker) SetUserQuota(user string, q Quota) error {
+	return lkr.setQuota(q, userQuotaKey(user), userUsageKey(user), func(file quotaFile) bool {
+		return file.user == user
+	})
+}
+
+// UserQuota returns the quota of `user`.
+func (lkr *Linker) UserQuota(user string) (Quota, error) {
+	return lkr.getQuota(userQuotaKey(user)...)
+}
+
+// SetPathQuota sets the quota of all files below the directory `dirPath`.
+// Passing an unlimited quota removes it.
+func (lkr *Linker) SetPathQuota(dirPath string, q Quota) error {
+	dirPath = path.Clean("/" + dirPath)
+	return lkr.setQuota(q, pathQuotaKey(dirPath), pathUsageKey(dirPath), func(file quotaFile) bool {
+		return isBelowDir(dirPath, file.path)
+	})
+}
+
+// PathQuota returns the quota of the directory at `dirPath`.
+func (lkr *Linker) PathQuota(dirPath string) (Quota, error) {
+	return lkr.getQuota(pathQuotaKey(path.Clean("/" + dirPath))...)
+}
+
+func (lkr *Linker) loadQuotas() (*quotas, error) {
+	if lkr.quotas != nil {
+		return lkr.quotas, nil
+	}
+
+	qs := &quotas{
+		byUser: make(map[string]Quota),
+		byPath: make(map[string]Quota),
+	}
+
+	// Only look at the definitions; the usage counters live below quota/ too.
+	for _, kind := range []string{"user", "path"} {
+		keys, err := lkr.kv.Keys("quota", kind)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			if len(key) < 3 {
+				continue
+			}
+
+			q, err := lkr.getQuota(key...)
+			if err != nil {
+				return nil, err
+			}
+
+			if kind == "user" {
+				qs.byUser[key[2]] = q
+			} else {
+				// Backends split the key at slashes, so glue the path together again.
+				qs.byPath[path.Clean("/"+strings.Join(key[2:], "/"))] = q
+			}
+		}
+	}
+
+	// Inside a batch, the quotas might still change or be rolled back.
+	if lkr.atomicDepth == 0 {
+		lkr.quotas = qs
+	}
+
+	return qs, nil
+}
+
+func isBelowDir(dirPath, repoPath string) bool {
+	return dirPath == "/" || strings.HasPrefix(repoPath, dirPath+"/")
+}
+
+// UsageReport sums up the usage of the current staging tree per user
+// and per directory with a quota. The usage per user is taken from the
+// files each user modified last. This method walks the whole tree and
+// should not be used in loops; quotas are checked with counters instead.
+func (lkr *Linker) UsageReport() (*UsageReport, error) {
+	qs, err := lkr.loadQuotas()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := lkr.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{
+		ByUser: make(map[string]Usage),
+		ByPath: make(map[string]Usage),
+	}
+
+	for dirPath := range qs.byPath {
+		report.ByPath[dirPath] = Usage{}
+	}
+
+	files, err := quotaFilesBelow(lkr, root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		report.Total.Bytes += file.size
+		report.Total.Files++
+
+		usage := report.ByUser[file.user]
+		usage.Bytes += file.size
+		usage.Files++
+		report.ByUser[file.user] = usage
+
+		for dirPath, usage := range report.ByPath {
+			if isBelowDir(dirPath, file.path) {
+				usage.Bytes += file.size
+				usage.Files++
+				report.ByPath[dirPath] = usage
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// RecountUsage sets the usage counters of all quotas to the real usage of
+// the staging tree. It walks the whole tree. Code that changes the tree
+// without Stage, Remove, Move or CheckoutCommit should call it afterwards.
+func (lkr *Linker) RecountUsage() error {
+	qs, err := lkr.loadQuotas()
+	if err != nil {
+		return err
+	}
+
+	if len(qs.byUser) == 0 && len(qs.byPath) == 0 {
+		return nil
+	}
+
+	report, err := lkr.UsageReport()
+	if err != nil {
+		return err
+	}
+
+	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		for user := range qs.byUser {
+			batch.Put(usageToBytes(report.ByUser[user]), userUsageKey(user)...)
+		}
+
+		for dirPath := range qs.byPath {
+			batch.Put(usageToBytes(report.ByPath[dirPath]), pathUsageKey(dirPath)...)
+		}
+
+		return false, nil
+	})
+}
+
+// quotaFile is what quotas need to know about a file.
+type quotaFile struct {
+	path string
+	user string
+	size uint64
+}
+
+// quotaFilesBelow returns all files in the tree of `nd`.
+func quotaFilesBelow(lkr *Linker, nd n.Node) ([]quotaFile, error) {
+	files := []quotaFile{}
+	return files, n.Walk(lkr, nd, true, func(child n.Node) error {
+		if child.Type() == n.NodeTypeFile {
+			files = append(files, quotaFile{
+				path: child.Path(),
+				user: child.User(),
+				size: child.Size(),
+			})
+		}
+
+		return nil
+	})
+}
+
+// quotaFilesIfNeeded is like quotaFilesBelow, but does not walk
+// the tree of `nd` if there are no quotas to update.
+func quotaFilesIfNeeded(lkr *Linker, nd n.Node) ([]quotaFile, error) {
+	qs, err := lkr.loadQuotas()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(qs.byUser) == 0 && len(qs.byPath) == 0 {
+		return nil, nil
+	}
+
+	return quotaFilesBelow(lkr, nd)
+}
+
+// quotaFilesChanged returns the files that differ between the trees of
+// `oldNd` and `newNd`, either of which may be nil. Subtrees with the same
+// tree hash are skipped, so only the changed parts are walked. A file
+// with the same path and content is taken as unchanged, even if another
+// user modified it last. It returns nothing if there are no quotas.
+func quotaFilesChanged(lkr *Linker, oldNd, newNd n.Node) (removed, added []quotaFile, err error) {
+	qs, err := lkr.loadQuotas()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(qs.byUser) == 0 && len(qs.byPath) == 0 {
+		return nil, nil, nil
+	}
+
+	return removed, added, diffQuotaFiles(lkr, oldNd, newNd, &removed, &added)
+}
+
+func diffQuotaFiles(lkr *Linker, oldNd, newNd n.Node, removed, added *[]quotaFile) error {
+	if oldNd != nil && newNd != nil && oldNd.TreeHash().Equal(newNd.TreeHash()) {
+		return nil
+	}
+
+	oldDir, oldIsDir := oldNd.(*n.Directory)
+	newDir, newIsDir := newNd.(*n.Directory)
+	if !oldIsDir || !newIsDir {
+		oldFiles, err := quotaFilesBelow(lkr, oldNd)
+		if err != nil {
+			return err
+		}
+
+		newFiles, err := quotaFilesBelow(lkr, newNd)
+		if err != nil {
+			return err
+		}
+
+		*removed = append(*removed, oldFiles...)
+		*added = append(*added, newFiles...)
+		return nil
+	}
+
+	children := make(map[string][2]n.Node)
+	for idx, dir := range []*n.Directory{oldDir, newDir} {
+		err := dir.VisitChildren(lkr, func(child n.Node) error {
+			pair := children[child.Name()]
+			pair[idx] = child
+			children[child.Name()] = pair
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		pair := children[name]
+		if err := diffQuotaFiles(lkr, pair[0], pair[1], removed, added); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// usageDelta is a change of a Usage.
+type usageDelta struct {
+	bytes, files int64
+}
+
+func (ud usageDelta) apply(usage Usage) Usage {
+	// Counters never go below zero, even if they were wrong before.
+	add := func(val uint64, delta int64) uint64 {
+		if delta < 0 && uint64(-delta) > val {
+			return 0
+		}
+
+		return uint64(int64(val) + delta)
+	}
+
+	return Usage{
+		Bytes: add(usage.Bytes, ud.bytes),
+		Files: add(usage.Files, ud.files),
+	}
+}
+
+func exceedsQuota(subject string, q Quota, usage Usage, delta usageDelta) error {
+	// Do not forbid changes that reduce the usage,
+	// even if the quota is already exceeded.
+	if q.MaxBytes > 0 && delta.bytes > 0 {
+		if need := usage.Bytes + uint64(delta.bytes); need > q.MaxBytes {
+			return ie.QuotaExceeded(subject, "bytes", q.MaxBytes, need)
+		}
+	}
+
+	if q.MaxFiles > 0 && delta.files > 0 {
+		if need := usage.Files + uint64(delta.files); need > q.MaxFiles {
+			return ie.QuotaExceeded(subject, "files", q.MaxFiles, need)
+		}
+	}
+
+	return nil
+}
+
+// quotaSubject is a user or a directory with a quota.
+type quotaSubject struct {
+	name     string
+	quota    Quota
+	usageKey []string
+	delta    usageDelta
+}
+
+// updateUsage replaces the `removed` files by the `added` files in the usage
+// counters of all users and directories with a quota. If a quota would be
+// exceeded, nothing is changed and a quota error is returned. The files of
+// a move have different paths, the files of an overwrite might have
+// different users; both is accounted for.
+func updateUsage(lkr *Linker, removed, added []quotaFile) error {
+	return applyUsage(lkr, removed, added, true)
+}
+
+// forceUsage is like updateUsage, but never fails because of a quota.
+// It is used when the tree is replaced as a whole, like on checkout.
+func forceUsage(lkr *Linker, removed, added []quotaFile) error {
+	return applyUsage(lkr, removed, added, false)
+}
+
+func applyUsage(lkr *Linker, removed, added []quotaFile, check bool) error {
+	subjects, usages, err := planUsage(lkr, removed, added, check)
+	if err != nil || len(subjects) == 0 {
+		return err
+	}
+
+	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		for idx, subject := range subjects {
+			if subject.delta == (usageDelta{}) {
+				continue
+			}
+
+			batch.Put(usageToBytes(subject.delta.apply(usages[idx])), subject.usageKey...)
+		}
+
+		return false, nil
+	})
+}
+
+// checkUsage is like updateUsage, but only checks the quotas.
+func checkUsage(lkr *Linker, removed, added []quotaFile) error {
+	_, _, err := planUsage(lkr, removed, added, true)
+	return err
+}
+
+// planUsage returns the subjects whose usage changes by replacing
+// `removed` with `added`, along with their current usage. If `check`
+// is true, an error is returned if any of their quotas would be exceeded.
+func planUsage(lkr *Linker, removed, added []quotaFile, check bool) ([]*quotaSubject, []Usage, error) {
+	qs, err := lkr.loadQuotas()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(qs.byUser) == 0 && len(qs.byPath) == 0 {
+		return nil, nil, nil
+	}
+
+	// Keep the order stable, so the same error is reported every time:
+	subjects := []*quotaSubject{}
+	byName := make(map[string]*quotaSubject)
+	change := func(name string, quota Quota, usageKey []string, size uint64, sign int64) {
+		subject, ok := byName[name]
+		if !ok {
+			subject = &quotaSubject{name: name, quota: quota, usageKey: usageKey}
+			subjects = append(subjects, subject)
+			byName[name] = subject
+		}
+
+		subject.delta.bytes += sign * int64(size)
+		subject.delta.files += sign
+	}
+
+	dirPaths := make([]string, 0, len(qs.byPath))
+	for dirPath := range qs.byPath {
+		dirPaths = append(dirPaths, dirPath)
+	}
+
+	sort.Strings(dirPaths)
+
+	for _, files := range []struct {
+		list []quotaFile
+		sign int64
+	}{{removed, -1}, {added, 1}} {
+		for _, file := range files.list {
+			if q, ok := qs.byUser[file.user]; ok {
+				change("user:"+file.user, q, userUsageKey(file.user), file.size, files.sign)
+			}
+
+			for _, dirPath := range dirPaths {
+				if isBelowDir(dirPath, file.path) {
+					change(dirPath, qs.byPath[dirPath], pathUsageKey(dirPath), file.size, files.sign)
+				}
+			}
+		}
+	}
+
+	usages := make([]Usage, len(subjects))
+	for idx, subject := range subjects {
+		usage, err := lkr.getUsage(subject.usageKey...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if check {
+			name := strings.TrimPrefix(subject.name, "user:")
+			if err := exceedsQuota(name, subject.quota, usage, subject.delta); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		usages[idx] = usage
+	}
+
+	return subjects, usages, nil
+}
@@ -0,0 +1,411 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"floo/catfs/db"
+	"floo/catfs/mio"
+	"floo/catfs/mio/encrypt"
+	n "floo/catfs/nodes"
+	h "floo/util/hashlib"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// ObjectStore gives access to the encrypted data of files by backend hash.
+type ObjectStore interface {
+	// Get returns the data stored under `hash`.
+	Get(hash h.Hash) (io.ReadSeeker, error)
+
+	// Put stores all data of `r` and returns the backend hash of it.
+	Put(r io.Reader) (h.Hash, error)
+}
+
+// RekeyOptions configure Rekey().
+type RekeyOptions struct {
+	// AllHistory re-encrypts all versions of all files ever committed.
+	// Otherwise only the files of the current tree are re-encrypted;
+	// older versions keep their data and key, unless they share the
+	// object with a current file.
+	AllHistory bool
+
+	// Cipher is the name of the cipher for the new data (see
+	// encrypt.CipherByName). The default cipher is used if empty.
+	Cipher string
+
+	// Progress is called after every re-encrypted object, if not nil.
+	Progress func(progress RekeyProgress)
+}
+
+// RekeyProgress tells how far Rekey() is.
+type RekeyProgress struct {
+	// Done is the number of objects re-encrypted so far,
+	// including the ones of an interrupted previous run.
+	Done int
+
+	// Total is the number of objects that need to be re-encrypted.
+	Total int
+
+	// Old and New are the backend hashes of the last object.
+	Old, New h.Hash
+}
+
+// RekeyResult is returned by Rekey() on success.
+type RekeyResult struct {
+	// Rekeyed is the number of re-encrypted objects.
+	Rekeyed int
+
+	// SkippedChunked is the number of objects that were not re-encrypted,
+	// because they belong to files stored in chunks. Chunks have no key
+	// of their own (see mio.ChunkKey), so they can not be re-keyed.
+	SkippedChunked int
+
+	// Old are the backend hashes of the replaced objects. This linker
+	// does not need them anymore, but the file nodes still refer to
+	// them; peers that do not know about the re-key still read them.
+	Old []h.Hash
+}
+
+// rekeyedObject is stored for every finished object, so an interrupted
+// Rekey() can be resumed. Once Rekey() is done, it is stored for good
+// under the replaced object, since the nodes still refer to that one.
+type rekeyedObject struct {
+	Backend    string `json:"backend"`
+	Key        []byte `json:"key,omitempty"`
+	KeySalt    []byte `json:"key_salt,omitempty"`
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+}
+
+// rekeyTarget is a file whose data needs to be re-encrypted.
+// `backend` is where the data is currently stored (see FileBackend).
+type rekeyTarget struct {
+	backend h.Hash
+	file    *n.File
+}
+
+// Rekey decrypts the data of files from `store` and encrypts it again with
+// fresh keys, for example when a key might have leaked. New keys are derived
+// from the master key if one is set; otherwise they are random and stored
+// in the file nodes. Files that are stored in chunks have no key of their
+// own; they are skipped and counted in RekeyResult.SkippedChunked.
+//
+// The nodes are not changed, since that would change their hashes (and
+// therefore the history) on this side only. Instead, the new backend hash
+// and key of every replaced object is stored on the side; use
+// Linker.FileBackend() and Linker.FileKey() to read the data of a file.
+// The operation is recorded in the oplog as OpRekey. If Rekey() is interrupted
+// (by an error or by cancelling `ctx`), calling it again continues where it
+// stopped; objects that were re-encrypted already are not done again.
+func (lkr *Linker) Rekey(ctx context.Context, store ObjectStore, opts RekeyOptions) (*RekeyResult, error) {
+	cipherType, err := encrypt.CipherByName(opts.Cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, skipped, err := lkr.rekeyTargets(opts.AllHistory)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(map[string]rekeyedObject)
+	progress := RekeyProgress{Total: len(targets)}
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		obj, err := lkr.rekeyObject(store, target, cipherType)
+		if err != nil {
+			return nil, err
+		}
+
+		done[target.backend.B58String()] = *obj
+		progress.Done++
+
+		if opts.Progress != nil {
+			progress.Old = target.backend
+			progress.New, _ = h.FromB58String(obj.Backend)
+			opts.Progress(progress)
+		}
+	}
+
+	args := []string{
+		strconv.FormatBool(opts.AllHistory),
+		encrypt.CipherName(cipherType),
+		strconv.Itoa(len(done)),
+	}
+
+	result := &RekeyResult{Rekeyed: len(done), SkippedChunked: skipped}
+	err = lkr.atomicOpWithBatch(OpRekey, args, func(batch db.Batch) (bool, error) {
+		if err := lkr.saveReplacedObjects(batch, done); err != nil {
+			return true, err
+		}
+
+		// The new objects are in use now; no need to resume anymore.
+		if err := lkr.clearRekeyState(batch); err != nil {
+			return true, err
+		}
+
+		return false, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range targets {
+		result.Old = append(result.Old, target.backend)
+	}
+
+	return result, nil
+}
+
+// FileBackend returns the backend hash that the data of `file` is stored
+// under. That is file.BackendHash(), unless the data was re-encrypted
+// by Rekey().
+func (lkr *Linker) FileBackend(file *n.File) (h.Hash, error) {
+	obj, err := lkr.replacedObject(file.BackendHash())
+	if err != nil || obj == nil {
+		return file.BackendHash(), err
+	}
+
+	return h.FromB58String(obj.Backend)
+}
+
+// replacedObject returns the object that replaced `backend`,
+// or nil if there is none.
+func (lkr *Linker) replacedObject(backend h.Hash) (*rekeyedObject, error) {
+	if len(backend) == 0 {
+		return nil, nil
+	}
+
+	data, err := lkr.kv.Get("rekeyed", backend.B58String())
+	if err == db.ErrNoSuchKey {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &rekeyedObject{}
+	return obj, json.Unmarshal(data, obj)
+}
+
+// rekeyTargets returns one file per backend hash that needs to be
+// re-encrypted, sorted by backend hash, and the number of objects
+// that were skipped because they are stored in chunks.
+func (lkr *Linker) rekeyTargets(allHistory bool) ([]rekeyTarget, int, error) {
+	byBackend := make(map[string]rekeyTarget)
+	chunked := make(map[string]bool)
+	addFile := func(file *n.File) error {
+		if len(file.Chunks()) > 0 {
+			chunked[file.BackendHash().B58String()] = true
+			return nil
+		}
+
+		backend, err := lkr.FileBackend(file)
+		if err != nil || len(backend) == 0 {
+			return err
+		}
+
+		// Objects written by an interrupted run are new already:
+		if _, err := lkr.kv.Get("rekey", "new", backend.B58String()); err != db.ErrNoSuchKey {
+			return err
+		}
+
+		byBackend[backend.B58String()] = rekeyTarget{backend: backend.Clone(), file: file}
+		return nil
+	}
+
+	root, err := lkr.Root()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = n.Walk(lkr, root, true, func(child n.Node) error {
+		if file, ok := child.(*n.File); ok {
+			return addFile(file)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if allHistory {
+		for _, prefix := range [][]string{{"objects"}, {"stage", "objects"}} {
+			err := lkr.forEachStoredFile(prefix, func(_ []string, _ n.Node, file *n.File) error {
+				return addFile(file)
+			})
+
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	targets := make([]rekeyTarget, 0, len(byBackend))
+	for _, target := range byBackend {
+		targets = append(targets, target)
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].backend.B58String() < targets[j].backend.B58String()
+	})
+
+	return targets, len(chunked), nil
+}
+
+// rekeyObject re-encrypts the data of a single target,
+// unless a previous run did it already.
+func (lkr *Linker) rekeyObject(store ObjectStore, target rekeyTarget, cipherType uint16) (*rekeyedObject, error) {
+	b58Backend := target.backend.B58String()
+	data, err := lkr.kv.Get("rekey", "done", b58Backend)
+	if err != nil && err != db.ErrNoSuchKey {
+		return nil, err
+	}
+
+	if err == nil {
+		obj := &rekeyedObject{}
+		return obj, json.Unmarshal(data, obj)
+	}
+
+	oldKey, err := lkr.FileKey(target.file)
+	if err != nil {
+		return nil, err
+	}
+
+	newKey, keys, err := lkr.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &rekeyedObject{Key: keys.key, KeySalt: keys.salt}
+
+	r, err := store.Get(target.backend)
+	if err != nil {
+		return nil, err
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	stream, err := mio.NewRekeyStream(r, oldKey, newKey, cipherType)
+	if err != nil {
+		return nil, err
+	}
+
+	newBackend, err := store.Put(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	obj.Backend = newBackend.B58String()
+	if data, err = json.Marshal(obj); err != nil {
+		return nil, err
+	}
+
+	err = lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		batch.Put(data, "rekey", "done", b58Backend)
+		batch.Put([]byte{}, "rekey", "new", obj.Backend)
+		return false, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// saveReplacedObjects remembers the new objects of the replaced ones.
+// Objects that replaced others earlier and were now replaced again
+// are updated, so every node always points to the newest one.
+func (lkr *Linker) saveReplacedObjects(batch db.Batch, done map[string]rekeyedObject) error {
+	iter := lkr.kv.Iterator(db.IterOptions{Prefix: []string{"rekeyed"}})
+	defer iter.Close()
+
+	for iter.Next() {
+		obj := rekeyedObject{}
+		if err := json.Unmarshal(iter.Value(), &obj); err != nil {
+			return err
+		}
+
+		if newObj, ok := done[obj.Backend]; ok {
+			data, err := json.Marshal(newObj)
+			if err != nil {
+				return err
+			}
+
+			batch.Put(data, iter.Key()...)
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for b58Backend, obj := range done {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+
+		batch.Put(data, "rekeyed", b58Backend)
+	}
+
+	return nil
+}
+
+func (lkr *Linker) clearRekeyState(batch db.Batch) error {
+	iter := lkr.kv.Iterator(db.IterOptions{Prefix: []string{"rekey"}, KeysOnly: true})
+	defer iter.Close()
+
+	for iter.Next() {
+		batch.Erase(iter.Key()...)
+	}
+
+	return iter.Err()
+}
+
+// forEachStoredFile calls `fn` for every file node below `prefix`,
+// including the files of ghosts. `nd` is the node that was stored
+// under `key`; it contains `file` and has to be marshaled after
+// modifying `file`.
+func (lkr *Linker) forEachStoredFile(prefix []string, fn func(key []string, nd n.Node, file *n.File) error) error {
+	iter := lkr.kv.Iterator(db.IterOptions{Prefix: prefix})
+	defer iter.Close()
+
+	for iter.Next() {
+		nd, err := n.UnmarshalNode(iter.Value())
+		if err != nil {
+			return err
+		}
+
+		var file *n.File
+		switch nd.Type() {
+		case n.NodeTypeFile:
+			file, _ = nd.(*n.File)
+		case n.NodeTypeGhost:
+			if ghost, ok := nd.(*n.Ghost); ok {
+				// Ghosts of directories are not interesting:
+				file, _ = ghost.OldFile()
+			}
+		}
+
+		if file == nil {
+			continue
+		}
+
+		if err := fn(append([]string(nil), iter.Key()...), nd, file); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
@@ -0,0 +1,278 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"floo/catfs/db"
+	"floo/catfs/mio"
+	"floo/catfs/mio/compress"
+	"floo/catfs/mio/encrypt"
+	n "floo/catfs/nodes"
+	h "floo/util/hashlib"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+type memObjectStore struct {
+	objects map[string][]byte
+
+	// Put fails once `failAfter` objects were put, if > 0.
+	failAfter int
+}
+
+var errStoreFull = errors.New("store is full")
+
+func newMemObjectStore() *memObjectStore {
+	return &memObjectStore{objects: make(map[string][]byte)}
+}
+
+func (ms *memObjectStore) Get(hash h.Hash) (io.ReadSeeker, error) {
+	data, ok := ms.objects[hash.B58String()]
+	if !ok {
+		return nil, errors.New("no such object")
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+func (ms *memObjectStore) Put(r io.Reader) (h.Hash, error) {
+	if ms.failAfter > 0 && len(ms.objects) >= ms.failAfter {
+		return nil, errStoreFull
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := h.Sum(data)
+	ms.objects[hash.B58String()] = data
+	return hash, nil
+}
+
+func stageWithData(t *testing.T, lkr *Linker, store *memObjectStore, path string, data []byte) *n.File {
+	key := make([]byte, 32)
+	copy(key, path)
+
+	stream, err := mio.NewInStream(bytes.NewReader(data), key, compress.AlgoSnappy)
+	require.Nil(t, err)
+
+	backend, err := store.Put(stream)
+	require.Nil(t, err)
+
+	file, err := Stage(lkr, path, h.Sum(data), backend, uint64(len(data)), key)
+	require.Nil(t, err)
+	return file
+}
+
+func readFileData(t *testing.T, lkr *Linker, store *memObjectStore, file *n.File) []byte {
+	key, err := lkr.FileKey(file)
+	require.Nil(t, err)
+
+	backend, err := lkr.FileBackend(file)
+	require.Nil(t, err)
+
+	r, err := store.Get(backend)
+	require.Nil(t, err)
+
+	stream, err := mio.NewOutStream(r, key)
+	require.Nil(t, err)
+
+	data, err := io.ReadAll(stream)
+	require.Nil(t, err)
+	return data
+}
+
+func lookupFile(t *testing.T, lkr *Linker, path string) *n.File {
+	nd, err := lkr.LookupNode(path)
+	require.Nil(t, err)
+	return nd.(*n.File)
+}
+
+func TestRekeyHead(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		store := newMemObjectStore()
+		// Stage() modifies the node of /a later; remember the old version:
+		oldA := stageWithData(t, lkr, store, "/a", []byte("old a")).Copy(0)
+		require.Nil(t, lkr.MakeCommit(n.AuthorOfStage, "first"))
+
+		stageWithData(t, lkr, store, "/a", []byte("new a"))
+		stageWithData(t, lkr, store, "/b", []byte("b"))
+		require.Nil(t, lkr.MakeCommit(n.AuthorOfStage, "second"))
+
+		before := lookupFile(t, lkr, "/a").Copy(0).(*n.File)
+		progress := []RekeyProgress{}
+		result, err := lkr.Rekey(context.Background(), store, RekeyOptions{
+			Cipher: "aes-gcm",
+			Progress: func(p RekeyProgress) {
+				progress = append(progress, p)
+			},
+		})
+
+		require.Nil(t, err)
+		require.Equal(t, 2, result.Rekeyed)
+		require.Len(t, progress, 2)
+		require.Equal(t, RekeyProgress{Done: 2, Total: 2}, RekeyProgress{
+			Done:  progress[1].Done,
+			Total: progress[1].Total,
+		})
+
+		// The node and therefore its hash is the same,
+		// but the data is read from the new object:
+		after := lookupFile(t, lkr, "/a")
+		require.Equal(t, before.BackendHash(), after.BackendHash())
+		require.Equal(t, before.TreeHash(), after.TreeHash())
+		require.Equal(t, []byte("new a"), readFileData(t, lkr, store, after))
+		require.Equal(t, []byte("b"), readFileData(t, lkr, store, lookupFile(t, lkr, "/b")))
+
+		newBackend, err := lkr.FileBackend(after)
+		require.Nil(t, err)
+		require.False(t, before.BackendHash().Equal(newBackend))
+
+		// No commit was made:
+		head, err := lkr.Head()
+		require.Nil(t, err)
+		require.Equal(t, "second", head.Message())
+
+		// The cipher was changed:
+		data := store.objects[newBackend.B58String()]
+		require.Equal(t, encrypt.CipherAESGCM, uint16(data[10])|uint16(data[11])<<8)
+
+		// The old version was not re-encrypted:
+		old, err := lkr.NodeByHash(oldA.TreeHash())
+		require.Nil(t, err)
+
+		oldBackend, err := lkr.FileBackend(old.(*n.File))
+		require.Nil(t, err)
+		require.Equal(t, oldA.BackendHash(), oldBackend)
+
+		var lastOp Op
+		require.Nil(t, lkr.Oplog(0, func(op Op) error {
+			lastOp = op
+			return nil
+		}))
+		require.Equal(t, OpRekey, lastOp.Type)
+	})
+}
+
+func TestRekeyAllHistoryResume(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		require.Nil(t, lkr.SetMasterKey(testMasterKey))
+
+		store := newMemObjectStore()
+		// Stage() modifies the node of /a later; remember the old version:
+		oldA := stageWithData(t, lkr, store, "/a", []byte("old a")).Copy(0)
+		require.Nil(t, lkr.MakeCommit(n.AuthorOfStage, "first"))
+
+		stageWithData(t, lkr, store, "/a", []byte("new a"))
+		stageWithData(t, lkr, store, "/b", []byte("b"))
+		require.Nil(t, lkr.MakeCommit(n.AuthorOfStage, "second"))
+
+		// Interrupt after the first re-encrypted object:
+		store.failAfter = len(store.objects) + 1
+		_, err := lkr.Rekey(context.Background(), store, RekeyOptions{AllHistory: true})
+		require.Equal(t, errStoreFull, err)
+
+		// Nothing is applied yet:
+		require.Equal(t, []byte("new a"), readFileData(t, lkr, store, lookupFile(t, lkr, "/a")))
+
+		store.failAfter = 0
+		progress := []RekeyProgress{}
+		result, err := lkr.Rekey(context.Background(), store, RekeyOptions{
+			AllHistory: true,
+			Progress: func(p RekeyProgress) {
+				progress = append(progress, p)
+			},
+		})
+
+		require.Nil(t, err)
+		require.Equal(t, 3, result.Rekeyed)
+		require.Len(t, progress, 3)
+
+		// 3 original objects, 3 re-encrypted ones: the first one
+		// of the interrupted run must have been reused.
+		require.Len(t, store.objects, 6)
+
+		// The node of the old version is unchanged,
+		// but its data is read from the new object:
+		old, err := lkr.NodeByHash(oldA.TreeHash())
+		require.Nil(t, err)
+
+		oldFile := old.(*n.File)
+		require.True(t, oldA.BackendHash().Equal(oldFile.BackendHash()))
+
+		oldBackend, err := lkr.FileBackend(oldFile)
+		require.Nil(t, err)
+		require.False(t, oldA.BackendHash().Equal(oldBackend))
+		require.Equal(t, []byte("old a"), readFileData(t, lkr, store, oldFile))
+		require.Equal(t, []byte("new a"), readFileData(t, lkr, store, lookupFile(t, lkr, "/a")))
+
+		// Old versions follow a second re-key too:
+		for _, hash := range result.Old {
+			delete(store.objects, hash.B58String())
+		}
+
+		result, err = lkr.Rekey(context.Background(), store, RekeyOptions{AllHistory: true})
+		require.Nil(t, err)
+		require.Equal(t, 3, result.Rekeyed)
+
+		for _, hash := range result.Old {
+			delete(store.objects, hash.B58String())
+		}
+
+		require.Len(t, store.objects, 3)
+		require.Equal(t, []byte("old a"), readFileData(t, lkr, store, oldFile))
+		require.Equal(t, []byte("new a"), readFileData(t, lkr, store, lookupFile(t, lkr, "/a")))
+
+		// The resume state is gone:
+		_, err = lkr.kv.Get("rekey", "new", oldBackend.B58String())
+		require.Equal(t, db.ErrNoSuchKey, err)
+	})
+}
+
+func TestRekeyCancel(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		store := newMemObjectStore()
+		stageWithData(t, lkr, store, "/a", []byte("a"))
+		require.Nil(t, lkr.MakeCommit(n.AuthorOfStage, "first"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := lkr.Rekey(ctx, store, RekeyOptions{})
+		require.Equal(t, context.Canceled, err)
+
+		_, err = lkr.Rekey(context.Background(), store, RekeyOptions{Cipher: "rot13"})
+		require.NotNil(t, err)
+	})
+}
+
+func TestRekeyUncommittedAndChunked(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		store := newMemObjectStore()
+		stageWithData(t, lkr, store, "/a", []byte("a"))
+
+		chunks := []n.Chunk{{Hash: h.TestDummy(t, 1), Size: 3}}
+		_, err := StageChunked(lkr, "/chunked", h.TestDummy(t, 2), chunks, 3)
+		require.Nil(t, err)
+
+		// Staged files are re-encrypted too; nothing is committed:
+		result, err := lkr.Rekey(context.Background(), store, RekeyOptions{})
+		require.Nil(t, err)
+		require.Equal(t, 1, result.Rekeyed)
+		require.Equal(t, 1, result.SkippedChunked)
+		require.Len(t, result.Old, 1)
+
+		delete(store.objects, result.Old[0].B58String())
+		require.Equal(t, []byte("a"), readFileData(t, lkr, store, lookupFile(t, lkr, "/a")))
+
+		// The staged changes are still there:
+		require.Nil(t, lkr.MakeCommit(n.AuthorOfStage, "first"))
+
+		chunked := lookupFile(t, lkr, "/chunked")
+		require.Equal(t, chunks, chunked.Chunks())
+		require.Equal(t, n.ChunksHash(chunks), chunked.BackendHash())
+	})
+}
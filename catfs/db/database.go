@@ -2,7 +2,9 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"path/filepath"
 )
 
 type Batch interface {
@@ -19,9 +21,21 @@ type Batch interface {
 	// this is when all changes are written to the disk
 	Flush() error
 
-	// Rollback will forget all the changes without executing them
+	// Rollback will forget all the changes without executing them.
+	// When called in a nested batch, the changes of the outer
+	// batches are forgotten too.
 	Rollback()
 
+	// Savepoint marks the current state of the batch and returns an id for it.
+	// Savepoints are only valid until the batch is flushed or rolled back.
+	Savepoint() int
+
+	// RollbackTo forgets all changes made after `savepoint`, but keeps
+	// the ones made before it. The savepoint itself stays valid, all
+	// savepoints taken after it are dropped. ErrNoSuchSavepoint is
+	// returned if `savepoint` is not valid (anymore).
+	RollbackTo(savepoint int) error
+
 	// HaveWrites return if the batch has something we can
 	// write to the disk with Flush()
 	HaveWrites() bool
@@ -34,11 +48,15 @@ type Database interface {
 	// Keys iterates all keys in the database and return in lexical order
 	Keys(prefix ...string) ([][]string, error)
 
+	// Iterator returns an Iterator over all keys matching `opts`.
+	// Prefer it over Keys() when many keys are expected.
+	Iterator(opts IterOptions) Iterator
+
 	// Batch returns new Batch object
 	Batch() Batch
 
-	// Export backups all database content to `w`
-	// in an implementation specific format that can be read by Import
+	// Export backups all database content to `w` in the dump format
+	// (see dump.go) that can be read by Import of any backend
 	Export(w io.Writer) error
 
 	// Import reads a previously exported db dump by Export()
@@ -54,6 +72,9 @@ type Database interface {
 
 var (
 	ErrNoSuchKey = errors.New("this key does not exist")
+
+	// ErrNoSuchSavepoint is returned by Batch.RollbackTo for unknown savepoints.
+	ErrNoSuchSavepoint = errors.New("no such savepoint")
 )
 
 // CopyKey is a helper method to copy a bunch of keys in `src` to `dst`.
@@ -67,3 +88,23 @@ func CopyKey(db Database, src, dst []string) error {
 	batch.Put(data, dst...)
 	return batch.Flush()
 }
+
+// Backends lists the names that can be passed to NewDatabase.
+var Backends = []string{"memory", "disk", "badger", "bolt"}
+
+// NewDatabase opens the database backend called `backend` in the directory
+// `dir`. The directory is ignored for the memory backend.
+func NewDatabase(backend, dir string) (Database, error) {
+	switch backend {
+	case "memory":
+		return NewMemoryDatabase(), nil
+	case "disk":
+		return NewDiskDatabase(dir)
+	case "badger":
+		return NewBadgerDatabase(dir)
+	case "bolt":
+		return NewBoltDatabase(filepath.Join(dir, "meta.bolt"))
+	default:
+		return nil, fmt.Errorf("no such database backend: %s", backend)
+	}
+}
@@ -1,22 +1,36 @@
 package db
 
 import (
+	"bufio"
 	"github.com/dgraph-io/badger"
 	"github.com/dgraph-io/badger/options"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"strings"
 	"sync"
-	"time"
 )
 
+// BadgerDatabase is a database backed by badger.
+// Key parts are normalized (see normalizeKey) and joined with a zero byte,
+// i.e. the key ("stage", "tree", "/a/b.txt") is stored as "stage\x00tree\x00a\x00b.txt".
+// The zero byte sorts before every other byte, so badger's key order is the
+// same as the order of Database.Iterator. Stores of the older dot format
+// are migrated on open, see database_badger_format.go.
 type BadgerDatabase struct {
 	mu         sync.Mutex
 	db         *badger.DB
+	dir        string
 	txn        *badger.Txn
 	refCount   int
 	haveWrites bool
-	gcTicker   *time.Ticker
+	journal    batchJournal
+	gcPending  bool
+
+	// batchErr is the first error of the current batch.
+	// The batch is not committed if it is set; Flush returns it.
+	batchErr error
+
+	gc badgerGC
 }
 
 // NewBadgerDatabase creates a new badger database.
@@ -36,21 +50,24 @@ func NewBadgerDatabase(path string) (*BadgerDatabase, error) {
 		return nil, err
 	}
 
-	gcTicker := time.NewTicker(5 * time.Minute)
-	go func() {
-		for range gcTicker.C {
-		again:
-			err := db.RunValueLogGC(0.5)
-			if err == nil {
-				goto again
-			}
-		}
-	}()
+	bdb := &BadgerDatabase{db: db, dir: path}
+	if err := bdb.checkFormat(); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	return &BadgerDatabase{
-		db:       db,
-		gcTicker: gcTicker,
-	}, nil
+	bdb.startGC(badgerGCInterval)
+	return bdb, nil
+}
+
+const badgerKeySep = "\x00"
+
+func badgerKey(key []string) string {
+	return strings.Join(normalizeKey(key), badgerKeySep)
+}
+
+func splitBadgerKey(key []byte) []string {
+	return strings.Split(string(key), badgerKeySep)
 }
 
 func (db *BadgerDatabase) view(fn func(txn *badger.Txn) error) error {
@@ -59,6 +76,11 @@ func (db *BadgerDatabase) view(fn func(txn *badger.Txn) error) error {
 	if db.txn != nil {
 		return fn(db.txn)
 	}
+
+	if db.db == nil {
+		return ErrClosed
+	}
+
 	// If no transaction is running (no Batch()-call), use a fresh view txn.
 	return db.db.View(fn)
 }
@@ -73,8 +95,7 @@ func (db *BadgerDatabase) Get(key ...string) ([]byte, error) {
 		if db.txn != nil {
 			txn = db.txn
 		}
-		keyPath := strings.Join(key, ".")
-		item, err := txn.Get([]byte(keyPath))
+		item, err := txn.Get([]byte(badgerKey(key)))
 		if err == badger.ErrKeyNotFound {
 			return ErrNoSuchKey
 		}
@@ -96,6 +117,8 @@ func (db *BadgerDatabase) Keys(prefix ...string) ([][]string, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	prefix = normalizeKey(prefix)
+
 	keys := [][]string{}
 	return keys, db.view(func(txn *badger.Txn) error {
 		iter := txn.NewIterator(badger.IteratorOptions{})
@@ -103,39 +126,132 @@ func (db *BadgerDatabase) Keys(prefix ...string) ([][]string, error) {
 
 		for iter.Rewind(); iter.Valid(); iter.Next() {
 			item := iter.Item()
+			if isReservedBadgerKey(item.Key()) {
+				continue
+			}
 
 			fullKey := string(item.Key())
-			splitKey := strings.Split(fullKey, ".")
+			splitKey := strings.Split(fullKey, badgerKeySep)
 
 			hasPrefix := len(prefix) <= len(splitKey)
 			for i := 0; hasPrefix && i < len(prefix) && i < len(splitKey); i++ {
 				if prefix[i] != splitKey[i] {
 					hasPrefix = false
 				}
-				if hasPrefix {
-					keys = append(keys, strings.Split(fullKey, "."))
+			}
+
+			if hasPrefix {
+				keys = append(keys, splitKey)
+			}
+		}
+		return nil
+	})
+}
+
+// Iterator is the badger implementation of Database.Iterator.
+// badger allows only one iterator per transaction, so the keys are
+// read in pages and no iterator is kept open between calls.
+func (db *BadgerDatabase) Iterator(opts IterOptions) Iterator {
+	return newPagedIterator(opts, db.scan)
+}
+
+func (db *BadgerDatabase) scan(opts IterOptions, after []string, limit int) ([]iterEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	seek := opts.seekKey()
+	if after != nil {
+		seek = after
+	}
+
+	entries := []iterEntry{}
+	return entries, db.view(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.IteratorOptions{})
+		defer iter.Close()
+
+		for iter.Seek([]byte(badgerKey(seek))); iter.Valid() && len(entries) < limit; iter.Next() {
+			item := iter.Item()
+			if isReservedBadgerKey(item.Key()) {
+				continue
+			}
+
+			key := splitBadgerKey(item.Key())
+			if opts.beyond(key) {
+				break
+			}
+
+			if after != nil && compareKeys(key, after) == 0 {
+				continue
+			}
+
+			entry := iterEntry{key: key}
+			if !opts.KeysOnly {
+				val, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
 				}
+
+				entry.val = val
 			}
+
+			entries = append(entries, entry)
 		}
+
 		return nil
 	})
 }
 
 // Export is the badger implementation of Database.Export.
+// All keys are read from a single transaction, so the dump is consistent.
 func (db *BadgerDatabase) Export(w io.Writer) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	_, err := db.db.Backup(w, 0)
-	return err
+	dw, err := NewDumpWriter(w)
+	if err != nil {
+		return err
+	}
+
+	err = db.view(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.IteratorOptions{})
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if isReservedBadgerKey(item.Key()) {
+				continue
+			}
+
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			if err := dw.Write(splitBadgerKey(item.Key()), val); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return dw.Close()
 }
 
 // Import is the badger implementation of Database.Import.
+// Dumps of older versions were plain badger backups; they are loaded
+// as they are and their keys are migrated to the current format.
 func (db *BadgerDatabase) Import(r io.Reader) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	br := bufio.NewReader(r)
+	if isLegacyDump(br) {
+		return db.importLegacyBackup(br)
+	}
 
-	return db.db.Load(r)
+	return importDump(db, br)
 }
 
 // Glob is a badger implementation of the Database.Glob
@@ -143,7 +259,12 @@ func (db *BadgerDatabase) Glob(prefix []string) ([][]string, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	fullPrefix := strings.Join(prefix, ".")
+	fullPrefix := badgerKey(prefix)
+
+	// A trailing slash means "everything in this bucket".
+	if len(prefix) > 0 && strings.HasSuffix(prefix[len(prefix)-1], "/") && fullPrefix != "" {
+		fullPrefix += badgerKeySep
+	}
 
 	results := [][]string{}
 	err := db.view(func(txn *badger.Txn) error {
@@ -152,14 +273,18 @@ func (db *BadgerDatabase) Glob(prefix []string) ([][]string, error) {
 
 		for iter.Seek([]byte(fullPrefix)); iter.Valid(); iter.Next() {
 			fullKey := string(iter.Item().Key())
+			if isReservedBadgerKey(iter.Item().Key()) {
+				continue
+			}
+
 			if !strings.HasPrefix(fullKey, fullPrefix) {
 				break
 			}
 
 			// Don't do recursive globbing:
 			leftOver := fullKey[len(fullPrefix):]
-			if !strings.Contains(leftOver, ".") {
-				results = append(results, strings.Split(fullKey, "."))
+			if !strings.Contains(leftOver, badgerKeySep) {
+				results = append(results, strings.Split(fullKey, badgerKeySep))
 			}
 		}
 
@@ -178,29 +303,49 @@ func (db *BadgerDatabase) Batch() Batch {
 }
 
 func (db *BadgerDatabase) batch() Batch {
-	if db.txn == nil {
-		db.txn = db.db.NewTransaction(true)
+	if db.txn == nil && db.batchErr == nil {
+		if db.db == nil {
+			// Batch() has no way to return an error; Flush will.
+			db.batchErr = ErrClosed
+		} else {
+			db.txn = db.db.NewTransaction(true)
+		}
 	}
 
 	db.refCount++
 	return db
 }
 
+// setBatchErr remembers `err` if it is the first error of the batch.
+func (db *BadgerDatabase) setBatchErr(err error) {
+	if db.batchErr == nil {
+		db.batchErr = err
+	}
+}
+
 // Put is a badger implementation of Batch.Put
 func (db *BadgerDatabase) Put(val []byte, key ...string) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	db.haveWrites = true
+	db.journal.record(journalPut, key, val)
 
-	fullKey := []byte(strings.Join(key, "."))
+	if err := db.put(val, key); err != nil {
+		log.Warningf("badger: failed to set key %s: %v", badgerKey(key), err)
+		db.setBatchErr(err)
+	}
+}
+
+func (db *BadgerDatabase) put(val []byte, key []string) error {
+	if db.txn == nil {
+		return ErrClosed
+	}
 
-	err := db.withRetry(func() error {
+	fullKey := []byte(badgerKey(key))
+	return db.withRetry(func() error {
 		return db.txn.Set(fullKey, val)
 	})
-	if err != nil {
-		log.Warningf("badger: failed to set key %s: %v", fullKey, err)
-	}
 }
 
 func (db *BadgerDatabase) withRetry(fn func() error) error {
@@ -213,6 +358,9 @@ func (db *BadgerDatabase) withRetry(fn func() error) error {
 	}
 	db.txn = db.db.NewTransaction(true)
 
+	// What was committed cannot be rolled back to anymore.
+	db.journal.reset()
+
 	return fn()
 }
 
@@ -222,13 +370,29 @@ func (db *BadgerDatabase) Clear(key ...string) error {
 	defer db.mu.Unlock()
 
 	db.haveWrites = true
+	db.journal.record(journalClear, key, nil)
+	if err := db.clear(key); err != nil {
+		db.setBatchErr(err)
+		return err
+	}
+
+	return nil
+}
+
+func (db *BadgerDatabase) clear(key []string) error {
+	if db.txn == nil {
+		return ErrClosed
+	}
 
 	iter := db.txn.NewIterator(badger.IteratorOptions{})
-	prefix := strings.Join(key, ".")
+	prefix := badgerKey(key)
 
 	keys := [][]byte{}
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		item := iter.Item()
+		if isReservedBadgerKey(item.Key()) {
+			continue
+		}
 
 		key := make([]byte, len(item.Key()))
 		copy(key, item.Key())
@@ -236,8 +400,10 @@ func (db *BadgerDatabase) Clear(key ...string) error {
 	}
 	iter.Close()
 
+	deleted := 0
 	for _, key := range keys {
-		if !strings.HasPrefix(string(key), prefix) {
+		// Only clear `key` itself and keys nested below it.
+		if prefix != "" && string(key) != prefix && !strings.HasPrefix(string(key), prefix+badgerKeySep) {
 			continue
 		}
 
@@ -247,6 +413,14 @@ func (db *BadgerDatabase) Clear(key ...string) error {
 		if err != nil {
 			return err
 		}
+
+		deleted++
+	}
+
+	if deleted >= badgerGCClearThreshold {
+		// Most of the freed space is in the value log; get it back
+		// once the deletes are written.
+		db.gcPending = true
 	}
 
 	return nil
@@ -258,18 +432,76 @@ func (db *BadgerDatabase) Erase(key ...string) {
 	defer db.mu.Unlock()
 
 	db.haveWrites = true
+	db.journal.record(journalErase, key, nil)
+
+	if err := db.erase(key); err != nil {
+		log.Warningf("badger: failed to del key %s: %v", badgerKey(key), err)
+		db.setBatchErr(err)
+	}
+}
 
-	fullKey := []byte(strings.Join(key, "."))
-	err := db.withRetry(func() error {
+func (db *BadgerDatabase) erase(key []string) error {
+	if db.txn == nil {
+		return ErrClosed
+	}
+
+	fullKey := []byte(badgerKey(key))
+	return db.withRetry(func() error {
 		return db.txn.Delete(fullKey)
 	})
+}
+
+// Savepoint is the badger implementation of Batch.Savepoint
+func (db *BadgerDatabase) Savepoint() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.journal.savepoint()
+}
 
+// RollbackTo is the badger implementation of Batch.RollbackTo.
+// badger cannot undo parts of a transaction, so a new one is started
+// and all writes up to the savepoint are done again.
+func (db *BadgerDatabase) RollbackTo(savepoint int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.txn == nil {
+		return ErrNoSuchSavepoint
+	}
+
+	ops, err := db.journal.rollbackTo(savepoint)
 	if err != nil {
-		log.Warningf("badger: failed to del key %s: %v", fullKey, err)
+		return err
 	}
+
+	db.txn.Discard()
+	db.txn = db.db.NewTransaction(true)
+
+	// Errors of the undone writes do not matter anymore;
+	// the remaining ones are done again below.
+	db.batchErr = nil
+	for _, op := range ops {
+		switch op.kind {
+		case journalPut:
+			err = db.put(op.val, op.key)
+		case journalErase:
+			err = db.erase(op.key)
+		case journalClear:
+			err = db.clear(op.key)
+		}
+
+		if err != nil {
+			db.setBatchErr(err)
+			return err
+		}
+	}
+
+	return nil
 }
 
-// Flush is a badger implementation of Batch.Flush
+// Flush is a badger implementation of Batch.Flush.
+// If any write of the batch failed, nothing is committed.
 func (db *BadgerDatabase) Flush() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -280,10 +512,16 @@ func (db *BadgerDatabase) Flush() error {
 	}
 
 	if db.refCount < 0 {
-		log.Errorf("negative batch ref count: %d", db.refCount)
+		// A nested Rollback() already ended the batch.
+		db.refCount = 0
 		return nil
 	}
 
+	if batchErr := db.batchErr; batchErr != nil {
+		db.resetBatch()
+		return batchErr
+	}
+
 	defer db.txn.Discard()
 	if err := db.txn.Commit(nil); err != nil {
 		return err
@@ -291,6 +529,13 @@ func (db *BadgerDatabase) Flush() error {
 
 	db.txn = nil
 	db.haveWrites = false
+	db.journal.reset()
+
+	if db.gcPending {
+		db.gcPending = false
+		db.triggerGC()
+	}
+
 	return nil
 }
 
@@ -299,20 +544,23 @@ func (db *BadgerDatabase) Rollback() {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.refCount--
-	if db.refCount > 0 {
-		return
-	}
+	// Like the other backends, a nested Rollback() ends the whole batch;
+	// the outer Flush() or Rollback() then has nothing left to do.
+	db.resetBatch()
+}
 
-	if db.refCount < 0 {
-		log.Errorf("negative batch ref count: %d", db.refCount)
-		return
+// resetBatch discards the current batch and everything written in it.
+func (db *BadgerDatabase) resetBatch() {
+	if db.txn != nil {
+		db.txn.Discard()
 	}
 
-	db.txn.Discard()
 	db.txn = nil
 	db.haveWrites = false
 	db.refCount = 0
+	db.journal.reset()
+	db.gcPending = false
+	db.batchErr = nil
 }
 
 // HaveWrites is the badger implementation of Database.HaveWrites
@@ -325,17 +573,14 @@ func (db *BadgerDatabase) HaveWrites() bool {
 
 // Close is a badger implementation of Database.Close
 func (db *BadgerDatabase) Close() error {
+	// Must happen before locking; a running GC might need the lock.
+	db.stopGC()
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.gcTicker.Stop()
-
 	// with an open transaction it would deadlock
-	if db.txn != nil {
-		db.txn.Discard()
-		db.txn = nil
-		db.haveWrites = false
-	}
+	db.resetBatch()
 
 	if db.db != nil {
 		oldDb := db.db
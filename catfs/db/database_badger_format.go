@@ -0,0 +1,191 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+// Key format of BadgerDatabase
+//
+// Before the format marker existed, key parts were joined with a dot,
+// i.e. ("stage", "tree", "/a/b.txt") was stored as "stage.tree./a/b.txt".
+// Now they are normalized and joined with a zero byte (see badgerKey).
+// The format is stored under badgerFormatKey. When it is missing on open,
+// all keys are converted to the current format before the database is used.
+
+// badgerFormat is the current version of the key format.
+const badgerFormat = 1
+
+// badgerReservedPrefix starts all keys that are used by BadgerDatabase
+// itself. Normalized keys never start with a separator, so it can not
+// collide with any user key. Reserved keys are hidden from all listings.
+const badgerReservedPrefix = badgerKeySep
+
+var badgerFormatKey = []byte(badgerReservedPrefix + "format")
+
+// ErrUnknownFormat is returned when a database was written
+// with a newer key format than this version understands.
+var ErrUnknownFormat = errors.New("database was written in an unknown, newer format")
+
+func isReservedBadgerKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(badgerReservedPrefix))
+}
+
+// legacyBadgerKey converts a key of the dot format to the current format.
+// A dot between two parts can not be told apart from a dot inside a part.
+// All paths start with a slash though, so everything from the first slash
+// on is taken as one part and only the parts before it are split at dots.
+// Keys that are already in the current format are returned as they are.
+func legacyBadgerKey(key string) string {
+	if strings.Contains(key, badgerKeySep) {
+		return key
+	}
+
+	head, tail := key, ""
+	if idx := strings.Index(key, "/"); idx >= 0 {
+		head, tail = key[:idx], key[idx:]
+	}
+
+	return badgerKey(append(strings.Split(head, "."), tail))
+}
+
+// checkFormat reads the format marker and migrates old keys if it is missing.
+func (db *BadgerDatabase) checkFormat() error {
+	var format []byte
+	err := db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(badgerFormatKey)
+		if err != nil {
+			return err
+		}
+
+		format, err = item.ValueCopy(nil)
+		return err
+	})
+
+	switch err {
+	case nil:
+		version, err := strconv.Atoi(string(format))
+		if err != nil {
+			return fmt.Errorf("badger: bad format marker %q: %v", format, err)
+		}
+
+		if version > badgerFormat {
+			return ErrUnknownFormat
+		}
+
+		return nil
+	case badger.ErrKeyNotFound:
+		return db.migrateKeys()
+	default:
+		return err
+	}
+}
+
+// migrateKeys converts all keys to the current format and sets the marker.
+// The keys are moved in several transactions if needed; a partial migration
+// is completed on the next open since the marker is written last.
+func (db *BadgerDatabase) migrateKeys() error {
+	type move struct {
+		oldKey, newKey []byte
+		val            []byte
+	}
+
+	moves := []move{}
+	err := db.db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.IteratorOptions{})
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if isReservedBadgerKey(item.Key()) {
+				continue
+			}
+
+			newKey := legacyBadgerKey(string(item.Key()))
+			if newKey == string(item.Key()) {
+				continue
+			}
+
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			moves = append(moves, move{
+				oldKey: item.KeyCopy(nil),
+				newKey: []byte(newKey),
+				val:    val,
+			})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(moves) > 0 {
+		log.Infof("badger: migrating %d keys to format %d", len(moves), badgerFormat)
+	}
+
+	txn := db.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+
+	apply := func(fn func() error) error {
+		if err := fn(); err != badger.ErrTxnTooBig {
+			return err
+		}
+
+		if err := txn.Commit(nil); err != nil {
+			return err
+		}
+
+		txn = db.db.NewTransaction(true)
+		return fn()
+	}
+
+	for _, mv := range moves {
+		// Set the new key first, so no value is lost between transactions.
+		if err := apply(func() error { return txn.Set(mv.newKey, mv.val) }); err != nil {
+			return err
+		}
+
+		if err := apply(func() error { return txn.Delete(mv.oldKey) }); err != nil {
+			return err
+		}
+	}
+
+	err = apply(func() error {
+		return txn.Set(badgerFormatKey, []byte(strconv.Itoa(badgerFormat)))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit(nil)
+}
+
+// importLegacyBackup loads a dump written by Export() before the
+// backend neutral dump format existed, which was a plain badger backup.
+func (db *BadgerDatabase) importLegacyBackup(r *bufio.Reader) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.txn != nil {
+		return errors.New("badger: can not import a legacy backup during a batch")
+	}
+
+	if err := db.db.Load(r); err != nil {
+		return err
+	}
+
+	return db.migrateKeys()
+}
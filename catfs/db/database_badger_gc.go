@@ -0,0 +1,186 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How often the value log is garbage collected.
+	badgerGCInterval = 5 * time.Minute
+
+	// A value log file is rewritten when at least this ratio of it is garbage.
+	badgerGCDiscardRatio = 0.5
+
+	// Clear() calls that delete at least this many keys trigger a GC right
+	// after the batch was flushed, instead of waiting for the next run.
+	badgerGCClearThreshold = 1000
+)
+
+// ErrClosed is returned for operations on a closed database.
+var ErrClosed = errors.New("database is closed")
+
+// badgerGC is the maintenance routine of BadgerDatabase.
+// badger never reclaims space in the value log on its own,
+// so deleted values would stay on disk forever without it.
+type badgerGC struct {
+	// runMu makes sure only one GC runs at a time and none after Close().
+	runMu  sync.Mutex
+	closed bool
+
+	ticker  *time.Ticker
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	statsMu sync.Mutex
+	stats   badgerGCStats
+}
+
+// GCReport describes the outcome of one value log GC run.
+type GCReport struct {
+	// Rewrites is the number of value log files that were rewritten.
+	Rewrites int `json:"rewrites"`
+
+	// Reclaimed is the number of bytes the value log shrunk.
+	Reclaimed int64 `json:"reclaimed"`
+
+	Took time.Duration `json:"took"`
+}
+
+func (db *BadgerDatabase) startGC(interval time.Duration) {
+	db.gc.ticker = time.NewTicker(interval)
+	db.gc.trigger = make(chan struct{}, 1)
+	db.gc.stop = make(chan struct{})
+	db.gc.done = make(chan struct{})
+
+	go db.gcLoop()
+}
+
+func (db *BadgerDatabase) gcLoop() {
+	defer close(db.gc.done)
+
+	for {
+		select {
+		case <-db.gc.ticker.C:
+		case <-db.gc.trigger:
+		case <-db.gc.stop:
+			return
+		}
+
+		report, err := db.RunGC()
+		if err != nil && err != ErrClosed {
+			log.Warningf("badger: value log gc failed: %v", err)
+			continue
+		}
+
+		if report.Rewrites > 0 {
+			log.Debugf("badger: value log gc reclaimed %d bytes", report.Reclaimed)
+		}
+	}
+}
+
+// triggerGC schedules a GC run without waiting for it.
+func (db *BadgerDatabase) triggerGC() {
+	select {
+	case db.gc.trigger <- struct{}{}:
+	default:
+		// A run is already scheduled.
+	}
+}
+
+// stopGC waits for a running GC and makes sure no other one starts.
+func (db *BadgerDatabase) stopGC() {
+	db.gc.runMu.Lock()
+	wasClosed := db.gc.closed
+	db.gc.closed = true
+	db.gc.runMu.Unlock()
+
+	if wasClosed {
+		return
+	}
+
+	db.gc.ticker.Stop()
+	close(db.gc.stop)
+	<-db.gc.done
+}
+
+// RunGC garbage collects the value log right now and reports how many
+// bytes were reclaimed. It is also run periodically and after large
+// Clear() calls. It is safe to call while batches are in flight;
+// their writes are not touched.
+func (db *BadgerDatabase) RunGC() (GCReport, error) {
+	db.gc.runMu.Lock()
+	defer db.gc.runMu.Unlock()
+
+	if db.gc.closed {
+		return GCReport{}, ErrClosed
+	}
+
+	// Don't hold the lock during GC; batches should go on meanwhile.
+	db.mu.Lock()
+	bdb := db.db
+	db.mu.Unlock()
+
+	if bdb == nil {
+		return GCReport{}, ErrClosed
+	}
+
+	start := time.Now()
+	sizeBefore := badgerVlogSize(db.dir)
+
+	report := GCReport{}
+	err := bdb.RunValueLogGC(badgerGCDiscardRatio)
+	for err == nil {
+		report.Rewrites++
+		err = bdb.RunValueLogGC(badgerGCDiscardRatio)
+	}
+
+	if err == badger.ErrNoRewrite {
+		err = nil
+	}
+
+	if reclaimed := sizeBefore - badgerVlogSize(db.dir); reclaimed > 0 {
+		report.Reclaimed = reclaimed
+	}
+
+	report.Took = time.Since(start)
+
+	db.gc.statsMu.Lock()
+	defer db.gc.statsMu.Unlock()
+
+	db.gc.stats.runs++
+	db.gc.stats.rewrites += uint64(report.Rewrites)
+	db.gc.stats.reclaimed += report.Reclaimed
+	db.gc.stats.lastRun = time.Now()
+	db.gc.stats.lastError = ""
+	if err != nil {
+		db.gc.stats.lastError = err.Error()
+	}
+
+	return report, err
+}
+
+// badgerVlogSize returns the current size of all value log files in `dir`.
+// badger's own Size() is only updated once a minute.
+func badgerVlogSize(dir string) int64 {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	if err != nil {
+		return 0
+	}
+
+	size := int64(0)
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// BadgerStats are the internal statistics of a badger database.
+type BadgerStats struct {
+	// LSMSize and VlogSize are the sizes of the LSM tree and
+	// the value log in bytes, as last calculated by badger.
+	LSMSize  int64 `json:"lsm_size"`
+	VlogSize int64 `json:"vlog_size"`
+
+	// TablesPerLevel is the number of LSM tables on each level.
+	// Many tables on level 0 mean that compaction lags behind.
+	TablesPerLevel []int `json:"tables_per_level"`
+
+	// BlockedPuts counts writes that had to wait for compaction.
+	// badger counts this for all databases of the process.
+	BlockedPuts int64 `json:"blocked_puts"`
+
+	// GCRuns is the number of value log GC runs,
+	// GCRewrites the number of value log files that were rewritten
+	// and GCReclaimed the number of bytes freed by them.
+	GCRuns      uint64    `json:"gc_runs"`
+	GCRewrites  uint64    `json:"gc_rewrites"`
+	GCReclaimed int64     `json:"gc_reclaimed"`
+	LastGC      time.Time `json:"last_gc"`
+	LastGCError string    `json:"last_gc_error,omitempty"`
+}
+
+// badgerGCStats are the value log GC numbers collected by badgerGC.
+type badgerGCStats struct {
+	runs      uint64
+	rewrites  uint64
+	reclaimed int64
+	lastRun   time.Time
+	lastError string
+}
+
+// Stats returns the current internal statistics of badger.
+func (db *BadgerDatabase) Stats() BadgerStats {
+	db.gc.statsMu.Lock()
+	stats := BadgerStats{
+		BlockedPuts: y.NumBlockedPuts.Value(),
+		GCRuns:      db.gc.stats.runs,
+		GCRewrites:  db.gc.stats.rewrites,
+		GCReclaimed: db.gc.stats.reclaimed,
+		LastGC:      db.gc.stats.lastRun,
+		LastGCError: db.gc.stats.lastError,
+	}
+	db.gc.statsMu.Unlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.db == nil {
+		return stats
+	}
+
+	stats.LSMSize, stats.VlogSize = db.db.Size()
+	for _, table := range db.db.Tables() {
+		for len(stats.TablesPerLevel) <= table.Level {
+			stats.TablesPerLevel = append(stats.TablesPerLevel, 0)
+		}
+
+		stats.TablesPerLevel[table.Level]++
+	}
+
+	return stats
+}
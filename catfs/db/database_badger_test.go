@@ -0,0 +1,198 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/require"
+)
+
+func withBadgerDatabase(t *testing.T, fn func(db *BadgerDatabase)) {
+	dir, err := os.MkdirTemp("", "floo-db-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewBadgerDatabase(dir)
+	require.Nil(t, err)
+
+	fn(db)
+	require.Nil(t, db.Close())
+}
+
+func TestBadgerGCAfterClear(t *testing.T) {
+	withBadgerDatabase(t, func(db *BadgerDatabase) {
+		batch := db.Batch()
+		for idx := 0; idx < badgerGCClearThreshold; idx++ {
+			batch.Put([]byte("x"), "stage", "objects", fmt.Sprintf("%d", idx))
+		}
+		require.Nil(t, batch.Flush())
+		require.Equal(t, uint64(0), db.Stats().GCRuns)
+
+		batch = db.Batch()
+		require.Nil(t, batch.Clear("stage"))
+		require.Nil(t, batch.Flush())
+
+		// The GC runs in the background after the flush:
+		deadline := time.Now().Add(5 * time.Second)
+		for db.Stats().GCRuns == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		require.Equal(t, uint64(1), db.Stats().GCRuns)
+		require.Empty(t, db.Stats().LastGCError)
+	})
+}
+
+func TestBadgerGCDuringBatch(t *testing.T) {
+	withBadgerDatabase(t, func(db *BadgerDatabase) {
+		mustPut(t, db, "1", "a")
+
+		batch := db.Batch()
+		batch.Put([]byte("2"), "b")
+
+		_, err := db.RunGC()
+		require.Nil(t, err)
+
+		batch.Put([]byte("3"), "c")
+		require.Nil(t, batch.Flush())
+
+		for _, key := range []string{"a", "b", "c"} {
+			_, err := db.Get(key)
+			require.Nil(t, err)
+		}
+	})
+}
+
+func TestBadgerGCAfterClose(t *testing.T) {
+	dir, err := os.MkdirTemp("", "floo-db-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewBadgerDatabase(dir)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	_, err = db.RunGC()
+	require.Equal(t, ErrClosed, err)
+
+	// Closing twice must not hang or panic:
+	require.Nil(t, db.Close())
+}
+
+// legacyBadgerKeys are keys as the linker stored them before the
+// format marker existed, with the key they are read with today.
+var legacyBadgerKeys = map[string][]string{
+	"stage.tree./a/b.txt":  {"stage", "tree", "/a/b.txt"},
+	"ignore./sub/.":        {"ignore", "/sub/."},
+	"ignore./.":            {"ignore", "/."},
+	"stats.max-inode":      {"stats", "max-inode"},
+	"moves.overlay.QmHash": {"moves", "overlay", "QmHash"},
+	"refs.HEAD":            {"refs", "HEAD"},
+}
+
+func writeLegacyBadger(t *testing.T, dir string) {
+	opts := badger.DefaultOptions
+	opts.Dir, opts.ValueDir = dir, dir
+	raw, err := badger.Open(opts)
+	require.Nil(t, err)
+
+	require.Nil(t, raw.Update(func(txn *badger.Txn) error {
+		for legacyKey := range legacyBadgerKeys {
+			if err := txn.Set([]byte(legacyKey), []byte(legacyKey)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.Nil(t, raw.Close())
+}
+
+func requireLegacyKeys(t *testing.T, db *BadgerDatabase) {
+	for legacyKey, key := range legacyBadgerKeys {
+		requireValue(t, db, legacyKey, key...)
+	}
+
+	keys, err := db.Keys()
+	require.Nil(t, err)
+	require.Len(t, keys, len(legacyBadgerKeys))
+	require.Contains(t, keys, []string{"stage", "tree", "a", "b.txt"})
+	require.Contains(t, keys, []string{"ignore", "sub", "."})
+}
+
+func TestBadgerMigrateLegacyFormat(t *testing.T) {
+	dir, err := os.MkdirTemp("", "floo-db-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeLegacyBadger(t, dir)
+
+	db, err := NewBadgerDatabase(dir)
+	require.Nil(t, err)
+	requireLegacyKeys(t, db)
+
+	// The format marker must not show up as key:
+	require.Empty(t, collectKeys(t, db.Iterator(IterOptions{Prefix: []string{"format"}})))
+	require.Nil(t, db.Close())
+
+	// Opening again must not change anything:
+	db, err = NewBadgerDatabase(dir)
+	require.Nil(t, err)
+	requireLegacyKeys(t, db)
+
+	// Clearing everything keeps the marker:
+	batch := db.Batch()
+	require.Nil(t, batch.Clear())
+	require.Nil(t, batch.Flush())
+	require.Nil(t, db.Close())
+
+	db, err = NewBadgerDatabase(dir)
+	require.Nil(t, err)
+	mustPut(t, db, "x", "a.b")
+	requireValue(t, db, "x", "a.b")
+	require.Nil(t, db.Close())
+}
+
+func TestBadgerImportLegacyBackup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "floo-db-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Export() used to write a plain badger backup:
+	writeLegacyBadger(t, dir)
+	opts := badger.DefaultOptions
+	opts.Dir, opts.ValueDir = dir, dir
+	raw, err := badger.Open(opts)
+	require.Nil(t, err)
+
+	buf := &bytes.Buffer{}
+	_, err = raw.Backup(buf, 0)
+	require.Nil(t, err)
+	require.Nil(t, raw.Close())
+
+	withBadgerDatabase(t, func(db *BadgerDatabase) {
+		require.Nil(t, db.Import(buf))
+		requireLegacyKeys(t, db)
+	})
+}
+
+func TestBadgerUnknownFormat(t *testing.T) {
+	dir, err := os.MkdirTemp("", "floo-db-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := badger.DefaultOptions
+	opts.Dir, opts.ValueDir = dir, dir
+	raw, err := badger.Open(opts)
+	require.Nil(t, err)
+	require.Nil(t, raw.Update(func(txn *badger.Txn) error {
+		return txn.Set(badgerFormatKey, []byte("999"))
+	}))
+	require.Nil(t, raw.Close())
+
+	_, err = NewBadgerDatabase(dir)
+	require.Equal(t, ErrUnknownFormat, err)
+}
@@ -0,0 +1,637 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// All keys are stored below this bucket, since the root
+// of a bolt database can only contain buckets, but no values.
+var boltRootBucket = []byte("floo")
+
+// BoltDatabase is a database backed by a single bbolt file.
+// Each part of a key path is mapped to a nested bucket, the last part
+// is the key inside of it. Unlike badger, bolt does not need any background
+// compaction and has a small, predictable memory footprint, which makes it
+// a good choice for small machines.
+type BoltDatabase struct {
+	mu         sync.Mutex
+	db         *bolt.DB
+	tx         *bolt.Tx
+	refCount   int
+	haveWrites bool
+	journal    batchJournal
+
+	// batchErr is the first error of the current batch.
+	// The batch is not committed if it is set; Flush returns it.
+	batchErr error
+}
+
+// NewBoltDatabase opens (or creates) the bolt database file at `path`.
+func NewBoltDatabase(path string) (*BoltDatabase, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRootBucket)
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltDatabase{db: db}, nil
+}
+
+// splitBoltKey converts a key path into bucket names (see normalizeKey).
+func splitBoltKey(key []string) [][]byte {
+	parts := [][]byte{}
+	for _, part := range normalizeKey(key) {
+		parts = append(parts, []byte(part))
+	}
+
+	return parts
+}
+
+func joinBoltKey(parts [][]byte) []string {
+	key := make([]string, 0, len(parts))
+	for _, part := range parts {
+		key = append(key, string(part))
+	}
+
+	return key
+}
+
+// view runs `fn` either in the currently open write transaction
+// (to see uncommitted writes) or in a new read transaction.
+func (db *BoltDatabase) view(fn func(tx *bolt.Tx) error) error {
+	if db.tx != nil {
+		return fn(db.tx)
+	}
+
+	if db.refCount > 0 && db.batchErr != nil {
+		// The transaction of the batch could not be started;
+		// reading without it would not show the batch's writes.
+		return db.batchErr
+	}
+
+	return db.db.View(fn)
+}
+
+// lookupBucket returns the bucket at `parts` or nil if it does not exist.
+func lookupBucket(tx *bolt.Tx, parts [][]byte) *bolt.Bucket {
+	bkt := tx.Bucket(boltRootBucket)
+	for _, part := range parts {
+		if bkt = bkt.Bucket(part); bkt == nil {
+			return nil
+		}
+	}
+
+	return bkt
+}
+
+// Get is the bolt implementation of Database.Get
+func (db *BoltDatabase) Get(key ...string) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	parts := splitBoltKey(key)
+	if len(parts) == 0 {
+		return nil, ErrNoSuchKey
+	}
+
+	var data []byte
+	return data, db.view(func(tx *bolt.Tx) error {
+		bkt := lookupBucket(tx, parts[:len(parts)-1])
+		if bkt == nil {
+			return ErrNoSuchKey
+		}
+
+		val := bkt.Get(parts[len(parts)-1])
+		if val == nil {
+			// Either not there or a nested bucket.
+			return ErrNoSuchKey
+		}
+
+		// Values are only valid during the transaction.
+		data = make([]byte, len(val))
+		copy(data, val)
+		return nil
+	})
+}
+
+// walkBucket calls `fn` for every value below `bkt` in lexical order.
+func walkBucket(bkt *bolt.Bucket, prefix [][]byte, fn func(key [][]byte, val []byte) error) error {
+	curs := bkt.Cursor()
+	for k, v := curs.First(); k != nil; k, v = curs.Next() {
+		key := append(append([][]byte{}, prefix...), k)
+		if v != nil {
+			if err := fn(key, v); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := walkBucket(bkt.Bucket(k), key, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// seekBucket calls `fn` for every value below `bkt`, in the order of
+// Database.Iterator, starting at `seek` (relative to `bkt`).
+// The walk stops when `fn` returns false.
+func seekBucket(bkt *bolt.Bucket, prefix [][]byte, seek [][]byte, fn func(key [][]byte, val []byte) (bool, error)) (bool, error) {
+	curs := bkt.Cursor()
+
+	k, v := curs.First()
+	if len(seek) > 0 {
+		k, v = curs.Seek(seek[0])
+	}
+
+	for ; k != nil; k, v = curs.Next() {
+		key := append(append([][]byte{}, prefix...), k)
+		if v != nil {
+			cont, err := fn(key, v)
+			if !cont || err != nil {
+				return cont, err
+			}
+
+			continue
+		}
+
+		// Only the first visited bucket can contain the seek key.
+		var childSeek [][]byte
+		if len(seek) > 0 && bytes.Equal(k, seek[0]) {
+			childSeek = seek[1:]
+		}
+
+		cont, err := seekBucket(bkt.Bucket(k), key, childSeek, fn)
+		if !cont || err != nil {
+			return cont, err
+		}
+
+		seek = nil
+	}
+
+	return true, nil
+}
+
+// Iterator is the bolt implementation of Database.Iterator.
+// Long running read transactions can deadlock bolt when a write
+// transaction needs to grow the file, so the keys are read in pages.
+func (db *BoltDatabase) Iterator(opts IterOptions) Iterator {
+	return newPagedIterator(opts, db.scan)
+}
+
+func (db *BoltDatabase) scan(opts IterOptions, after []string, limit int) ([]iterEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	seek := opts.seekKey()
+	if after != nil {
+		seek = after
+	}
+
+	entries := []iterEntry{}
+	return entries, db.view(func(tx *bolt.Tx) error {
+		_, err := seekBucket(tx.Bucket(boltRootBucket), nil, splitBoltKey(seek), func(parts [][]byte, val []byte) (bool, error) {
+			key := joinBoltKey(parts)
+			if opts.beyond(key) {
+				return false, nil
+			}
+
+			if opts.before(key) || (after != nil && compareKeys(key, after) == 0) {
+				return true, nil
+			}
+
+			entry := iterEntry{key: key}
+			if !opts.KeysOnly {
+				// Values are only valid during the transaction.
+				entry.val = append([]byte{}, val...)
+			}
+
+			entries = append(entries, entry)
+			return len(entries) < limit, nil
+		})
+
+		return err
+	})
+}
+
+// Keys is the bolt implementation of Database.Keys
+func (db *BoltDatabase) Keys(prefix ...string) ([][]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	parts := splitBoltKey(prefix)
+	keys := [][]string{}
+	return keys, db.view(func(tx *bolt.Tx) error {
+		if len(parts) > 0 {
+			// The prefix might name a single value:
+			parent := lookupBucket(tx, parts[:len(parts)-1])
+			if parent != nil && parent.Get(parts[len(parts)-1]) != nil {
+				keys = append(keys, joinBoltKey(parts))
+				return nil
+			}
+		}
+
+		bkt := lookupBucket(tx, parts)
+		if bkt == nil {
+			return nil
+		}
+
+		return walkBucket(bkt, parts, func(key [][]byte, val []byte) error {
+			keys = append(keys, joinBoltKey(key))
+			return nil
+		})
+	})
+}
+
+// Glob is the bolt implementation of Database.Glob
+func (db *BoltDatabase) Glob(prefix []string) ([][]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	parts := splitBoltKey(prefix)
+
+	// A trailing slash means "everything in this bucket".
+	last := []byte{}
+	if len(prefix) > 0 && !strings.HasSuffix(prefix[len(prefix)-1], "/") && len(parts) > 0 {
+		last = parts[len(parts)-1]
+		parts = parts[:len(parts)-1]
+	}
+
+	results := [][]string{}
+	return results, db.view(func(tx *bolt.Tx) error {
+		bkt := lookupBucket(tx, parts)
+		if bkt == nil {
+			return nil
+		}
+
+		curs := bkt.Cursor()
+		for k, v := curs.Seek(last); k != nil && bytes.HasPrefix(k, last); k, v = curs.Next() {
+			// Don't do recursive globbing:
+			if v == nil {
+				continue
+			}
+
+			key := append(append([][]byte{}, parts...), k)
+			results = append(results, joinBoltKey(key))
+		}
+
+		return nil
+	})
+}
+
+// Batch is the bolt implementation of Database.Batch
+func (db *BoltDatabase) Batch() Batch {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.tx == nil && db.batchErr == nil {
+		tx, err := db.db.Begin(true)
+		if err != nil {
+			// Batch() has no way to return an error; Flush will.
+			log.Warningf("bolt: failed to begin transaction: %v", err)
+			db.batchErr = err
+		}
+
+		db.tx = tx
+	}
+
+	db.refCount++
+	return db
+}
+
+// setBatchErr remembers `err` if it is the first error of the batch.
+func (db *BoltDatabase) setBatchErr(err error) {
+	if db.batchErr == nil {
+		db.batchErr = err
+	}
+}
+
+// createBucketPath creates all buckets in `parts` and returns the last one.
+// Values that are in the way are removed, like DiskDatabase does.
+func createBucketPath(tx *bolt.Tx, parts [][]byte) (*bolt.Bucket, error) {
+	bkt := tx.Bucket(boltRootBucket)
+	for _, part := range parts {
+		if bkt.Get(part) != nil {
+			if err := bkt.Delete(part); err != nil {
+				return nil, err
+			}
+		}
+
+		child, err := bkt.CreateBucketIfNotExists(part)
+		if err != nil {
+			return nil, err
+		}
+
+		bkt = child
+	}
+
+	return bkt, nil
+}
+
+func (db *BoltDatabase) put(val []byte, parts [][]byte) error {
+	if db.tx == nil {
+		return fmt.Errorf("bolt: put outside of batch")
+	}
+
+	if len(parts) == 0 {
+		return fmt.Errorf("bolt: empty key")
+	}
+
+	bkt, err := createBucketPath(db.tx, parts[:len(parts)-1])
+	if err != nil {
+		return err
+	}
+
+	name := parts[len(parts)-1]
+	if bkt.Bucket(name) != nil {
+		// Setting a key over a nested bucket replaces it.
+		if err := bkt.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+
+	// bolt does not allow nil values; those mean "bucket".
+	if val == nil {
+		val = []byte{}
+	}
+
+	return bkt.Put(name, val)
+}
+
+// Put is the bolt implementation of Batch.Put
+func (db *BoltDatabase) Put(val []byte, key ...string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.haveWrites = true
+	db.journal.record(journalPut, key, val)
+
+	if err := db.put(val, splitBoltKey(key)); err != nil {
+		log.Warningf("bolt: failed to set key %v: %v", key, err)
+		db.setBatchErr(err)
+	}
+}
+
+// Clear is the bolt implementation of Batch.Clear
+func (db *BoltDatabase) Clear(key ...string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.haveWrites = true
+	db.journal.record(journalClear, key, nil)
+	if err := db.clear(splitBoltKey(key)); err != nil {
+		db.setBatchErr(err)
+		return err
+	}
+
+	return nil
+}
+
+func (db *BoltDatabase) clear(parts [][]byte) error {
+	if db.tx == nil {
+		return fmt.Errorf("bolt: clear outside of batch")
+	}
+
+	if len(parts) == 0 {
+		// Clear everything.
+		if err := db.tx.DeleteBucket(boltRootBucket); err != nil {
+			return err
+		}
+
+		_, err := db.tx.CreateBucket(boltRootBucket)
+		return err
+	}
+
+	parent := lookupBucket(db.tx, parts[:len(parts)-1])
+	if parent == nil {
+		return nil
+	}
+
+	name := parts[len(parts)-1]
+	if parent.Bucket(name) != nil {
+		return parent.DeleteBucket(name)
+	}
+
+	return parent.Delete(name)
+}
+
+// Erase is the bolt implementation of Batch.Erase
+func (db *BoltDatabase) Erase(key ...string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.haveWrites = true
+	db.journal.record(journalErase, key, nil)
+
+	if err := db.erase(splitBoltKey(key)); err != nil {
+		log.Warningf("bolt: failed to del key %v: %v", key, err)
+		db.setBatchErr(err)
+	}
+}
+
+func (db *BoltDatabase) erase(parts [][]byte) error {
+	if db.tx == nil {
+		return fmt.Errorf("bolt: erase outside of batch")
+	}
+
+	if len(parts) == 0 {
+		return nil
+	}
+
+	parent := lookupBucket(db.tx, parts[:len(parts)-1])
+	if parent == nil {
+		return nil
+	}
+
+	return parent.Delete(parts[len(parts)-1])
+}
+
+// Savepoint is the bolt implementation of Batch.Savepoint
+func (db *BoltDatabase) Savepoint() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.journal.savepoint()
+}
+
+// RollbackTo is the bolt implementation of Batch.RollbackTo.
+// bolt has no nested transactions, so the transaction is rolled back
+// and all writes up to the savepoint are done again in a new one.
+func (db *BoltDatabase) RollbackTo(savepoint int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.tx == nil {
+		return ErrNoSuchSavepoint
+	}
+
+	ops, err := db.journal.rollbackTo(savepoint)
+	if err != nil {
+		return err
+	}
+
+	if err := db.tx.Rollback(); err != nil {
+		db.tx = nil
+		db.setBatchErr(err)
+		return err
+	}
+
+	// Errors of the undone writes do not matter anymore;
+	// the remaining ones are done again below.
+	db.batchErr = nil
+	db.tx, err = db.db.Begin(true)
+	if err != nil {
+		db.batchErr = err
+		return err
+	}
+
+	for _, op := range ops {
+		parts := splitBoltKey(op.key)
+		switch op.kind {
+		case journalPut:
+			err = db.put(op.val, parts)
+		case journalErase:
+			err = db.erase(parts)
+		case journalClear:
+			err = db.clear(parts)
+		}
+
+		if err != nil {
+			db.setBatchErr(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush is the bolt implementation of Batch.Flush.
+// If any write of the batch failed, nothing is committed.
+func (db *BoltDatabase) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.refCount--
+	if db.refCount > 0 {
+		return nil
+	}
+
+	if db.refCount < 0 {
+		log.Errorf("negative batch ref count: %d", db.refCount)
+		db.refCount = 0
+		return nil
+	}
+
+	tx, batchErr := db.tx, db.batchErr
+	db.tx = nil
+	db.haveWrites = false
+	db.batchErr = nil
+	db.journal.reset()
+
+	if batchErr != nil {
+		if tx != nil {
+			tx.Rollback()
+		}
+
+		return batchErr
+	}
+
+	if tx == nil {
+		return nil
+	}
+
+	return tx.Commit()
+}
+
+// Rollback is the bolt implementation of Batch.Rollback
+func (db *BoltDatabase) Rollback() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.tx != nil {
+		if err := db.tx.Rollback(); err != nil {
+			log.Warningf("bolt: rollback failed: %v", err)
+		}
+	}
+
+	db.tx = nil
+	db.haveWrites = false
+	db.batchErr = nil
+	db.refCount = 0
+	db.journal.reset()
+}
+
+// HaveWrites is the bolt implementation of Batch.HaveWrites
+func (db *BoltDatabase) HaveWrites() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.haveWrites
+}
+
+// Export is the bolt implementation of Database.Export.
+// All keys are read from a single transaction, so the dump is consistent.
+func (db *BoltDatabase) Export(w io.Writer) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	dw, err := NewDumpWriter(w)
+	if err != nil {
+		return err
+	}
+
+	err = db.view(func(tx *bolt.Tx) error {
+		return walkBucket(tx.Bucket(boltRootBucket), nil, func(key [][]byte, val []byte) error {
+			return dw.Write(joinBoltKey(key), val)
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return dw.Close()
+}
+
+// Import is the bolt implementation of Database.Import.
+func (db *BoltDatabase) Import(r io.Reader) error {
+	return importDump(db, r)
+}
+
+// Close is the bolt implementation of Database.Close
+func (db *BoltDatabase) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// An open write transaction would block closing forever.
+	if db.tx != nil {
+		db.tx.Rollback()
+		db.tx = nil
+		db.haveWrites = false
+		db.refCount = 0
+		db.journal.reset()
+	}
+
+	db.batchErr = nil
+
+	return db.db.Close()
+}
@@ -1,14 +1,15 @@
 package db
 
 import (
+	"bufio"
 	"floo/util"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
-	"time"
 )
 
 const (
@@ -17,7 +18,6 @@ const (
 
 // DiskDatabase is a database that simply uses the filesystem as storage.
 // Each bucket is one directory. Leaf keys are simple files.
-// The exported form of the database is simply a gzipped .tar of the directory.
 //
 // Note that this database backends was written for easy debugging.
 // It is currently by no means optimized for fast reads and writes and
@@ -28,6 +28,7 @@ type DiskDatabase struct {
 	ops      []func() error
 	refs     int64
 	deletes  map[string]struct{}
+	undo     undoLog
 }
 
 // NewDiskDatabase creates a new database at `basePath`.
@@ -109,6 +110,7 @@ func (db *DiskDatabase) Flush() error {
 	// Make sure that db.ops is nil, even if Flush failed.
 	ops := db.ops
 	db.ops = nil
+	db.undo.reset()
 
 	// Currently no revertible operations are implemented. If something goes
 	// wrong on the filesystem, chances are high that we're not able to revert
@@ -132,6 +134,47 @@ func (db *DiskDatabase) Rollback() {
 	db.ops = nil
 	db.cache = make(map[string][]byte)
 	db.deletes = make(map[string]struct{})
+	db.undo.reset()
+}
+
+// Savepoint is the disk implementation of Batch.Savepoint
+func (db *DiskDatabase) Savepoint() int {
+	return db.undo.savepoint()
+}
+
+// RollbackTo is the disk implementation of Batch.RollbackTo.
+// Nothing is written before Flush(), so only the pending
+// operations and the cached state of the touched keys are reset.
+func (db *DiskDatabase) RollbackTo(savepoint int) error {
+	if debug {
+		fmt.Println("ROLLBACK TO", savepoint)
+	}
+
+	return db.undo.rollbackTo(savepoint)
+}
+
+// recordUndo remembers the pending state of `fullKey` and the
+// number of pending operations for RollbackTo.
+func (db *DiskDatabase) recordUndo(fullKey string) {
+	nOps := len(db.ops)
+	oldVal, cached := db.cache[fullKey]
+	_, deleted := db.deletes[fullKey]
+
+	db.undo.record(func() {
+		db.ops = db.ops[:nOps]
+
+		if cached {
+			db.cache[fullKey] = oldVal
+		} else {
+			delete(db.cache, fullKey)
+		}
+
+		if deleted {
+			db.deletes[fullKey] = struct{}{}
+		} else {
+			delete(db.deletes, fullKey)
+		}
+	})
 }
 
 // Get a single value from `bucket` by `key`.
@@ -196,6 +239,9 @@ func (db *DiskDatabase) Put(val []byte, key ...string) {
 		fmt.Println("SET", key)
 	}
 
+	fullKey := path.Join(key...)
+	db.recordUndo(fullKey)
+
 	db.ops = append(db.ops, func() error {
 		filePath := filepath.Join(db.basePath, fixDirectoryKeys(key))
 
@@ -228,7 +274,6 @@ func (db *DiskDatabase) Put(val []byte, key ...string) {
 		return os.WriteFile(filePath, val, 0600)
 	})
 
-	fullKey := path.Join(key...)
 	db.cache[fullKey] = val
 	delete(db.deletes, fullKey)
 }
@@ -239,6 +284,9 @@ func (db *DiskDatabase) Clear(key ...string) error {
 		fmt.Println("CLEAR", key)
 	}
 
+	// Undoing any of the changes below also drops the operation.
+	db.recordUndo(path.Join(key...))
+
 	// Cache the real modification for later:
 	db.ops = append(db.ops, func() error {
 		filePrefix := filepath.Join(db.basePath, fixDirectoryKeys(key))
@@ -264,6 +312,7 @@ func (db *DiskDatabase) Clear(key ...string) error {
 	prefix := path.Join(key...)
 	for key := range db.cache {
 		if strings.HasPrefix(key, prefix) {
+			db.recordUndo(key)
 			delete(db.cache, key)
 			db.deletes[key] = struct{}{}
 		}
@@ -281,8 +330,9 @@ func (db *DiskDatabase) Clear(key ...string) error {
 		}
 
 		if !info.IsDir() {
-			key := reverseDirectoryKeys(filePath[len(db.basePath):])
-			db.deletes[path.Join(key...)] = struct{}{}
+			fullKey := path.Join(reverseDirectoryKeys(filePath[len(db.basePath):])...)
+			db.recordUndo(fullKey)
+			db.deletes[fullKey] = struct{}{}
 		}
 
 		return nil
@@ -297,6 +347,9 @@ func (db *DiskDatabase) Erase(key ...string) {
 		fmt.Println("ERASE", key)
 	}
 
+	fullKey := path.Join(key...)
+	db.recordUndo(fullKey)
+
 	db.ops = append(db.ops, func() error {
 		fullPath := filepath.Join(db.basePath, fixDirectoryKeys(key))
 		err := os.Remove(fullPath)
@@ -307,7 +360,6 @@ func (db *DiskDatabase) Erase(key ...string) {
 		return err
 	})
 
-	fullKey := path.Join(key...)
 	db.deletes[fullKey] = struct{}{}
 	delete(db.cache, fullKey)
 }
@@ -341,6 +393,166 @@ func (db *DiskDatabase) Keys(prefix ...string) ([][]string, error) {
 	})
 }
 
+// diskDirEntry is a directory entry with its unescaped key part.
+type diskDirEntry struct {
+	part  string
+	name  string
+	isDir bool
+}
+
+func readDiskDir(dirPath string) ([]diskDirEntry, error) {
+	infos, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]diskDirEntry, 0, len(infos))
+	for _, info := range infos {
+		entry := diskDirEntry{
+			part:  info.Name(),
+			name:  info.Name(),
+			isDir: info.IsDir(),
+		}
+
+		// Undo the escaping of fixDirectoryKeys():
+		if !entry.isDir {
+			switch entry.part {
+			case "DOT":
+				entry.part = "."
+			case "__NO_DOT__":
+				entry.part = "DOT"
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	// The escaping changes the order:
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].part < entries[j].part
+	})
+
+	return entries, nil
+}
+
+type diskIterFrame struct {
+	dirPath string
+	key     []string
+	entries []diskDirEntry
+	pos     int
+}
+
+// diskIterator walks the directory tree with one frame per directory.
+type diskIterator struct {
+	db    *DiskDatabase
+	opts  IterOptions
+	stack []*diskIterFrame
+	key   []string
+	val   []byte
+	err   error
+}
+
+// Iterator is the disk implementation of Database.Iterator.
+// Like Keys(), it does not see keys that were put but not flushed yet.
+func (db *DiskDatabase) Iterator(opts IterOptions) Iterator {
+	iter := &diskIterator{
+		db:   db,
+		opts: opts.normalize(),
+	}
+
+	entries, err := readDiskDir(db.basePath)
+	if err != nil && !os.IsNotExist(err) {
+		iter.err = err
+	}
+
+	iter.stack = []*diskIterFrame{{
+		dirPath: db.basePath,
+		entries: entries,
+	}}
+
+	return iter
+}
+
+func (di *diskIterator) Next() bool {
+	for di.err == nil && len(di.stack) > 0 {
+		frame := di.stack[len(di.stack)-1]
+		if frame.pos >= len(frame.entries) {
+			di.stack = di.stack[:len(di.stack)-1]
+			continue
+		}
+
+		entry := frame.entries[frame.pos]
+		frame.pos++
+
+		key := append(append([]string{}, frame.key...), entry.part)
+		if di.opts.beyond(key) {
+			// Everything after this key is out of range too.
+			di.stack = nil
+			break
+		}
+
+		if di.opts.canSkipBelow(key) {
+			continue
+		}
+
+		dirPath := filepath.Join(frame.dirPath, entry.name)
+		if entry.isDir {
+			entries, err := readDiskDir(dirPath)
+			if err != nil {
+				di.err = err
+				break
+			}
+
+			di.stack = append(di.stack, &diskIterFrame{
+				dirPath: dirPath,
+				key:     key,
+				entries: entries,
+			})
+			continue
+		}
+
+		if !di.opts.contains(key) {
+			continue
+		}
+
+		if _, ok := di.db.deletes[path.Join(key...)]; ok {
+			continue
+		}
+
+		di.key, di.val = key, nil
+		if !di.opts.KeysOnly {
+			val, err := di.db.Get(key...)
+			if err != nil {
+				di.err = err
+				break
+			}
+
+			di.val = val
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func (di *diskIterator) Key() []string {
+	return di.key
+}
+
+func (di *diskIterator) Value() []byte {
+	return di.val
+}
+
+func (di *diskIterator) Err() error {
+	return di.err
+}
+
+func (di *diskIterator) Close() error {
+	di.stack = nil
+	return di.err
+}
+
 // Glob is the disk implementation of Database.Glob
 func (db *DiskDatabase) Glob(prefix []string) ([][]string, error) {
 	fullPrefix := filepath.Join(db.basePath, filepath.Join(prefix...))
@@ -367,15 +579,45 @@ func (db *DiskDatabase) Glob(prefix []string) ([][]string, error) {
 	return results, nil
 }
 
-// Export writes all key/values into a gzipped .tar that is written to `w`.
+// Export is the disk implementation of Database.Export.
 func (db *DiskDatabase) Export(w io.Writer) error {
-	archiveName := fmt.Sprintf("floometa-%s.gz", time.Now().Format(time.RFC3339))
-	return util.Tar(db.basePath, archiveName, w)
+	return exportDump(db, w)
 }
 
-// Import a gzipped tar from `r` into the current database.
+// Import is the disk implementation of Database.Import.
+// Older versions exported a gzipped .tar of the directory;
+// those are still accepted (see importLegacyTar).
 func (db *DiskDatabase) Import(r io.Reader) error {
-	return util.Untar(r, db.basePath)
+	br := bufio.NewReader(r)
+	if isLegacyDump(br) {
+		return db.importLegacyTar(br)
+	}
+
+	return importDump(db, br)
+}
+
+// importLegacyTar unpacks a legacy export into a temporary directory
+// and copies its keys over. Unpacking it directly into basePath would
+// bypass the batch and the cache of `db`.
+func (db *DiskDatabase) importLegacyTar(r io.Reader) error {
+	tmpDir, err := os.MkdirTemp("", "floo-disk-import-")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	if err := util.Untar(r, tmpDir); err != nil {
+		// Neither a dump nor a legacy export.
+		return ErrBadDump
+	}
+
+	legacyDb, err := NewDiskDatabase(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	return Migrate(db, legacyDb)
 }
 
 // Close the database
@@ -0,0 +1,703 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The header is stored unencrypted at this key of the wrapped database.
+// It can never collide with an encrypted key part, since those are longer.
+var encryptedHeaderKey = []string{"__encrypted_db__"}
+
+const (
+	encryptedFormatVersion = 1
+	encryptedSivSize       = 16
+
+	defaultKDFTime   = 1
+	defaultKDFMemory = 64 * 1024
+)
+
+var (
+	// ErrWrongPassword is returned by NewEncryptedDatabase
+	// when the password does not match the one the database was created with.
+	ErrWrongPassword = errors.New("wrong password for encrypted database")
+
+	// ErrBadCiphertext is returned when a value or key could not be
+	// decrypted, i.e. it was modified or not written by this database.
+	ErrBadCiphertext = errors.New("encrypted database: corrupted value or key")
+)
+
+// EncryptedOptions configures an EncryptedDatabase.
+type EncryptedOptions struct {
+	// EncryptKeys enables the encryption of key parts too.
+	// Each part is encrypted deterministically, depending on the parts
+	// before it, so prefix lookups still work. Keys that are equal leak
+	// this fact, and the order of keys is lost, so Iterator() and Keys()
+	// need to sort all matching keys in memory.
+	// It is only used when the database is created; afterwards the
+	// setting stored in the database is used.
+	EncryptKeys bool
+
+	// KDFTime and KDFMemory (in KiB) are the argon2id parameters used to
+	// derive a key from the password. They default to 1 and 64 MiB.
+	KDFTime   uint32
+	KDFMemory uint32
+}
+
+// encryptedHeader is stored as JSON at encryptedHeaderKey.
+type encryptedHeader struct {
+	Version     int    `json:"version"`
+	EncryptKeys bool   `json:"encrypt_keys"`
+	Salt        []byte `json:"salt"`
+	KDFTime     uint32 `json:"kdf_time"`
+	KDFMemory   uint32 `json:"kdf_memory"`
+
+	// WrappedKey is the data key, encrypted with the password key.
+	// Changing the password only needs to re-wrap it.
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// encryptedKeys are the keys derived from the data key.
+type encryptedKeys struct {
+	values  cipher.AEAD
+	partEnc cipher.Block
+	partMac []byte
+}
+
+func deriveEncryptedKeys(dataKey []byte) (*encryptedKeys, error) {
+	sub := func(info string, size int) ([]byte, error) {
+		key := make([]byte, size)
+		_, err := io.ReadFull(hkdf.New(sha256.New, dataKey, nil, []byte(info)), key)
+		return key, err
+	}
+
+	valueKey, err := sub("floo-db-values", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	partKey, err := sub("floo-db-key-parts", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	partMac, err := sub("floo-db-key-siv", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := chacha20poly1305.NewX(valueKey)
+	if err != nil {
+		return nil, err
+	}
+
+	partEnc, err := aes.NewCipher(partKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedKeys{
+		values:  values,
+		partEnc: partEnc,
+		partMac: partMac,
+	}, nil
+}
+
+// EncryptedDatabase encrypts all values (and optionally all key parts)
+// before passing them to the wrapped database. It works with every backend.
+//
+// Values are encrypted with XChaCha20-Poly1305 and a random nonce,
+// with the key as additional data, so values cannot be swapped between keys.
+// The data key is random and stored in the wrapped database, encrypted with
+// a key derived from the password by argon2id.
+//
+// Export() writes decrypted data, so that Migrate() works between encrypted
+// and unencrypted databases. Export the wrapped database for encrypted backups.
+type EncryptedDatabase struct {
+	db     Database
+	header encryptedHeader
+	keys   *encryptedKeys
+}
+
+func randomBytes(size int) ([]byte, error) {
+	buf := make([]byte, size)
+	_, err := io.ReadFull(rand.Reader, buf)
+	return buf, err
+}
+
+func passwordKey(password []byte, hdr *encryptedHeader) cipher.AEAD {
+	key := argon2.IDKey(password, hdr.Salt, hdr.KDFTime, hdr.KDFMemory, 1, chacha20poly1305.KeySize)
+
+	// Only fails for wrong key sizes.
+	aead, _ := chacha20poly1305.NewX(key)
+	return aead
+}
+
+func wrapDataKey(password, dataKey []byte, hdr *encryptedHeader) error {
+	salt, err := randomBytes(16)
+	if err != nil {
+		return err
+	}
+
+	hdr.Salt = salt
+
+	aead := passwordKey(password, hdr)
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return err
+	}
+
+	hdr.WrappedKey = aead.Seal(nonce, nonce, dataKey, []byte("floo-db-data-key"))
+	return nil
+}
+
+func unwrapDataKey(password []byte, hdr *encryptedHeader) ([]byte, error) {
+	aead := passwordKey(password, hdr)
+	if len(hdr.WrappedKey) < aead.NonceSize() {
+		return nil, ErrBadCiphertext
+	}
+
+	nonce, sealed := hdr.WrappedKey[:aead.NonceSize()], hdr.WrappedKey[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte("floo-db-data-key"))
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+
+	return dataKey, nil
+}
+
+// NewEncryptedDatabase wraps `db`. If `db` was not encrypted yet, a new
+// data key is generated and protected with `password`. Otherwise the
+// password is checked and ErrWrongPassword is returned if it does not match.
+// Keys that exist in `db` before it is encrypted cannot be read anymore;
+// use Migrate() to encrypt an existing database.
+func NewEncryptedDatabase(db Database, password []byte, opts EncryptedOptions) (*EncryptedDatabase, error) {
+	ed := &EncryptedDatabase{db: db}
+
+	data, err := db.Get(encryptedHeaderKey...)
+	switch err {
+	case nil:
+		if err := json.Unmarshal(data, &ed.header); err != nil {
+			return nil, err
+		}
+
+		if ed.header.Version != encryptedFormatVersion {
+			return nil, fmt.Errorf("encrypted database: unsupported version %d", ed.header.Version)
+		}
+
+		dataKey, err := unwrapDataKey(password, &ed.header)
+		if err != nil {
+			return nil, err
+		}
+
+		if ed.keys, err = deriveEncryptedKeys(dataKey); err != nil {
+			return nil, err
+		}
+
+		return ed, nil
+	case ErrNoSuchKey:
+		// New database, create a header below.
+	default:
+		return nil, err
+	}
+
+	if opts.KDFTime == 0 {
+		opts.KDFTime = defaultKDFTime
+	}
+
+	if opts.KDFMemory == 0 {
+		opts.KDFMemory = defaultKDFMemory
+	}
+
+	ed.header = encryptedHeader{
+		Version:     encryptedFormatVersion,
+		EncryptKeys: opts.EncryptKeys,
+		KDFTime:     opts.KDFTime,
+		KDFMemory:   opts.KDFMemory,
+	}
+
+	dataKey, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wrapDataKey(password, dataKey, &ed.header); err != nil {
+		return nil, err
+	}
+
+	if ed.keys, err = deriveEncryptedKeys(dataKey); err != nil {
+		return nil, err
+	}
+
+	batch := db.Batch()
+	if err := ed.putHeader(batch); err != nil {
+		batch.Rollback()
+		return nil, err
+	}
+
+	if err := batch.Flush(); err != nil {
+		return nil, err
+	}
+
+	return ed, nil
+}
+
+func (ed *EncryptedDatabase) putHeader(batch Batch) error {
+	data, err := json.Marshal(ed.header)
+	if err != nil {
+		return err
+	}
+
+	batch.Put(data, encryptedHeaderKey...)
+	return nil
+}
+
+func isEncryptedHeaderKey(key []string) bool {
+	return len(key) == 1 && key[0] == encryptedHeaderKey[0]
+}
+
+// partSiv returns the synthetic IV of `part`. It depends on all parts
+// before it, so equal names in different directories look different.
+func (ek *encryptedKeys) partSiv(parents []string, part string) []byte {
+	mac := hmac.New(sha256.New, ek.partMac)
+	for _, parent := range parents {
+		mac.Write([]byte(parent))
+		mac.Write([]byte{0})
+	}
+
+	mac.Write([]byte(part))
+	return mac.Sum(nil)[:encryptedSivSize]
+}
+
+func (ek *encryptedKeys) encryptKey(key []string) []string {
+	key = normalizeKey(key)
+
+	encKey := make([]string, 0, len(key))
+	for idx, part := range key {
+		siv := ek.partSiv(key[:idx], part)
+		buf := make([]byte, encryptedSivSize+len(part))
+		copy(buf, siv)
+		cipher.NewCTR(ek.partEnc, siv).XORKeyStream(buf[encryptedSivSize:], []byte(part))
+		encKey = append(encKey, base64.RawURLEncoding.EncodeToString(buf))
+	}
+
+	return encKey
+}
+
+func (ek *encryptedKeys) decryptKey(encKey []string) ([]string, error) {
+	key := make([]string, 0, len(encKey))
+	for _, encPart := range encKey {
+		buf, err := base64.RawURLEncoding.DecodeString(encPart)
+		if err != nil || len(buf) < encryptedSivSize {
+			return nil, ErrBadCiphertext
+		}
+
+		siv, part := buf[:encryptedSivSize], make([]byte, len(buf)-encryptedSivSize)
+		cipher.NewCTR(ek.partEnc, siv).XORKeyStream(part, buf[encryptedSivSize:])
+		if !hmac.Equal(siv, ek.partSiv(key, string(part))) {
+			return nil, ErrBadCiphertext
+		}
+
+		key = append(key, string(part))
+	}
+
+	return key, nil
+}
+
+func (ek *encryptedKeys) encryptValue(key []string, val []byte) ([]byte, error) {
+	nonce, err := randomBytes(ek.values.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{encryptedFormatVersion}, nonce...)
+	return ek.values.Seal(out, nonce, val, []byte(joinKey(key))), nil
+}
+
+func (ek *encryptedKeys) decryptValue(key []string, data []byte) ([]byte, error) {
+	nonceSize := ek.values.NonceSize()
+	if len(data) < 1+nonceSize || data[0] != encryptedFormatVersion {
+		return nil, ErrBadCiphertext
+	}
+
+	val, err := ek.values.Open(nil, data[1:1+nonceSize], data[1+nonceSize:], []byte(joinKey(key)))
+	if err != nil {
+		return nil, ErrBadCiphertext
+	}
+
+	return val, nil
+}
+
+func (ed *EncryptedDatabase) innerKey(key []string) []string {
+	if ed.header.EncryptKeys {
+		return ed.keys.encryptKey(key)
+	}
+
+	return normalizeKey(key)
+}
+
+func (ed *EncryptedDatabase) outerKey(innerKey []string) ([]string, error) {
+	if ed.header.EncryptKeys {
+		return ed.keys.decryptKey(innerKey)
+	}
+
+	return innerKey, nil
+}
+
+// Get is the encrypted implementation of Database.Get
+func (ed *EncryptedDatabase) Get(key ...string) ([]byte, error) {
+	data, err := ed.db.Get(ed.innerKey(key)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed.keys.decryptValue(key, data)
+}
+
+// Keys is the encrypted implementation of Database.Keys
+func (ed *EncryptedDatabase) Keys(prefix ...string) ([][]string, error) {
+	innerKeys, err := ed.db.Keys(ed.innerKey(prefix)...)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]string, 0, len(innerKeys))
+	for _, innerKey := range innerKeys {
+		if isEncryptedHeaderKey(innerKey) {
+			continue
+		}
+
+		key, err := ed.outerKey(innerKey)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys(keys[i], keys[j]) < 0
+	})
+
+	return keys, nil
+}
+
+// Glob is the encrypted implementation of Database.Glob
+func (ed *EncryptedDatabase) Glob(prefix []string) ([][]string, error) {
+	if !ed.header.EncryptKeys {
+		matches, err := ed.db.Glob(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		results := matches[:0]
+		for _, match := range matches {
+			if !isEncryptedHeaderKey(match) {
+				results = append(results, match)
+			}
+		}
+
+		return results, nil
+	}
+
+	// The last part of the prefix may be incomplete, so we have to look
+	// at all keys in its parent and compare the decrypted parts.
+	parts := normalizeKey(prefix)
+	last := ""
+	if len(parts) > 0 && (len(prefix) == 0 || !strings.HasSuffix(prefix[len(prefix)-1], "/")) {
+		parts, last = parts[:len(parts)-1], parts[len(parts)-1]
+	}
+
+	keys, err := ed.Keys(parts...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := [][]string{}
+	for _, key := range keys {
+		if len(key) == len(parts)+1 && strings.HasPrefix(key[len(parts)], last) {
+			results = append(results, key)
+		}
+	}
+
+	return results, nil
+}
+
+// encryptedIterator decrypts the keys and values of the wrapped iterator.
+type encryptedIterator struct {
+	ed       *EncryptedDatabase
+	iter     Iterator
+	keysOnly bool
+	key      []string
+	val      []byte
+	err      error
+}
+
+func (ei *encryptedIterator) Next() bool {
+	for ei.err == nil && ei.iter.Next() {
+		if isEncryptedHeaderKey(ei.iter.Key()) {
+			continue
+		}
+
+		ei.key, ei.val = ei.iter.Key(), nil
+		if !ei.keysOnly {
+			ei.val, ei.err = ei.ed.keys.decryptValue(ei.key, ei.iter.Value())
+		}
+
+		return ei.err == nil
+	}
+
+	return false
+}
+
+func (ei *encryptedIterator) Key() []string {
+	return ei.key
+}
+
+func (ei *encryptedIterator) Value() []byte {
+	return ei.val
+}
+
+func (ei *encryptedIterator) Err() error {
+	if ei.err != nil {
+		return ei.err
+	}
+
+	return ei.iter.Err()
+}
+
+func (ei *encryptedIterator) Close() error {
+	if err := ei.iter.Close(); err != nil {
+		return err
+	}
+
+	return ei.err
+}
+
+// Iterator is the encrypted implementation of Database.Iterator.
+// With encrypted keys, the order of the wrapped database is meaningless,
+// so all keys below the prefix are decrypted and sorted in memory.
+func (ed *EncryptedDatabase) Iterator(opts IterOptions) Iterator {
+	if !ed.header.EncryptKeys {
+		return &encryptedIterator{
+			ed:       ed,
+			iter:     ed.db.Iterator(opts),
+			keysOnly: opts.KeysOnly,
+		}
+	}
+
+	iter := ed.db.Iterator(IterOptions{
+		Prefix:   ed.innerKey(opts.Prefix),
+		KeysOnly: true,
+	})
+
+	keys := [][]string{}
+	for iter.Next() {
+		if isEncryptedHeaderKey(iter.Key()) {
+			continue
+		}
+
+		key, err := ed.outerKey(iter.Key())
+		if err != nil {
+			iter.Close()
+			return &errIterator{err: err}
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := iter.Close(); err != nil {
+		return &errIterator{err: err}
+	}
+
+	return newSliceIterator(opts, keys, func(key []string) ([]byte, error) {
+		val, err := ed.Get(key...)
+		if err == ErrNoSuchKey {
+			// Erased since the keys were listed.
+			return nil, nil
+		}
+
+		return val, err
+	})
+}
+
+// Export is the encrypted implementation of Database.Export.
+// Note that the dump contains the decrypted data.
+func (ed *EncryptedDatabase) Export(w io.Writer) error {
+	return exportDump(ed, w)
+}
+
+// Import is the encrypted implementation of Database.Import.
+func (ed *EncryptedDatabase) Import(r io.Reader) error {
+	return importDump(ed, r)
+}
+
+// Close closes the wrapped database.
+func (ed *EncryptedDatabase) Close() error {
+	return ed.db.Close()
+}
+
+// Batch is the encrypted implementation of Database.Batch
+func (ed *EncryptedDatabase) Batch() Batch {
+	return &encryptedBatch{
+		ed:    ed,
+		Batch: ed.db.Batch(),
+	}
+}
+
+// encryptedBatch encrypts all writes; the rest is passed through.
+type encryptedBatch struct {
+	Batch
+	ed *EncryptedDatabase
+}
+
+func (eb *encryptedBatch) Put(val []byte, key ...string) {
+	data, err := eb.ed.keys.encryptValue(key, val)
+	if err != nil {
+		// Never fall back to storing the plaintext.
+		log.Warningf("encrypted: failed to set key %v: %v", key, err)
+		return
+	}
+
+	eb.Batch.Put(data, eb.ed.innerKey(key)...)
+}
+
+func (eb *encryptedBatch) Clear(key ...string) error {
+	if len(normalizeKey(key)) == 0 {
+		// Clearing everything would also remove the header.
+		keys, err := eb.ed.Keys()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			eb.Batch.Erase(eb.ed.innerKey(key)...)
+		}
+
+		return nil
+	}
+
+	return eb.Batch.Clear(eb.ed.innerKey(key)...)
+}
+
+func (eb *encryptedBatch) Erase(key ...string) {
+	eb.Batch.Erase(eb.ed.innerKey(key)...)
+}
+
+// ChangePassword protects the data key with `newPassword`.
+// No data needs to be re-encrypted for this.
+func (ed *EncryptedDatabase) ChangePassword(oldPassword, newPassword []byte) error {
+	dataKey, err := unwrapDataKey(oldPassword, &ed.header)
+	if err != nil {
+		return err
+	}
+
+	hdr := ed.header
+	if err := wrapDataKey(newPassword, dataKey, &hdr); err != nil {
+		return err
+	}
+
+	oldHdr := ed.header
+	ed.header = hdr
+
+	batch := ed.db.Batch()
+	if err := ed.putHeader(batch); err != nil {
+		batch.Rollback()
+		ed.header = oldHdr
+		return err
+	}
+
+	if err := batch.Flush(); err != nil {
+		ed.header = oldHdr
+		return err
+	}
+
+	return nil
+}
+
+// RotateKey generates a new data key, protected by `password`, and
+// re-encrypts all keys and values with it in a single batch.
+// Use this when the old data key might have leaked.
+// All keys and values are held in memory during the rotation.
+func (ed *EncryptedDatabase) RotateKey(password []byte) error {
+	if _, err := unwrapDataKey(password, &ed.header); err != nil {
+		return err
+	}
+
+	keys, err := ed.Keys()
+	if err != nil {
+		return err
+	}
+
+	dataKey, err := randomBytes(32)
+	if err != nil {
+		return err
+	}
+
+	newKeys, err := deriveEncryptedKeys(dataKey)
+	if err != nil {
+		return err
+	}
+
+	newHdr := ed.header
+	if err := wrapDataKey(password, dataKey, &newHdr); err != nil {
+		return err
+	}
+
+	newEd := &EncryptedDatabase{
+		db:     ed.db,
+		header: newHdr,
+		keys:   newKeys,
+	}
+
+	batch := ed.db.Batch()
+
+	// Read everything first; the new keys may show up
+	// in the old ones when keys are encrypted.
+	vals := make([][]byte, len(keys))
+	for idx, key := range keys {
+		if vals[idx], err = ed.Get(key...); err != nil {
+			batch.Rollback()
+			return err
+		}
+	}
+
+	for idx, key := range keys {
+		batch.Erase(ed.innerKey(key)...)
+
+		data, err := newEd.keys.encryptValue(key, vals[idx])
+		if err != nil {
+			batch.Rollback()
+			return err
+		}
+
+		batch.Put(data, newEd.innerKey(key)...)
+	}
+
+	if err := newEd.putHeader(batch); err != nil {
+		batch.Rollback()
+		return err
+	}
+
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	ed.header, ed.keys = newHdr, newKeys
+	return nil
+}
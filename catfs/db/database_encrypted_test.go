@@ -0,0 +1,150 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func withEncryptedDatabase(t *testing.T, fn func(inner Database, ed *EncryptedDatabase)) {
+	for _, encryptKeys := range []bool{false, true} {
+		inner := NewMemoryDatabase()
+		ed, err := NewEncryptedDatabase(inner, []byte("secret"), testEncryptedOptions(encryptKeys))
+		require.Nil(t, err)
+
+		fn(inner, ed)
+	}
+}
+
+func TestEncryptedDatabasePlaintext(t *testing.T) {
+	withEncryptedDatabase(t, func(inner Database, ed *EncryptedDatabase) {
+		mustPut(t, ed, "super-secret-file-key", "stage", "tree", "/secret-name.txt")
+
+		dump := &bytes.Buffer{}
+		require.Nil(t, inner.Export(dump))
+		require.False(t, bytes.Contains(dump.Bytes(), []byte("super-secret-file-key")))
+		require.Equal(t,
+			ed.header.EncryptKeys,
+			!bytes.Contains(dump.Bytes(), []byte("secret-name")),
+		)
+
+		data, err := ed.Get("stage", "tree", "/secret-name.txt")
+		require.Nil(t, err)
+		require.Equal(t, []byte("super-secret-file-key"), data)
+	})
+}
+
+func TestEncryptedDatabasePassword(t *testing.T) {
+	withEncryptedDatabase(t, func(inner Database, ed *EncryptedDatabase) {
+		mustPut(t, ed, "1", "objects", "a")
+
+		_, err := NewEncryptedDatabase(inner, []byte("wrong"), EncryptedOptions{})
+		require.Equal(t, ErrWrongPassword, err)
+
+		require.Equal(t, ErrWrongPassword, ed.ChangePassword([]byte("wrong"), []byte("new")))
+		require.Nil(t, ed.ChangePassword([]byte("secret"), []byte("new")))
+
+		_, err = NewEncryptedDatabase(inner, []byte("secret"), EncryptedOptions{})
+		require.Equal(t, ErrWrongPassword, err)
+
+		reopened, err := NewEncryptedDatabase(inner, []byte("new"), EncryptedOptions{})
+		require.Nil(t, err)
+
+		data, err := reopened.Get("objects", "a")
+		require.Nil(t, err)
+		require.Equal(t, []byte("1"), data)
+	})
+}
+
+func TestEncryptedDatabaseRotateKey(t *testing.T) {
+	withEncryptedDatabase(t, func(inner Database, ed *EncryptedDatabase) {
+		mustPut(t, ed, "1", "objects", "a")
+		mustPut(t, ed, "2", "stage", "tree", "/x", ".")
+
+		before := &bytes.Buffer{}
+		require.Nil(t, inner.Export(before))
+
+		require.Equal(t, ErrWrongPassword, ed.RotateKey([]byte("wrong")))
+		require.Nil(t, ed.RotateKey([]byte("secret")))
+
+		// All ciphertexts changed:
+		after := &bytes.Buffer{}
+		require.Nil(t, inner.Export(after))
+		require.NotEqual(t, before.Bytes(), after.Bytes())
+
+		for _, db := range []Database{ed, mustReopen(t, inner)} {
+			keys, err := db.Keys()
+			require.Nil(t, err)
+			require.Equal(t, [][]string{
+				{"objects", "a"},
+				{"stage", "tree", "x", "."},
+			}, keys)
+
+			data, err := db.Get("stage", "tree", "/x", ".")
+			require.Nil(t, err)
+			require.Equal(t, []byte("2"), data)
+		}
+	})
+}
+
+func mustReopen(t *testing.T, inner Database) *EncryptedDatabase {
+	ed, err := NewEncryptedDatabase(inner, []byte("secret"), EncryptedOptions{})
+	require.Nil(t, err)
+	return ed
+}
+
+func TestEncryptedDatabaseTampered(t *testing.T) {
+	inner := NewMemoryDatabase()
+	ed, err := NewEncryptedDatabase(inner, []byte("secret"), testEncryptedOptions(false))
+	require.Nil(t, err)
+
+	mustPut(t, ed, "1", "objects", "a")
+	mustPut(t, ed, "2", "objects", "b")
+
+	// Swapping values between keys must be noticed:
+	data, err := inner.Get("objects", "b")
+	require.Nil(t, err)
+	mustPut(t, inner, string(data), "objects", "a")
+
+	_, err = ed.Get("objects", "a")
+	require.Equal(t, ErrBadCiphertext, err)
+}
+
+func TestEncryptedDatabaseIteratorTampered(t *testing.T) {
+	withEncryptedDatabase(t, func(inner Database, ed *EncryptedDatabase) {
+		mustPut(t, ed, "1", "objects", "a")
+
+		keys, err := inner.Keys()
+		require.Nil(t, err)
+		for _, key := range keys {
+			if isEncryptedHeaderKey(key) {
+				continue
+			}
+
+			data, err := inner.Get(key...)
+			require.Nil(t, err)
+			data[len(data)-1] ^= 0x01
+			mustPut(t, inner, string(data), key...)
+		}
+
+		iter := ed.Iterator(IterOptions{})
+		require.False(t, iter.Next())
+		require.Equal(t, ErrBadCiphertext, iter.Err())
+		require.Equal(t, ErrBadCiphertext, iter.Close())
+	})
+}
+
+func TestEncryptedDatabaseMigrate(t *testing.T) {
+	src := NewMemoryDatabase()
+	mustPut(t, src, "1", "objects", "a")
+	mustPut(t, src, "2", "stage", "tree", "/x", ".")
+
+	dst, err := NewEncryptedDatabase(NewMemoryDatabase(), []byte("secret"), testEncryptedOptions(true))
+	require.Nil(t, err)
+	require.Nil(t, Migrate(dst, src))
+
+	data, err := dst.Get("stage", "tree", "/x", ".")
+	require.Nil(t, err)
+	require.Equal(t, []byte("2"), data)
+}
@@ -0,0 +1,416 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+)
+
+// FaultOp names an operation of FaultyDatabase that can be made to fail.
+type FaultOp string
+
+const (
+	// FaultGet fails Get() with ErrFaultInjected.
+	FaultGet = FaultOp("get")
+	// FaultIterate fails Keys(), Glob() and Iterator().
+	FaultIterate = FaultOp("iterate")
+	// FaultPut drops the write and makes the next Flush() fail.
+	FaultPut = FaultOp("put")
+	// FaultErase drops the erase and makes the next Flush() fail.
+	FaultErase = FaultOp("erase")
+	// FaultClear fails Clear() and makes the next Flush() fail.
+	FaultClear = FaultOp("clear")
+	// FaultFlush fails Flush(); nothing of the batch is written.
+	FaultFlush = FaultOp("flush")
+)
+
+var (
+	// ErrFaultInjected is returned by operations that failed on purpose.
+	ErrFaultInjected = errors.New("injected fault")
+
+	// ErrCrashed is returned by all operations after a simulated crash,
+	// until Recover() is called.
+	ErrCrashed = errors.New("database crashed (simulated)")
+)
+
+type faultRule struct {
+	op    FaultOp
+	at    int
+	prob  float64
+	crash bool
+}
+
+// FaultyDatabase wraps a database and makes chosen operations fail.
+// It is meant for testing how callers deal with partial failures:
+// Operations can fail at the n-th call or with a given probability,
+// and a crash can be simulated, which drops all writes that were not
+// flushed yet and fails everything until Recover() is called.
+//
+// Since Put() and Erase() cannot return errors, a failed write is
+// dropped and the next Flush() fails and writes nothing, like a backend
+// that reports write errors on commit.
+type FaultyDatabase struct {
+	mu      sync.Mutex
+	db      Database
+	rnd     *rand.Rand
+	rules   []*faultRule
+	calls   map[FaultOp]int
+	batch   Batch
+	depth   int
+	doomed  bool
+	crashed bool
+
+	// doomed state at the time of each savepoint
+	savepoints []bool
+}
+
+// NewFaultyDatabase wraps `db`. `seed` makes random failures reproducible.
+func NewFaultyDatabase(db Database, seed int64) *FaultyDatabase {
+	return &FaultyDatabase{
+		db:    db,
+		rnd:   rand.New(rand.NewSource(seed)), // #nosec
+		calls: make(map[FaultOp]int),
+	}
+}
+
+// FailAt makes the `n`-th call of `op` fail, counted from now on.
+// The rule is removed after it fired.
+func (fdb *FaultyDatabase) FailAt(op FaultOp, n int) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	fdb.rules = append(fdb.rules, &faultRule{op: op, at: fdb.calls[op] + n})
+}
+
+// FailRandomly makes every call of `op` fail with a probability of `prob`.
+func (fdb *FaultyDatabase) FailRandomly(op FaultOp, prob float64) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	fdb.rules = append(fdb.rules, &faultRule{op: op, prob: prob})
+}
+
+// CrashAt simulates a crash right before the `n`-th call of `op`.
+func (fdb *FaultyDatabase) CrashAt(op FaultOp, n int) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	fdb.rules = append(fdb.rules, &faultRule{op: op, at: fdb.calls[op] + n, crash: true})
+}
+
+// Crash simulates a crash now: all writes that were not flushed are lost.
+func (fdb *FaultyDatabase) Crash() {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	fdb.crash()
+}
+
+func (fdb *FaultyDatabase) crash() {
+	if fdb.depth > 0 {
+		fdb.batch.Rollback()
+	}
+
+	fdb.crashed = true
+	fdb.depth = 0
+	fdb.doomed = false
+	fdb.savepoints = nil
+}
+
+// Recover ends a simulated crash and removes all rules.
+// The wrapped database is in the state of the last successful flush.
+func (fdb *FaultyDatabase) Recover() {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	fdb.rules = nil
+	fdb.crashed = false
+	fdb.doomed = false
+}
+
+// Reset removes all rules, but does not end a crash.
+func (fdb *FaultyDatabase) Reset() {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	fdb.rules = nil
+}
+
+// Calls returns how often `op` was called so far.
+// Tests can use it to find out how many failure points an operation has.
+func (fdb *FaultyDatabase) Calls(op FaultOp) int {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	return fdb.calls[op]
+}
+
+// Crashed returns true if a crash was simulated and Recover() was not called yet.
+func (fdb *FaultyDatabase) Crashed() bool {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	return fdb.crashed
+}
+
+// check counts a call of `op` and returns the error it should fail with.
+func (fdb *FaultyDatabase) check(op FaultOp) error {
+	if fdb.crashed {
+		return ErrCrashed
+	}
+
+	fdb.calls[op]++
+
+	rules := fdb.rules[:0]
+	var err error
+	for _, rule := range fdb.rules {
+		if rule.op != op || err != nil {
+			rules = append(rules, rule)
+			continue
+		}
+
+		switch {
+		case rule.at == fdb.calls[op] && rule.crash:
+			fdb.crash()
+			err = ErrCrashed
+		case rule.at == fdb.calls[op]:
+			err = ErrFaultInjected
+		case rule.at == 0 && fdb.rnd.Float64() < rule.prob:
+			err = ErrFaultInjected
+			rules = append(rules, rule)
+		default:
+			rules = append(rules, rule)
+		}
+	}
+
+	if fdb.crashed {
+		// crash() might have been called above; all rules are gone then.
+		rules = nil
+	}
+
+	fdb.rules = rules
+	return err
+}
+
+// Get is the faulty implementation of Database.Get
+func (fdb *FaultyDatabase) Get(key ...string) ([]byte, error) {
+	fdb.mu.Lock()
+	err := fdb.check(FaultGet)
+	fdb.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fdb.db.Get(key...)
+}
+
+// Keys is the faulty implementation of Database.Keys
+func (fdb *FaultyDatabase) Keys(prefix ...string) ([][]string, error) {
+	fdb.mu.Lock()
+	err := fdb.check(FaultIterate)
+	fdb.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fdb.db.Keys(prefix...)
+}
+
+// Glob is the faulty implementation of Database.Glob
+func (fdb *FaultyDatabase) Glob(prefix []string) ([][]string, error) {
+	fdb.mu.Lock()
+	err := fdb.check(FaultIterate)
+	fdb.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fdb.db.Glob(prefix)
+}
+
+// Iterator is the faulty implementation of Database.Iterator
+func (fdb *FaultyDatabase) Iterator(opts IterOptions) Iterator {
+	fdb.mu.Lock()
+	err := fdb.check(FaultIterate)
+	fdb.mu.Unlock()
+
+	if err != nil {
+		return &errIterator{err: err}
+	}
+
+	return fdb.db.Iterator(opts)
+}
+
+// Export is the faulty implementation of Database.Export
+func (fdb *FaultyDatabase) Export(w io.Writer) error {
+	return exportDump(fdb, w)
+}
+
+// Import is the faulty implementation of Database.Import
+func (fdb *FaultyDatabase) Import(r io.Reader) error {
+	return importDump(fdb, r)
+}
+
+// Close closes the wrapped database.
+func (fdb *FaultyDatabase) Close() error {
+	return fdb.db.Close()
+}
+
+// Batch is the faulty implementation of Database.Batch
+func (fdb *FaultyDatabase) Batch() Batch {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if !fdb.crashed {
+		fdb.batch = fdb.db.Batch()
+		fdb.depth++
+	}
+
+	return fdb
+}
+
+// Put is the faulty implementation of Batch.Put
+func (fdb *FaultyDatabase) Put(val []byte, key ...string) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if err := fdb.check(FaultPut); err != nil {
+		fdb.doomed = !fdb.crashed
+		return
+	}
+
+	fdb.batch.Put(val, key...)
+}
+
+// Erase is the faulty implementation of Batch.Erase
+func (fdb *FaultyDatabase) Erase(key ...string) {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if err := fdb.check(FaultErase); err != nil {
+		fdb.doomed = !fdb.crashed
+		return
+	}
+
+	fdb.batch.Erase(key...)
+}
+
+// Clear is the faulty implementation of Batch.Clear
+func (fdb *FaultyDatabase) Clear(key ...string) error {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if err := fdb.check(FaultClear); err != nil {
+		fdb.doomed = !fdb.crashed
+		return err
+	}
+
+	return fdb.batch.Clear(key...)
+}
+
+// Flush is the faulty implementation of Batch.Flush
+func (fdb *FaultyDatabase) Flush() error {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if err := fdb.check(FaultFlush); err != nil {
+		fdb.doomed = fdb.doomed || !fdb.crashed
+	}
+
+	if fdb.crashed {
+		return ErrCrashed
+	}
+
+	if fdb.depth > 0 {
+		fdb.depth--
+	}
+
+	if fdb.depth > 0 {
+		// Nested flush; the outermost one decides.
+		if err := fdb.batch.Flush(); err != nil {
+			return err
+		}
+
+		if fdb.doomed {
+			return ErrFaultInjected
+		}
+
+		return nil
+	}
+
+	fdb.savepoints = nil
+	if fdb.doomed {
+		fdb.doomed = false
+		fdb.batch.Rollback()
+		return ErrFaultInjected
+	}
+
+	return fdb.batch.Flush()
+}
+
+// Rollback is the faulty implementation of Batch.Rollback
+func (fdb *FaultyDatabase) Rollback() {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.crashed || fdb.depth == 0 {
+		return
+	}
+
+	fdb.batch.Rollback()
+	fdb.depth = 0
+	fdb.doomed = false
+	fdb.savepoints = nil
+}
+
+// Savepoint is the faulty implementation of Batch.Savepoint
+func (fdb *FaultyDatabase) Savepoint() int {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.crashed || fdb.batch == nil {
+		return -1
+	}
+
+	fdb.savepoints = append(fdb.savepoints, fdb.doomed)
+	return fdb.batch.Savepoint()
+}
+
+// RollbackTo is the faulty implementation of Batch.RollbackTo.
+// Faults injected after `savepoint` do not make the batch fail anymore.
+func (fdb *FaultyDatabase) RollbackTo(savepoint int) error {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.crashed {
+		return ErrCrashed
+	}
+
+	if fdb.batch == nil || savepoint < 0 || savepoint >= len(fdb.savepoints) {
+		return ErrNoSuchSavepoint
+	}
+
+	if err := fdb.batch.RollbackTo(savepoint); err != nil {
+		return err
+	}
+
+	fdb.doomed = fdb.savepoints[savepoint]
+	fdb.savepoints = fdb.savepoints[:savepoint+1]
+	return nil
+}
+
+// HaveWrites is the faulty implementation of Batch.HaveWrites
+func (fdb *FaultyDatabase) HaveWrites() bool {
+	fdb.mu.Lock()
+	defer fdb.mu.Unlock()
+
+	if fdb.crashed || fdb.batch == nil {
+		return false
+	}
+
+	return fdb.batch.HaveWrites()
+}
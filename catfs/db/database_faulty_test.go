@@ -0,0 +1,92 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultyDatabaseFailPut(t *testing.T) {
+	fdb := NewFaultyDatabase(NewMemoryDatabase(), 0)
+	mustPut(t, fdb, "1", "a")
+
+	fdb.FailAt(FaultPut, 2)
+
+	batch := fdb.Batch()
+	batch.Put([]byte("2"), "a")
+	batch.Put([]byte("3"), "b")
+	require.Equal(t, ErrFaultInjected, batch.Flush())
+
+	// Nothing of the failed batch may be visible:
+	data, err := fdb.Get("a")
+	require.Nil(t, err)
+	require.Equal(t, []byte("1"), data)
+
+	_, err = fdb.Get("b")
+	require.Equal(t, ErrNoSuchKey, err)
+
+	// The rule fired once; the next batch goes through.
+	mustPut(t, fdb, "3", "b")
+}
+
+func TestFaultyDatabaseNestedFlush(t *testing.T) {
+	fdb := NewFaultyDatabase(NewMemoryDatabase(), 0)
+	fdb.FailAt(FaultFlush, 1)
+
+	outer := fdb.Batch()
+	outer.Put([]byte("1"), "a")
+
+	inner := fdb.Batch()
+	inner.Put([]byte("2"), "b")
+	require.Equal(t, ErrFaultInjected, inner.Flush())
+	require.Equal(t, ErrFaultInjected, outer.Flush())
+
+	keys, err := fdb.Keys()
+	require.Nil(t, err)
+	require.Empty(t, keys)
+}
+
+func TestFaultyDatabaseCrash(t *testing.T) {
+	fdb := NewFaultyDatabase(NewMemoryDatabase(), 0)
+	mustPut(t, fdb, "1", "a")
+
+	fdb.CrashAt(FaultGet, 1)
+
+	batch := fdb.Batch()
+	batch.Put([]byte("2"), "b")
+
+	_, err := fdb.Get("a")
+	require.Equal(t, ErrCrashed, err)
+	require.True(t, fdb.Crashed())
+
+	batch.Put([]byte("3"), "c")
+	require.Equal(t, ErrCrashed, batch.Flush())
+
+	fdb.Recover()
+	require.False(t, fdb.Crashed())
+
+	keys, err := fdb.Keys()
+	require.Nil(t, err)
+	require.Equal(t, [][]string{{"a"}}, keys)
+}
+
+func TestFaultyDatabaseRandomly(t *testing.T) {
+	fdb := NewFaultyDatabase(NewMemoryDatabase(), 0)
+	mustPut(t, fdb, "1", "a")
+	fdb.FailRandomly(FaultGet, 0.5)
+
+	failed := 0
+	for idx := 0; idx < 100; idx++ {
+		if _, err := fdb.Get("a"); err != nil {
+			require.Equal(t, ErrFaultInjected, err)
+			failed++
+		}
+	}
+
+	require.True(t, failed > 0 && failed < 100)
+	require.Equal(t, 100, fdb.Calls(FaultGet))
+
+	fdb.Reset()
+	_, err := fdb.Get("a")
+	require.Nil(t, err)
+}
@@ -0,0 +1,428 @@
+package db
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MetricOp names an operation that InstrumentedDatabase measures.
+type MetricOp string
+
+// Operations that are measured by InstrumentedDatabase.
+const (
+	MetricGet        = MetricOp("get")
+	MetricKeys       = MetricOp("keys")
+	MetricGlob       = MetricOp("glob")
+	MetricIterate    = MetricOp("iterate")
+	MetricPut        = MetricOp("put")
+	MetricErase      = MetricOp("erase")
+	MetricClear      = MetricOp("clear")
+	MetricFlush      = MetricOp("flush")
+	MetricRollback   = MetricOp("rollback")
+	MetricRollbackTo = MetricOp("rollback-to")
+	MetricExport     = MetricOp("export")
+	MetricImport     = MetricOp("import")
+)
+
+// Top level key parts that get their own metrics.
+// All other keys are counted as "other", so the number
+// of metrics stays bounded no matter what keys are used.
+var metricPrefixes = map[string]bool{
+	"objects":  true,
+	"tree":     true,
+	"stage":    true,
+	"moves":    true,
+	"refs":     true,
+	"inode":    true,
+	"index":    true,
+	"oplog":    true,
+	"stats":    true,
+	"metadata": true,
+}
+
+func metricPrefix(key []string) string {
+	key = normalizeKey(key)
+	if len(key) == 0 {
+		return ""
+	}
+
+	if metricPrefixes[key[0]] {
+		return key[0]
+	}
+
+	return "other"
+}
+
+// Upper bounds of the latency histogram buckets.
+// Latencies above the last bound go to an extra bucket.
+var latencyBounds = []time.Duration{
+	1 * time.Microsecond,
+	4 * time.Microsecond,
+	16 * time.Microsecond,
+	64 * time.Microsecond,
+	256 * time.Microsecond,
+	1 * time.Millisecond,
+	4 * time.Millisecond,
+	16 * time.Millisecond,
+	64 * time.Millisecond,
+	256 * time.Millisecond,
+	1 * time.Second,
+}
+
+// LatencyHistogram counts how many operations took how long.
+// Counts[i] is the number of operations that took at most Bounds[i]
+// (and longer than Bounds[i-1]). The last element of Counts has no bound.
+type LatencyHistogram struct {
+	Bounds []time.Duration `json:"bounds"`
+	Counts []uint64        `json:"counts"`
+	Sum    time.Duration   `json:"sum"`
+	Max    time.Duration   `json:"max"`
+}
+
+func newLatencyHistogram() LatencyHistogram {
+	return LatencyHistogram{
+		Bounds: latencyBounds,
+		Counts: make([]uint64, len(latencyBounds)+1),
+	}
+}
+
+func (lh *LatencyHistogram) add(took time.Duration) {
+	idx := sort.Search(len(lh.Bounds), func(i int) bool {
+		return took <= lh.Bounds[i]
+	})
+
+	lh.Counts[idx]++
+	lh.Sum += took
+	if took > lh.Max {
+		lh.Max = took
+	}
+}
+
+// Total returns the number of recorded operations.
+func (lh LatencyHistogram) Total() uint64 {
+	total := uint64(0)
+	for _, count := range lh.Counts {
+		total += count
+	}
+
+	return total
+}
+
+// Mean returns the average latency.
+func (lh LatencyHistogram) Mean() time.Duration {
+	total := lh.Total()
+	if total == 0 {
+		return 0
+	}
+
+	return lh.Sum / time.Duration(total)
+}
+
+// Quantile returns an upper bound for the latency of the `q` quantile
+// (e.g. 0.99), as far as the bucket resolution allows.
+func (lh LatencyHistogram) Quantile(q float64) time.Duration {
+	total := lh.Total()
+	if total == 0 {
+		return 0
+	}
+
+	seen := uint64(0)
+	for idx, count := range lh.Counts {
+		seen += count
+		if float64(seen) >= q*float64(total) {
+			if idx < len(lh.Bounds) {
+				return lh.Bounds[idx]
+			}
+
+			break
+		}
+	}
+
+	return lh.Max
+}
+
+// OpMetrics are the metrics of one operation on one key prefix.
+type OpMetrics struct {
+	Op     MetricOp `json:"op"`
+	Prefix string   `json:"prefix"`
+
+	// Count is the number of calls, Errors how many of them failed.
+	Count  uint64 `json:"count"`
+	Errors uint64 `json:"errors"`
+
+	// Bytes is the size of all values that were read or written.
+	Bytes uint64 `json:"bytes"`
+
+	Latency LatencyHistogram `json:"latency"`
+}
+
+// DatabaseMetrics is a snapshot of all metrics of an InstrumentedDatabase.
+type DatabaseMetrics struct {
+	// Since is the time the metrics were started or reset.
+	Since time.Time `json:"since"`
+
+	// Ops is sorted by operation and prefix.
+	// Operations without a key (e.g. flush) have an empty prefix.
+	Ops []OpMetrics `json:"ops"`
+
+	// Badger is only set when the wrapped database is badger.
+	Badger *BadgerStats `json:"badger,omitempty"`
+}
+
+// Op returns the metrics for `op` and `prefix` or nil if there are none.
+func (dm *DatabaseMetrics) Op(op MetricOp, prefix string) *OpMetrics {
+	for idx := range dm.Ops {
+		if dm.Ops[idx].Op == op && dm.Ops[idx].Prefix == prefix {
+			return &dm.Ops[idx]
+		}
+	}
+
+	return nil
+}
+
+type metricKey struct {
+	op     MetricOp
+	prefix string
+}
+
+// InstrumentedDatabase wraps a database and records counts, transferred bytes
+// and latencies of all operations, grouped by the top level key part.
+// Use Metrics() to read them, e.g. to expose them from the daemon.
+type InstrumentedDatabase struct {
+	db Database
+
+	mu    sync.Mutex
+	since time.Time
+	ops   map[metricKey]*OpMetrics
+}
+
+// NewInstrumentedDatabase wraps `db`.
+func NewInstrumentedDatabase(db Database) *InstrumentedDatabase {
+	return &InstrumentedDatabase{
+		db:    db,
+		since: time.Now(),
+		ops:   make(map[metricKey]*OpMetrics),
+	}
+}
+
+func (idb *InstrumentedDatabase) record(op MetricOp, key []string, took time.Duration, bytes int, err error) {
+	idb.mu.Lock()
+	defer idb.mu.Unlock()
+
+	mkey := metricKey{op: op, prefix: metricPrefix(key)}
+	metrics, ok := idb.ops[mkey]
+	if !ok {
+		metrics = &OpMetrics{
+			Op:      mkey.op,
+			Prefix:  mkey.prefix,
+			Latency: newLatencyHistogram(),
+		}
+
+		idb.ops[mkey] = metrics
+	}
+
+	metrics.Count++
+	metrics.Bytes += uint64(bytes)
+	metrics.Latency.add(took)
+	if err != nil && err != ErrNoSuchKey {
+		metrics.Errors++
+	}
+}
+
+// Metrics returns a snapshot of the current metrics.
+func (idb *InstrumentedDatabase) Metrics() *DatabaseMetrics {
+	idb.mu.Lock()
+
+	dm := &DatabaseMetrics{
+		Since: idb.since,
+		Ops:   make([]OpMetrics, 0, len(idb.ops)),
+	}
+
+	for _, metrics := range idb.ops {
+		copied := *metrics
+		copied.Latency.Counts = append([]uint64(nil), metrics.Latency.Counts...)
+		dm.Ops = append(dm.Ops, copied)
+	}
+
+	idb.mu.Unlock()
+
+	sort.Slice(dm.Ops, func(i, j int) bool {
+		if dm.Ops[i].Op != dm.Ops[j].Op {
+			return dm.Ops[i].Op < dm.Ops[j].Op
+		}
+
+		return dm.Ops[i].Prefix < dm.Ops[j].Prefix
+	})
+
+	if bdb, ok := idb.db.(*BadgerDatabase); ok {
+		stats := bdb.Stats()
+		dm.Badger = &stats
+	}
+
+	return dm
+}
+
+// ResetMetrics starts all metrics from zero.
+func (idb *InstrumentedDatabase) ResetMetrics() {
+	idb.mu.Lock()
+	defer idb.mu.Unlock()
+
+	idb.since = time.Now()
+	idb.ops = make(map[metricKey]*OpMetrics)
+}
+
+// Get is the instrumented implementation of Database.Get
+func (idb *InstrumentedDatabase) Get(key ...string) ([]byte, error) {
+	start := time.Now()
+	data, err := idb.db.Get(key...)
+	idb.record(MetricGet, key, time.Since(start), len(data), err)
+	return data, err
+}
+
+// Keys is the instrumented implementation of Database.Keys
+func (idb *InstrumentedDatabase) Keys(prefix ...string) ([][]string, error) {
+	start := time.Now()
+	keys, err := idb.db.Keys(prefix...)
+	idb.record(MetricKeys, prefix, time.Since(start), 0, err)
+	return keys, err
+}
+
+// Glob is the instrumented implementation of Database.Glob
+func (idb *InstrumentedDatabase) Glob(prefix []string) ([][]string, error) {
+	start := time.Now()
+	keys, err := idb.db.Glob(prefix)
+	idb.record(MetricGlob, prefix, time.Since(start), 0, err)
+	return keys, err
+}
+
+// Iterator is the instrumented implementation of Database.Iterator.
+// An iteration is recorded as one operation when the iterator is closed;
+// its latency is the time spent inside the iterator, not in the caller.
+func (idb *InstrumentedDatabase) Iterator(opts IterOptions) Iterator {
+	start := time.Now()
+	iter := idb.db.Iterator(opts)
+
+	return &instrumentedIterator{
+		Iterator: iter,
+		idb:      idb,
+		prefix:   opts.Prefix,
+		took:     time.Since(start),
+	}
+}
+
+type instrumentedIterator struct {
+	Iterator
+
+	idb    *InstrumentedDatabase
+	prefix []string
+	took   time.Duration
+	bytes  int
+	closed bool
+}
+
+func (ii *instrumentedIterator) Next() bool {
+	start := time.Now()
+	ok := ii.Iterator.Next()
+	ii.took += time.Since(start)
+
+	if ok {
+		ii.bytes += len(ii.Iterator.Value())
+	}
+
+	return ok
+}
+
+func (ii *instrumentedIterator) Close() error {
+	start := time.Now()
+	err := ii.Iterator.Close()
+	if !ii.closed {
+		ii.closed = true
+		ii.took += time.Since(start)
+		ii.idb.record(MetricIterate, ii.prefix, ii.took, ii.bytes, err)
+	}
+
+	return err
+}
+
+// Export is the instrumented implementation of Database.Export
+func (idb *InstrumentedDatabase) Export(w io.Writer) error {
+	start := time.Now()
+	err := idb.db.Export(w)
+	idb.record(MetricExport, nil, time.Since(start), 0, err)
+	return err
+}
+
+// Import is the instrumented implementation of Database.Import
+func (idb *InstrumentedDatabase) Import(r io.Reader) error {
+	start := time.Now()
+	err := idb.db.Import(r)
+	idb.record(MetricImport, nil, time.Since(start), 0, err)
+	return err
+}
+
+// Close closes the wrapped database.
+func (idb *InstrumentedDatabase) Close() error {
+	return idb.db.Close()
+}
+
+// Batch is the instrumented implementation of Database.Batch
+func (idb *InstrumentedDatabase) Batch() Batch {
+	return &instrumentedBatch{
+		batch: idb.db.Batch(),
+		idb:   idb,
+	}
+}
+
+type instrumentedBatch struct {
+	batch Batch
+	idb   *InstrumentedDatabase
+}
+
+func (ib *instrumentedBatch) Put(val []byte, key ...string) {
+	start := time.Now()
+	ib.batch.Put(val, key...)
+	ib.idb.record(MetricPut, key, time.Since(start), len(val), nil)
+}
+
+func (ib *instrumentedBatch) Erase(key ...string) {
+	start := time.Now()
+	ib.batch.Erase(key...)
+	ib.idb.record(MetricErase, key, time.Since(start), 0, nil)
+}
+
+func (ib *instrumentedBatch) Clear(key ...string) error {
+	start := time.Now()
+	err := ib.batch.Clear(key...)
+	ib.idb.record(MetricClear, key, time.Since(start), 0, err)
+	return err
+}
+
+func (ib *instrumentedBatch) Flush() error {
+	start := time.Now()
+	err := ib.batch.Flush()
+	ib.idb.record(MetricFlush, nil, time.Since(start), 0, err)
+	return err
+}
+
+func (ib *instrumentedBatch) Rollback() {
+	start := time.Now()
+	ib.batch.Rollback()
+	ib.idb.record(MetricRollback, nil, time.Since(start), 0, nil)
+}
+
+func (ib *instrumentedBatch) Savepoint() int {
+	return ib.batch.Savepoint()
+}
+
+func (ib *instrumentedBatch) RollbackTo(savepoint int) error {
+	start := time.Now()
+	err := ib.batch.RollbackTo(savepoint)
+	ib.idb.record(MetricRollbackTo, nil, time.Since(start), 0, err)
+	return err
+}
+
+func (ib *instrumentedBatch) HaveWrites() bool {
+	return ib.batch.HaveWrites()
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentedDatabaseMetrics(t *testing.T) {
+	idb := NewInstrumentedDatabase(NewMemoryDatabase())
+
+	batch := idb.Batch()
+	batch.Put([]byte("12345"), "objects", "a")
+	batch.Put([]byte("123"), "objects", "b")
+	batch.Put([]byte("x"), "stage", "STATUS")
+	batch.Put([]byte("y"), "something", "else")
+	require.Nil(t, batch.Flush())
+
+	_, err := idb.Get("objects", "a")
+	require.Nil(t, err)
+
+	// Missing keys are not errors:
+	_, err = idb.Get("objects", "c")
+	require.Equal(t, ErrNoSuchKey, err)
+
+	iter := idb.Iterator(IterOptions{Prefix: []string{"objects"}})
+	for iter.Next() {
+	}
+	require.Nil(t, iter.Close())
+	require.Nil(t, iter.Close())
+
+	metrics := idb.Metrics()
+	require.Nil(t, metrics.Badger)
+
+	put := metrics.Op(MetricPut, "objects")
+	require.NotNil(t, put)
+	require.Equal(t, uint64(2), put.Count)
+	require.Equal(t, uint64(8), put.Bytes)
+	require.Equal(t, uint64(2), put.Latency.Total())
+
+	require.Equal(t, uint64(1), metrics.Op(MetricPut, "stage").Count)
+	require.Equal(t, uint64(1), metrics.Op(MetricPut, "other").Count)
+	require.Equal(t, uint64(1), metrics.Op(MetricFlush, "").Count)
+
+	get := metrics.Op(MetricGet, "objects")
+	require.Equal(t, uint64(2), get.Count)
+	require.Equal(t, uint64(0), get.Errors)
+	require.Equal(t, uint64(5), get.Bytes)
+
+	iterate := metrics.Op(MetricIterate, "objects")
+	require.Equal(t, uint64(1), iterate.Count)
+	require.Equal(t, uint64(8), iterate.Bytes)
+
+	idb.ResetMetrics()
+	require.Empty(t, idb.Metrics().Ops)
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	lh := newLatencyHistogram()
+	for idx := 0; idx < 99; idx++ {
+		lh.add(3 * time.Microsecond)
+	}
+
+	lh.add(2 * time.Second)
+
+	require.Equal(t, uint64(100), lh.Total())
+	require.Equal(t, 4*time.Microsecond, lh.Quantile(0.5))
+	require.Equal(t, 4*time.Microsecond, lh.Quantile(0.99))
+	require.Equal(t, 2*time.Second, lh.Quantile(1))
+	require.Equal(t, 2*time.Second, lh.Max)
+}
+
+func TestInstrumentedDatabaseBadgerStats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "floo-db-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	bdb, err := NewBadgerDatabase(dir)
+	require.Nil(t, err)
+
+	idb := NewInstrumentedDatabase(bdb)
+	mustPut(t, idb, "1", "objects", "a")
+
+	_, err = bdb.RunGC()
+	require.Nil(t, err)
+
+	metrics := idb.Metrics()
+	require.NotNil(t, metrics.Badger)
+	require.Equal(t, uint64(1), metrics.Badger.GCRuns)
+	require.False(t, metrics.Badger.LastGC.IsZero())
+	require.Nil(t, idb.Close())
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"bufio"
 	"encoding/gob"
 	"io"
 	"path"
@@ -14,6 +15,7 @@ type MemoryDatabase struct {
 	oldData    map[string][]byte
 	haveWrites bool
 	refCount   int
+	undo       undoLog
 }
 
 // a shallow copy is enough here.
@@ -48,9 +50,14 @@ func (mdb *MemoryDatabase) Batch() Batch {
 // Flush is a no-op for a memory database.
 func (mdb *MemoryDatabase) Flush() error {
 	mdb.refCount--
+	if mdb.refCount < 0 {
+		// A nested Rollback() already ended the batch.
+		mdb.refCount = 0
+	}
 
 	if mdb.refCount == 0 {
 		mdb.haveWrites = false
+		mdb.undo.reset()
 	}
 	return nil
 }
@@ -63,11 +70,34 @@ func (mdb *MemoryDatabase) Rollback() {
 	}
 
 	mdb.refCount = 0
+	mdb.undo.reset()
+}
+
+// Savepoint is the memory implementation of Batch.Savepoint
+func (mdb *MemoryDatabase) Savepoint() int {
+	return mdb.undo.savepoint()
+}
+
+// RollbackTo is the memory implementation of Batch.RollbackTo
+func (mdb *MemoryDatabase) RollbackTo(savepoint int) error {
+	return mdb.undo.rollbackTo(savepoint)
+}
+
+// recordUndo remembers the current value of `fullKey` for RollbackTo.
+func (mdb *MemoryDatabase) recordUndo(fullKey string) {
+	oldVal, existed := mdb.data[fullKey]
+	mdb.undo.record(func() {
+		if existed {
+			mdb.data[fullKey] = oldVal
+		} else {
+			delete(mdb.data, fullKey)
+		}
+	})
 }
 
 // Get returns `key` of `bucket`.
 func (mdb *MemoryDatabase) Get(key ...string) ([]byte, error) {
-	data, ok := mdb.data[path.Join(key...)]
+	data, ok := mdb.data[joinKey(key)]
 	if !ok {
 		return nil, ErrNoSuchKey
 	}
@@ -77,16 +107,19 @@ func (mdb *MemoryDatabase) Get(key ...string) ([]byte, error) {
 
 // Put sets `key` in `bucket` to `data`.
 func (mdb *MemoryDatabase) Put(data []byte, key ...string) {
+	fullKey := joinKey(key)
 	mdb.haveWrites = true
-	mdb.data[path.Join(key...)] = data
+	mdb.recordUndo(fullKey)
+	mdb.data[fullKey] = data
 }
 
 // Clear removes all keys includin and below `key`.
 func (mdb *MemoryDatabase) Clear(key ...string) error {
 	mdb.haveWrites = true
-	joinedKey := path.Join(key...)
+	joinedKey := joinKey(key)
 	for mapKey := range mdb.data {
 		if strings.HasPrefix(mapKey, joinedKey) {
+			mdb.recordUndo(mapKey)
 			delete(mdb.data, mapKey)
 		}
 	}
@@ -96,13 +129,16 @@ func (mdb *MemoryDatabase) Clear(key ...string) error {
 
 // Erase removes `key`
 func (mdb *MemoryDatabase) Erase(key ...string) {
-	fullKey := path.Join(key...)
+	fullKey := joinKey(key)
 	mdb.haveWrites = true
+	mdb.recordUndo(fullKey)
 	delete(mdb.data, fullKey)
 }
 
 // Keys will return all keys currently stored in the memory map
 func (mdb *MemoryDatabase) Keys(prefix ...string) ([][]string, error) {
+	prefix = normalizeKey(prefix)
+
 	keys := [][]string{}
 	for key := range mdb.data {
 		splitKey := strings.Split(key, "/")
@@ -129,6 +165,15 @@ func (mdb *MemoryDatabase) Keys(prefix ...string) ([][]string, error) {
 	return keys, nil
 }
 
+// Iterator is the memory implementation of Database.Iterator.
+// Since all values are in memory anyways, a sorted copy of the keys is used.
+func (mdb *MemoryDatabase) Iterator(opts IterOptions) Iterator {
+	keys, _ := mdb.Keys(opts.Prefix...)
+	return newSliceIterator(opts, keys, func(key []string) ([]byte, error) {
+		return mdb.data[joinKey(key)], nil
+	})
+}
+
 // HaveWrites returns true if there are any open writes.
 func (mdb *MemoryDatabase) HaveWrites() bool {
 	return mdb.haveWrites
@@ -136,7 +181,7 @@ func (mdb *MemoryDatabase) HaveWrites() bool {
 
 // Glob returns all keys starting with `prefix`.
 func (mdb *MemoryDatabase) Glob(prefix []string) ([][]string, error) {
-	prefixKey := path.Join(prefix...)
+	prefixKey := joinKey(prefix)
 
 	var result [][]string
 
@@ -146,7 +191,7 @@ func (mdb *MemoryDatabase) Glob(prefix []string) ([][]string, error) {
 	}
 
 	for _, key := range keys {
-		fullKey := path.Join(key...)
+		fullKey := joinKey(key)
 		if strings.HasPrefix(fullKey, prefixKey) {
 			// Filter "directories":
 			suffix := fullKey[len(prefixKey):]
@@ -163,15 +208,37 @@ func (mdb *MemoryDatabase) Glob(prefix []string) ([][]string, error) {
 	return result, nil
 }
 
-// Export encodes the internal memory map to a gob structure,
-// and writes it to `w`.
+// Export is the memory implementation of Database.Export.
 func (mdb *MemoryDatabase) Export(w io.Writer) error {
-	return gob.NewEncoder(w).Encode(mdb.data)
+	return exportDump(mdb, w)
 }
 
-// Import imports a previously exported dump and decodes the gob structure.
+// Import is the memory implementation of Database.Import.
+// Older versions exported the gob encoded map of the database;
+// those are still accepted (see importLegacyGob).
 func (mdb *MemoryDatabase) Import(r io.Reader) error {
-	return gob.NewDecoder(r).Decode(&mdb.data)
+	br := bufio.NewReader(r)
+	if isLegacyDump(br) {
+		return mdb.importLegacyGob(br)
+	}
+
+	return importDump(mdb, br)
+}
+
+// importLegacyGob reads a gob encoded map of "/" joined keys to values.
+func (mdb *MemoryDatabase) importLegacyGob(r io.Reader) error {
+	data := make(map[string][]byte)
+	if err := gob.NewDecoder(r).Decode(&data); err != nil {
+		// Neither a dump nor a legacy export.
+		return ErrBadDump
+	}
+
+	batch := mdb.Batch()
+	for key, val := range data {
+		batch.Put(val, strings.Split(key, "/")...)
+	}
+
+	return batch.Flush()
 }
 
 // Close the memory - a no op.
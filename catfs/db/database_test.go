@@ -0,0 +1,610 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"floo/util"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withEachBackend runs `fn` once for every backend.
+// `open` can be used to create as many databases of the backend as needed.
+// All of them are closed and removed after `fn` returned.
+func withEachBackend(t *testing.T, fn func(t *testing.T, open func() Database)) {
+	// The wrappers must behave like every other backend:
+	variants := append([]string{}, Backends...)
+	variants = append(variants, "encrypted-values", "encrypted-keys", "instrumented")
+
+	for _, backend := range variants {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			opened := []Database{}
+			open := func() Database {
+				dir, err := os.MkdirTemp("", "floo-db-test")
+				require.Nil(t, err)
+				t.Cleanup(func() { os.RemoveAll(dir) })
+
+				db, err := openTestDatabase(backend, dir)
+				require.Nil(t, err)
+
+				opened = append(opened, db)
+				return db
+			}
+
+			fn(t, open)
+
+			for _, db := range opened {
+				require.Nil(t, db.Close())
+			}
+		})
+	}
+}
+
+func openTestDatabase(backend, dir string) (Database, error) {
+	switch backend {
+	case "encrypted-values":
+		inner, err := NewDatabase("disk", dir)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewEncryptedDatabase(inner, []byte("secret"), testEncryptedOptions(false))
+	case "encrypted-keys":
+		inner, err := NewDatabase("bolt", dir)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewEncryptedDatabase(inner, []byte("secret"), testEncryptedOptions(true))
+	case "instrumented":
+		inner, err := NewDatabase("badger", dir)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewInstrumentedDatabase(inner), nil
+	default:
+		return NewDatabase(backend, dir)
+	}
+}
+
+func testEncryptedOptions(encryptKeys bool) EncryptedOptions {
+	// Keep the key derivation cheap in tests.
+	return EncryptedOptions{
+		EncryptKeys: encryptKeys,
+		KDFMemory:   64,
+	}
+}
+
+// withEachDatabase is like withEachBackend, but only needs one database.
+// All backends are expected to behave the same in those tests.
+func withEachDatabase(t *testing.T, fn func(t *testing.T, db Database)) {
+	withEachBackend(t, func(t *testing.T, open func() Database) {
+		fn(t, open())
+	})
+}
+
+func mustPut(t *testing.T, db Database, val string, key ...string) {
+	batch := db.Batch()
+	batch.Put([]byte(val), key...)
+	require.Nil(t, batch.Flush())
+}
+
+func TestDatabasePutGet(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		_, err := db.Get("a", "b")
+		require.Equal(t, ErrNoSuchKey, err)
+
+		mustPut(t, db, "1", "a", "b")
+		data, err := db.Get("a", "b")
+		require.Nil(t, err)
+		require.Equal(t, []byte("1"), data)
+
+		// Overwrite an existing key:
+		mustPut(t, db, "2", "a", "b")
+		data, err = db.Get("a", "b")
+		require.Nil(t, err)
+		require.Equal(t, []byte("2"), data)
+
+		batch := db.Batch()
+		batch.Erase("a", "b")
+		require.Nil(t, batch.Flush())
+
+		_, err = db.Get("a", "b")
+		require.Equal(t, ErrNoSuchKey, err)
+	})
+}
+
+func TestDatabaseBatchVisibility(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		batch := db.Batch()
+		require.False(t, batch.HaveWrites())
+
+		batch.Put([]byte("x"), "a", "b")
+		require.True(t, batch.HaveWrites())
+
+		// Values should be visible in the batch already:
+		data, err := db.Get("a", "b")
+		require.Nil(t, err)
+		require.Equal(t, []byte("x"), data)
+		require.Nil(t, batch.Flush())
+		require.False(t, batch.HaveWrites())
+	})
+}
+
+func TestDatabaseRollback(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		mustPut(t, db, "old", "a", "b")
+
+		batch := db.Batch()
+		batch.Put([]byte("new"), "a", "b")
+		batch.Put([]byte("new"), "a", "c")
+		batch.Rollback()
+
+		data, err := db.Get("a", "b")
+		require.Nil(t, err)
+		require.Equal(t, []byte("old"), data)
+
+		_, err = db.Get("a", "c")
+		require.Equal(t, ErrNoSuchKey, err)
+	})
+}
+
+func TestDatabaseNestedBatch(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		outer := db.Batch()
+		outer.Put([]byte("1"), "outer")
+
+		inner := db.Batch()
+		inner.Put([]byte("2"), "inner")
+		require.Nil(t, inner.Flush())
+
+		// The outer batch is still open, so a rollback
+		// should also undo the flushed inner batch.
+		outer.Rollback()
+
+		_, err := db.Get("outer")
+		require.Equal(t, ErrNoSuchKey, err)
+
+		_, err = db.Get("inner")
+		require.Equal(t, ErrNoSuchKey, err)
+	})
+}
+
+func TestDatabaseNestedRollback(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		mustPut(t, db, "old", "a")
+
+		outer := db.Batch()
+		outer.Put([]byte("1"), "outer")
+		outer.Put([]byte("new"), "a")
+
+		inner := db.Batch()
+		inner.Put([]byte("2"), "inner")
+
+		// A nested rollback ends the outer batch too:
+		inner.Rollback()
+		require.Nil(t, outer.Flush())
+
+		requireValue(t, db, "old", "a")
+		for _, key := range []string{"outer", "inner"} {
+			_, err := db.Get(key)
+			require.Equal(t, ErrNoSuchKey, err)
+		}
+
+		// The next batch must work as usual:
+		mustPut(t, db, "new", "a")
+		requireValue(t, db, "new", "a")
+	})
+}
+
+// Writes must never get lost silently: if a batch cannot be written
+// (here because the database was closed), Flush has to say so.
+func TestDatabaseBatchAfterClose(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		require.Nil(t, db.Close())
+
+		batch := db.Batch()
+		batch.Put([]byte("1"), "a")
+		if err := batch.Flush(); err != nil {
+			return
+		}
+
+		requireValue(t, db, "1", "a")
+	})
+}
+
+func requireValue(t *testing.T, db Database, val string, key ...string) {
+	data, err := db.Get(key...)
+	if val == "" {
+		require.Equal(t, ErrNoSuchKey, err, "key %v", key)
+		return
+	}
+
+	require.Nil(t, err, "key %v", key)
+	require.Equal(t, []byte(val), data, "key %v", key)
+}
+
+func TestDatabaseSavepoint(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		mustPut(t, db, "old", "dir", "x")
+
+		batch := db.Batch()
+		batch.Put([]byte("1"), "a")
+		first := batch.Savepoint()
+
+		batch.Put([]byte("2"), "b")
+		batch.Erase("a")
+		second := batch.Savepoint()
+
+		batch.Put([]byte("3"), "c")
+		require.Nil(t, batch.Clear("dir"))
+
+		require.Nil(t, batch.RollbackTo(second))
+		requireValue(t, db, "", "a")
+		requireValue(t, db, "2", "b")
+		requireValue(t, db, "", "c")
+		requireValue(t, db, "old", "dir", "x")
+
+		require.Nil(t, batch.RollbackTo(first))
+		requireValue(t, db, "1", "a")
+		requireValue(t, db, "", "b")
+
+		// Rolling back to `first` dropped `second`:
+		require.Equal(t, ErrNoSuchSavepoint, batch.RollbackTo(second))
+
+		batch.Put([]byte("4"), "d")
+		require.Nil(t, batch.Flush())
+
+		requireValue(t, db, "1", "a")
+		requireValue(t, db, "", "b")
+		requireValue(t, db, "4", "d")
+
+		// Savepoints do not survive the batch:
+		batch = db.Batch()
+		require.Equal(t, ErrNoSuchSavepoint, batch.RollbackTo(first))
+		require.Nil(t, batch.Flush())
+	})
+}
+
+func TestDatabaseSavepointOverwrite(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		batch := db.Batch()
+		batch.Put([]byte("1"), "a")
+		savepoint := batch.Savepoint()
+
+		// Several writes to the same key restore the state at the savepoint:
+		batch.Put([]byte("2"), "a")
+		batch.Erase("a")
+		batch.Put([]byte("3"), "a")
+		require.Nil(t, batch.RollbackTo(savepoint))
+		requireValue(t, db, "1", "a")
+
+		// The savepoint can be used again:
+		batch.Put([]byte("4"), "a")
+		require.Nil(t, batch.RollbackTo(savepoint))
+		requireValue(t, db, "1", "a")
+		require.Nil(t, batch.Flush())
+
+		requireValue(t, db, "1", "a")
+	})
+}
+
+func TestDatabaseSavepointNested(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		outer := db.Batch()
+		outer.Put([]byte("1"), "outer")
+
+		// An inner operation fails and undoes only its own changes:
+		inner := db.Batch()
+		savepoint := inner.Savepoint()
+		inner.Put([]byte("2"), "inner")
+		require.Nil(t, inner.RollbackTo(savepoint))
+		require.Nil(t, inner.Flush())
+
+		outer.Put([]byte("3"), "after")
+		require.Nil(t, outer.Flush())
+
+		requireValue(t, db, "1", "outer")
+		requireValue(t, db, "", "inner")
+		requireValue(t, db, "3", "after")
+	})
+}
+
+func TestDatabaseKeys(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		mustPut(t, db, "1", "objects", "a")
+		mustPut(t, db, "2", "objects", "b")
+		mustPut(t, db, "3", "stage", "objects", "c")
+		mustPut(t, db, "4", "stats", "max-inode")
+
+		keys, err := db.Keys("objects")
+		require.Nil(t, err)
+		require.Equal(t, [][]string{{"objects", "a"}, {"objects", "b"}}, keys)
+
+		keys, err = db.Keys("stage")
+		require.Nil(t, err)
+		require.Equal(t, [][]string{{"stage", "objects", "c"}}, keys)
+
+		keys, err = db.Keys()
+		require.Nil(t, err)
+		require.Len(t, keys, 4)
+
+		keys, err = db.Keys("nope")
+		require.Nil(t, err)
+		require.Len(t, keys, 0)
+	})
+}
+
+func TestDatabaseGlob(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		mustPut(t, db, "1", "objects", "abc")
+		mustPut(t, db, "2", "objects", "abd")
+		mustPut(t, db, "3", "objects", "xyz")
+		mustPut(t, db, "4", "objects", "ab", "nested")
+
+		keys, err := db.Glob([]string{"objects", "ab"})
+		require.Nil(t, err)
+		require.Equal(t, [][]string{{"objects", "abc"}, {"objects", "abd"}}, keys)
+	})
+}
+
+func TestDatabaseClear(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		mustPut(t, db, "1", "stage", "objects", "a")
+		mustPut(t, db, "2", "stage", "tree", "b")
+		mustPut(t, db, "3", "objects", "c")
+
+		batch := db.Batch()
+		require.Nil(t, batch.Clear("stage"))
+		require.Nil(t, batch.Flush())
+
+		keys, err := db.Keys()
+		require.Nil(t, err)
+		require.Equal(t, [][]string{{"objects", "c"}}, keys)
+	})
+}
+
+func TestDatabaseExportImport(t *testing.T) {
+	withEachBackend(t, func(t *testing.T, open func() Database) {
+		src, dst := open(), open()
+		mustPut(t, src, "1", "objects", "a")
+		mustPut(t, src, "2", "stage", "tree", "b")
+		mustPut(t, dst, "3", "objects", "c")
+
+		buf := &bytes.Buffer{}
+		require.Nil(t, src.Export(buf))
+		require.Nil(t, dst.Import(buf))
+
+		// Imported keys are merged with the existing ones.
+		keys, err := dst.Keys()
+		require.Nil(t, err)
+		require.Equal(t, [][]string{
+			{"objects", "a"},
+			{"objects", "c"},
+			{"stage", "tree", "b"},
+		}, keys)
+
+		data, err := dst.Get("stage", "tree", "b")
+		require.Nil(t, err)
+		require.Equal(t, []byte("2"), data)
+	})
+}
+
+func TestDatabaseMigrate(t *testing.T) {
+	// Keys like the ones the linker uses; dots and slashes in key parts
+	// must survive the way through every backend.
+	keys := [][]string{
+		{"objects", "QmA"},
+		{"stage", "tree", "/", "."},
+		{"stage", "tree", "/sub.dir", "."},
+		{"stage", "tree", "/sub.dir/a.txt"},
+		{"ignore", "/sub.dir/."},
+	}
+
+	for _, srcBackend := range Backends {
+		for _, dstBackend := range Backends {
+			srcBackend, dstBackend := srcBackend, dstBackend
+			t.Run(srcBackend+"-to-"+dstBackend, func(t *testing.T) {
+				srcDir, err := os.MkdirTemp("", "floo-db-test")
+				require.Nil(t, err)
+				defer os.RemoveAll(srcDir)
+
+				dstDir, err := os.MkdirTemp("", "floo-db-test")
+				require.Nil(t, err)
+				defer os.RemoveAll(dstDir)
+
+				src, err := NewDatabase(srcBackend, srcDir)
+				require.Nil(t, err)
+				defer src.Close()
+
+				dst, err := NewDatabase(dstBackend, dstDir)
+				require.Nil(t, err)
+				defer dst.Close()
+
+				for idx, key := range keys {
+					mustPut(t, src, fmt.Sprintf("%d", idx), key...)
+				}
+
+				require.Nil(t, Migrate(dst, src))
+
+				for idx, key := range keys {
+					data, err := dst.Get(key...)
+					require.Nil(t, err, "key: %v", key)
+					require.Equal(t, fmt.Sprintf("%d", idx), string(data))
+				}
+			})
+		}
+	}
+}
+
+func TestDumpCorrupted(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dw, err := NewDumpWriter(buf)
+	require.Nil(t, err)
+	require.Nil(t, dw.Write([]string{"objects", "a"}, []byte("hello")))
+	require.Nil(t, dw.Write([]string{"objects", "b"}, []byte("world")))
+	require.Nil(t, dw.Close())
+
+	dump := buf.Bytes()
+
+	// Flip a bit in the value of the first record:
+	corrupted := append([]byte{}, dump...)
+	corrupted[bytes.Index(corrupted, []byte("hello"))] ^= 0x1
+
+	// Cut off the trailer:
+	truncated := dump[:len(dump)-5]
+
+	for _, data := range [][]byte{corrupted, truncated, []byte("garbage")} {
+		db := NewMemoryDatabase()
+		require.Equal(t, ErrBadDump, db.Import(bytes.NewReader(data)))
+
+		// Nothing may have been written:
+		keys, err := db.Keys()
+		require.Nil(t, err)
+		require.Empty(t, keys)
+	}
+
+	db := NewMemoryDatabase()
+	require.Nil(t, db.Import(bytes.NewReader(dump)))
+
+	data, err := db.Get("objects", "b")
+	require.Nil(t, err)
+	require.Equal(t, []byte("world"), data)
+}
+
+func TestDiskImportLegacyTar(t *testing.T) {
+	dir, err := os.MkdirTemp("", "floo-db-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	legacyDb, err := NewDiskDatabase(dir)
+	require.Nil(t, err)
+	mustPut(t, legacyDb, "1", "objects", "a")
+	mustPut(t, legacyDb, "2", "stage", "tree", "/sub/.")
+
+	// Export() used to write a gzipped tar of the directory:
+	buf := &bytes.Buffer{}
+	require.Nil(t, util.Tar(dir, "floometa.gz", buf))
+
+	dstDir, err := os.MkdirTemp("", "floo-db-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dstDir)
+
+	db, err := NewDiskDatabase(dstDir)
+	require.Nil(t, err)
+	require.Nil(t, db.Import(buf))
+	requireValue(t, db, "1", "objects", "a")
+	requireValue(t, db, "2", "stage", "tree", "/sub/.")
+}
+
+func TestMemoryImportLegacyGob(t *testing.T) {
+	// Export() used to write the gob encoded map of path.Join()ed keys:
+	buf := &bytes.Buffer{}
+	require.Nil(t, gob.NewEncoder(buf).Encode(map[string][]byte{
+		"objects/a":        []byte("1"),
+		"stage/tree/sub/x": []byte("2"),
+	}))
+
+	db := NewMemoryDatabase()
+	require.Nil(t, db.Import(buf))
+	requireValue(t, db, "1", "objects", "a")
+	requireValue(t, db, "2", "stage", "tree", "sub", "x")
+}
+
+func collectKeys(t *testing.T, iter Iterator) [][]string {
+	keys := [][]string{}
+	for iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+
+	require.Nil(t, iter.Close())
+	return keys
+}
+
+func TestDatabaseIterator(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		mustPut(t, db, "1", "a", "b")
+		mustPut(t, db, "2", "a.b")
+		mustPut(t, db, "3", "objects", "x")
+		mustPut(t, db, "4", "objects", "y")
+		mustPut(t, db, "5", "objects", "z")
+		mustPut(t, db, "6", "stage", "tree", "/sub", ".")
+		mustPut(t, db, "7", "stage", "tree", "/sub/a.txt")
+
+		// Keys are sorted part by part:
+		require.Equal(t, [][]string{
+			{"a", "b"},
+			{"a.b"},
+			{"objects", "x"},
+			{"objects", "y"},
+			{"objects", "z"},
+			{"stage", "tree", "sub", "."},
+			{"stage", "tree", "sub", "a.txt"},
+		}, collectKeys(t, db.Iterator(IterOptions{})))
+
+		iter := db.Iterator(IterOptions{Prefix: []string{"objects"}})
+		require.True(t, iter.Next())
+		require.Equal(t, []string{"objects", "x"}, iter.Key())
+		require.Equal(t, []byte("3"), iter.Value())
+		require.Nil(t, iter.Close())
+
+		require.Equal(t, [][]string{
+			{"objects", "y"},
+		}, collectKeys(t, db.Iterator(IterOptions{
+			Prefix: []string{"objects"},
+			Start:  []string{"objects", "xx"},
+			End:    []string{"objects", "z"},
+		})))
+
+		require.Equal(t, [][]string{
+			{"stage", "tree", "sub", "."},
+			{"stage", "tree", "sub", "a.txt"},
+		}, collectKeys(t, db.Iterator(IterOptions{Prefix: []string{"stage", "tree", "/sub"}})))
+
+		iter = db.Iterator(IterOptions{Prefix: []string{"a"}, KeysOnly: true})
+		require.True(t, iter.Next())
+		require.Equal(t, []string{"a", "b"}, iter.Key())
+		require.Nil(t, iter.Value())
+		require.False(t, iter.Next())
+		require.Nil(t, iter.Close())
+
+		require.Empty(t, collectKeys(t, db.Iterator(IterOptions{Prefix: []string{"nope"}})))
+	})
+}
+
+func TestDatabaseIteratorErase(t *testing.T) {
+	withEachDatabase(t, func(t *testing.T, db Database) {
+		// More than one page for the paged iterators:
+		batch := db.Batch()
+		for idx := 0; idx < 2*iterPageSize+1; idx++ {
+			batch.Put([]byte("x"), "objects", fmt.Sprintf("%05d", idx))
+		}
+		require.Nil(t, batch.Flush())
+
+		batch = db.Batch()
+		iter := db.Iterator(IterOptions{Prefix: []string{"objects"}})
+
+		seen := 0
+		for iter.Next() {
+			require.Equal(t, fmt.Sprintf("%05d", seen), iter.Key()[1])
+			if seen%2 == 0 {
+				batch.Erase(iter.Key()...)
+			}
+
+			seen++
+		}
+
+		require.Nil(t, iter.Close())
+		require.Nil(t, batch.Flush())
+		require.Equal(t, 2*iterPageSize+1, seen)
+
+		keys, err := db.Keys("objects")
+		require.Nil(t, err)
+		require.Len(t, keys, iterPageSize)
+	})
+}
@@ -0,0 +1,404 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Dump format
+//
+// All backends use the same format for Export() and Import(),
+// so a dump of one backend can be imported into any other one.
+// A dump is a stream of the following form (all integers big endian,
+// "uvarint" is the varint encoding of encoding/binary):
+//
+//	header:  "FLOODUMP" | version (uint16)
+//	record:  0x01 | number of key parts (uvarint)
+//	              | for each part: length (uvarint) | part
+//	              | length of value (uvarint) | value
+//	              | crc32c of everything after the 0x01 (uint32)
+//	trailer: 0x00 | number of records (uint64) | crc32c of the count (uint32)
+//
+// Key parts are always normalized (see normalizeKey), i.e. the dump does
+// not depend on how a backend joins the key internally. A dump without
+// trailer is considered truncated and is rejected by the reader.
+
+// DumpVersion is the version of the dump format written by DumpWriter.
+const DumpVersion = 1
+
+var dumpMagic = []byte("FLOODUMP")
+
+const (
+	dumpTagEnd    = 0x00
+	dumpTagRecord = 0x01
+
+	// Upper bounds to avoid huge allocations on corrupted dumps.
+	maxDumpKeyParts = 1 << 12
+	maxDumpPartSize = 1 << 16
+	maxDumpValSize  = 1 << 30
+)
+
+var (
+	// ErrBadDump is returned when a dump is corrupted or truncated.
+	ErrBadDump = errors.New("bad or truncated database dump")
+
+	dumpCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// normalizeKey splits all parts of `key` at slashes and drops empty parts.
+// Parts of the key may contain slashes themselves (e.g. tree paths like
+// "/a/b.txt"), which each backend would otherwise store differently.
+func normalizeKey(key []string) []string {
+	parts := []string{}
+	for _, part := range key {
+		for _, elem := range strings.Split(part, "/") {
+			if elem != "" {
+				parts = append(parts, elem)
+			}
+		}
+	}
+
+	return parts
+}
+
+// joinKey converts `key` into a single string. Unlike path.Join()
+// it keeps "." parts, which are used to mark directories.
+func joinKey(key []string) string {
+	return strings.Join(normalizeKey(key), "/")
+}
+
+// DumpWriter writes records in the dump format to an underlying writer.
+type DumpWriter struct {
+	w       *bufio.Writer
+	buf     []byte
+	count   uint64
+	trailer bool
+}
+
+// NewDumpWriter writes the dump header to `w` and returns a DumpWriter.
+// Close() must be called after the last record to write the trailer.
+func NewDumpWriter(w io.Writer) (*DumpWriter, error) {
+	dw := &DumpWriter{w: bufio.NewWriter(w)}
+	if _, err := dw.w.Write(dumpMagic); err != nil {
+		return nil, err
+	}
+
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, DumpVersion)
+	if _, err := dw.w.Write(version); err != nil {
+		return nil, err
+	}
+
+	return dw, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	return append(buf, tmp[:binary.PutUvarint(tmp, v)]...)
+}
+
+// Write adds a single key/value record to the dump.
+func (dw *DumpWriter) Write(key []string, val []byte) error {
+	if dw.trailer {
+		return fmt.Errorf("dump: write after close")
+	}
+
+	parts := normalizeKey(key)
+	if len(parts) == 0 {
+		return fmt.Errorf("dump: empty key")
+	}
+
+	buf := dw.buf[:0]
+	buf = appendUvarint(buf, uint64(len(parts)))
+	for _, part := range parts {
+		buf = appendUvarint(buf, uint64(len(part)))
+		buf = append(buf, part...)
+	}
+
+	buf = appendUvarint(buf, uint64(len(val)))
+	buf = append(buf, val...)
+
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(buf, dumpCRCTable))
+
+	// Remember the buffer for the next record.
+	dw.buf = buf
+
+	if err := dw.w.WriteByte(dumpTagRecord); err != nil {
+		return err
+	}
+
+	if _, err := dw.w.Write(buf); err != nil {
+		return err
+	}
+
+	if _, err := dw.w.Write(sum); err != nil {
+		return err
+	}
+
+	dw.count++
+	return nil
+}
+
+// Close writes the trailer and flushes all buffered data.
+// It does not close the underlying writer.
+func (dw *DumpWriter) Close() error {
+	if dw.trailer {
+		return nil
+	}
+
+	dw.trailer = true
+
+	trailer := make([]byte, 1+8+4)
+	trailer[0] = dumpTagEnd
+	binary.BigEndian.PutUint64(trailer[1:], dw.count)
+	binary.BigEndian.PutUint32(trailer[9:], crc32.Checksum(trailer[1:9], dumpCRCTable))
+
+	if _, err := dw.w.Write(trailer); err != nil {
+		return err
+	}
+
+	return dw.w.Flush()
+}
+
+// DumpReader reads records written by a DumpWriter.
+type DumpReader struct {
+	r     *bufio.Reader
+	crc   uint32
+	count uint64
+	done  bool
+}
+
+// NewDumpReader reads and checks the dump header from `r`.
+func NewDumpReader(r io.Reader) (*DumpReader, error) {
+	dr := &DumpReader{r: bufio.NewReader(r)}
+
+	header := make([]byte, len(dumpMagic)+2)
+	if _, err := io.ReadFull(dr.r, header); err != nil {
+		return nil, ErrBadDump
+	}
+
+	if string(header[:len(dumpMagic)]) != string(dumpMagic) {
+		return nil, ErrBadDump
+	}
+
+	if version := binary.BigEndian.Uint16(header[len(dumpMagic):]); version != DumpVersion {
+		return nil, fmt.Errorf("dump: unsupported version %d", version)
+	}
+
+	return dr, nil
+}
+
+// ReadByte implements io.ByteReader so binary.ReadUvarint
+// can be used, while all read bytes go into the checksum.
+func (dr *DumpReader) ReadByte() (byte, error) {
+	b, err := dr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	dr.crc = crc32.Update(dr.crc, dumpCRCTable, []byte{b})
+	return b, nil
+}
+
+func (dr *DumpReader) readUvarint(max uint64) (uint64, error) {
+	v, err := binary.ReadUvarint(dr)
+	if err != nil || v > max {
+		return 0, ErrBadDump
+	}
+
+	return v, nil
+}
+
+func (dr *DumpReader) readBytes(size uint64) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(dr.r, data); err != nil {
+		return nil, ErrBadDump
+	}
+
+	dr.crc = crc32.Update(dr.crc, dumpCRCTable, data)
+	return data, nil
+}
+
+func (dr *DumpReader) readTrailer() error {
+	trailer := make([]byte, 8+4)
+	if _, err := io.ReadFull(dr.r, trailer); err != nil {
+		return ErrBadDump
+	}
+
+	if crc32.Checksum(trailer[:8], dumpCRCTable) != binary.BigEndian.Uint32(trailer[8:]) {
+		return ErrBadDump
+	}
+
+	if binary.BigEndian.Uint64(trailer[:8]) != dr.count {
+		return ErrBadDump
+	}
+
+	return nil
+}
+
+// Next returns the next record of the dump.
+// It returns io.EOF after the last record, if the dump was complete.
+func (dr *DumpReader) Next() ([]string, []byte, error) {
+	if dr.done {
+		return nil, nil, io.EOF
+	}
+
+	tag, err := dr.r.ReadByte()
+	if err != nil {
+		return nil, nil, ErrBadDump
+	}
+
+	switch tag {
+	case dumpTagEnd:
+		if err := dr.readTrailer(); err != nil {
+			return nil, nil, err
+		}
+
+		dr.done = true
+		return nil, nil, io.EOF
+	case dumpTagRecord:
+	default:
+		return nil, nil, ErrBadDump
+	}
+
+	dr.crc = 0
+
+	nParts, err := dr.readUvarint(maxDumpKeyParts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := make([]string, 0, nParts)
+	for idx := uint64(0); idx < nParts; idx++ {
+		size, err := dr.readUvarint(maxDumpPartSize)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		part, err := dr.readBytes(size)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key = append(key, string(part))
+	}
+
+	size, err := dr.readUvarint(maxDumpValSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	val, err := dr.readBytes(size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(dr.r, sum); err != nil {
+		return nil, nil, ErrBadDump
+	}
+
+	if binary.BigEndian.Uint32(sum) != dr.crc {
+		return nil, nil, ErrBadDump
+	}
+
+	dr.count++
+	return key, val, nil
+}
+
+// exportDump writes all keys of `db` to `w` in the dump format.
+// It is used by backends that have no cheaper way to iterate.
+func exportDump(db Database, w io.Writer) error {
+	keys, err := db.Keys()
+	if err != nil {
+		return err
+	}
+
+	dw, err := NewDumpWriter(w)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		val, err := db.Get(key...)
+		if err != nil {
+			return err
+		}
+
+		if err := dw.Write(key, val); err != nil {
+			return err
+		}
+	}
+
+	return dw.Close()
+}
+
+// isLegacyDump tells if `r` does not start with the dump magic,
+// i.e. if it was written by the Export() of an older version.
+// An empty stream is not considered legacy.
+func isLegacyDump(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(dumpMagic))
+	if err == io.EOF && len(magic) == 0 {
+		return false
+	}
+
+	return !bytes.Equal(magic, dumpMagic)
+}
+
+// importDump reads a dump from `r` and puts all keys into `db`
+// in a single batch. Nothing is written if the dump is corrupted.
+func importDump(db Database, r io.Reader) error {
+	dr, err := NewDumpReader(r)
+	if err != nil {
+		return err
+	}
+
+	batch := db.Batch()
+	for {
+		key, val, err := dr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			batch.Rollback()
+			return err
+		}
+
+		batch.Put(val, key...)
+	}
+
+	return batch.Flush()
+}
+
+// Migrate copies all keys of `src` to `dst`, by piping an export
+// of `src` into an import of `dst`. Existing keys in `dst` are
+// overwritten, other keys are kept.
+func Migrate(dst, src Database) error {
+	pr, pw := io.Pipe()
+	exportErrCh := make(chan error, 1)
+	go func() {
+		err := src.Export(pw)
+		pw.CloseWithError(err)
+		exportErrCh <- err
+	}()
+
+	importErr := dst.Import(pr)
+
+	// Make sure the exporter does not block forever on failure.
+	pr.CloseWithError(importErr)
+
+	// The export error is more telling than a truncated dump.
+	if exportErr := <-exportErrCh; exportErr != nil && exportErr != io.ErrClosedPipe {
+		return exportErr
+	}
+
+	return importErr
+}
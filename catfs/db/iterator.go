@@ -0,0 +1,294 @@
+package db
+
+import (
+	"sort"
+	"strings"
+)
+
+// IterOptions configures which keys an Iterator visits.
+// The zero value visits all keys of the database.
+type IterOptions struct {
+	// Prefix limits the iteration to keys at or below this key.
+	Prefix []string
+
+	// Start is the first key that may be visited (inclusive).
+	Start []string
+
+	// End is the first key that is not visited anymore (exclusive).
+	End []string
+
+	// KeysOnly tells the iterator that Value() is not needed.
+	// Backends may use this to avoid reading values.
+	KeysOnly bool
+}
+
+// Iterator walks over a range of keys without loading all of them into
+// memory. Keys are visited in the order of their parts, i.e. ("a", "b")
+// comes before ("a.b"). A typical loop looks like this:
+//
+//	iter := db.Iterator(IterOptions{Prefix: []string{"objects"}})
+//	for iter.Next() {
+//		fmt.Println(iter.Key(), iter.Value())
+//	}
+//
+//	if err := iter.Close(); err != nil {
+//		// handle error
+//	}
+//
+// Changes made to the database during the iteration may or may not be
+// visible to the iterator, but keys that were already visited are never
+// visited twice. It is safe to erase the current key while iterating.
+type Iterator interface {
+	// Next advances to the next key and returns false when done or on error.
+	Next() bool
+
+	// Key returns the current key. It must not be modified.
+	Key() []string
+
+	// Value returns the value of the current key.
+	// It is nil if IterOptions.KeysOnly was set.
+	Value() []byte
+
+	// Err returns the first error that happened during iteration.
+	Err() error
+
+	// Close releases all resources held by the iterator and returns Err().
+	Close() error
+}
+
+// compareKeys compares `a` and `b` part by part, like strings.Compare.
+// A key is always smaller than the keys below it.
+func compareKeys(a, b []string) int {
+	for idx := 0; idx < len(a) && idx < len(b); idx++ {
+		if cmp := strings.Compare(a[idx], b[idx]); cmp != 0 {
+			return cmp
+		}
+	}
+
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// hasKeyPrefix checks if `key` is `prefix` or below it.
+func hasKeyPrefix(key, prefix []string) bool {
+	if len(key) < len(prefix) {
+		return false
+	}
+
+	for idx := range prefix {
+		if key[idx] != prefix[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalize returns a copy of `opts` with all keys normalized.
+func (opts IterOptions) normalize() IterOptions {
+	opts.Prefix = normalizeKey(opts.Prefix)
+	opts.Start = normalizeKey(opts.Start)
+	if opts.End != nil {
+		opts.End = normalizeKey(opts.End)
+	}
+
+	return opts
+}
+
+// seekKey is the smallest key that may be visited.
+func (opts IterOptions) seekKey() []string {
+	if compareKeys(opts.Start, opts.Prefix) > 0 {
+		return opts.Start
+	}
+
+	return opts.Prefix
+}
+
+// before checks if `key` comes before the range of `opts`.
+func (opts IterOptions) before(key []string) bool {
+	return compareKeys(key, opts.seekKey()) < 0
+}
+
+// beyond checks if `key` and all keys after it are outside the range.
+func (opts IterOptions) beyond(key []string) bool {
+	if opts.End != nil && compareKeys(key, opts.End) >= 0 {
+		return true
+	}
+
+	return !hasKeyPrefix(key, opts.Prefix) && compareKeys(key, opts.Prefix) > 0
+}
+
+// contains checks if `key` is inside the range of `opts`.
+func (opts IterOptions) contains(key []string) bool {
+	return hasKeyPrefix(key, opts.Prefix) && !opts.before(key) && !opts.beyond(key)
+}
+
+// canSkipBelow checks if no key below `key` (including itself)
+// can be in the range. Used to skip whole subtrees.
+func (opts IterOptions) canSkipBelow(key []string) bool {
+	seek := opts.seekKey()
+	return compareKeys(key, seek) < 0 && !hasKeyPrefix(seek, key)
+}
+
+type iterEntry struct {
+	key []string
+	val []byte
+}
+
+// Number of entries a pagedIterator fetches at once.
+const iterPageSize = 512
+
+// scanFunc returns up to `limit` entries in the range of `opts`,
+// starting after `after` (or at the start of the range if `after` is nil).
+type scanFunc func(opts IterOptions, after []string, limit int) ([]iterEntry, error)
+
+// pagedIterator is used by backends that must not keep
+// their transactions open between calls (badger and bolt).
+type pagedIterator struct {
+	opts  IterOptions
+	scan  scanFunc
+	page  []iterEntry
+	pos   int
+	after []string
+	done  bool
+	err   error
+}
+
+func newPagedIterator(opts IterOptions, scan scanFunc) *pagedIterator {
+	return &pagedIterator{
+		opts: opts.normalize(),
+		scan: scan,
+		pos:  -1,
+	}
+}
+
+func (pi *pagedIterator) Next() bool {
+	if pi.err != nil {
+		return false
+	}
+
+	if pi.pos+1 < len(pi.page) {
+		pi.pos++
+		return true
+	}
+
+	if pi.done {
+		return false
+	}
+
+	page, err := pi.scan(pi.opts, pi.after, iterPageSize)
+	if err != nil {
+		pi.err = err
+		return false
+	}
+
+	pi.done = len(page) < iterPageSize
+	pi.page, pi.pos = page, 0
+	if len(page) == 0 {
+		return false
+	}
+
+	pi.after = page[len(page)-1].key
+	return true
+}
+
+func (pi *pagedIterator) Key() []string {
+	return pi.page[pi.pos].key
+}
+
+func (pi *pagedIterator) Value() []byte {
+	return pi.page[pi.pos].val
+}
+
+func (pi *pagedIterator) Err() error {
+	return pi.err
+}
+
+func (pi *pagedIterator) Close() error {
+	pi.page = nil
+	pi.done = true
+	return pi.err
+}
+
+// sliceIterator iterates over a sorted list of keys.
+// The iteration stops at the first error returned by `get`.
+type sliceIterator struct {
+	keys [][]string
+	pos  int
+	get  func(key []string) ([]byte, error)
+	val  []byte
+	err  error
+}
+
+func newSliceIterator(opts IterOptions, keys [][]string, get func(key []string) ([]byte, error)) *sliceIterator {
+	opts = opts.normalize()
+
+	filtered := keys[:0]
+	for _, key := range keys {
+		if opts.contains(key) {
+			filtered = append(filtered, key)
+		}
+	}
+
+	sort.Slice(filtered, func(i, j int) bool {
+		return compareKeys(filtered[i], filtered[j]) < 0
+	})
+
+	if opts.KeysOnly {
+		get = nil
+	}
+
+	return &sliceIterator{
+		keys: filtered,
+		pos:  -1,
+		get:  get,
+	}
+}
+
+func (si *sliceIterator) Next() bool {
+	if si.err != nil || si.pos+1 >= len(si.keys) {
+		si.pos = len(si.keys)
+		return false
+	}
+
+	si.pos++
+	if si.get != nil {
+		si.val, si.err = si.get(si.keys[si.pos])
+	}
+
+	return si.err == nil
+}
+
+func (si *sliceIterator) Key() []string {
+	return si.keys[si.pos]
+}
+
+func (si *sliceIterator) Value() []byte {
+	return si.val
+}
+
+func (si *sliceIterator) Err() error {
+	return si.err
+}
+
+func (si *sliceIterator) Close() error {
+	si.keys = nil
+	return si.err
+}
+
+// errIterator is an empty iterator that only reports an error.
+type errIterator struct {
+	err error
+}
+
+func (ei *errIterator) Next() bool    { return false }
+func (ei *errIterator) Key() []string { return nil }
+func (ei *errIterator) Value() []byte { return nil }
+func (ei *errIterator) Err() error    { return ei.err }
+func (ei *errIterator) Close() error  { return ei.err }
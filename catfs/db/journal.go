@@ -0,0 +1,100 @@
+package db
+
+type journalOpKind int
+
+const (
+	journalPut journalOpKind = iota
+	journalErase
+	journalClear
+)
+
+// journalOp is one recorded write of a batch.
+type journalOp struct {
+	kind journalOpKind
+	key  []string
+	val  []byte
+}
+
+// batchJournal records the writes of a batch for backends whose
+// transactions cannot be undone partially (badger and bolt).
+// Savepoints are implemented by throwing away the transaction and
+// replaying all writes up to the savepoint in a new one.
+type batchJournal struct {
+	ops        []journalOp
+	savepoints []int
+}
+
+func (bj *batchJournal) record(kind journalOpKind, key []string, val []byte) {
+	bj.ops = append(bj.ops, journalOp{
+		kind: kind,
+		key:  append([]string(nil), key...),
+		val:  val,
+	})
+}
+
+func (bj *batchJournal) savepoint() int {
+	bj.savepoints = append(bj.savepoints, len(bj.ops))
+	return len(bj.savepoints) - 1
+}
+
+// rollbackTo forgets all writes after `savepoint` and
+// returns the writes that need to be replayed.
+func (bj *batchJournal) rollbackTo(savepoint int) ([]journalOp, error) {
+	if savepoint < 0 || savepoint >= len(bj.savepoints) {
+		return nil, ErrNoSuchSavepoint
+	}
+
+	bj.ops = bj.ops[:bj.savepoints[savepoint]]
+	bj.savepoints = bj.savepoints[:savepoint+1]
+	return bj.ops, nil
+}
+
+// reset forgets everything. It has to be called when the
+// transaction ends or when parts of it were already committed.
+func (bj *batchJournal) reset() {
+	bj.ops = nil
+	bj.savepoints = nil
+}
+
+// undoLog records how to undo each write done after the first savepoint.
+// It is used by backends that keep the pending state of a batch in memory
+// (memory and disk), so a rollback only touches the keys that were changed
+// since the savepoint instead of copying the whole state at each savepoint.
+type undoLog struct {
+	undos      []func()
+	savepoints []int
+}
+
+// record remembers `undo` if there is any savepoint to roll back to.
+// It has to be called before the write is done.
+func (ul *undoLog) record(undo func()) {
+	if len(ul.savepoints) > 0 {
+		ul.undos = append(ul.undos, undo)
+	}
+}
+
+func (ul *undoLog) savepoint() int {
+	ul.savepoints = append(ul.savepoints, len(ul.undos))
+	return len(ul.savepoints) - 1
+}
+
+// rollbackTo undoes all writes after `savepoint`, newest first.
+func (ul *undoLog) rollbackTo(savepoint int) error {
+	if savepoint < 0 || savepoint >= len(ul.savepoints) {
+		return ErrNoSuchSavepoint
+	}
+
+	start := ul.savepoints[savepoint]
+	for idx := len(ul.undos) - 1; idx >= start; idx-- {
+		ul.undos[idx]()
+	}
+
+	ul.undos = ul.undos[:start]
+	ul.savepoints = ul.savepoints[:savepoint+1]
+	return nil
+}
+
+func (ul *undoLog) reset() {
+	ul.undos = nil
+	ul.savepoints = nil
+}
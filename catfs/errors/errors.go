@@ -83,3 +83,59 @@ func IsNoSuchFileError(err error) bool {
 	_, ok := err.(*errNoSuchFile)
 	return ok
 }
+
+//////////////
+
+type errIgnored struct {
+	path string
+}
+
+// Error will return an error description with the ignored path.
+func (e *errIgnored) Error() string {
+	return "Path is ignored by ignore patterns: " + e.path
+}
+
+// Ignored creates a new error that reports `path` as ignored.
+func Ignored(path string) error {
+	return &errIgnored{path}
+}
+
+// IsIgnoredError asserts that `err` means that the path was ignored.
+// Callers that stage whole trees usually want to skip those silently.
+func IsIgnoredError(err error) bool {
+	_, ok := err.(*errIgnored)
+	return ok
+}
+
+/////////////////
+
+// ErrQuotaExceeded is returned when an operation would exceed a quota.
+type ErrQuotaExceeded struct {
+	// Subject is the user or the directory path the quota belongs to.
+	Subject string
+
+	// Kind is either "bytes" or "files".
+	Kind string
+
+	// Limit is the configured maximum, Need is what would have been used.
+	Limit, Need uint64
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf(
+		"Quota of `%s` exceeded: %d %s allowed, %d %s needed",
+		e.Subject, e.Limit, e.Kind, e.Need, e.Kind,
+	)
+}
+
+// QuotaExceeded returns an error for `subject` that would need `need` of `kind`,
+// but only `limit` is allowed.
+func QuotaExceeded(subject, kind string, limit, need uint64) error {
+	return &ErrQuotaExceeded{Subject: subject, Kind: kind, Limit: limit, Need: need}
+}
+
+// IsErrQuotaExceeded checks if `err` is a quota error.
+func IsErrQuotaExceeded(err error) bool {
+	_, ok := err.(*ErrQuotaExceeded)
+	return ok
+}
@@ -0,0 +1,221 @@
+// Package ignore implements gitignore compatible pattern matching.
+//
+// Patterns are added per directory of a repository and apply to all paths
+// below it; the core package stores them in the database of the repository.
+// The syntax is the same as the one of gitignore(5), so `.flooignore` files
+// can be passed to Add() as they are:
+//
+//   - Blank lines and lines starting with `#` are skipped.
+//   - A leading `!` negates the pattern; previously excluded paths are
+//     included again. Paths below an excluded directory can not be re-included.
+//   - A trailing `/` makes the pattern only match directories.
+//   - Patterns with a `/` at the beginning or in the middle are relative to
+//     the directory of the pattern file. Others match at any level below it.
+//   - `*`, `?` and `[...]` work like in path.Match, `**` matches any number
+//     of directories.
+package ignore
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strings"
+
+	"floo/util/trie"
+)
+
+type pattern struct {
+	// Path elements of the pattern, `**` is kept as own element.
+	elems []string
+
+	// If true, the pattern re-includes matched paths.
+	negate bool
+
+	// If true, the pattern only matches directories.
+	dirOnly bool
+}
+
+// Matcher decides if a path should be ignored.
+// Patterns are attached to a path trie at the directory they were defined in,
+// so a lookup only needs to consider the directories on the way to a path.
+// The zero value is not usable, use NewMatcher().
+type Matcher struct {
+	root *trie.Node
+}
+
+// NewMatcher returns a new Matcher without any patterns.
+func NewMatcher() *Matcher {
+	return &Matcher{root: trie.NewNode()}
+}
+
+// Add parses the patterns in `r` and makes them effective for all
+// paths below `dirPath`. Add can be called several times for the same
+// directory; later patterns take precedence over earlier ones.
+func (m *Matcher) Add(dirPath string, r io.Reader) error {
+	patterns, err := parse(r)
+	if err != nil {
+		return err
+	}
+
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	// Note: Insert() would also attach data to intermediate nodes,
+	// so only set the data on the node of the directory itself.
+	nd := m.root
+	if dirPath = path.Clean("/" + dirPath); dirPath != "/" {
+		if nd = m.root.Lookup(dirPath); nd == nil {
+			nd = m.root.Insert(dirPath)
+		}
+	}
+
+	existing, _ := nd.Data.([]pattern)
+	nd.Data = append(existing, patterns...)
+	return nil
+}
+
+// Match returns true if `repoPath` should be ignored.
+// `isDir` tells if `repoPath` is a directory, since some patterns
+// only apply to directories. If a parent directory of `repoPath` is
+// ignored, then `repoPath` is ignored too.
+func (m *Matcher) Match(repoPath string, isDir bool) bool {
+	elems := trie.SplitPath(path.Clean("/" + repoPath))
+	if len(elems) == 0 || elems[0] == "" {
+		// The root directory is never ignored.
+		return false
+	}
+
+	// Check each parent directory first; there's no way
+	// to re-include something below an ignored directory.
+	for idx := 1; idx < len(elems); idx++ {
+		if m.matchElems(elems[:idx], true) {
+			return true
+		}
+	}
+
+	return m.matchElems(elems, isDir)
+}
+
+// matchElems checks only the path made of `elems`, not its parents.
+func (m *Matcher) matchElems(elems []string, isDir bool) bool {
+	ignored := false
+
+	// Go down the trie along the path and apply the patterns
+	// of every directory we pass. Deeper patterns win over upper ones.
+	curr := m.root
+	for depth := 0; curr != nil && depth < len(elems); depth++ {
+		if patterns, ok := curr.Data.([]pattern); ok {
+			rel := elems[depth:]
+			for _, pat := range patterns {
+				if pat.dirOnly && !isDir {
+					continue
+				}
+
+				if matchPattern(pat.elems, rel) {
+					ignored = !pat.negate
+				}
+			}
+		}
+
+		curr = curr.Children[elems[depth]]
+	}
+
+	return ignored
+}
+
+// matchPattern matches the pattern elements against the path elements.
+// `**` may swallow zero or more path elements.
+func matchPattern(pat, elems []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			// Skip consecutive `**` and try every possible split.
+			rest := pat[1:]
+			for idx := 0; idx <= len(elems); idx++ {
+				if matchPattern(rest, elems[idx:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(elems) == 0 {
+			return false
+		}
+
+		ok, err := path.Match(pat[0], elems[0])
+		if err != nil || !ok {
+			return false
+		}
+
+		pat, elems = pat[1:], elems[1:]
+	}
+
+	return len(elems) == 0
+}
+
+func parse(r io.Reader) ([]pattern, error) {
+	var patterns []pattern
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if pat, ok := parseLine(scanner.Text()); ok {
+			patterns = append(patterns, pat)
+		}
+	}
+
+	return patterns, scanner.Err()
+}
+
+func parseLine(line string) (pattern, bool) {
+	pat := pattern{}
+
+	line = strings.TrimSuffix(line, "\r")
+	line = trimTrailingSpaces(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pat, false
+	}
+
+	switch {
+	case strings.HasPrefix(line, "!"):
+		pat.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pat.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return pat, false
+	}
+
+	// A slash anywhere but at the end anchors the pattern to its directory.
+	// Unanchored patterns may match at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimLeft(line, "/")
+	if !anchored {
+		pat.elems = append(pat.elems, "**")
+	}
+
+	pat.elems = append(pat.elems, strings.Split(line, "/")...)
+	return pat, true
+}
+
+// trimTrailingSpaces removes trailing spaces unless they are escaped.
+func trimTrailingSpaces(line string) string {
+	for strings.HasSuffix(line, " ") {
+		if strings.HasSuffix(line, "\\ ") {
+			// Keep the space, but drop the escape.
+			return line[:len(line)-2] + " "
+		}
+
+		line = line[:len(line)-1]
+	}
+
+	return line
+}
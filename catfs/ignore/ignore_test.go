@@ -0,0 +1,64 @@
+package ignore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	m := NewMatcher()
+	require.Nil(t, m.Add("/", strings.NewReader(`
+# comment
+*.swp
+build/
+/dist
+node_modules
+docs/**/*.pdf
+*.log
+!keep.log
+`)))
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"/a.swp", false, true},
+		{"/sub/dir/a.swp", false, true},
+		{"/a.txt", false, false},
+		{"/build", true, true},
+		{"/build", false, false},
+		{"/sub/build/x.o", false, true},
+		{"/dist", true, true},
+		{"/sub/dist", true, false},
+		{"/node_modules/x/y.js", false, true},
+		{"/docs/a.pdf", false, true},
+		{"/docs/x/y/a.pdf", false, true},
+		{"/other/a.pdf", false, false},
+		{"/x.log", false, true},
+		{"/keep.log", false, false},
+		{"/", true, false},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.ignored, m.Match(test.path, test.isDir), test.path)
+	}
+}
+
+func TestMatchNested(t *testing.T) {
+	m := NewMatcher()
+	require.Nil(t, m.Add("/", strings.NewReader("*.tmp\n")))
+	require.Nil(t, m.Add("/sub", strings.NewReader("!important.tmp\n/local\n")))
+	require.Nil(t, m.Add("/ignored", strings.NewReader("*\n")))
+
+	require.True(t, m.Match("/a.tmp", false))
+	require.True(t, m.Match("/sub/a.tmp", false))
+	require.True(t, m.Match("/important.tmp", false))
+	require.False(t, m.Match("/sub/important.tmp", false))
+	require.True(t, m.Match("/sub/local", false))
+	require.False(t, m.Match("/local", false))
+	require.False(t, m.Match("/ignored", true))
+	require.True(t, m.Match("/ignored/x", false))
+}
@@ -0,0 +1,193 @@
+// Package blockcache implements a size bounded LRU cache for decoded blocks
+// of mio streams. One cache can be shared by many readers and by both the
+// encryption and the compression layer; the key tells them apart.
+package blockcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultReadAhead is the number of blocks readers fetch in advance
+// once they notice a sequential access pattern.
+const DefaultReadAhead = 4
+
+// Layer tells which layer of a stream a block belongs to.
+type Layer uint8
+
+const (
+	// LayerEncrypt blocks are the decrypted blocks of encrypt.Reader.
+	LayerEncrypt Layer = iota
+
+	// LayerCompress blocks are the decompressed chunks of compress.Reader.
+	LayerCompress
+)
+
+// Key identifies a single block.
+type Key struct {
+	// Stream identifies the stream, usually by its backend hash.
+	Stream string
+
+	// Layer is the layer that decoded the block.
+	Layer Layer
+
+	// Block is the index of the block in its layer, counted from zero.
+	Block int64
+}
+
+// Stats tells how well the cache works.
+type Stats struct {
+	// Hits and Misses count the lookups with Get().
+	Hits   uint64
+	Misses uint64
+
+	// Prefetched is the number of blocks added by read-ahead.
+	Prefetched uint64
+
+	// Evictions is the number of blocks removed to make room.
+	Evictions uint64
+
+	// Entries and Size are the number of blocks and bytes in the cache.
+	Entries int
+	Size    int64
+}
+
+// HitRate returns the ratio of hits to all lookups, between 0 and 1.
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type entry struct {
+	key  Key
+	data []byte
+}
+
+// Cache is a LRU cache for blocks of at most a fixed number of bytes.
+// It is safe for concurrent use.
+type Cache struct {
+	mu        sync.Mutex
+	maxSize   int64
+	readAhead int
+	lru       *list.List
+	entries   map[Key]*list.Element
+	stats     Stats
+}
+
+// New returns a cache that holds up to `maxSize` bytes of block data.
+func New(maxSize int64) *Cache {
+	return &Cache{
+		maxSize:   maxSize,
+		readAhead: DefaultReadAhead,
+		lru:       list.New(),
+		entries:   make(map[Key]*list.Element),
+	}
+}
+
+// SetReadAhead sets how many blocks readers fetch in advance when they read
+// sequentially. A value <= 0 disables read-ahead.
+func (c *Cache) SetReadAhead(blocks int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if blocks < 0 {
+		blocks = 0
+	}
+
+	c.readAhead = blocks
+}
+
+// ReadAhead returns the number of blocks readers should fetch in advance.
+func (c *Cache) ReadAhead() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.readAhead
+}
+
+// Get returns the data of the block at `key`, if it is cached.
+// The data must not be modified.
+func (c *Cache) Get(key Key) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*entry).data, true
+}
+
+// Put adds the data of a block to the cache and takes ownership of it;
+// the caller must not modify it afterwards. Blocks larger than the whole
+// cache are not added.
+func (c *Cache) Put(key Key, data []byte) {
+	c.put(key, data, false)
+}
+
+// Prefetch is like Put, but counts the block as read-ahead in the stats.
+// It does nothing if the block is cached already.
+func (c *Cache) Prefetch(key Key, data []byte) {
+	c.put(key, data, true)
+}
+
+func (c *Cache) put(key Key, data []byte, prefetch bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if int64(len(data)) > c.maxSize {
+		return
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		if prefetch {
+			return
+		}
+
+		c.removeElement(elem)
+	}
+
+	c.entries[key] = c.lru.PushFront(&entry{key: key, data: data})
+	c.stats.Size += int64(len(data))
+	c.stats.Entries++
+	if prefetch {
+		c.stats.Prefetched++
+	}
+
+	for c.stats.Size > c.maxSize {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) removeElement(elem *list.Element) {
+	ent := c.lru.Remove(elem).(*entry)
+	delete(c.entries, ent.key)
+	c.stats.Size -= int64(len(ent.data))
+	c.stats.Entries--
+}
+
+// Has returns true if the block at `key` is cached.
+// Unlike Get() it does not count as a lookup.
+func (c *Cache) Has(key Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[key]
+	return ok
+}
+
+// Stats returns a snapshot of the cache statistics.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
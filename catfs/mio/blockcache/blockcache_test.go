@@ -0,0 +1,77 @@
+package blockcache
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func testKey(block int64) Key {
+	return Key{Stream: "stream", Layer: LayerEncrypt, Block: block}
+}
+
+func TestGetPut(t *testing.T) {
+	c := New(1024)
+
+	_, ok := c.Get(testKey(0))
+	require.False(t, ok)
+
+	c.Put(testKey(0), []byte("hello"))
+	data, ok := c.Get(testKey(0))
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), data)
+
+	// Same block, other layer:
+	_, ok = c.Get(Key{Stream: "stream", Layer: LayerCompress, Block: 0})
+	require.False(t, ok)
+
+	stats := c.Stats()
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, uint64(2), stats.Misses)
+	require.Equal(t, 1, stats.Entries)
+	require.Equal(t, int64(5), stats.Size)
+	require.InDelta(t, 1.0/3.0, stats.HitRate(), 0.001)
+}
+
+func TestEviction(t *testing.T) {
+	c := New(300)
+	for idx := int64(0); idx < 3; idx++ {
+		c.Put(testKey(idx), make([]byte, 100))
+	}
+
+	// Block 0 is used recently now; block 1 should go first:
+	_, ok := c.Get(testKey(0))
+	require.True(t, ok)
+
+	c.Put(testKey(3), make([]byte, 100))
+	require.False(t, c.Has(testKey(1)))
+	require.True(t, c.Has(testKey(0)))
+	require.True(t, c.Has(testKey(2)))
+	require.True(t, c.Has(testKey(3)))
+
+	// Replacing a block does not count twice:
+	c.Put(testKey(3), make([]byte, 50))
+	stats := c.Stats()
+	require.Equal(t, int64(250), stats.Size)
+	require.Equal(t, 3, stats.Entries)
+	require.Equal(t, uint64(1), stats.Evictions)
+
+	// Too big to be cached at all:
+	c.Put(testKey(4), make([]byte, 301))
+	require.False(t, c.Has(testKey(4)))
+	require.Equal(t, int64(250), c.Stats().Size)
+}
+
+func TestPrefetch(t *testing.T) {
+	c := New(1024)
+	c.Put(testKey(0), []byte("put"))
+	c.Prefetch(testKey(0), []byte("prefetched"))
+	c.Prefetch(testKey(1), []byte("prefetched"))
+
+	data, ok := c.Get(testKey(0))
+	require.True(t, ok)
+	require.Equal(t, []byte("put"), data)
+	require.Equal(t, uint64(1), c.Stats().Prefetched)
+
+	c.SetReadAhead(-1)
+	require.Equal(t, 0, c.ReadAhead())
+}
@@ -0,0 +1,367 @@
+package mio
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"floo/catfs/mio/blockcache"
+	"floo/catfs/mio/chunker"
+	"floo/catfs/mio/compress"
+	n "floo/catfs/nodes"
+	h "floo/util/hashlib"
+	"io"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrNoSuchChunk is returned by a ChunkStore for unknown chunks.
+	ErrNoSuchChunk = errors.New("no such chunk")
+
+	// ErrNoChunkSecret is returned when chunks should be
+	// written or read without a secret to derive their keys from.
+	ErrNoChunkSecret = errors.New("no chunk secret given")
+)
+
+// ChunkStore stores the encrypted and compressed data of chunks by their
+// chunk id (see ChunkID). Every chunk is stored only once, no matter
+// how many files or versions of a file contain it.
+type ChunkStore interface {
+	// Has returns true if the chunk with `id` was stored already.
+	Has(id h.Hash) (bool, error)
+
+	// Put stores `data` under `id`.
+	Put(id h.Hash, data []byte) error
+
+	// Get returns the data stored under `id` or ErrNoSuchChunk.
+	Get(id h.Hash) (io.ReadSeeker, error)
+}
+
+// MemoryChunkStore is a ChunkStore that keeps all chunks in memory.
+type MemoryChunkStore struct {
+	mu     sync.Mutex
+	chunks map[string][]byte
+}
+
+// NewMemoryChunkStore returns an empty MemoryChunkStore.
+func NewMemoryChunkStore() *MemoryChunkStore {
+	return &MemoryChunkStore{
+		chunks: make(map[string][]byte),
+	}
+}
+
+// Has is the MemoryChunkStore implementation of ChunkStore.Has
+func (ms *MemoryChunkStore) Has(id h.Hash) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	_, ok := ms.chunks[string(id)]
+	return ok, nil
+}
+
+// Put is the MemoryChunkStore implementation of ChunkStore.Put
+func (ms *MemoryChunkStore) Put(id h.Hash, data []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.chunks[string(id)] = data
+	return nil
+}
+
+// Get is the MemoryChunkStore implementation of ChunkStore.Get
+func (ms *MemoryChunkStore) Get(id h.Hash) (io.ReadSeeker, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	data, ok := ms.chunks[string(id)]
+	if !ok {
+		return nil, ErrNoSuchChunk
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// Len returns the number of stored chunks.
+func (ms *MemoryChunkStore) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return len(ms.chunks)
+}
+
+// ChunkKey returns the key that the chunk with the content hash `hash` is
+// encrypted with. Identical chunks of different files need to be encrypted
+// with the same key to be stored once, so the key is derived from the content
+// (convergent encryption). It is also derived from `secret`, which belongs to
+// the repository; without it, neither the key can be computed from a content
+// hash nor can anyone tell whether a known plain text is stored.
+func ChunkKey(secret []byte, hash h.Hash) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("floo chunk key"))
+	mac.Write(hash)
+	return mac.Sum(nil)
+}
+
+// ChunkID returns the id that the chunk encrypted with `key` is stored
+// under. The id is a one-way hash of the key, so the store learns
+// neither the key nor the content hash of the chunk.
+func ChunkID(key []byte) h.Hash {
+	return h.Sum(append([]byte("floo chunk id\x00"), key...))
+}
+
+// WriteChunked splits the data of `r` into content defined chunks,
+// compresses them with `algo`, encrypts them with keys derived from `secret`
+// and puts all chunks into `store` that are not stored yet. The returned
+// chunks can be set on a file node and be read back with NewChunkedOutStream.
+func WriteChunked(r io.Reader, store ChunkStore, secret []byte, algo compress.AlgorithmType) ([]n.Chunk, error) {
+	return WriteChunkedWithSizes(r, store, secret, algo, chunker.DefaultSizes)
+}
+
+// WriteChunkedWithSizes is like WriteChunked with custom chunk sizes.
+func WriteChunkedWithSizes(r io.Reader, store ChunkStore, secret []byte, algo compress.AlgorithmType, sizes chunker.Sizes) ([]n.Chunk, error) {
+	if len(secret) == 0 {
+		return nil, ErrNoChunkSecret
+	}
+
+	chk, err := chunker.NewWithSizes(r, sizes)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := []n.Chunk{}
+	for {
+		data, err := chk.Next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		hash := h.Sum(data)
+		chunks = append(chunks, n.Chunk{
+			Hash: hash,
+			Size: uint64(len(data)),
+		})
+
+		key := ChunkKey(secret, hash)
+		id := ChunkID(key)
+
+		have, err := store.Has(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if have {
+			continue
+		}
+
+		encStream, err := NewInStream(bytes.NewReader(data), key, algo)
+		if err != nil {
+			return nil, err
+		}
+
+		encData, err := io.ReadAll(encStream)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := store.Put(id, encData); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// chunkedStream reads a file that is stored in chunks.
+// Only one chunk is opened at a time.
+type chunkedStream struct {
+	store  ChunkStore
+	secret []byte
+	chunks []n.Chunk
+
+	// Optional cache for the blocks of the chunks.
+	cache *blockcache.Cache
+
+	// offsets[idx] is the offset of chunks[idx] in the file;
+	// the last element is the size of the file.
+	offsets []int64
+
+	pos int64
+
+	// Currently opened chunk; curr is nil if there is none.
+	currIdx int
+	curr    Stream
+}
+
+// NewChunkedOutStream returns a stream that reads the data of `chunks`
+// from `store` as if it was one stream. `secret` has to be the one the
+// chunks were written with. Seeking is supported across chunk boundaries;
+// only the chunk at the new offset is read.
+func NewChunkedOutStream(chunks []n.Chunk, store ChunkStore, secret []byte) Stream {
+	return NewCachedChunkedOutStream(chunks, store, secret, nil)
+}
+
+// NewCachedChunkedOutStream is like NewChunkedOutStream, but the blocks of
+// the chunks are cached in `cache` (see NewCachedOutStream). Since chunks
+// are shared between files, so are their cached blocks.
+func NewCachedChunkedOutStream(chunks []n.Chunk, store ChunkStore, secret []byte, cache *blockcache.Cache) Stream {
+	offsets := make([]int64, len(chunks)+1)
+	for idx, chunk := range chunks {
+		offsets[idx+1] = offsets[idx] + int64(chunk.Size)
+	}
+
+	return &chunkedStream{
+		store:   store,
+		secret:  secret,
+		chunks:  chunks,
+		offsets: offsets,
+		cache:   cache,
+	}
+}
+
+func (cs *chunkedStream) size() int64 {
+	return cs.offsets[len(cs.offsets)-1]
+}
+
+// open makes sure the chunk at the current offset is opened
+// and positioned at the current offset.
+func (cs *chunkedStream) open() error {
+	idx := sort.Search(len(cs.chunks), func(i int) bool {
+		return cs.offsets[i+1] > cs.pos
+	})
+
+	if cs.curr != nil && cs.currIdx == idx {
+		return nil
+	}
+
+	if cs.curr != nil {
+		cs.curr.Close()
+		cs.curr = nil
+	}
+
+	if len(cs.secret) == 0 {
+		return ErrNoChunkSecret
+	}
+
+	key := ChunkKey(cs.secret, cs.chunks[idx].Hash)
+	id := ChunkID(key)
+	r, err := cs.store.Get(id)
+	if err != nil {
+		return err
+	}
+
+	stream, err := newOutStream(r, key, cs.cache, string(id), nil)
+	if err != nil {
+		return err
+	}
+
+	if chunkOff := cs.pos - cs.offsets[idx]; chunkOff > 0 {
+		if _, err := stream.Seek(chunkOff, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	cs.curr = stream
+	cs.currIdx = idx
+	return nil
+}
+
+func (cs *chunkedStream) Read(buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		if cs.pos >= cs.size() {
+			return read, io.EOF
+		}
+
+		if err := cs.open(); err != nil {
+			return read, err
+		}
+
+		// Never read over the end of the chunk:
+		left := cs.offsets[cs.currIdx+1] - cs.pos
+		dst := buf[read:]
+		if int64(len(dst)) > left {
+			dst = dst[:left]
+		}
+
+		got, err := io.ReadFull(cs.curr, dst)
+		read += got
+		cs.pos += int64(got)
+		if err == io.EOF {
+			// The chunk is shorter than the file node says.
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return read, err
+		}
+	}
+
+	return read, nil
+}
+
+func (cs *chunkedStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += cs.pos
+	case io.SeekEnd:
+		offset += cs.size()
+	}
+
+	if offset < 0 {
+		return cs.pos, io.EOF
+	}
+
+	if offset == cs.pos {
+		return offset, nil
+	}
+
+	// Seeking inside the opened chunk is cheap; otherwise open() will
+	// pick the right chunk on the next read.
+	if cs.curr != nil && offset >= cs.offsets[cs.currIdx] && offset < cs.offsets[cs.currIdx+1] {
+		if _, err := cs.curr.Seek(offset-cs.offsets[cs.currIdx], io.SeekStart); err != nil {
+			return cs.pos, err
+		}
+	} else if cs.curr != nil {
+		cs.curr.Close()
+		cs.curr = nil
+	}
+
+	cs.pos = offset
+	return offset, nil
+}
+
+func (cs *chunkedStream) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	for cs.pos < cs.size() {
+		if err := cs.open(); err != nil {
+			return written, err
+		}
+
+		left := cs.offsets[cs.currIdx+1] - cs.pos
+		copied, err := io.Copy(w, io.LimitReader(cs.curr, left))
+		written += copied
+		cs.pos += copied
+		if err != nil {
+			return written, err
+		}
+
+		if copied < left {
+			return written, io.ErrUnexpectedEOF
+		}
+	}
+
+	return written, nil
+}
+
+func (cs *chunkedStream) Close() error {
+	if cs.curr == nil {
+		return nil
+	}
+
+	err := cs.curr.Close()
+	cs.curr = nil
+	return err
+}
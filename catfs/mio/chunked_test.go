@@ -0,0 +1,157 @@
+package mio
+
+import (
+	"bytes"
+	"floo/catfs/mio/chunker"
+	"floo/catfs/mio/compress"
+	h "floo/util/hashlib"
+	"floo/util/testutil"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+var (
+	testChunkSizes  = chunker.Sizes{Min: 4 * 1024, Avg: 16 * 1024, Max: 64 * 1024}
+	testChunkSecret = []byte("01234567890123456789012345678901")
+)
+
+func TestChunkedWriteAndRead(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int64{0, 1, 4 * 1024, 1024 * 1024} {
+		data := testutil.CreateRandomDummyBuf(size, 42)
+		store := NewMemoryChunkStore()
+
+		chunks, err := WriteChunkedWithSizes(bytes.NewReader(data), store, testChunkSecret, compress.AlgoSnappy, testChunkSizes)
+		require.Nil(t, err)
+
+		total := uint64(0)
+		for _, chunk := range chunks {
+			total += chunk.Size
+		}
+
+		require.Equal(t, uint64(size), total)
+
+		out := &bytes.Buffer{}
+		_, err = io.Copy(out, NewChunkedOutStream(chunks, store, testChunkSecret))
+		require.Nil(t, err)
+		require.True(t, bytes.Equal(data, out.Bytes()))
+
+		// Read() instead of WriteTo():
+		read, err := io.ReadAll(struct{ io.Reader }{NewChunkedOutStream(chunks, store, testChunkSecret)})
+		require.Nil(t, err)
+		require.True(t, bytes.Equal(data, read))
+	}
+}
+
+func TestChunkedDedup(t *testing.T) {
+	t.Parallel()
+
+	data := testutil.CreateRandomDummyBuf(1024*1024, 23)
+	store := NewMemoryChunkStore()
+
+	chunks, err := WriteChunkedWithSizes(bytes.NewReader(data), store, testChunkSecret, compress.AlgoNone, testChunkSizes)
+	require.Nil(t, err)
+	require.Equal(t, len(chunks), store.Len())
+
+	// Changing one byte should only add the chunk around it:
+	edited := append([]byte(nil), data...)
+	edited[600*1024] ^= 0xFF
+
+	editedChunks, err := WriteChunkedWithSizes(bytes.NewReader(edited), store, testChunkSecret, compress.AlgoNone, testChunkSizes)
+	require.Nil(t, err)
+	require.True(t, store.Len() <= len(chunks)+2, "%d chunks stored", store.Len())
+
+	out := &bytes.Buffer{}
+	_, err = io.Copy(out, NewChunkedOutStream(editedChunks, store, testChunkSecret))
+	require.Nil(t, err)
+	require.Equal(t, edited, out.Bytes())
+}
+
+func TestChunkedSeek(t *testing.T) {
+	t.Parallel()
+
+	data := testutil.CreateDummyBuf(512 * 1024)
+	store := NewMemoryChunkStore()
+
+	chunks, err := WriteChunkedWithSizes(bytes.NewReader(data), store, testChunkSecret, compress.AlgoLZ4, testChunkSizes)
+	require.Nil(t, err)
+	require.True(t, len(chunks) > 2)
+
+	stream := NewChunkedOutStream(chunks, store, testChunkSecret)
+	defer stream.Close()
+
+	// Reads that cross the boundary of the first chunk:
+	boundary := int64(chunks[0].Size)
+	for _, off := range []int64{0, boundary - 10, boundary, 300 * 1024, int64(len(data)) - 5} {
+		pos, err := stream.Seek(off, io.SeekStart)
+		require.Nil(t, err)
+		require.Equal(t, off, pos)
+
+		buf := make([]byte, 100)
+		n, err := stream.Read(buf)
+		end := off + int64(n)
+		if end == int64(len(data)) {
+			require.True(t, err == nil || err == io.EOF)
+		} else {
+			require.Nil(t, err)
+			require.Equal(t, 100, n)
+		}
+
+		require.Equal(t, data[off:end], buf[:n])
+	}
+
+	pos, err := stream.Seek(-1024, io.SeekEnd)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(data)-1024), pos)
+
+	rest := &bytes.Buffer{}
+	_, err = io.Copy(rest, stream)
+	require.Nil(t, err)
+	require.Equal(t, data[len(data)-1024:], rest.Bytes())
+}
+
+func TestChunkedStoreKeyCannotDecrypt(t *testing.T) {
+	t.Parallel()
+
+	data := testutil.CreateDummyBuf(128 * 1024)
+	store := NewMemoryChunkStore()
+
+	chunks, err := WriteChunkedWithSizes(bytes.NewReader(data), store, testChunkSecret, compress.AlgoNone, testChunkSizes)
+	require.Nil(t, err)
+	require.True(t, len(chunks) > 1)
+
+	for _, chunk := range chunks {
+		// The plain content hash must not be visible in the store:
+		have, err := store.Has(chunk.Hash)
+		require.Nil(t, err)
+		require.False(t, have)
+	}
+
+	// Everything that can be derived from the store id is not the key:
+	for id, encData := range store.chunks {
+		for _, key := range [][]byte{
+			ChunkKey(nil, h.Hash(id)),
+			ChunkKey([]byte(id), h.Hash(id)),
+			ChunkKey(testChunkSecret, h.Hash(id)),
+		} {
+			stream, err := NewOutStream(bytes.NewReader(encData), key)
+			if err == nil {
+				_, err = io.ReadAll(stream)
+			}
+
+			require.NotNil(t, err)
+		}
+	}
+
+	// The chunks can only be read with the secret they were written with:
+	_, err = io.ReadAll(NewChunkedOutStream(chunks, store, []byte("another secret of the same size.")))
+	require.NotNil(t, err)
+
+	_, err = io.ReadAll(NewChunkedOutStream(chunks, store, nil))
+	require.Equal(t, ErrNoChunkSecret, err)
+
+	_, err = WriteChunked(bytes.NewReader(data), store, nil, compress.AlgoNone)
+	require.Equal(t, ErrNoChunkSecret, err)
+}
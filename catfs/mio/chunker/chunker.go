@@ -0,0 +1,192 @@
+// Package chunker splits a stream into content defined chunks using FastCDC.
+//
+// Chunk boundaries only depend on the bytes around them, so inserting or
+// changing data in a file only changes the chunks around the edit. The
+// remaining chunks hash to the same value as before and need to be stored
+// only once. See "FastCDC: a Fast and Efficient Content-Defined Chunking
+// Approach for Data Deduplication" (Xia et al., 2016) for the details.
+package chunker
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	// DefaultMinSize is the default minimum size of a chunk.
+	DefaultMinSize = 256 * 1024
+
+	// DefaultAvgSize is the default size that chunks are normalized to.
+	DefaultAvgSize = 1024 * 1024
+
+	// DefaultMaxSize is the default maximum size of a chunk.
+	DefaultMaxSize = 4 * 1024 * 1024
+
+	// Gear hashes only "see" the last 64 bytes, smaller chunks make no sense.
+	minMinSize = 64
+)
+
+var (
+	// ErrBadSizes is returned for sizes that do not fulfill min < avg < max.
+	ErrBadSizes = errors.New("chunk sizes must fulfill 64 <= min < avg < max")
+)
+
+// Sizes configures the chunk sizes of a Chunker.
+// Changing them will change all chunk boundaries.
+type Sizes struct {
+	Min int
+	Avg int
+	Max int
+}
+
+// DefaultSizes are suitable for files between a few megabytes
+// and many gigabytes.
+var DefaultSizes = Sizes{
+	Min: DefaultMinSize,
+	Avg: DefaultAvgSize,
+	Max: DefaultMaxSize,
+}
+
+// gear maps every byte to a random 64 bit value.
+// It must never change, otherwise the boundaries change too.
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed; no dependency on math/rand's algorithm.
+	state := uint64(0x666c6f6f63646321)
+	for idx := range gear {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[idx] = z ^ (z >> 31)
+	}
+}
+
+// Chunker reads from a stream and cuts it into chunks.
+type Chunker struct {
+	r     io.Reader
+	sizes Sizes
+
+	// Before reaching the average size, the harder maskS is used;
+	// afterwards the easier maskL. This "normalizes" the chunk sizes
+	// closer to the average than a single mask would.
+	maskS uint64
+	maskL uint64
+
+	// buf[start:end] is the data that was read, but not returned yet.
+	buf   []byte
+	start int
+	end   int
+	err   error
+}
+
+// spreadMask returns a mask with `n` bits set, taken from the upper bits
+// of the hash, since those depend on the most input bytes.
+func spreadMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+
+	if n >= 64 {
+		return ^uint64(0)
+	}
+
+	return ((uint64(1) << n) - 1) << (64 - n)
+}
+
+// New returns a Chunker using DefaultSizes.
+func New(r io.Reader) *Chunker {
+	chk, _ := NewWithSizes(r, DefaultSizes)
+	return chk
+}
+
+// NewWithSizes returns a Chunker that cuts chunks of `sizes`.
+func NewWithSizes(r io.Reader, sizes Sizes) (*Chunker, error) {
+	if sizes.Min < minMinSize || sizes.Min >= sizes.Avg || sizes.Avg >= sizes.Max {
+		return nil, ErrBadSizes
+	}
+
+	// Number of bits a boundary has to match to reach the average:
+	avgBits := bits.Len(uint(sizes.Avg)) - 1
+	return &Chunker{
+		r:     r,
+		sizes: sizes,
+		maskS: spreadMask(avgBits + 2),
+		maskL: spreadMask(avgBits - 2),
+		buf:   make([]byte, sizes.Max),
+	}, nil
+}
+
+// cut returns the length of the first chunk in `data`.
+// If `data` is shorter than the maximum chunk size,
+// it has to be the last data of the stream.
+func (c *Chunker) cut(data []byte) int {
+	size := len(data)
+	if size <= c.sizes.Min {
+		return size
+	}
+
+	if size > c.sizes.Max {
+		size = c.sizes.Max
+	}
+
+	normal := c.sizes.Avg
+	if size < normal {
+		normal = size
+	}
+
+	fp := uint64(0)
+	idx := c.sizes.Min
+	for ; idx < normal; idx++ {
+		fp = (fp << 1) + gear[data[idx]]
+		if fp&c.maskS == 0 {
+			return idx + 1
+		}
+	}
+
+	for ; idx < size; idx++ {
+		fp = (fp << 1) + gear[data[idx]]
+		if fp&c.maskL == 0 {
+			return idx + 1
+		}
+	}
+
+	return size
+}
+
+// fill reads until the buffer is full or the stream is exhausted.
+func (c *Chunker) fill() {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+
+	for c.end < len(c.buf) && c.err == nil {
+		var n int
+		n, c.err = c.r.Read(c.buf[c.end:])
+		c.end += n
+	}
+}
+
+// Next returns the next chunk. The returned slice is only valid until the
+// next call to Next(). After the last chunk, io.EOF is returned.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.sizes.Max && c.err == nil {
+		c.fill()
+	}
+
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	size := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+size]
+	c.start += size
+	return chunk, nil
+}
@@ -0,0 +1,89 @@
+package chunker
+
+import (
+	"bytes"
+	"floo/util/testutil"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testSizes = Sizes{Min: 2 * 1024, Avg: 8 * 1024, Max: 32 * 1024}
+
+func chunkAll(t *testing.T, data []byte, sizes Sizes) [][]byte {
+	chk, err := NewWithSizes(bytes.NewReader(data), sizes)
+	require.Nil(t, err)
+
+	chunks := [][]byte{}
+	for {
+		chunk, err := chk.Next()
+		if err == io.EOF {
+			return chunks
+		}
+
+		require.Nil(t, err)
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	data := testutil.CreateRandomDummyBuf(1024*1024, 23)
+	chunks := chunkAll(t, data, testSizes)
+
+	require.Equal(t, data, bytes.Join(chunks, nil))
+	for idx, chunk := range chunks {
+		require.True(t, len(chunk) <= testSizes.Max)
+		if idx != len(chunks)-1 {
+			require.True(t, len(chunk) > testSizes.Min)
+		}
+	}
+
+	// Normalized chunking should keep the average near the configured one:
+	avg := len(data) / len(chunks)
+	require.True(t, avg > testSizes.Avg/2 && avg < testSizes.Avg*2, "avg: %d", avg)
+}
+
+func TestChunkerEmpty(t *testing.T) {
+	require.Empty(t, chunkAll(t, nil, testSizes))
+
+	chunks := chunkAll(t, []byte("x"), testSizes)
+	require.Equal(t, [][]byte{[]byte("x")}, chunks)
+}
+
+func TestChunkerShift(t *testing.T) {
+	data := testutil.CreateRandomDummyBuf(1024*1024, 42)
+	before := chunkAll(t, data, testSizes)
+
+	// Insert a few bytes in the middle; only the chunks around
+	// the insertion may change.
+	edited := append([]byte(nil), data[:500*1024]...)
+	edited = append(edited, []byte("hello world")...)
+	edited = append(edited, data[500*1024:]...)
+	after := chunkAll(t, edited, testSizes)
+
+	known := make(map[string]bool)
+	for _, chunk := range before {
+		known[string(chunk)] = true
+	}
+
+	changed := 0
+	for _, chunk := range after {
+		if !known[string(chunk)] {
+			changed++
+		}
+	}
+
+	require.True(t, changed > 0 && changed <= 2, "changed: %d", changed)
+}
+
+func TestChunkerBadSizes(t *testing.T) {
+	for _, sizes := range []Sizes{
+		{Min: 0, Avg: 1024, Max: 4096},
+		{Min: 1024, Avg: 1024, Max: 4096},
+		{Min: 1024, Avg: 4096, Max: 4096},
+	} {
+		_, err := NewWithSizes(nil, sizes)
+		require.Equal(t, ErrBadSizes, err)
+	}
+}
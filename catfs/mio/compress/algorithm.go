@@ -4,11 +4,16 @@ import (
 	"errors"
 	"github.com/bkaradzic/go-lz4"
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"sync"
 )
 
 var (
 	// ErrBadAlgo is returned on unsupported/unknown algorithm.
 	ErrBadAlgo = errors.New("invalid algorithm type")
+
+	// ErrBadLevel is returned on compression levels the algorithm does not know.
+	ErrBadLevel = errors.New("invalid compression level")
 )
 
 // Algorithm is the common interface for all supported algorithms.
@@ -20,24 +25,48 @@ type Algorithm interface {
 type noneAlgo struct{}
 type snappyAlgo struct{}
 type lz4Algo struct{}
+type zstdAlgo struct {
+	level int
+}
+
+const (
+	// DefaultLevel lets the algorithm choose its usual compression level.
+	DefaultLevel = 0
+
+	// MaxZstdLevel is the highest level zstd supports.
+	//
+	// The zstd encoder we use only knows four speeds, so the levels
+	// are mapped like this (see zstd.EncoderLevelFromZstd):
+	//
+	//	1-2:   fastest
+	//	3-5:   default
+	//	6-9:   better compression
+	//	10-22: best compression
+	//
+	// The stream header still records the level that was asked for.
+	MaxZstdLevel = 22
+)
 
 var (
 	AlgoMap = map[AlgorithmType]Algorithm{
 		AlgoNone:   noneAlgo{},
 		AlgoSnappy: snappyAlgo{},
 		AlgoLZ4:    lz4Algo{},
+		AlgoZstd:   zstdAlgo{},
 	}
 
 	algoToString = map[AlgorithmType]string{
 		AlgoNone:   "none",
 		AlgoSnappy: "snappy",
 		AlgoLZ4:    "lz4",
+		AlgoZstd:   "zstd",
 	}
 
 	stringToAlgo = map[string]AlgorithmType{
 		"none":   AlgoNone,
 		"snappy": AlgoSnappy,
 		"lz4":    AlgoLZ4,
+		"zstd":   AlgoZstd,
 	}
 )
 
@@ -69,12 +98,98 @@ func (a lz4Algo) Decode(src []byte) ([]byte, error) {
 	return lz4.Decode(nil, src)
 }
 
+// AlgoZstd
+var (
+	// Encoders are expensive to create, but safe for concurrent EncodeAll().
+	// Therefore there is one per encoder speed, created on first use.
+	zstdEncoders sync.Map
+
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+)
+
+// zstdSpeed maps a zstd level to the speed of the encoder (see MaxZstdLevel).
+func zstdSpeed(level int) zstd.EncoderLevel {
+	if level == DefaultLevel {
+		return zstd.SpeedDefault
+	}
+
+	return zstd.EncoderLevelFromZstd(level)
+}
+
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	speed := zstdSpeed(level)
+	if enc, ok := zstdEncoders.Load(speed); ok {
+		return enc.(*zstd.Encoder), nil
+	}
+
+	enc, err := zstd.NewWriter(
+		nil,
+		zstd.WithEncoderLevel(speed),
+		zstd.WithEncoderConcurrency(1),
+		// A chunk always fits into the window. It is not exactly one chunk,
+		// since the encoder skips entropy coding of literals then.
+		zstd.WithWindowSize(2*maxChunkSize),
+		zstd.WithZeroFrames(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := zstdEncoders.LoadOrStore(speed, enc)
+	return actual.(*zstd.Encoder), nil
+}
+
+func (a zstdAlgo) Encode(src []byte) ([]byte, error) {
+	enc, err := zstdEncoder(a.level)
+	if err != nil {
+		return nil, err
+	}
+
+	return enc.EncodeAll(src, nil), nil
+}
+
+func (a zstdAlgo) Decode(src []byte) ([]byte, error) {
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, zstdDecoderErr = zstd.NewReader(
+			nil,
+			zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(maxChunkSize),
+		)
+	})
+
+	if zstdDecoderErr != nil {
+		return nil, zstdDecoderErr
+	}
+
+	return zstdDecoder.DecodeAll(src, nil)
+}
+
 // AlgorithmFromType returns an interface to the given AlgorithmType
 func AlgorithmFromType(a AlgorithmType) (Algorithm, error) {
-	if algo, ok := AlgoMap[a]; ok {
+	return AlgorithmWithLevel(a, DefaultLevel)
+}
+
+// AlgorithmWithLevel is like AlgorithmFromType, but also sets the
+// compression level. Only zstd knows levels (1-22, see MaxZstdLevel
+// for how they map to the encoder); all other algorithms only accept
+// DefaultLevel.
+func AlgorithmWithLevel(a AlgorithmType, level int) (Algorithm, error) {
+	algo, ok := AlgoMap[a]
+	if !ok {
+		return nil, ErrBadAlgo
+	}
+
+	if level == DefaultLevel {
 		return algo, nil
 	}
-	return nil, ErrBadAlgo
+
+	if a != AlgoZstd || level < 0 || level > MaxZstdLevel {
+		return nil, ErrBadLevel
+	}
+
+	return zstdAlgo{level: level}, nil
 }
 
 // AlgoToString converts a algorithm type to a string.
@@ -0,0 +1,105 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"floo/util/testutil"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// levelsOf returns every level `algo` accepts.
+func levelsOf(algo AlgorithmType) []int {
+	levels := []int{DefaultLevel}
+	if algo == AlgoZstd {
+		for level := 1; level <= MaxZstdLevel; level++ {
+			levels = append(levels, level)
+		}
+	}
+
+	return levels
+}
+
+func TestRoundTripAllLevels(t *testing.T) {
+	// More than one chunk, with an odd sized last one:
+	data := testutil.CreateDummyBuf(3*maxChunkSize + 17)
+
+	for algo := range AlgoMap {
+		for _, level := range levelsOf(algo) {
+			algo, level := algo, level
+			t.Run(fmt.Sprintf("%s-%d", AlgoToString(algo), level), func(t *testing.T) {
+				packed, err := PackLevel(data, algo, level)
+				require.Nil(t, err)
+
+				// The header stores the algorithm in the lower
+				// and the level in the upper byte:
+				hdr, err := readHeader(packed[:headerSize])
+				require.Nil(t, err)
+				require.Equal(t, algo, hdr.algo)
+				require.Equal(t, level, hdr.level)
+
+				algoField := binary.LittleEndian.Uint16(packed[10:12])
+				require.Equal(t, byte(algo), byte(algoField))
+				require.Equal(t, byte(level), byte(algoField>>8))
+
+				r := NewReader(bytes.NewReader(packed))
+				readAlgo, readLevel, err := r.Algorithm()
+				require.Nil(t, err)
+				require.Equal(t, algo, readAlgo)
+				require.Equal(t, level, readLevel)
+
+				unpacked, err := Unpack(packed)
+				require.Nil(t, err)
+				require.Equal(t, data, unpacked)
+			})
+		}
+	}
+}
+
+func TestRoundTripEmpty(t *testing.T) {
+	for algo := range AlgoMap {
+		packed, err := Pack(nil, algo)
+		require.Nil(t, err)
+
+		unpacked, err := Unpack(packed)
+		require.Nil(t, err)
+		require.Empty(t, unpacked)
+	}
+}
+
+func TestBadLevels(t *testing.T) {
+	for algo := range AlgoMap {
+		for _, level := range []int{-1, MaxZstdLevel + 1} {
+			_, err := AlgorithmWithLevel(algo, level)
+			require.Equal(t, ErrBadLevel, err)
+		}
+
+		if algo != AlgoZstd {
+			_, err := AlgorithmWithLevel(algo, 1)
+			require.Equal(t, ErrBadLevel, err)
+		}
+	}
+
+	_, err := AlgorithmWithLevel(AlgorithmType(0xFF), DefaultLevel)
+	require.Equal(t, ErrBadAlgo, err)
+}
+
+func TestZstdSpeed(t *testing.T) {
+	expected := map[int]zstd.EncoderLevel{
+		DefaultLevel: zstd.SpeedDefault,
+		1:            zstd.SpeedFastest,
+		2:            zstd.SpeedFastest,
+		3:            zstd.SpeedDefault,
+		5:            zstd.SpeedDefault,
+		6:            zstd.SpeedBetterCompression,
+		9:            zstd.SpeedBetterCompression,
+		10:           zstd.SpeedBestCompression,
+		MaxZstdLevel: zstd.SpeedBestCompression,
+	}
+
+	for level, speed := range expected {
+		require.Equal(t, speed, zstdSpeed(level), "level: %d", level)
+	}
+}
@@ -20,12 +20,17 @@ const (
 	//AlgoLZ4 represents the lz4 compression algorithm:
 	// https://en.wikipedia.org/wiki/LZ4_(compression_algorithm)
 	AlgoLZ4
+
+	// AlgoZstd represents the zstandard compression algorithm:
+	// https://en.wikipedia.org/wiki/Zstandard
+	// It compresses better than snappy and lz4, but is slower.
+	AlgoZstd
 )
 
 // IsValid returns true if `at` is a valid algorithm type.
 func (at AlgorithmType) IsValid() bool {
 	switch at {
-	case AlgoNone, AlgoSnappy, AlgoLZ4:
+	case AlgoNone, AlgoSnappy, AlgoLZ4, AlgoZstd:
 		return true
 	}
 
@@ -97,12 +102,16 @@ func (rc *record) unmarshal(buf []byte) {
 
 type header struct {
 	algo    AlgorithmType
+	level   int
 	version uint16
 }
 
-func makeHeader(algo AlgorithmType, version byte) []byte {
+// makeHeader builds the header of a stream. The algorithm field has two bytes:
+// The lower one is the algorithm, the upper one the compression level.
+// The level is not needed for decompression; it's only there for information.
+func makeHeader(algo AlgorithmType, level int, version byte) []byte {
 	algoField := make([]byte, 2)
-	binary.LittleEndian.PutUint16(algoField, uint16(algo))
+	binary.LittleEndian.PutUint16(algoField, uint16(algo)|uint16(level)<<8)
 
 	versionField := make([]byte, 2)
 	binary.LittleEndian.PutUint16(versionField, uint16(version))
@@ -129,13 +138,15 @@ func readHeader(bHeader []byte) (*header, error) {
 		return nil, ErrBadAlgorithm
 	}
 
-	algo := AlgorithmType(binary.LittleEndian.Uint16(bHeader[10:12]))
+	algoField := binary.LittleEndian.Uint16(bHeader[10:12])
+	algo := AlgorithmType(algoField & 0xFF)
 	if !algo.IsValid() {
 		return nil, ErrBadAlgorithm
 	}
 
 	return &header{
 		algo:    algo,
+		level:   int(algoField >> 8),
 		version: version,
 	}, nil
 }
@@ -143,8 +154,13 @@ func readHeader(bHeader []byte) (*header, error) {
 // Pack compresses `data` with `algo` and returns the resulting data.
 // This is a convinience method meant to be used for small data packages.
 func Pack(data []byte, algo AlgorithmType) ([]byte, error) {
+	return PackLevel(data, algo, DefaultLevel)
+}
+
+// PackLevel is like Pack, but with a compression level (see NewWriterLevel).
+func PackLevel(data []byte, algo AlgorithmType, level int) ([]byte, error) {
 	zipBuf := &bytes.Buffer{}
-	zipW, err := NewWriter(zipBuf, algo)
+	zipW, err := NewWriterLevel(zipBuf, algo, level)
 	if err != nil {
 		return nil, err
 	}
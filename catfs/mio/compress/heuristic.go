@@ -1,11 +1,14 @@
 package compress
 
 import (
+	"io"
+	"math"
 	"mime"
 	"net/http"
 	"path/filepath"
 	"strings"
 
+	"github.com/golang/snappy"
 	"github.com/sdemontfort/go-mimemagic"
 )
 
@@ -23,6 +26,24 @@ var (
 const (
 	// HeaderSizeThreshold is the number of bytes needed to enable compression at all.
 	HeaderSizeThreshold = 2048
+
+	// SampleSize is the size of a single sample read by GuessAlgorithmSampled.
+	SampleSize = 16 * 1024
+
+	// SampleCount is the number of samples taken after the header.
+	SampleCount = 4
+)
+
+const (
+	// Data that shrinks less than this is not worth compressing.
+	incompressibleRatio = 0.95
+
+	// Data in between this and incompressibleRatio might go either way;
+	// the mime type decides for it.
+	ambiguousRatio = 0.8
+
+	// Data that shrinks more than this is worth spending time on.
+	thoroughRatio = 0.5
 )
 
 func guessMime(path string, buf []byte) string {
@@ -54,25 +75,110 @@ func isCompressible(mimetype string) bool {
 	return CompressibleMapping[mimetype]
 }
 
+// entropy returns the shannon entropy of `buf` in bits per byte (0-8).
+func entropy(buf []byte) float64 {
+	if len(buf) == 0 {
+		return 0
+	}
+
+	counts := [256]int{}
+	for _, b := range buf {
+		counts[b]++
+	}
+
+	bits := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+
+		p := float64(count) / float64(len(buf))
+		bits -= p * math.Log2(p)
+	}
+
+	return bits
+}
+
+// estimateRatio guesses the compressed to raw size ratio of `samples`.
+// A trial compression with snappy finds repetitions, while the entropy
+// finds skewed byte distributions that only entropy coders (like zstd)
+// can make use of. The better of both estimates is taken.
+func estimateRatio(samples [][]byte) float64 {
+	raw, trial, bits := 0, 0, 0.0
+	for _, sample := range samples {
+		raw += len(sample)
+		trial += len(snappy.Encode(nil, sample))
+		bits += entropy(sample) * float64(len(sample))
+	}
+
+	if raw == 0 {
+		return 1
+	}
+
+	return math.Min(float64(trial)/float64(raw), bits/8/float64(raw))
+}
+
+func chooseAlgorithm(mime string, ratio float64) AlgorithmType {
+	switch {
+	case ratio <= thoroughRatio:
+		// Data that shrinks a lot deserves some thorough compression:
+		return AlgoZstd
+	case ratio < ambiguousRatio:
+		// text like files too, since they are usually read as a whole.
+		if strings.HasPrefix(mime, "text/") {
+			return AlgoZstd
+		}
+
+		return AlgoSnappy
+	case ratio < incompressibleRatio && isCompressible(mime):
+		return AlgoSnappy
+	default:
+		return AlgoNone
+	}
+}
+
 // GuessAlgorithm takes the path name and the header data of it
 // and tries to guess a suitable compression algorithm.
+// The decision is made by looking at the data; the mime type
+// is only used for data that might go either way.
 func GuessAlgorithm(path string, header []byte) (AlgorithmType, error) {
 	if len(header) < HeaderSizeThreshold {
 		return AlgoNone, nil
 	}
 
 	mime := guessMime(path, header)
-	compressible := isCompressible(mime)
+	return chooseAlgorithm(mime, estimateRatio([][]byte{header})), nil
+}
 
-	if !compressible {
+// GuessAlgorithmSampled is like GuessAlgorithm, but looks at more than the
+// header. Besides the header, SampleCount samples are read from evenly
+// spaced offsets of `r`, which is `size` bytes big. This catches files
+// whose header looks different from the rest, like archives with a
+// plain text table of contents.
+func GuessAlgorithmSampled(path string, r io.ReaderAt, size int64) (AlgorithmType, error) {
+	if size < HeaderSizeThreshold {
 		return AlgoNone, nil
 	}
 
-	// text like files probably deserve some thorough compression:
-	if strings.HasPrefix(mime, "text/") {
-		return AlgoLZ4, nil
+	samples := [][]byte{}
+	step, end := size/(SampleCount+1), int64(0)
+	for idx := int64(0); idx <= SampleCount; idx++ {
+		off := idx * step
+		if idx > 0 && off < end {
+			// Small file; the previous sample already covered this.
+			continue
+		}
+
+		sample := make([]byte, SampleSize)
+		n, err := r.ReadAt(sample, off)
+		if err != nil && err != io.EOF {
+			return AlgoNone, err
+		}
+
+		samples = append(samples, sample[:n])
+		end = off + int64(n)
 	}
 
-	// fallback to snappy for generic files:
-	return AlgoSnappy, nil
+	mime := guessMime(path, samples[0])
+	return chooseAlgorithm(mime, estimateRatio(samples)), nil
 }
@@ -2,6 +2,7 @@ package compress
 
 import (
 	"bytes"
+	"floo/catfs/mio/blockcache"
 	"floo/catfs/mio/chunkbuf"
 	"fmt"
 	"io"
@@ -21,6 +22,9 @@ type Reader struct {
 	// Structure with parsed trailer.
 	trailer *trailer
 
+	// Structure with parsed header.
+	header *header
+
 	// Current seek offset in the compressed stream.
 	zipSeekOffset int64
 
@@ -34,6 +38,30 @@ type Reader struct {
 	algo Algorithm
 
 	decodeBuf *bytes.Buffer
+
+	// Optional cache for decompressed chunks and the stream's name in it.
+	cache       *blockcache.Cache
+	cacheStream string
+
+	// Index of the chunk read last; used to detect sequential reads.
+	prevChunk int
+}
+
+// SetCache makes the reader look up decompressed chunks in `cache` before
+// reading them, and add the ones it reads. `stream` names the data in the
+// cache and has to be unique for it, e.g. the backend hash. When reading
+// sequentially, the next chunks are read ahead as configured in the cache.
+func (r *Reader) SetCache(cache *blockcache.Cache, stream string) {
+	r.cache = cache
+	r.cacheStream = stream
+}
+
+func (r *Reader) cacheKey(chunkIdx int) blockcache.Key {
+	return blockcache.Key{
+		Stream: r.cacheStream,
+		Layer:  blockcache.LayerCompress,
+		Block:  int64(chunkIdx),
+	}
 }
 
 // Seek implements io.Seeker
@@ -123,6 +151,8 @@ func (r *Reader) parseTrailerIfNeeded() error {
 		return err
 	}
 
+	r.header = header
+
 	// goto the end of file and read the trailer
 	if _, err := r.zipR.Seek(-trailerSize, io.SeekEnd); err != nil {
 		return err
@@ -184,19 +214,73 @@ func (r *Reader) parseTrailerIfNeeded() error {
 	return nil
 }
 
+// Algorithm returns the algorithm and the compression level
+// that were used to write the stream, as recorded in its header.
+func (r *Reader) Algorithm() (AlgorithmType, int, error) {
+	if err := r.parseTrailerIfNeeded(); err != nil {
+		return 0, 0, err
+	}
+
+	return r.header.algo, r.header.level, nil
+}
+
+// ChunkInfo is the position of a single chunk in the stream.
+type ChunkInfo struct {
+	// RawOffset is the offset of the chunk in the uncompressed data.
+	RawOffset int64
+
+	// ZipOffset is the offset of the chunk in the compressed stream.
+	ZipOffset int64
+}
+
+// StreamInfo describes a compressed stream as stored in its header and trailer.
+type StreamInfo struct {
+	Version   uint16
+	Algorithm AlgorithmType
+	Level     int
+
+	// Index has one entry for the start of every chunk, plus
+	// a last one that marks the end of the stream.
+	Index []ChunkInfo
+}
+
+// Info returns the parsed header, trailer and index of the stream.
+// It is meant for debugging; normal readers do not need it.
+func (r *Reader) Info() (*StreamInfo, error) {
+	if err := r.parseTrailerIfNeeded(); err != nil {
+		return nil, err
+	}
+
+	info := &StreamInfo{
+		Version:   r.header.version,
+		Algorithm: r.header.algo,
+		Level:     r.header.level,
+	}
+
+	for _, record := range r.index {
+		info.Index = append(info.Index, ChunkInfo{
+			RawOffset: record.rawOff,
+			ZipOffset: record.zipOff,
+		})
+	}
+
+	return info, nil
+}
+
 // Read reads len(p) bytes from the compressed stream into p.
 func (r *Reader) Read(p []byte) (int, error) {
 	if err := r.parseTrailerIfNeeded(); err != nil {
-		return 0, nil
+		return 0, err
 	}
 
 	// handle stream using compression
 	read := 0
 	for {
 		if r.chunkBuf.Len() != 0 {
+			// io.EOF only means that the current chunk is exhausted.
 			n, err := r.chunkBuf.Read(p)
-			if err != nil {
-				return 0, err
+			if err != nil && err != io.EOF {
+				return read, err
 			}
 
 			r.rawSeekOffset += int64(n)
@@ -246,6 +330,20 @@ func (r *Reader) WriteTo(w io.Writer) (int64, error) {
 	}
 }
 
+// chunkIndex returns the index of the record where the chunk
+// that contains the compressed offset `zipOff` starts.
+func (r *Reader) chunkIndex(zipOff int64) int {
+	idx := sort.Search(len(r.index), func(i int) bool {
+		return r.index[i].zipOff > zipOff
+	})
+
+	if idx > 0 {
+		idx--
+	}
+
+	return idx
+}
+
 func (r *Reader) fixZipChunk() (int64, error) {
 	// Get the start and end record of the chunk currOff is located in between.
 	prevRecord, currRecord := r.chunkLookup(r.zipSeekOffset, false)
@@ -259,11 +357,6 @@ func (r *Reader) fixZipChunk() (int64, error) {
 		return 0, io.EOF
 	}
 
-	// Set Reader to compressed offset.
-	if _, err := r.zipR.Seek(prevRecord.zipOff, io.SeekStart); err != nil {
-		return 0, err
-	}
-
 	r.zipSeekOffset = currRecord.zipOff
 	r.rawSeekOffset = prevRecord.rawOff
 	r.isInitialRead = false
@@ -273,26 +366,87 @@ func (r *Reader) fixZipChunk() (int64, error) {
 func (r *Reader) readZipChunk() ([]byte, error) {
 	// Get current position of the Reader; offset of the compressed file.
 	r.chunkBuf.Reset()
+	chunkIdx := r.chunkIndex(r.zipSeekOffset)
 	chunkSize, err := r.fixZipChunk()
 	if err != nil {
 		return nil, err
 	}
 
-	r.decodeBuf.Reset()
-	_, err = io.CopyN(r.decodeBuf, r.zipR, chunkSize)
+	if r.cache != nil {
+		if decData, ok := r.cache.Get(r.cacheKey(chunkIdx)); ok {
+			r.prevChunk = chunkIdx
+			r.chunkBuf = chunkbuf.NewChunkBuffer(decData)
+			return decData, nil
+		}
+	}
+
+	// Set Reader to compressed offset.
+	if _, err := r.zipR.Seek(r.index[chunkIdx].zipOff, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	decData, err := r.decodeChunk(chunkSize)
 	if err != nil {
 		return nil, err
 	}
 
+	if r.cache != nil {
+		// decData might point into decodeBuf, which
+		// is reused by read-ahead and later reads:
+		decData = append([]byte{}, decData...)
+		r.cache.Put(r.cacheKey(chunkIdx), decData)
+		if chunkIdx == r.prevChunk+1 {
+			r.readAhead(chunkIdx)
+		}
+
+		r.prevChunk = chunkIdx
+	}
+
+	r.chunkBuf = chunkbuf.NewChunkBuffer(decData)
+	return decData, nil
+}
+
+// decodeChunk reads `chunkSize` compressed bytes from the current
+// position of the underlying stream and decompresses them.
+func (r *Reader) decodeChunk(chunkSize int64) ([]byte, error) {
+	r.decodeBuf.Reset()
+	if _, err := io.CopyN(r.decodeBuf, r.zipR, chunkSize); err != nil {
+		return nil, err
+	}
+
 	decData, err := r.algo.Decode(r.decodeBuf.Bytes())
 	if err != nil {
 		return nil, err
 	}
 
-	r.chunkBuf = chunkbuf.NewChunkBuffer(decData)
+	// Some algorithms decode empty chunks to nil,
+	// which chunkbuf would take as "allocate a full chunk".
+	if decData == nil {
+		decData = []byte{}
+	}
+
 	return decData, nil
 }
 
+// readAhead decompresses the chunks after `chunkIdx` into the cache.
+// The underlying stream is expected to be at the end of that chunk.
+// Errors are ignored; they show up when the chunk is actually read.
+func (r *Reader) readAhead(chunkIdx int) {
+	for idx := chunkIdx + 1; idx <= chunkIdx+r.cache.ReadAhead() && idx+1 < len(r.index); idx++ {
+		key := r.cacheKey(idx)
+		if r.cache.Has(key) {
+			break
+		}
+
+		decData, err := r.decodeChunk(r.index[idx+1].zipOff - r.index[idx].zipOff)
+		if err != nil {
+			break
+		}
+
+		r.cache.Prefetch(key, append([]byte{}, decData...))
+	}
+}
+
 // NewReader returns a new ReadSeeker with compression support.
 // As random access is the purpose of this layer, a ReadSeeker is required as parameter.
 // The used compression algorithm is chosen based on header information.
@@ -301,5 +455,6 @@ func NewReader(r io.ReadSeeker) *Reader {
 		zipR:      r,
 		decodeBuf: &bytes.Buffer{},
 		chunkBuf:  chunkbuf.NewChunkBuffer([]byte{}),
+		prevChunk: -1,
 	}
 }
@@ -2,10 +2,17 @@ package compress
 
 import (
 	"bytes"
+	"floo/catfs/mio/workpool"
 	"floo/util"
 	"io"
 )
 
+// zipChunk is a compressed chunk, as produced by the worker pool.
+type zipChunk struct {
+	rawSize int
+	data    []byte
+}
+
 // Writer implements a compression writer.
 type Writer struct {
 	// Underlying raw, uncompressed data stream.
@@ -32,8 +39,14 @@ type Writer struct {
 	// Type of the algorithm
 	algoType AlgorithmType
 
+	// Compression level, recorded in the header.
+	level int
+
 	// Becomes true after the first write.
 	headerWritten bool
+
+	// Compresses chunks in parallel if not nil; see SetWorkers().
+	pool *workpool.Pool[zipChunk]
 }
 
 func (w *Writer) Write(p []byte) (n int, err error) {
@@ -69,23 +82,54 @@ func (w *Writer) flushBuffer(data []byte) error {
 	if len(data) < 0 {
 		return nil
 	}
-	// add record with start offset of the current chunk
-	w.addRecordToIndex()
 
-	// compress and flush current chunk
-	encData, err := w.algo.Encode(data)
+	if w.pool == nil {
+		encData, err := w.algo.Encode(data)
+		if err != nil {
+			return err
+		}
+
+		return w.writeChunk(len(data), encData)
+	}
+
+	// `data` is reused by the caller once we return:
+	data = append([]byte(nil), data...)
+	w.pool.Submit(func() (zipChunk, error) {
+		encData, err := w.algo.Encode(data)
+		return zipChunk{rawSize: len(data), data: encData}, err
+	})
+
+	for w.pool.Full() {
+		if err := w.writeNextChunk(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeNextChunk writes the oldest chunk compressed by the pool.
+func (w *Writer) writeNextChunk() error {
+	chunk, err := w.pool.Next()
 	if err != nil {
 		return err
 	}
+
+	return w.writeChunk(chunk.rawSize, chunk.data)
+}
+
+// writeChunk writes a compressed chunk and remembers it in the index.
+func (w *Writer) writeChunk(rawSize int, encData []byte) error {
+	// add record with start offset of the current chunk
+	w.addRecordToIndex()
+
 	n, err := w.rawW.Write(encData)
 	if err != nil {
 		return err
 	}
 
 	// update offset for the current chunk
-	// the compressed data offset is updated in the background
-	// using a SizeAccumulator in combination with a MultiWriter
-	w.rawOff += int64(len(data))
+	w.rawOff += int64(rawSize)
 	w.zipOff += int64(n)
 	return nil
 }
@@ -95,7 +139,7 @@ func (w *Writer) writeHeaderIfNeeded() error {
 		return nil
 	}
 
-	if _, err := w.rawW.Write(makeHeader(w.algoType, currentVersion)); err != nil {
+	if _, err := w.rawW.Write(makeHeader(w.algoType, w.level, currentVersion)); err != nil {
 		return err
 	}
 
@@ -132,7 +176,16 @@ func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
 
 // NewWriter returns a Writer with compression support.
 func NewWriter(w io.Writer, algoType AlgorithmType) (*Writer, error) {
-	algo, err := AlgorithmFromType(algoType)
+	return NewWriterLevel(w, algoType, DefaultLevel)
+}
+
+// NewWriterLevel is like NewWriter, but compresses with `level`.
+// Only AlgoZstd supports levels other than DefaultLevel (1-22,
+// higher is slower but smaller; see MaxZstdLevel for the speeds
+// they map to). Each chunk is compressed on its own, so the
+// stream stays seekable with every level.
+func NewWriterLevel(w io.Writer, algoType AlgorithmType, level int) (*Writer, error) {
+	algo, err := AlgorithmWithLevel(algoType, level)
 	if err != nil {
 		return nil, err
 	}
@@ -140,13 +193,28 @@ func NewWriter(w io.Writer, algoType AlgorithmType) (*Writer, error) {
 		rawW:     w,
 		algo:     algo,
 		algoType: algoType,
+		level:    level,
 		chunkBuf: &bytes.Buffer{},
 		trailer:  &trailer{},
 	}, nil
 }
 
+// SetWorkers makes the writer compress up to `workers` chunks in parallel.
+// The output is exactly the same as with a single worker, which is the
+// default. It has to be called before the first write; Close() has to be
+// called to stop the workers.
+func (w *Writer) SetWorkers(workers int) {
+	if workers > 1 && w.pool == nil {
+		w.pool = workpool.New[zipChunk](workers)
+	}
+}
+
 // Close cleans up all internal resources
 func (w *Writer) Close() error {
+	if w.pool != nil {
+		defer w.pool.Close()
+	}
+
 	if err := w.writeHeaderIfNeeded(); err != nil {
 		return err
 	}
@@ -155,6 +223,13 @@ func (w *Writer) Close() error {
 	if err := w.flushBuffer(w.chunkBuf.Bytes()); err != nil {
 		return err
 	}
+
+	for w.pool != nil && w.pool.Pending() > 0 {
+		if err := w.writeNextChunk(); err != nil {
+			return err
+		}
+	}
+
 	w.addRecordToIndex()
 
 	// handle trailer of uncompressed file
@@ -0,0 +1,122 @@
+package encrypt
+
+import (
+	"bytes"
+	"floo/util/testutil"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("01234567890ABCDE01234567890ABCDE")
+
+func encryptData(t *testing.T, data, key []byte, cipherType uint16, workers int) []byte {
+	out := &bytes.Buffer{}
+	w, err := NewWriterWithType(out, key, cipherType)
+	require.Nil(t, err)
+
+	w.SetWorkers(workers)
+	_, err = w.Write(data)
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	return out.Bytes()
+}
+
+func TestReadVersions(t *testing.T) {
+	data := testutil.CreateDummyBuf(3*defaultMaxBlockSize + 123)
+
+	for _, cipherType := range []uint16{aeadCipherAES, aeadCipherChaCha, aeadCipherXChaCha} {
+		encrypted := encryptData(t, data, testKey, cipherType, 1)
+
+		r, err := NewReader(bytes.NewReader(encrypted), testKey)
+		require.Nil(t, err)
+
+		decrypted, err := io.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, data, decrypted)
+		require.Equal(t, versionForCipher(cipherType), r.info.Version)
+
+		// SEEK_END needs to know the layout of the version:
+		pos, err := r.Seek(-200, io.SeekEnd)
+		require.Nil(t, err)
+		require.Equal(t, int64(len(data)-200), pos)
+
+		rest, err := io.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, data[len(data)-200:], rest)
+
+		// Random access into the middle of a block:
+		pos, err = r.Seek(defaultMaxBlockSize+10, io.SeekStart)
+		require.Nil(t, err)
+		require.Equal(t, int64(defaultMaxBlockSize+10), pos)
+
+		buf := make([]byte, 100)
+		_, err = io.ReadFull(r, buf)
+		require.Nil(t, err)
+		require.Equal(t, data[defaultMaxBlockSize+10:defaultMaxBlockSize+110], buf)
+	}
+}
+
+func TestRandomNoncePrefix(t *testing.T) {
+	data := testutil.CreateDummyBuf(1024)
+
+	// Same data and key must not produce the same stream:
+	a := encryptData(t, data, testKey, aeadCipherXChaCha, 1)
+	b := encryptData(t, data, testKey, aeadCipherXChaCha, 1)
+	require.Equal(t, len(a), len(b))
+	require.NotEqual(t, a, b)
+	require.Equal(t, headerSizeV2, len(a)-blockNumSize-len(data)-16)
+}
+
+func TestKeyCommitment(t *testing.T) {
+	encrypted := encryptData(t, []byte("hello"), testKey, aeadCipherXChaCha, 1)
+
+	otherKey := bytes.Repeat([]byte{0x42}, KeySize)
+	r, err := NewReader(bytes.NewReader(encrypted), otherKey)
+	require.Nil(t, err)
+
+	_, err = io.ReadAll(r)
+	require.Equal(t, ErrBadKeyCommitment, err)
+
+	// A forged header does not pass the MAC:
+	encrypted[commonHeaderSize] ^= 0xFF
+	_, err = ParseHeader(encrypted, testKey)
+	require.NotNil(t, err)
+}
+
+func TestParallelIdentical(t *testing.T) {
+	oldRandReader := randReader
+	defer func() { randReader = oldRandReader }()
+
+	data := testutil.CreateRandomDummyBuf(10*defaultMaxBlockSize+1, 42)
+	for _, cipherType := range []uint16{aeadCipherAES, aeadCipherXChaCha} {
+		randReader = bytes.NewReader(make([]byte, noncePrefixSize))
+		serial := encryptData(t, data, testKey, cipherType, 1)
+
+		randReader = bytes.NewReader(make([]byte, noncePrefixSize))
+		parallel := encryptData(t, data, testKey, cipherType, 4)
+
+		require.True(t, bytes.Equal(serial, parallel))
+	}
+}
+
+func TestBlockError(t *testing.T) {
+	data := testutil.CreateDummyBuf(3 * defaultMaxBlockSize)
+	encrypted := encryptData(t, data, testKey, aeadCipherXChaCha, 1)
+
+	// Flip a bit in the payload of the second block:
+	blockSize := blockNumSize + defaultMaxBlockSize + 16
+	encrypted[headerSizeV2+blockSize+100] ^= 1
+
+	r, err := NewReader(bytes.NewReader(encrypted), testKey)
+	require.Nil(t, err)
+
+	n, err := io.Copy(io.Discard, r)
+	require.Equal(t, int64(defaultMaxBlockSize), n)
+
+	blockErr, ok := err.(*BlockError)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, uint64(1), blockErr.Block)
+	require.Equal(t, int64(headerSizeV2+blockSize), blockErr.Offset)
+}
@@ -5,7 +5,7 @@ file format look like this:
 
 [HEADER][[BLOCKHEADER][PAYLOAD]...]
 
-HEADER is 36 bytes big, contains following fields:
+HEADER is 36 bytes big in version 1, contains following fields:
 	-	8-byte: Magic Number (to identify non-floo files quickly)
 	-	2-Byte: Format version
     -   2-Byte: Used cipher type (ChaCha20 or AES-GCM currently)
@@ -13,8 +13,19 @@ HEADER is 36 bytes big, contains following fields:
 	-	4-byte: Block size (the last one may be smaller)
 	-  16-byte: MAC (protect the header from forgery)
 
-BLOCKHEADER is 8 bytes big,  contains following fields:
-	-	8 byte: Nonce (derived from current block number)
+Version 2 uses XChaCha20-Poly1305 and has two more fields before the MAC,
+making the header 84 bytes big:
+	-  16-byte: Random nonce prefix, chosen anew for every stream
+	-  32-byte: Key commitment (proves which key the stream was written with)
+
+BLOCKHEADER contains following fields:
+	-	Version 1: Nonce (derived from current block number, NonceSize() bytes)
+	-	Version 2: 8 byte block number; the nonce is the prefix plus the block number
+
+In version 1 the nonces only depend on the block number, so writing
+different data with the same key reuses nonces. Version 2 derives a
+separate key for every stream from the key and the random prefix,
+so this cannot happen anymore. Version 1 is only kept for reading.
 
 PAYLOAD contains the actual encrypted data, including a MAC at the end
 The size of the MAC depends on the algorithm, for poly1305 it is 16 bytes
@@ -34,30 +45,92 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/sha3"
+	"io"
 )
 
 const (
 	aeadCipherChaCha = iota
 	aeadCipherAES
+	aeadCipherXChaCha
+)
+
+// Cipher types that can be passed to NewWriterWithType. CipherXChaCha20
+// is the default and writes format version 2; the others write version 1.
+const (
+	CipherChaCha20  uint16 = aeadCipherChaCha
+	CipherAESGCM    uint16 = aeadCipherAES
+	CipherXChaCha20 uint16 = aeadCipherXChaCha
 )
 
+var cipherNames = map[uint16]string{
+	CipherChaCha20:  "chacha20",
+	CipherAESGCM:    "aes-gcm",
+	CipherXChaCha20: "xchacha20",
+}
+
+// CipherName returns a human readable name of `cipherType`.
+func CipherName(cipherType uint16) string {
+	if name, ok := cipherNames[cipherType]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown(%d)", cipherType)
+}
+
+// CipherByName is the reverse of CipherName.
+// An empty name selects the default cipher.
+func CipherByName(name string) (uint16, error) {
+	if name == "" {
+		return defaultCipherType, nil
+	}
+
+	for cipherType, cipherName := range cipherNames {
+		if cipherName == name {
+			return cipherType, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no such cipher: %s", name)
+}
+
 // Other constants:
 const (
 	// Size of the header mac:
 	macSize = 16
 
-	// current file format version, increment on incompatible changes.
-	version = 1
+	// Format versions; increment on incompatible changes.
+	version1 = 1
+	version2 = 2
+
+	// Size of the random nonce prefix in version 2:
+	noncePrefixSize = 16
+
+	// Size of the key commitment in version 2:
+	commitmentSize = 32
+
+	// Size of the header fields common to all versions (without MAC):
+	commonHeaderSize = 20
 
 	// Size of the initial header:
-	headerSize = 20 + macSize
+	headerSize = commonHeaderSize + macSize
+
+	// Size of the version 2 header:
+	headerSizeV2 = commonHeaderSize + noncePrefixSize + commitmentSize + macSize
+
+	// MaxHeaderSize is the size of the biggest header of all versions.
+	MaxHeaderSize = headerSizeV2
+
+	// Size of the block number in front of each block in version 2:
+	blockNumSize = 8
 
-	// Chacha20 appears to be twice as fast as AES-GCM on my machine
-	defaultCipherType = aeadCipherAES
+	// XChaCha20 is the only cipher with nonces big enough for a random prefix.
+	defaultCipherType = aeadCipherXChaCha
 
 	// Default maxBlockSize if not set
 	defaultMaxBlockSize = 64 * 1024
@@ -75,28 +148,59 @@ var (
 	}
 )
 
+var (
+	// ErrBadKeyCommitment is returned when a version 2 stream
+	// was written with a different key than the one given.
+	ErrBadKeyCommitment = errors.New("key commitment differs: wrong key")
+
+	// randReader is the source of nonce prefixes; replaced in tests.
+	randReader io.Reader = rand.Reader
+)
+
 // KeySize of the used cipher's key in bytes.
 var KeySize = chacha20poly1305.KeySize
 
-// GenerateHeader generates a valid header for the format file
-func GenerateHeader(key []byte, maxBlockSize int64, cipher uint16) []byte {
-	// This is in big endian:
-	header := []byte{
-		// floo's magic number (8 Byte):
-		0, 0, 0, 0, 0, 0, 0, 0,
-		// File format version (2 Byte):
-		0, 0,
-		// Cipher type (2 Byte):
-		0, 0,
-		// Key length (4 Byte):
-		0, 0, 0, 0,
-		// Block length (4 Byte):
-		0, 0, 0, 0,
-		// MAC Header (16 Byte):
-		0, 0, 0, 0, 0, 0, 0, 0,
-		0, 0, 0, 0, 0, 0, 0, 0,
+// versionForCipher returns the format version streams with `cipherType` are written in.
+func versionForCipher(cipherType uint16) uint16 {
+	if cipherType == aeadCipherXChaCha {
+		return version2
+	}
+
+	return version1
+}
+
+// headerSizeForVersion returns the size of the header in `version`.
+func headerSizeForVersion(version uint16) int {
+	if version == version2 {
+		return headerSizeV2
 	}
 
+	return headerSize
+}
+
+// deriveStreamKeys returns the key a version 2 stream is encrypted
+// with and the commitment to `key` that is stored in the header.
+func deriveStreamKeys(key, noncePrefix []byte) (streamKey, commitment []byte) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha3.New256, key)
+		mac.Write([]byte(label))
+		mac.Write(noncePrefix)
+		return mac.Sum(nil)
+	}
+
+	return derive("floo stream key\x00"), derive("floo key commitment\x00")
+}
+
+// GenerateHeader generates a valid header for the format file.
+// The version depends on `cipher`; `noncePrefix` is only used
+// by version 2 and must be noncePrefixSize bytes long there.
+func GenerateHeader(key []byte, maxBlockSize int64, cipher uint16, noncePrefix []byte) []byte {
+	version := versionForCipher(cipher)
+	size := headerSizeForVersion(version)
+
+	// Layout is described in the package doc:
+	header := make([]byte, size)
+
 	// Magic number
 	copy(header[:len(MagicNumber)], MagicNumber)
 
@@ -108,22 +212,28 @@ func GenerateHeader(key []byte, maxBlockSize int64, cipher uint16) []byte {
 	// Encode max block size
 	binary.LittleEndian.PutUint32(header[16:20], uint32(maxBlockSize))
 
+	if version == version2 {
+		_, commitment := deriveStreamKeys(key, noncePrefix)
+		copy(header[commonHeaderSize:], noncePrefix)
+		copy(header[commonHeaderSize+noncePrefixSize:], commitment)
+	}
+
 	// Calculate a MAC of the header. This needs to be done last.
 	headerMac := hmac.New(sha3.New224, key)
-	if _, err := headerMac.Write(header[:(headerSize - macSize)]); err != nil {
+	if _, err := headerMac.Write(header[:(size - macSize)]); err != nil {
 		return nil
 	}
 
 	// Copy the MAC to the output
 	shortHeaderMac := headerMac.Sum(nil)[:macSize]
-	copy(header[headerSize-macSize:headerSize], shortHeaderMac)
+	copy(header[size-macSize:size], shortHeaderMac)
 
 	return header
 }
 
 // HeaderInfo represents a parsed header.
 type HeaderInfo struct {
-	// Version of the file format. Currently, it's always 1.
+	// Version of the file format; either 1 or 2.
 	Version uint16
 
 	// Cipher type used in the file.
@@ -135,13 +245,42 @@ type HeaderInfo struct {
 	// Blocklen is the max number of bytes in a block.
 	// The last block may be smaller.
 	Blocklen uint32
+
+	// NoncePrefix is the random start of every nonce.
+	// It is only set for version 2.
+	NoncePrefix []byte
+}
+
+// HeaderSize returns the size of the header in bytes.
+func (info *HeaderInfo) HeaderSize() int {
+	return headerSizeForVersion(info.Version)
+}
+
+// PeekHeaderSize returns the size of the whole header, given at least
+// the first commonHeaderSize bytes of it.
+func PeekHeaderSize(header []byte) (int, error) {
+	if len(header) < commonHeaderSize || !bytes.Equal(header[:len(MagicNumber)], MagicNumber) {
+		return 0, fmt.Errorf("magic number in header differs")
+	}
+
+	switch version := binary.LittleEndian.Uint16(header[8:10]); version {
+	case version1, version2:
+		return headerSizeForVersion(version), nil
+	default:
+		return 0, fmt.Errorf("unsupported format version: %d", version)
+	}
 }
 
 // ParseHeader parses the header of the format file
 // returns the flags, key and block length.
 func ParseHeader(header, key []byte) (*HeaderInfo, error) {
-	if bytes.Compare(header[:len(MagicNumber)], MagicNumber) != 0 {
-		return nil, fmt.Errorf("magic number in header differs")
+	size, err := PeekHeaderSize(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(header) < size {
+		return nil, fmt.Errorf("header is too short: %d < %d", len(header), size)
 	}
 
 	version := binary.LittleEndian.Uint16(header[8:10])
@@ -149,30 +288,48 @@ func ParseHeader(header, key []byte) (*HeaderInfo, error) {
 	switch cipherType {
 	case aeadCipherAES:
 	case aeadCipherChaCha:
+	case aeadCipherXChaCha:
 		// we support this!
 	default:
 		return nil, fmt.Errorf("unknown cipher type: %d", cipherType)
 	}
+
+	if versionForCipher(cipherType) != version {
+		return nil, fmt.Errorf("cipher type %d is not allowed in version %d", cipherType, version)
+	}
+
 	keylen := binary.LittleEndian.Uint32(header[12:16])
 	blocklen := binary.LittleEndian.Uint32(header[16:20])
 
+	var noncePrefix []byte
+	if version == version2 {
+		noncePrefix = header[commonHeaderSize : commonHeaderSize+noncePrefixSize]
+		storedCommitment := header[commonHeaderSize+noncePrefixSize : size-macSize]
+
+		_, commitment := deriveStreamKeys(key, noncePrefix)
+		if !hmac.Equal(commitment, storedCommitment) {
+			return nil, ErrBadKeyCommitment
+		}
+	}
+
 	// check the header MAC
 	headerMac := hmac.New(sha3.New224, key)
-	if _, err := headerMac.Write(header[:headerSize-macSize]); err != nil {
+	if _, err := headerMac.Write(header[:size-macSize]); err != nil {
 		return nil, err
 	}
 
 	shortHeaderMac := headerMac.Sum(nil)[:macSize]
-	storedMac := header[headerSize-macSize : headerSize]
+	storedMac := header[size-macSize : size]
 	if !hmac.Equal(shortHeaderMac, storedMac) {
 		return nil, fmt.Errorf("header MAC differs from expected")
 	}
 
 	return &HeaderInfo{
-		Version:  version,
-		Cipher:   cipherType,
-		Keylen:   keylen,
-		Blocklen: blocklen,
+		Version:     version,
+		Cipher:      cipherType,
+		Keylen:      keylen,
+		Blocklen:    blocklen,
+		NoncePrefix: append([]byte(nil), noncePrefix...),
 	}, nil
 }
 
@@ -184,9 +341,17 @@ type aeadCommon struct {
 	// Nonce that form the first aead.NonceSize() bytes of the output
 	nonce []byte
 
-	// Key used for encryption/decryption
+	// Part of the nonce that is the same for all blocks (version 2).
+	// Only nonce[len(noncePrefix):] is stored in front of each block.
+	noncePrefix []byte
+
+	// Key used for the header
 	key []byte
 
+	// Key used for encryption/decryption of the blocks;
+	// derived from `key` in version 2.
+	aeadKey []byte
+
 	// For more information, see:
 	// https://en.wikipedia.org/wiki/Authenticated_encryption
 	aead cipher.AEAD
@@ -205,6 +370,8 @@ func createAEADWorker(cipherType uint16, key []byte) (cipher.AEAD, error) {
 		return cipher.NewGCM(block)
 	case aeadCipherChaCha:
 		return chacha20poly1305.New(key)
+	case aeadCipherXChaCha:
+		return chacha20poly1305.NewX(key)
 	}
 
 	return nil, fmt.Errorf("no such cipher type: %d", cipherType)
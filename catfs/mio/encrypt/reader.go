@@ -3,10 +3,32 @@ package encrypt
 import (
 	"bytes"
 	"encoding/binary"
+	"floo/catfs/mio/blockcache"
 	"fmt"
 	"io"
 )
 
+// BlockError is returned when a block cannot be read or authenticated.
+type BlockError struct {
+	// Block is the number of the block, counted from zero.
+	Block uint64
+
+	// Offset is where the block starts in the encrypted stream.
+	Offset int64
+
+	Err error
+}
+
+func (be *BlockError) Error() string {
+	return fmt.Sprintf("block %d at offset %d: %v", be.Block, be.Offset, be.Err)
+}
+
+// Unwrap returns the underlying error.
+func (be *BlockError) Unwrap() error {
+	return be.Err
+}
+
+// Reader decrypts the data of a stream written by Writer.
 type Reader struct {
 	io.Reader
 
@@ -39,6 +61,42 @@ type Reader struct {
 	// Total size of the underlying stream in bytes.
 	// This is only set when SEEK_END was used.
 	endOffsetEnc int64
+
+	// Decrypted data of the current block; either decBuf or cached.
+	block []byte
+
+	// Optional cache for decrypted blocks and the stream's name in it.
+	cache       *blockcache.Cache
+	cacheStream string
+
+	// Number of the block read last; used to detect sequential reads.
+	prevBlock int64
+
+	// true if the underlying stream is not at lastEncSeekPos,
+	// because blocks were taken from the cache or read ahead.
+	needSeek bool
+}
+
+// SetCache makes the reader look up decrypted blocks in `cache` before
+// reading them, and add the ones it reads. `stream` names the data in the
+// cache and has to be unique for it, e.g. the backend hash. When reading
+// sequentially, the next blocks are read ahead as configured in the cache.
+// The cache is only used if the underlying reader is an io.Seeker.
+func (r *Reader) SetCache(cache *blockcache.Cache, stream string) {
+	if _, ok := r.Reader.(io.Seeker); !ok {
+		return
+	}
+
+	r.cache = cache
+	r.cacheStream = stream
+}
+
+func (r *Reader) cacheKey(blockNum int64) blockcache.Key {
+	return blockcache.Key{
+		Stream: r.cacheStream,
+		Layer:  blockcache.LayerEncrypt,
+		Block:  blockNum,
+	}
 }
 
 // Read from source and decrypt.
@@ -79,14 +137,23 @@ func (r *Reader) readHeaderIfNotDone() error {
 
 	r.parsedHeader = true
 
+	// The version 1 header is the shortest one; read the rest
+	// once we know how long the header is.
 	header := make([]byte, headerSize)
-	n, err := r.Reader.Read(header)
+	if _, err := io.ReadFull(r.Reader, header); err != nil {
+		return fmt.Errorf("no valid header found, file maybe damaged: %v", err)
+	}
+
+	size, err := PeekHeaderSize(header)
 	if err != nil {
 		return err
 	}
 
-	if n != headerSize {
-		return fmt.Errorf("no valid header found, file maybe damaged")
+	if size > len(header) {
+		header = append(header, make([]byte, size-len(header))...)
+		if _, err := io.ReadFull(r.Reader, header[headerSize:]); err != nil {
+			return fmt.Errorf("no valid header found, file maybe damaged: %v", err)
+		}
 	}
 
 	info, err := ParseHeader(header, r.key)
@@ -94,80 +161,175 @@ func (r *Reader) readHeaderIfNotDone() error {
 		return err
 	}
 
-	if info.Version != 1 {
-		return fmt.Errorf("this implementation does not support versions != 1")
-	}
-
 	if uint32(len(r.key)) != info.Keylen {
 		return fmt.Errorf("key length differs: file=%d, user=%d", info.Keylen, len(r.key))
 	}
 
 	r.info = info
-	if err := r.initAeadCommon(r.key, info.Cipher, int64(r.info.Blocklen)); err != nil {
+	if err := r.initAeadCommon(r.key, info.Cipher, int64(r.info.Blocklen), info.NoncePrefix); err != nil {
 		return err
 	}
 
-	r.lastEncSeekPos += headerSize
+	r.lastEncSeekPos += int64(size)
 	r.decBuf = make([]byte, 0, r.info.Blocklen)
 	return nil
 }
 
-func (c *aeadCommon) initAeadCommon(key []byte, cipherType uint16, maxBlockSize int64) error {
-	aead, err := createAEADWorker(cipherType, key)
+func (c *aeadCommon) initAeadCommon(key []byte, cipherType uint16, maxBlockSize int64, noncePrefix []byte) error {
+	aeadKey := key
+	if versionForCipher(cipherType) == version2 {
+		if len(noncePrefix) != noncePrefixSize {
+			return fmt.Errorf("bad nonce prefix size: %d", len(noncePrefix))
+		}
+
+		aeadKey, _ = deriveStreamKeys(key, noncePrefix)
+	}
+
+	aead, err := createAEADWorker(cipherType, aeadKey)
 	if err != nil {
 		return err
 	}
 
 	c.nonce = make([]byte, aead.NonceSize())
+	copy(c.nonce, noncePrefix)
+	c.noncePrefix = noncePrefix
 	c.aead = aead
 	c.key = key
+	c.aeadKey = aeadKey
 	c.encBuf = make([]byte, 0, maxBlockSize+int64(aead.Overhead()))
 	return nil
 }
 
+// blockHeader returns the part of the nonce stored in front of each block.
+// It starts with the block number in both versions.
+func (c *aeadCommon) blockHeader() []byte {
+	return c.nonce[len(c.noncePrefix):]
+}
+
 // Fill internal buffer with current block
 func (r *Reader) readBlock() (int, error) {
 	if r.info == nil {
 		return 0, fmt.Errorf("invalid header data")
 	}
 
-	// Read nonce:
-	if n, err := r.Reader.Read(r.nonce); err != nil {
+	blockNum := r.lastDecSeekPos / int64(r.info.Blocklen)
+	if r.cache != nil {
+		if data, ok := r.cache.Get(r.cacheKey(blockNum)); ok {
+			r.lastEncSeekPos += int64(len(r.blockHeader()) + len(data) + r.aead.Overhead())
+			r.needSeek = true
+			r.prevBlock = blockNum
+			r.setBlock(data)
+			return len(data), nil
+		}
+
+		if r.needSeek {
+			if _, err := r.Reader.(io.Seeker).Seek(r.lastEncSeekPos, io.SeekStart); err != nil {
+				return 0, err
+			}
+
+			r.needSeek = false
+		}
+	}
+
+	var err error
+	r.decBuf, err = r.decryptNextBlock(uint64(blockNum), r.decBuf[:0])
+	if err != nil {
 		return 0, err
-	} else if n != r.aead.NonceSize() {
-		return 0, fmt.Errorf("nonce size mismatch; should: %d - have: %d",
-			r.aead.NonceSize(), n)
+	}
+
+	r.setBlock(r.decBuf)
+
+	if r.cache != nil {
+		r.cache.Put(r.cacheKey(blockNum), append([]byte(nil), r.decBuf...))
+		if blockNum == r.prevBlock+1 && len(r.decBuf) == int(r.info.Blocklen) {
+			r.readAhead(blockNum)
+		}
+
+		r.prevBlock = blockNum
+	}
+
+	return len(r.decBuf), nil
+}
+
+func (r *Reader) setBlock(data []byte) {
+	r.block = data
+	r.backlog = bytes.NewReader(data)
+	r.isInitialRead = false
+}
+
+// decryptNextBlock reads the block at the current position of the
+// underlying stream, checks that it is block `blockNum` and appends
+// its decrypted data to `dst`.
+func (r *Reader) decryptNextBlock(blockNum uint64, dst []byte) ([]byte, error) {
+	// Read nonce:
+	blockHeader := r.blockHeader()
+	if n, err := r.Reader.Read(blockHeader); err != nil {
+		return nil, err
+	} else if n != len(blockHeader) {
+		return nil, fmt.Errorf("nonce size mismatch; should: %d - have: %d",
+			len(blockHeader), n)
 	}
 
 	// Convert to block number:
-	readBlockNum := binary.LittleEndian.Uint64(r.nonce)
+	readBlockNum := binary.LittleEndian.Uint64(blockHeader)
 
 	// Check the block number:
-	currBlockNum := uint64(r.lastDecSeekPos / int64(r.info.Blocklen))
-	if currBlockNum != readBlockNum {
-		return 0, fmt.Errorf(
-			"bad block number; as %d, should be %d", readBlockNum, currBlockNum,
-		)
+	blockOffset := r.lastEncSeekPos
+	if blockNum != readBlockNum {
+		return nil, &BlockError{
+			Block:  blockNum,
+			Offset: blockOffset,
+			Err: fmt.Errorf(
+				"bad block number; as %d, should be %d", readBlockNum, blockNum,
+			),
+		}
 	}
 
 	// Read the *whole* block from the raw stream
 	N := int(r.info.Blocklen) + r.aead.Overhead()
 	n, err := io.ReadAtLeast(r.Reader, r.encBuf[:N], N)
 	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		return 0, err
+		return nil, err
 	}
 
-	r.lastEncSeekPos += int64(n) + int64(len(r.nonce))
+	r.lastEncSeekPos += int64(n) + int64(len(blockHeader))
 
-	r.decBuf, err = r.aead.Open(r.decBuf[:0], r.nonce, r.encBuf[:n], nil)
+	dst, err = r.aead.Open(dst, r.nonce, r.encBuf[:n], nil)
 	if err != nil {
-		return 0, err
+		return nil, &BlockError{Block: blockNum, Offset: blockOffset, Err: err}
 	}
 
-	r.backlog = bytes.NewReader(r.decBuf)
-	r.isInitialRead = false
+	return dst, nil
+}
 
-	return len(r.decBuf), nil
+// readAhead decrypts the blocks after `blockNum` into the cache.
+// Errors are ignored; they show up when the block is actually read.
+func (r *Reader) readAhead(blockNum int64) {
+	// lastEncSeekPos is only moved for consistency in decryptNextBlock;
+	// the current position stays where the last block ended.
+	encPos := r.lastEncSeekPos
+	defer func() {
+		r.lastEncSeekPos = encPos
+	}()
+
+	for idx := int64(1); idx <= int64(r.cache.ReadAhead()); idx++ {
+		key := r.cacheKey(blockNum + idx)
+		if r.cache.Has(key) {
+			break
+		}
+
+		r.needSeek = true
+		data, err := r.decryptNextBlock(uint64(key.Block), nil)
+		if err != nil || len(data) == 0 {
+			break
+		}
+
+		r.cache.Prefetch(key, data)
+		if len(data) < int(r.info.Blocklen) {
+			// Last block of the stream.
+			break
+		}
+	}
 }
 
 // Seek into the encrypted data
@@ -188,7 +350,8 @@ func (r *Reader) Seek(offset int64, whence int) (int64, error) {
 	wasMoved := false
 
 	// [nonce][block data][auth tag]
-	blockHeaderSize := int64(r.aead.NonceSize())
+	blockHeaderSize := int64(len(r.blockHeader()))
+	hdrSize := int64(r.info.HeaderSize())
 	blockOverhead := blockHeaderSize + int64(r.aead.Overhead())
 	totalBlockSize := blockOverhead + int64(r.info.Blocklen)
 
@@ -219,7 +382,7 @@ func (r *Reader) Seek(offset int64, whence int) (int64, error) {
 			r.endOffsetEnc = endOffsetEnc
 		}
 
-		encLen := r.endOffsetEnc - headerSize
+		encLen := r.endOffsetEnc - hdrSize
 		encRest := encLen % totalBlockSize
 		decBlocks := encLen / totalBlockSize
 
@@ -253,7 +416,7 @@ func (r *Reader) Seek(offset int64, whence int) (int64, error) {
 	}
 
 	// Convert decrypted offset to encrypted offset
-	absOffsetEnc := headerSize + ((absOffsetDec / int64(r.info.Blocklen)) * totalBlockSize)
+	absOffsetEnc := hdrSize + ((absOffsetDec / int64(r.info.Blocklen)) * totalBlockSize)
 
 	// Check if we're still in the same block as last time:
 	blockNum := absOffsetEnc / totalBlockSize
@@ -270,6 +433,8 @@ func (r *Reader) Seek(offset int64, whence int) (int64, error) {
 			return 0, err
 		}
 
+		r.needSeek = false
+
 		// Make read consume the current block:
 		if _, err := r.readBlock(); err != nil {
 			return 0, err
@@ -313,7 +478,7 @@ func (r *Reader) WriteTo(w io.Writer) (int64, error) {
 
 		r.lastDecSeekPos += int64(nread)
 
-		nwrite, werr := w.Write(r.decBuf[:nread])
+		nwrite, werr := w.Write(r.block[:nread])
 		if werr != nil {
 			return n, werr
 		}
@@ -340,10 +505,11 @@ func NewReader(r io.Reader, key []byte) (*Reader, error) {
 		parsedHeader:  false,
 		isInitialRead: true,
 		endOffsetEnc:  -1,
+		prevBlock:     -1,
 		aeadCommon: aeadCommon{
 			key: key,
 		},
 	}
 
 	return reader, nil
-}
\ No newline at end of file
+}
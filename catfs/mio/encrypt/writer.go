@@ -2,9 +2,13 @@ package encrypt
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"floo/catfs/mio/workpool"
+	"fmt"
 	"io"
+	"sync"
 )
 
 var (
@@ -38,6 +42,12 @@ type Writer struct {
 
 	// Used encryption algorithm
 	cipher uint16
+
+	// Encrypts blocks in parallel if not nil; see SetWorkers().
+	pool *workpool.Pool[[]byte]
+
+	// AEADs for the workers of `pool`.
+	aeads sync.Pool
 }
 
 // GoodDecBufferSize returns a buffer size that is suitable for decryption.
@@ -53,7 +63,7 @@ func (w *Writer) GoodEncBufferSize() int64 {
 func (w *Writer) emitHeaderIfNeeded() error {
 	if !w.headerWritten {
 		w.headerWritten = true
-		header := GenerateHeader(w.key, w.maxBlockSize, w.cipher)
+		header := GenerateHeader(w.key, w.maxBlockSize, w.cipher, w.noncePrefix)
 
 		if _, err := w.Writer.Write(header); err != nil {
 			return err
@@ -84,14 +94,18 @@ func (w *Writer) Write(p []byte) (int, error) {
 }
 
 func (w *Writer) flushPack(pack []byte) (int, error) {
+	if w.pool != nil {
+		return 0, w.submitPack(pack)
+	}
+
 	// Create a new Nonce for this block:
-	binary.LittleEndian.PutUint64(w.nonce, w.blockCount)
+	binary.LittleEndian.PutUint64(w.blockHeader(), w.blockCount)
 
 	// Encrypt the text:
 	w.encBuf = w.aead.Seal(w.encBuf[:0], w.nonce, pack, nil)
 
 	// Pass it to the underlying writer:
-	nNonce, err := w.Writer.Write(w.nonce)
+	nNonce, err := w.Writer.Write(w.blockHeader())
 	if err != nil {
 		return nNonce, err
 	}
@@ -101,9 +115,71 @@ func (w *Writer) flushPack(pack []byte) (int, error) {
 	return nNonce + nBuf, err
 }
 
+// submitPack lets the pool encrypt `pack` and writes
+// the oldest encrypted blocks if enough are pending.
+func (w *Writer) submitPack(pack []byte) error {
+	// `pack` is reused by the caller once we return:
+	pack = append([]byte(nil), pack...)
+	blockNum := w.blockCount
+	w.blockCount++
+
+	w.pool.Submit(func() ([]byte, error) {
+		aead, ok := w.aeads.Get().(cipher.AEAD)
+		if !ok {
+			var err error
+			if aead, err = createAEADWorker(w.cipher, w.aeadKey); err != nil {
+				return nil, err
+			}
+		}
+
+		defer w.aeads.Put(aead)
+
+		nonce := make([]byte, aead.NonceSize())
+		copy(nonce, w.noncePrefix)
+		blockHeader := nonce[len(w.noncePrefix):]
+		binary.LittleEndian.PutUint64(blockHeader, blockNum)
+
+		block := make([]byte, 0, len(blockHeader)+len(pack)+aead.Overhead())
+		block = append(block, blockHeader...)
+		return aead.Seal(block, nonce, pack, nil), nil
+	})
+
+	for w.pool.Full() {
+		if err := w.writeNextPack(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) writeNextPack() error {
+	block, err := w.pool.Next()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Writer.Write(block)
+	return err
+}
+
+// SetWorkers makes the writer encrypt up to `workers` blocks in parallel.
+// The output is exactly the same as with a single worker, which is the
+// default. It has to be called before the first write; Close() has to be
+// called to stop the workers.
+func (w *Writer) SetWorkers(workers int) {
+	if workers > 1 && w.pool == nil {
+		w.pool = workpool.New[[]byte](workers)
+	}
+}
+
 // Close the Writer and write any left-over blocks
 // This does not close the underlying data stream.
 func (w *Writer) Close() error {
+	if w.pool != nil {
+		defer w.pool.Close()
+	}
+
 	if err := w.emitHeaderIfNeeded(); err != nil {
 		return err
 	}
@@ -119,6 +195,13 @@ func (w *Writer) Close() error {
 			return err
 		}
 	}
+
+	for w.pool != nil && w.pool.Pending() > 0 {
+		if err := w.writeNextPack(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -173,6 +256,22 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 	return n, nil
 }
 
+// SetNoncePrefix replaces the random nonce prefix of a version 2 stream.
+// This is only useful to get reproducible output, e.g. in tests: a prefix
+// must never be used twice with the same key. It has to be called before
+// the first write.
+func (w *Writer) SetNoncePrefix(noncePrefix []byte) error {
+	if w.headerWritten {
+		return fmt.Errorf("nonce prefix can only be set before the first write")
+	}
+
+	if versionForCipher(w.cipher) != version2 {
+		return fmt.Errorf("only version 2 streams have a nonce prefix")
+	}
+
+	return w.initAeadCommon(w.key, w.cipher, w.maxBlockSize, noncePrefix)
+}
+
 // NewWriter calls NewWriterWithTypeAndBlockSize with a sane default cipher type
 // and a sane default max block size.
 func NewWriter(w io.Writer, key []byte) (*Writer, error) {
@@ -185,8 +284,8 @@ func NewWriterWithType(w io.Writer, key []byte, cipherType uint16) (*Writer, err
 }
 
 // NewWriterWithTypeAndBlockSize returns a new Writer which encrypts data with a certain key.
-// If `compressionFlag` is true, the compression flag in the file header will also be true.
-// Otherwise, no compression is done.
+// XChaCha20 streams are written in format version 2 with a fresh random
+// nonce prefix; the other ciphers produce version 1 streams.
 func NewWriterWithTypeAndBlockSize(w io.Writer, key []byte, cipherType uint16, maxBlockSize int64) (*Writer, error) {
 	ew := &Writer{
 		Writer:       w,
@@ -195,7 +294,15 @@ func NewWriterWithTypeAndBlockSize(w io.Writer, key []byte, cipherType uint16, m
 		cipher:       cipherType,
 	}
 
-	if err := ew.initAeadCommon(key, cipherType, ew.maxBlockSize); err != nil {
+	var noncePrefix []byte
+	if versionForCipher(cipherType) == version2 {
+		noncePrefix = make([]byte, noncePrefixSize)
+		if _, err := io.ReadFull(randReader, noncePrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ew.initAeadCommon(key, cipherType, ew.maxBlockSize, noncePrefix); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,242 @@
+package mio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"floo/catfs/mio/compress"
+	"floo/util/testutil"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+const corpusFileSize = 1024 * 1024
+
+var corpusWords = []string{
+	"floo", "is", "a", "distributed", "file", "system", "with", "the", "data",
+	"of", "every", "node", "stored", "encrypted", "and", "compressed", "in",
+	"backend", "commit", "stage", "directory", "hash", "which", "can", "be",
+}
+
+func corpusText(size int) []byte {
+	rnd := rand.New(rand.NewSource(42))
+	buf := &bytes.Buffer{}
+	for buf.Len() < size {
+		buf.WriteString(corpusWords[rnd.Intn(len(corpusWords))])
+		if rnd.Intn(12) == 0 {
+			buf.WriteString(".\n")
+		} else {
+			buf.WriteString(" ")
+		}
+	}
+
+	return buf.Bytes()[:size]
+}
+
+func corpusJSON(size int) []byte {
+	rnd := rand.New(rand.NewSource(23))
+	buf := &bytes.Buffer{}
+	buf.WriteString("[\n")
+	for idx := 0; buf.Len() < size; idx++ {
+		fmt.Fprintf(
+			buf,
+			"  {\"id\": %d, \"path\": \"/dir/%s\", \"size\": %d, \"pinned\": %t},\n",
+			idx, corpusWords[rnd.Intn(len(corpusWords))], rnd.Intn(1<<20), rnd.Intn(2) == 0,
+		)
+	}
+
+	return buf.Bytes()[:size]
+}
+
+func corpusGzip(size int) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	for buf.Len() < size {
+		w.Write(testutil.CreateRandomDummyBuf(4096, int64(buf.Len())))
+		w.Flush()
+	}
+
+	w.Close()
+	return buf.Bytes()[:size]
+}
+
+func corpusTable(size int) []byte {
+	// Little endian records of small, increasing numbers,
+	// similar to what databases or sensor logs look like.
+	rnd := rand.New(rand.NewSource(7))
+	buf := make([]byte, size)
+	for off, val := 0, uint32(0); off+8 <= size; off += 8 {
+		val += uint32(rnd.Intn(16))
+		binary.LittleEndian.PutUint32(buf[off:], val)
+		binary.LittleEndian.PutUint32(buf[off+4:], uint32(rnd.Intn(256)))
+	}
+
+	return buf
+}
+
+func corpusBase64(size int) []byte {
+	raw := testutil.CreateRandomDummyBuf(int64(size), 5)
+	return []byte(base64.StdEncoding.EncodeToString(raw))[:size]
+}
+
+func corpusMixed(size int) []byte {
+	// A text header with random data behind it,
+	// e.g. an archive with a plain table of contents.
+	buf := corpusText(compress.SampleSize)
+	return append(buf, testutil.CreateRandomDummyBuf(int64(size-len(buf)), 3)...)
+}
+
+type corpusFile struct {
+	path string
+	data []byte
+
+	// The expected algorithm class; nil if any is fine.
+	expect func(algo compress.AlgorithmType) bool
+}
+
+func isNone(algo compress.AlgorithmType) bool {
+	return algo == compress.AlgoNone
+}
+
+func isSome(algo compress.AlgorithmType) bool {
+	return algo != compress.AlgoNone
+}
+
+func isZstd(algo compress.AlgorithmType) bool {
+	return algo == compress.AlgoZstd
+}
+
+func corpus() []corpusFile {
+	return []corpusFile{
+		{"text.txt", corpusText(corpusFileSize), isZstd},
+		{"data.json", corpusJSON(corpusFileSize), isZstd},
+		{"random.bin", testutil.CreateRandomDummyBuf(corpusFileSize, 42), isNone},
+		{"mislabeled.txt", corpusGzip(corpusFileSize), isNone},
+		{"table.bin", corpusTable(corpusFileSize), isSome},
+		{"base64.dat", corpusBase64(corpusFileSize), isSome},
+		{"mixed.tar", corpusMixed(corpusFileSize), nil},
+	}
+}
+
+func TestGuessAlgorithmCorpus(t *testing.T) {
+	t.Parallel()
+
+	for _, file := range corpus() {
+		header := file.data[:compress.HeaderSizeThreshold]
+		byHeader, err := compress.GuessAlgorithm(file.path, header)
+		require.Nil(t, err)
+
+		sampled, err := compress.GuessAlgorithmSampled(
+			file.path,
+			bytes.NewReader(file.data),
+			int64(len(file.data)),
+		)
+		require.Nil(t, err)
+
+		if file.expect != nil {
+			require.True(t, file.expect(byHeader), "%s: header guess %v", file.path, byHeader)
+			require.True(t, file.expect(sampled), "%s: sampled guess %v", file.path, sampled)
+		}
+	}
+}
+
+func TestGuessAlgorithmSampledSmall(t *testing.T) {
+	t.Parallel()
+
+	data := corpusText(compress.HeaderSizeThreshold - 1)
+	algo, err := compress.GuessAlgorithmSampled("small.txt", bytes.NewReader(data), int64(len(data)))
+	require.Nil(t, err)
+	require.Equal(t, compress.AlgorithmType(compress.AlgoNone), algo)
+
+	// A file smaller than all samples together:
+	data = corpusText(3 * compress.SampleSize)
+	algo, err = compress.GuessAlgorithmSampled("small.txt", bytes.NewReader(data), int64(len(data)))
+	require.Nil(t, err)
+	require.Equal(t, compress.AlgorithmType(compress.AlgoZstd), algo)
+}
+
+func TestGuessAlgorithmStream(t *testing.T) {
+	t.Parallel()
+
+	data := corpusMixed(corpusFileSize)
+	byHeader, err := compress.GuessAlgorithm("mixed.tar", data[:compress.HeaderSizeThreshold])
+	require.Nil(t, err)
+
+	sampled, err := compress.GuessAlgorithmSampled("mixed.tar", bytes.NewReader(data), int64(len(data)))
+	require.Nil(t, err)
+	require.NotEqual(t, byHeader, sampled)
+
+	// Readers that cannot seek only get their header looked at:
+	algo, r, err := GuessAlgorithm("mixed.tar", struct{ io.Reader }{bytes.NewReader(data)})
+	require.Nil(t, err)
+	require.Equal(t, byHeader, algo)
+
+	read, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, data, read)
+
+	// Others are sampled, from their current position on:
+	algo, r, err = GuessAlgorithm("mixed.tar", bytes.NewReader(data))
+	require.Nil(t, err)
+	require.Equal(t, sampled, algo)
+
+	rest := data[compress.SampleSize:]
+	restSampled, err := compress.GuessAlgorithmSampled("mixed.tar", bytes.NewReader(rest), int64(len(rest)))
+	require.Nil(t, err)
+
+	br := bytes.NewReader(data)
+	_, err = br.Seek(compress.SampleSize, io.SeekStart)
+	require.Nil(t, err)
+
+	algo, r, err = GuessAlgorithm("mixed.tar", br)
+	require.Nil(t, err)
+	require.Equal(t, restSampled, algo)
+
+	read, err = io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, rest, read)
+}
+
+// benchmarkGuess runs `guess` on every corpus file and reports
+// the ratio that the chosen algorithm achieved on the whole file.
+func benchmarkGuess(b *testing.B, guess func(file corpusFile) (compress.AlgorithmType, error)) {
+	for _, file := range corpus() {
+		file := file
+		b.Run(file.path, func(b *testing.B) {
+			b.SetBytes(int64(len(file.data)))
+
+			var algo compress.AlgorithmType
+			for idx := 0; idx < b.N; idx++ {
+				var err error
+				if algo, err = guess(file); err != nil {
+					b.Fatalf("guess failed: %v", err)
+				}
+			}
+
+			b.StopTimer()
+			packed, err := compress.Pack(file.data, algo)
+			if err != nil {
+				b.Fatalf("pack failed: %v", err)
+			}
+
+			b.ReportMetric(float64(len(packed))/float64(len(file.data)), "ratio")
+			b.ReportMetric(float64(algo), "algo")
+		})
+	}
+}
+
+func BenchmarkGuessAlgorithm(b *testing.B) {
+	benchmarkGuess(b, func(file corpusFile) (compress.AlgorithmType, error) {
+		return compress.GuessAlgorithm(file.path, file.data[:compress.HeaderSizeThreshold])
+	})
+}
+
+func BenchmarkGuessAlgorithmSampled(b *testing.B) {
+	benchmarkGuess(b, func(file corpusFile) (compress.AlgorithmType, error) {
+		return compress.GuessAlgorithmSampled(file.path, bytes.NewReader(file.data), int64(len(file.data)))
+	})
+}
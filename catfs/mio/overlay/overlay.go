@@ -6,6 +6,10 @@ import (
 	"sort"
 )
 
+// DefaultSpillThreshold is the number of modified bytes a Layer keeps in
+// memory before it moves them to a temporary file.
+const DefaultSpillThreshold = 64 * 1024 * 1024
+
 // Interval represents a 2er set of integers modelling a range.
 type Interval interface {
 	// Range returns the minimum and maximum of the interval.
@@ -24,14 +28,18 @@ type Modification struct {
 	// Offset where the modification started:
 	offset int64
 
-	// Data that was changed:
-	// This might be changed to a mmap'd byte slice later.
+	// Number of bytes that were changed:
+	size int64
+
+	// Data that was changed. It is nil if the data was spilled
+	// to the layer's temporary file, where it can be read by
+	// the same offset it has in the layer.
 	data []byte
 }
 
 // Range returns a fitting integer interval
 func (n *Modification) Range() (int64, int64) {
-	return n.offset, n.offset + int64(len(n.data))
+	return n.offset, n.offset + n.size
 }
 
 // Merge adds the data of another interval where they intersect.
@@ -53,6 +61,15 @@ func (n *Modification) Merge(i Interval) {
 		return
 	}
 
+	// Spilled data is already at the right place in the temp file;
+	// only the range needs to cover both intervals.
+	if n.data == nil || other.data == nil {
+		n.offset = min(nMin, oMin)
+		n.size = max(nMax, oMax) - n.offset
+		other.data = nil
+		return
+	}
+
 	// Prepend non-overlapping data from `other`:
 	if nMin > oMin {
 		n.data = append(other.data[:nMin-oMin], n.data...)
@@ -61,10 +78,12 @@ func (n *Modification) Merge(i Interval) {
 
 	// Append non-overlapping data from `other`:
 	if nMax < oMax {
-		// Append other.data[(other.Max - n.Max):]
-		n.data = append(n.data, other.data[(oMax-nMax-1):]...)
+		// Append other.data[(n.Max - other.Min):]
+		n.data = append(n.data, other.data[(nMax-oMin):]...)
 	}
 
+	n.size = int64(len(n.data))
+
 	// Make sure old data gets invalidated quickly:
 	other.data = nil
 }
@@ -185,23 +204,72 @@ func max(a, b int64) int64 {
 // Layer is an io.ReadWriter that takes an underlying Reader
 // and caches Writes on top of it. To the outside it delivers
 // a zipped stream of the recent writes and the underlying stream.
+//
+// Writes are kept in memory until they exceed the spill threshold.
+// After that, all modified data is moved to a (sparse) temporary file
+// and further writes go there directly. The file is encrypted with a
+// key that is only held in memory; Close() removes it.
 type Layer struct {
 	index    *IntervalIndex
 	r        io.ReadSeeker
 	pos      int64
 	limit    int64
 	fileSize int64
+
+	// Number of bytes allocated for modifications in memory:
+	memSize int64
+
+	// Spill memSize to `spill` when it gets larger than this:
+	spillThreshold int64
+	spill          *spillFile
 }
 
 // NewLayer returns a new in memory layer.
 // No IO is performed on creation.
 func NewLayer(r io.ReadSeeker) *Layer {
 	return &Layer{
-		index:    &IntervalIndex{},
-		r:        r,
-		limit:    -1,
-		fileSize: -1,
+		index:          &IntervalIndex{},
+		r:              r,
+		limit:          -1,
+		fileSize:       -1,
+		spillThreshold: DefaultSpillThreshold,
+	}
+}
+
+// SetSpillThreshold sets the number of modified bytes that may be kept
+// in memory before they are moved to a temporary file.
+// A value < 0 keeps everything in memory.
+func (l *Layer) SetSpillThreshold(threshold int64) {
+	l.spillThreshold = threshold
+}
+
+// Spilled returns true if the modifications are stored in a temporary file.
+func (l *Layer) Spilled() bool {
+	return l.spill != nil
+}
+
+// spillAll moves the data of all modifications to a new temporary file.
+func (l *Layer) spillAll() error {
+	spill, err := newSpillFile()
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range l.index.r {
+		mod := chunk.(*Modification)
+		if _, err := spill.WriteAt(mod.data, mod.offset); err != nil {
+			spill.Remove()
+			return err
+		}
+	}
+
+	for _, chunk := range l.index.r {
+		chunk.(*Modification).data = nil
 	}
+
+	l.spill = spill
+	l.memSize = 0
+	return nil
 }
 
 // SetSize sets the size of the absolute layer.
@@ -213,11 +281,34 @@ func (l *Layer) SetSize(size int64) {
 // If the file was truncated before, the truncate limit is raised again
 // if the write operation extended the limit.
 func (l *Layer) Write(buf []byte) (int, error) {
-	// Copy the buffer, since we cannot rely on it being valid forever.
-	modBuf := make([]byte, len(buf))
-	copy(modBuf, buf)
+	mod := &Modification{offset: l.pos, size: int64(len(buf))}
+	if l.spill != nil {
+		if _, err := l.spill.WriteAt(buf, l.pos); err != nil {
+			return 0, err
+		}
+
+		l.index.Add(mod)
+	} else {
+		// Copy the buffer, since we cannot rely on it being valid forever.
+		mod.data = make([]byte, len(buf))
+		copy(mod.data, buf)
+
+		// The intervals that overlap will be merged into `mod`. Merging
+		// may reuse their buffers, so count what `mod` holds afterwards:
+		for _, chunk := range l.index.Overlays(mod.Range()) {
+			l.memSize -= int64(cap(chunk.(*Modification).data))
+		}
+
+		l.index.Add(mod)
+		l.memSize += int64(cap(mod.data))
+
+		if l.spillThreshold >= 0 && l.memSize > l.spillThreshold {
+			if err := l.spillAll(); err != nil {
+				return 0, err
+			}
+		}
+	}
 
-	l.index.Add(&Modification{l.pos, modBuf})
 	l.pos += int64(len(buf))
 	if l.limit >= 0 && l.pos > l.limit {
 		l.limit = l.pos
@@ -286,7 +377,11 @@ func (l *Layer) Read(buf []byte) (int, error) {
 		overlap, chunkLo, bufLo := int64(b-a), int64(a-lo), int64(a-l.pos)
 
 		// Copy overlapping data:
-		copy(buf[bufLo:bufLo+overlap], mod.data[chunkLo:chunkLo+overlap])
+		if mod.data != nil {
+			copy(buf[bufLo:bufLo+overlap], mod.data[chunkLo:chunkLo+overlap])
+		} else if _, err := l.spill.ReadAt(buf[bufLo:bufLo+overlap], a); err != nil {
+			return 0, err
+		}
 
 		// Extend, if write chunks go over original data stream:
 		// (caller wants max. offset where we wrote data to buf)
@@ -352,8 +447,17 @@ func (l *Layer) Seek(offset int64, whence int) (int64, error) {
 	return l.pos, nil
 }
 
-// Close tries to close the underlying stream (if supported).
+// Close removes the temporary file (if any)
+// and tries to close the underlying stream (if supported).
 func (l *Layer) Close() error {
+	if l.spill != nil {
+		if err := l.spill.Remove(); err != nil {
+			return err
+		}
+
+		l.spill = nil
+	}
+
 	if closer, ok := l.r.(io.Closer); ok {
 		return closer.Close()
 	}
@@ -0,0 +1,246 @@
+package overlay
+
+import (
+	"bytes"
+	"floo/util/testutil"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestMergeContained(t *testing.T) {
+	source := testutil.CreateDummyBuf(1024)
+	l := NewLayer(bytes.NewReader(source))
+
+	outer := bytes.Repeat([]byte{1}, 100)
+	inner := bytes.Repeat([]byte{2}, 10)
+
+	_, err := l.Write(outer)
+	require.Nil(t, err)
+
+	_, err = l.Seek(10, io.SeekStart)
+	require.Nil(t, err)
+
+	_, err = l.Write(inner)
+	require.Nil(t, err)
+
+	expected := append([]byte{}, source...)
+	copy(expected, outer)
+	copy(expected[10:], inner)
+
+	_, err = l.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+
+	got, err := io.ReadAll(l)
+	require.Nil(t, err)
+	require.Equal(t, expected, got)
+}
+
+// testOverlappingWrites writes random, overlapping buffers into windows
+// at large offsets and reads them back.
+func testOverlappingWrites(t *testing.T, threshold int64, shouldSpill bool) {
+	const windowSize = 256 * 1024
+
+	source := testutil.CreateDummyBuf(1024 * 1024)
+	l := NewLayer(bytes.NewReader(source))
+	l.SetSpillThreshold(threshold)
+
+	rnd := rand.New(rand.NewSource(23))
+	bases := []int64{3 << 30, 5 << 30}
+	windows := map[int64][]byte{}
+	for _, base := range bases {
+		windows[base] = make([]byte, windowSize)
+	}
+
+	for idx := 0; idx < 400; idx++ {
+		base := bases[idx%len(bases)]
+		buf := testutil.CreateRandomDummyBuf(rnd.Int63n(8*1024)+1, int64(idx))
+		off := rnd.Int63n(windowSize - int64(len(buf)))
+
+		_, err := l.Seek(base+off, io.SeekStart)
+		require.Nil(t, err)
+
+		n, err := l.Write(buf)
+		require.Nil(t, err)
+		require.Equal(t, len(buf), n)
+
+		copy(windows[base][off:], buf)
+	}
+
+	// Make sure the window ends are written, so reads do not stop early:
+	for _, base := range bases {
+		_, err := l.Seek(base+windowSize-1, io.SeekStart)
+		require.Nil(t, err)
+
+		_, err = l.Write([]byte{42})
+		require.Nil(t, err)
+		windows[base][windowSize-1] = 42
+	}
+
+	require.Equal(t, shouldSpill, l.Spilled())
+	require.Equal(t, bases[len(bases)-1]+windowSize, l.MinSize())
+
+	for _, base := range bases {
+		_, err := l.Seek(base, io.SeekStart)
+		require.Nil(t, err)
+
+		got := make([]byte, windowSize)
+		_, err = io.ReadFull(l, got)
+		require.Nil(t, err)
+		require.Equal(t, windows[base], got)
+	}
+
+	// The underlying data stays visible where nothing was written:
+	_, err := l.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+
+	got := make([]byte, len(source))
+	_, err = io.ReadFull(l, got)
+	require.Nil(t, err)
+	require.Equal(t, source, got)
+
+	var spillPath string
+	if l.Spilled() {
+		spillPath = l.spill.Name()
+	}
+
+	require.Nil(t, l.Close())
+	if spillPath != "" {
+		_, err := os.Stat(spillPath)
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestOverlappingWritesInMemory(t *testing.T) {
+	testOverlappingWrites(t, -1, false)
+}
+
+func TestOverlappingWritesSpilled(t *testing.T) {
+	testOverlappingWrites(t, 64*1024, true)
+}
+
+func TestSpillTruncate(t *testing.T) {
+	source := testutil.CreateDummyBuf(1024)
+	l := NewLayer(bytes.NewReader(source))
+	l.SetSpillThreshold(0)
+
+	_, err := l.Seek(4<<30, io.SeekStart)
+	require.Nil(t, err)
+
+	_, err = l.Write([]byte("hello world"))
+	require.Nil(t, err)
+	require.True(t, l.Spilled())
+
+	l.Truncate(4<<30 + 5)
+
+	_, err = l.Seek(4<<30, io.SeekStart)
+	require.Nil(t, err)
+
+	got, err := io.ReadAll(l)
+	require.Nil(t, err)
+	require.Equal(t, []byte("hello"), got)
+	require.Nil(t, l.Close())
+}
+
+func TestSpillEncrypted(t *testing.T) {
+	l := NewLayer(bytes.NewReader(nil))
+	l.SetSpillThreshold(0)
+
+	secret := bytes.Repeat([]byte("secret file content "), 100)
+	for _, off := range []int64{0, 7, 1 << 20} {
+		_, err := l.Seek(off, io.SeekStart)
+		require.Nil(t, err)
+
+		_, err = l.Write(secret)
+		require.Nil(t, err)
+	}
+
+	require.True(t, l.Spilled())
+
+	raw, err := os.ReadFile(l.spill.Name())
+	require.Nil(t, err)
+	require.False(t, bytes.Contains(raw, []byte("secret")))
+
+	_, err = l.Seek(1<<20+3, io.SeekStart)
+	require.Nil(t, err)
+
+	got := make([]byte, len(secret)-3)
+	_, err = io.ReadFull(l, got)
+	require.Nil(t, err)
+	require.Equal(t, secret[3:], got)
+	require.Nil(t, l.Close())
+}
+
+func TestSpillOverwrite(t *testing.T) {
+	sf, err := newSpillFile()
+	require.Nil(t, err)
+	defer sf.Remove()
+
+	readRaw := func() []byte {
+		raw, err := os.ReadFile(sf.Name())
+		require.Nil(t, err)
+		return raw
+	}
+
+	// Span an extent border, so two extents are sealed:
+	off := int64(spillExtentSize - 100)
+	first := bytes.Repeat([]byte{'a'}, 200)
+	second := bytes.Repeat([]byte{'b'}, 200)
+
+	_, err = sf.WriteAt(first, off)
+	require.Nil(t, err)
+	rawFirst := readRaw()
+
+	_, err = sf.WriteAt(second, off)
+	require.Nil(t, err)
+	rawSecond := readRaw()
+
+	// With a reused key stream, the ciphertexts would differ
+	// exactly like the plaintexts do, i.e. only in 'a' ^ 'b':
+	require.Equal(t, len(rawFirst), len(rawSecond))
+	sameKeyStream := true
+	for idx := range rawFirst {
+		if diff := rawFirst[idx] ^ rawSecond[idx]; diff != 0 && diff != 'a'^'b' {
+			sameKeyStream = false
+			break
+		}
+	}
+
+	require.False(t, sameKeyStream)
+
+	got := make([]byte, len(second))
+	_, err = sf.ReadAt(got, off)
+	require.Nil(t, err)
+	require.Equal(t, second, got)
+
+	// Modified data is not returned:
+	rawSecond[sf.aead.NonceSize()+10] ^= 0x1
+	_, err = sf.fd.WriteAt(rawSecond, 0)
+	require.Nil(t, err)
+
+	_, err = sf.ReadAt(got, off)
+	require.NotNil(t, err)
+}
+
+func TestMemSize(t *testing.T) {
+	l := NewLayer(bytes.NewReader(nil))
+	l.SetSpillThreshold(-1)
+
+	rnd := rand.New(rand.NewSource(42))
+	for idx := 0; idx < 1000; idx++ {
+		_, err := l.Seek(rnd.Int63n(64*1024), io.SeekStart)
+		require.Nil(t, err)
+
+		_, err = l.Write(make([]byte, rnd.Int63n(512)+1))
+		require.Nil(t, err)
+
+		allocated := int64(0)
+		for _, chunk := range l.index.r {
+			allocated += int64(cap(chunk.(*Modification).data))
+		}
+
+		require.Equal(t, allocated, l.memSize)
+	}
+}
@@ -0,0 +1,152 @@
+package overlay
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+)
+
+// spillExtentSize is the number of bytes that are encrypted together.
+const spillExtentSize = 4096
+
+// spillFile is a temporary file that holds the modifications of a Layer.
+// The modifications are decrypted file contents, so they are encrypted
+// with a key that only exists in memory; a file that is left behind
+// after a crash is useless without it.
+//
+// The file is split into extents of spillExtentSize bytes, each sealed
+// with AES-GCM on its own. Every write of an extent seals it again with
+// a fresh nonce, so overwriting data never reuses a key stream. The
+// extent index is authenticated too, so extents can not be swapped.
+type spillFile struct {
+	fd   *os.File
+	aead cipher.AEAD
+
+	// Nonces are a counter; it is never reset for the same key.
+	nonceCounter uint64
+
+	// Extents that were written at least once.
+	written map[int64]bool
+}
+
+func newSpillFile() (*spillFile, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.CreateTemp("", "floo-overlay-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &spillFile{
+		fd:      fd,
+		aead:    aead,
+		written: make(map[int64]bool),
+	}, nil
+}
+
+// sealedExtentSize is the size of an extent in the file:
+// nonce | encrypted extent | tag
+func (sf *spillFile) sealedExtentSize() int64 {
+	return int64(sf.aead.NonceSize() + spillExtentSize + sf.aead.Overhead())
+}
+
+func extentAD(idx int64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(idx))
+	return ad
+}
+
+// readExtent returns the decrypted extent `idx`.
+// Extents that were never written are all zero.
+func (sf *spillFile) readExtent(idx int64) ([]byte, error) {
+	if !sf.written[idx] {
+		return make([]byte, spillExtentSize), nil
+	}
+
+	sealed := make([]byte, sf.sealedExtentSize())
+	if _, err := sf.fd.ReadAt(sealed, idx*sf.sealedExtentSize()); err != nil {
+		return nil, err
+	}
+
+	nonceSize := sf.aead.NonceSize()
+	return sf.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], extentAD(idx))
+}
+
+// writeExtent encrypts `plain` with a fresh nonce and stores it as extent `idx`.
+func (sf *spillFile) writeExtent(idx int64, plain []byte) error {
+	sf.nonceCounter++
+	nonce := make([]byte, sf.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], sf.nonceCounter)
+
+	sealed := sf.aead.Seal(nonce, nonce, plain, extentAD(idx))
+	if _, err := sf.fd.WriteAt(sealed, idx*sf.sealedExtentSize()); err != nil {
+		return err
+	}
+
+	sf.written[idx] = true
+	return nil
+}
+
+func (sf *spillFile) WriteAt(buf []byte, off int64) (int, error) {
+	done := 0
+	for done < len(buf) {
+		curr := off + int64(done)
+		idx, extentOff := curr/spillExtentSize, int(curr%spillExtentSize)
+
+		plain, err := sf.readExtent(idx)
+		if err != nil {
+			return done, err
+		}
+
+		n := copy(plain[extentOff:], buf[done:])
+		if err := sf.writeExtent(idx, plain); err != nil {
+			return done, err
+		}
+
+		done += n
+	}
+
+	return done, nil
+}
+
+func (sf *spillFile) ReadAt(buf []byte, off int64) (int, error) {
+	done := 0
+	for done < len(buf) {
+		curr := off + int64(done)
+		idx, extentOff := curr/spillExtentSize, int(curr%spillExtentSize)
+
+		plain, err := sf.readExtent(idx)
+		if err != nil {
+			return done, err
+		}
+
+		done += copy(buf[done:], plain[extentOff:])
+	}
+
+	return done, nil
+}
+
+func (sf *spillFile) Name() string {
+	return sf.fd.Name()
+}
+
+// Remove closes and removes the file.
+func (sf *spillFile) Remove() error {
+	sf.fd.Close()
+	return os.Remove(sf.fd.Name())
+}
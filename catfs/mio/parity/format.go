@@ -0,0 +1,232 @@
+// Package parity implements an erasure coding layer for mio streams.
+//
+// It sits between encryption and storage: the encrypted stream is cut into
+// groups of `dataShards` shards, and `parityShards` Reed-Solomon parity
+// shards are added to every group. Every shard has a checksum, so damaged
+// shards are known and up to `parityShards` of them can be rebuilt per
+// group. Without this layer a single flipped bit makes a whole encrypted
+// block unreadable.
+//
+// Format:
+//
+//	[STREAM HEADER][STREAM HEADER][GROUP]...
+//
+// The stream header is stored twice, so one damaged copy can be repaired:
+//
+//	[MAGIC (8 bytes)][VERSION (2)][DATA SHARDS (1)][PARITY SHARDS (1)]
+//	[SHARD SIZE (4)][CRC32 of the preceding (4)]
+//
+// A group is:
+//
+//	[GROUP HEADER][GROUP HEADER][SHARD]...
+//
+// with the group header (again stored twice) being:
+//
+//	[DATA LENGTH (4)][CRC32 of every shard (4 each)][CRC32 of the preceding (4)]
+//
+// All groups but the last contain `dataShards * shardSize` bytes of data.
+// The shards of the last group are only as long as needed for its data.
+// All numbers are little endian; checksums use the Castagnoli polynomial.
+package parity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	// DefaultDataShards is the default number of data shards per group.
+	DefaultDataShards = 4
+
+	// DefaultParityShards is the default number of parity shards per group.
+	DefaultParityShards = 2
+
+	// defaultShardSize is the size of a shard in all groups but the last.
+	defaultShardSize = 16 * 1024
+
+	// maxShards is the limit of the Reed-Solomon implementation.
+	maxShards = 256
+
+	version1 = 1
+
+	// streamHeaderSize is the size of one copy of the stream header.
+	streamHeaderSize = 20
+)
+
+var (
+	// MagicNumber is the start of every parity stream.
+	MagicNumber = []byte("floopar\x00")
+
+	// ErrBadHeader is returned when both copies of a header are damaged.
+	ErrBadHeader = errors.New("parity: both header copies are damaged")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// HeaderInfo is the content of the stream header.
+type HeaderInfo struct {
+	Version      uint16
+	DataShards   int
+	ParityShards int
+	ShardSize    int
+}
+
+// groupDataSize is the amount of data in every full group.
+func (hi *HeaderInfo) groupDataSize() int64 {
+	return int64(hi.DataShards) * int64(hi.ShardSize)
+}
+
+// groupHeaderSize is the size of one copy of the group header.
+func (hi *HeaderInfo) groupHeaderSize() int64 {
+	return int64(4 + 4*(hi.DataShards+hi.ParityShards) + 4)
+}
+
+// shardLen returns the size of each shard of a group with `dataLen` bytes.
+func (hi *HeaderInfo) shardLen(dataLen int64) int64 {
+	return (dataLen + int64(hi.DataShards) - 1) / int64(hi.DataShards)
+}
+
+// groupSize returns the size of an encoded group with `dataLen` bytes.
+func (hi *HeaderInfo) groupSize(dataLen int64) int64 {
+	shards := int64(hi.DataShards + hi.ParityShards)
+	return 2*hi.groupHeaderSize() + shards*hi.shardLen(dataLen)
+}
+
+// groupOffset returns where group `group` starts in the encoded stream.
+func (hi *HeaderInfo) groupOffset(group int64) int64 {
+	return 2*streamHeaderSize + group*hi.groupSize(hi.groupDataSize())
+}
+
+func checkShards(dataShards, parityShards int) error {
+	if dataShards < 1 || parityShards < 1 || dataShards+parityShards > maxShards {
+		return fmt.Errorf(
+			"parity: bad shard counts: %d data, %d parity (need >= 1 each, <= %d in total)",
+			dataShards, parityShards, maxShards,
+		)
+	}
+
+	return nil
+}
+
+func generateStreamHeader(info *HeaderInfo) []byte {
+	header := make([]byte, streamHeaderSize)
+	copy(header, MagicNumber)
+	binary.LittleEndian.PutUint16(header[8:], info.Version)
+	header[10] = byte(info.DataShards)
+	header[11] = byte(info.ParityShards)
+	binary.LittleEndian.PutUint32(header[12:], uint32(info.ShardSize))
+	binary.LittleEndian.PutUint32(header[16:], crc32.Checksum(header[:16], castagnoli))
+	return header
+}
+
+func parseStreamHeader(header []byte) (*HeaderInfo, error) {
+	if len(header) != streamHeaderSize {
+		return nil, fmt.Errorf("parity: stream header has wrong size: %d", len(header))
+	}
+
+	if !bytes.Equal(header[:len(MagicNumber)], MagicNumber) {
+		return nil, fmt.Errorf("parity: magic number missing")
+	}
+
+	if crc32.Checksum(header[:16], castagnoli) != binary.LittleEndian.Uint32(header[16:]) {
+		return nil, fmt.Errorf("parity: stream header checksum mismatch")
+	}
+
+	info := &HeaderInfo{
+		Version:      binary.LittleEndian.Uint16(header[8:]),
+		DataShards:   int(header[10]),
+		ParityShards: int(header[11]),
+		ShardSize:    int(binary.LittleEndian.Uint32(header[12:])),
+	}
+
+	if info.Version != version1 {
+		return nil, fmt.Errorf("parity: unknown version: %d", info.Version)
+	}
+
+	if err := checkShards(info.DataShards, info.ParityShards); err != nil {
+		return nil, err
+	}
+
+	if info.ShardSize <= 0 {
+		return nil, fmt.Errorf("parity: bad shard size: %d", info.ShardSize)
+	}
+
+	return info, nil
+}
+
+// groupHeader is the parsed content of a group header.
+type groupHeader struct {
+	dataLen int64
+	crcs    []uint32
+}
+
+func generateGroupHeader(info *HeaderInfo, dataLen int64, shards [][]byte) []byte {
+	header := make([]byte, info.groupHeaderSize())
+	binary.LittleEndian.PutUint32(header, uint32(dataLen))
+	for idx, shard := range shards {
+		binary.LittleEndian.PutUint32(header[4+4*idx:], crc32.Checksum(shard, castagnoli))
+	}
+
+	end := len(header) - 4
+	binary.LittleEndian.PutUint32(header[end:], crc32.Checksum(header[:end], castagnoli))
+	return header
+}
+
+func parseGroupHeader(info *HeaderInfo, header []byte) (*groupHeader, error) {
+	end := len(header) - 4
+	if crc32.Checksum(header[:end], castagnoli) != binary.LittleEndian.Uint32(header[end:]) {
+		return nil, fmt.Errorf("parity: group header checksum mismatch")
+	}
+
+	gh := &groupHeader{dataLen: int64(binary.LittleEndian.Uint32(header))}
+	if gh.dataLen <= 0 || gh.dataLen > info.groupDataSize() {
+		return nil, fmt.Errorf("parity: bad group data length: %d", gh.dataLen)
+	}
+
+	for idx := 0; idx < info.DataShards+info.ParityShards; idx++ {
+		gh.crcs = append(gh.crcs, binary.LittleEndian.Uint32(header[4+4*idx:]))
+	}
+
+	return gh, nil
+}
+
+// pickCopy returns the first of the two header copies in `buf` that
+// `parse` accepts, and a Repair for the other copy if it is damaged.
+func pickCopy[T any](buf []byte, offset int64, parse func([]byte) (T, error)) (T, *Repair, error) {
+	size := len(buf) / 2
+	first, second := buf[:size], buf[size:]
+
+	parsed, err := parse(first)
+	if err == nil {
+		if !bytes.Equal(first, second) {
+			return parsed, &Repair{Offset: offset + int64(size), Data: first}, nil
+		}
+
+		return parsed, nil, nil
+	}
+
+	parsed, secondErr := parse(second)
+	if secondErr != nil {
+		return parsed, nil, ErrBadHeader
+	}
+
+	return parsed, &Repair{Offset: offset, Data: second}, nil
+}
+
+// IsParityStream returns true if `header`, the start of a stream,
+// looks like the start of a parity stream.
+func IsParityStream(header []byte) bool {
+	for _, off := range []int{0, streamHeaderSize} {
+		if len(header) >= off+len(MagicNumber) && bytes.Equal(header[off:off+len(MagicNumber)], MagicNumber) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PeekSize is the number of bytes IsParityStream() wants to see.
+const PeekSize = streamHeaderSize + 8
@@ -0,0 +1,164 @@
+package parity
+
+import (
+	"bytes"
+	"errors"
+	"floo/util/testutil"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func encode(t *testing.T, data []byte, dataShards, parityShards int) []byte {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, dataShards, parityShards)
+	require.Nil(t, err)
+
+	_, err = w.Write(data)
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+// writerAtBuffer is an io.WriterAt over a byte slice.
+type writerAtBuffer []byte
+
+func (wb writerAtBuffer) WriteAt(data []byte, off int64) (int, error) {
+	return copy(wb[off:], data), nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	groupSize := int64(DefaultDataShards * defaultShardSize)
+	for _, size := range []int64{0, 1, 1023, groupSize - 1, groupSize, groupSize + 1, 5*groupSize + 17} {
+		data := testutil.CreateDummyBuf(size)
+		encoded := encode(t, data, DefaultDataShards, DefaultParityShards)
+		require.True(t, IsParityStream(encoded))
+
+		r := NewReader(bytes.NewReader(encoded))
+		decoded, err := io.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, data, decoded, "size %d", size)
+		require.Empty(t, r.Repairs())
+
+		r = NewReader(bytes.NewReader(encoded))
+		end, err := r.Seek(0, io.SeekEnd)
+		require.Nil(t, err)
+		require.Equal(t, size, end)
+	}
+}
+
+func TestBadShardCounts(t *testing.T) {
+	for _, counts := range [][2]int{{0, 1}, {1, 0}, {200, 57}} {
+		_, err := NewWriter(&bytes.Buffer{}, counts[0], counts[1])
+		require.NotNil(t, err)
+	}
+}
+
+func TestRepairOnRead(t *testing.T) {
+	data := testutil.CreateDummyBuf(3*DefaultDataShards*defaultShardSize + 1234)
+	encoded := encode(t, data, DefaultDataShards, DefaultParityShards)
+
+	info, err := NewReader(bytes.NewReader(encoded)).Info()
+	require.Nil(t, err)
+
+	// Damage one copy of the stream header, two shards
+	// of the second group and one copy of a group header:
+	damaged := append([]byte{}, encoded...)
+	group := info.groupOffset(1)
+	shards := group + 2*info.groupHeaderSize()
+	damaged[3] ^= 0xFF
+	damaged[shards+10] ^= 0x01
+	damaged[shards+int64(info.ShardSize)*4+20] ^= 0x01
+	damaged[info.groupOffset(2)+1] ^= 0x01
+
+	repaired := []Repair{}
+	r := NewReader(bytes.NewReader(damaged))
+	r.SetRepairHandler(func(repair Repair) {
+		repaired = append(repaired, repair)
+	})
+
+	decoded, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, data, decoded)
+	require.Len(t, r.Repairs(), 4)
+	require.Equal(t, r.Repairs(), repaired)
+
+	offsets := []int64{}
+	for _, repair := range r.Repairs() {
+		offsets = append(offsets, repair.Offset)
+		require.Equal(t, encoded[repair.Offset:repair.Offset+int64(len(repair.Data))], repair.Data)
+	}
+
+	require.Equal(t, []int64{
+		0,
+		shards,
+		shards + int64(info.ShardSize)*4,
+		info.groupOffset(2),
+	}, offsets)
+
+	// Reading the same groups again does not report them twice:
+	_, err = r.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+	_, err = io.ReadAll(r)
+	require.Nil(t, err)
+	require.Len(t, r.Repairs(), 4)
+}
+
+func TestTooManyDamagedShards(t *testing.T) {
+	data := testutil.CreateDummyBuf(2 * DefaultDataShards * defaultShardSize)
+	encoded := encode(t, data, DefaultDataShards, 1)
+
+	info, err := NewReader(bytes.NewReader(encoded)).Info()
+	require.Nil(t, err)
+
+	shards := info.groupOffset(1) + 2*info.groupHeaderSize()
+	encoded[shards] ^= 0x01
+	encoded[shards+int64(info.ShardSize)] ^= 0x01
+
+	r := NewReader(bytes.NewReader(encoded))
+	n, err := io.Copy(io.Discard, r)
+	require.Equal(t, info.groupDataSize(), n)
+
+	groupErr := &GroupError{}
+	require.True(t, errors.As(err, &groupErr))
+	require.Equal(t, int64(1), groupErr.Group)
+	require.Equal(t, 2, groupErr.Damaged)
+}
+
+func TestTruncated(t *testing.T) {
+	data := testutil.CreateDummyBuf(DefaultDataShards*defaultShardSize + 5000)
+	encoded := encode(t, data, DefaultDataShards, DefaultParityShards)
+
+	// Losing the last parity shard is fine:
+	info, err := NewReader(bytes.NewReader(encoded)).Info()
+	require.Nil(t, err)
+
+	lastShardLen := info.shardLen(5000)
+	decoded, err := io.ReadAll(NewReader(bytes.NewReader(encoded[:int64(len(encoded))-lastShardLen])))
+	require.Nil(t, err)
+	require.Equal(t, data, decoded)
+}
+
+func TestScrub(t *testing.T) {
+	data := testutil.CreateDummyBuf(4*DefaultDataShards*defaultShardSize + 99)
+	encoded := encode(t, data, DefaultDataShards, DefaultParityShards)
+
+	damaged := append([]byte{}, encoded...)
+	for _, off := range []int64{streamHeaderSize + 2, 1000, 200000, int64(len(damaged)) - 1} {
+		damaged[off] ^= 0x42
+	}
+
+	repairs, err := Scrub(bytes.NewReader(damaged), nil)
+	require.Nil(t, err)
+	require.Len(t, repairs, 4)
+	require.NotEqual(t, encoded, damaged)
+
+	repairs, err = Scrub(bytes.NewReader(damaged), writerAtBuffer(damaged))
+	require.Nil(t, err)
+	require.Len(t, repairs, 4)
+	require.Equal(t, encoded, damaged)
+
+	repairs, err = Scrub(bytes.NewReader(damaged), nil)
+	require.Nil(t, err)
+	require.Empty(t, repairs)
+}
@@ -0,0 +1,357 @@
+package parity
+
+import (
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"hash/crc32"
+	"io"
+)
+
+// Repair is a part of a parity stream that was damaged and was rebuilt.
+type Repair struct {
+	// Offset is where the damaged part starts in the parity stream.
+	Offset int64
+
+	// Data is the correct content of the damaged part.
+	Data []byte
+}
+
+// GroupError is returned when a group has more damaged shards than
+// there are parity shards, so its data cannot be rebuilt.
+type GroupError struct {
+	// Group is the number of the group, counted from zero.
+	Group int64
+
+	// Offset is where the group starts in the parity stream.
+	Offset int64
+
+	// Damaged is the number of damaged or missing shards.
+	Damaged int
+
+	Err error
+}
+
+func (ge *GroupError) Error() string {
+	return fmt.Sprintf(
+		"parity: group %d at offset %d has %d damaged shards: %v",
+		ge.Group, ge.Offset, ge.Damaged, ge.Err,
+	)
+}
+
+// Unwrap returns the underlying error.
+func (ge *GroupError) Unwrap() error {
+	return ge.Err
+}
+
+// Reader returns the data of a stream written by Writer.
+// Damaged shards are rebuilt on the fly; see Repairs().
+type Reader struct {
+	r    io.Reader
+	info *HeaderInfo
+	dec  reedsolomon.Encoder
+
+	// Current position in the data and in the underlying stream.
+	pos    int64
+	encPos int64
+
+	// Number and data of the group that is loaded; group is -1 if none.
+	group int64
+	data  []byte
+
+	// Size of the data; -1 until it is needed by Seek().
+	size int64
+
+	repairs  []Repair
+	reported map[int64]bool
+	onRepair func(Repair)
+}
+
+// NewReader returns a new Reader that reads from `r`.
+// Seeking is only supported if `r` is an io.Seeker.
+// No IO is done until the first read.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:        r,
+		group:    -1,
+		size:     -1,
+		reported: make(map[int64]bool),
+	}
+}
+
+// SetRepairHandler makes the reader call `fn` for every repaired part
+// of the stream, as soon as it is repaired.
+func (pr *Reader) SetRepairHandler(fn func(Repair)) {
+	pr.onRepair = fn
+}
+
+// Repairs returns all parts of the stream that were repaired so far.
+// Each part is only reported once, even if it was read several times.
+func (pr *Reader) Repairs() []Repair {
+	return pr.repairs
+}
+
+// Info returns the parsed stream header.
+func (pr *Reader) Info() (*HeaderInfo, error) {
+	if err := pr.readHeaderIfNotDone(); err != nil {
+		return nil, err
+	}
+
+	return pr.info, nil
+}
+
+func (pr *Reader) addRepair(repair *Repair) {
+	if repair == nil || pr.reported[repair.Offset] {
+		return
+	}
+
+	pr.reported[repair.Offset] = true
+	pr.repairs = append(pr.repairs, *repair)
+	if pr.onRepair != nil {
+		pr.onRepair(*repair)
+	}
+}
+
+func (pr *Reader) readHeaderIfNotDone() error {
+	if pr.info != nil {
+		return nil
+	}
+
+	buf := make([]byte, 2*streamHeaderSize)
+	if _, err := io.ReadFull(pr.r, buf); err != nil {
+		return fmt.Errorf("parity: no valid header found: %v", err)
+	}
+
+	pr.encPos = int64(len(buf))
+	info, repair, err := pickCopy(buf, 0, parseStreamHeader)
+	if err != nil {
+		return err
+	}
+
+	dec, err := reedsolomon.New(info.DataShards, info.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	pr.info = info
+	pr.dec = dec
+	pr.addRepair(repair)
+	return nil
+}
+
+func (pr *Reader) seekEnc(offset int64) error {
+	if pr.encPos == offset {
+		return nil
+	}
+
+	seeker, ok := pr.r.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("parity: seek is not supported by underlying stream")
+	}
+
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	pr.encPos = offset
+	return nil
+}
+
+// loadGroup reads group number `group`, rebuilding damaged shards.
+// io.EOF is returned if the stream has no such group.
+func (pr *Reader) loadGroup(group int64) error {
+	offset := pr.info.groupOffset(group)
+	if err := pr.seekEnc(offset); err != nil {
+		return err
+	}
+
+	headerBuf := make([]byte, 2*pr.info.groupHeaderSize())
+	n, err := io.ReadFull(pr.r, headerBuf)
+	pr.encPos += int64(n)
+	if err == io.EOF {
+		return io.EOF
+	}
+
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	parse := func(buf []byte) (*groupHeader, error) {
+		return parseGroupHeader(pr.info, buf)
+	}
+
+	header, repair, err := pickCopy(headerBuf, offset, parse)
+	if err != nil {
+		return &GroupError{Group: group, Offset: offset, Err: err}
+	}
+
+	shardLen := pr.info.shardLen(header.dataLen)
+	shardsOffset := offset + int64(len(headerBuf))
+	shardsBuf := make([]byte, int64(len(header.crcs))*shardLen)
+
+	// A truncated stream just has missing shards:
+	n, err = io.ReadFull(pr.r, shardsBuf)
+	pr.encPos += int64(n)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	shards := make([][]byte, len(header.crcs))
+	damaged := []int{}
+	for idx := range shards {
+		start := int64(idx) * shardLen
+		shard := shardsBuf[start : start+shardLen]
+		if start+shardLen > int64(n) || crc32.Checksum(shard, castagnoli) != header.crcs[idx] {
+			damaged = append(damaged, idx)
+			continue
+		}
+
+		shards[idx] = shard
+	}
+
+	if len(damaged) > pr.info.ParityShards {
+		return &GroupError{
+			Group:   group,
+			Offset:  offset,
+			Damaged: len(damaged),
+			Err:     reedsolomon.ErrTooFewShards,
+		}
+	}
+
+	if len(damaged) > 0 {
+		if err := pr.dec.Reconstruct(shards); err != nil {
+			return &GroupError{Group: group, Offset: offset, Damaged: len(damaged), Err: err}
+		}
+	}
+
+	// Only report repairs once the group could be read:
+	pr.addRepair(repair)
+	for _, idx := range damaged {
+		pr.addRepair(&Repair{
+			Offset: shardsOffset + int64(idx)*shardLen,
+			Data:   shards[idx],
+		})
+	}
+
+	data := make([]byte, 0, header.dataLen)
+	for _, shard := range shards[:pr.info.DataShards] {
+		data = append(data, shard...)
+	}
+
+	pr.group = group
+	pr.data = data[:header.dataLen]
+	return nil
+}
+
+// Read reads the data of the stream, rebuilding damaged parts if needed.
+func (pr *Reader) Read(buf []byte) (int, error) {
+	if err := pr.readHeaderIfNotDone(); err != nil {
+		return 0, err
+	}
+
+	read := 0
+	for read < len(buf) {
+		group := pr.pos / pr.info.groupDataSize()
+		if group != pr.group {
+			if err := pr.loadGroup(group); err != nil {
+				return read, err
+			}
+		}
+
+		groupOff := pr.pos - group*pr.info.groupDataSize()
+		if groupOff >= int64(len(pr.data)) {
+			return read, io.EOF
+		}
+
+		n := copy(buf[read:], pr.data[groupOff:])
+		pr.pos += int64(n)
+		read += n
+	}
+
+	return read, nil
+}
+
+// Size returns the size of the data in the stream.
+// The underlying stream needs to be an io.Seeker.
+func (pr *Reader) Size() (int64, error) {
+	if err := pr.readHeaderIfNotDone(); err != nil {
+		return 0, err
+	}
+
+	if pr.size >= 0 {
+		return pr.size, nil
+	}
+
+	seeker, ok := pr.r.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("parity: seek is not supported by underlying stream")
+	}
+
+	encSize, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	pr.encPos = encSize
+
+	// All groups but the last are full. The last one might have
+	// the same size as a full one, so its header needs to be read:
+	fullGroupSize := pr.info.groupSize(pr.info.groupDataSize())
+	groups := (encSize - 2*streamHeaderSize + fullGroupSize - 1) / fullGroupSize
+	size := int64(0)
+	if groups > 0 {
+		if err := pr.loadGroup(groups - 1); err != nil {
+			return 0, err
+		}
+
+		size = (groups-1)*pr.info.groupDataSize() + int64(len(pr.data))
+	}
+
+	pr.size = size
+	return size, nil
+}
+
+// Seek sets the position in the data of the stream.
+func (pr *Reader) Seek(offset int64, whence int) (int64, error) {
+	if err := pr.readHeaderIfNotDone(); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += pr.pos
+	case io.SeekEnd:
+		size, err := pr.Size()
+		if err != nil {
+			return 0, err
+		}
+
+		offset += size
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("parity: negative seek offset: %d", offset)
+	}
+
+	pr.pos = offset
+	return offset, nil
+}
+
+// Scrub reads the whole parity stream `r` and returns all parts of it
+// that were damaged. If `w` is not nil, the repaired data is written to
+// it at the same offsets; pass the file `r` reads from to repair it.
+// Scrubbing stops at the first group that cannot be repaired; the
+// repairs found until then are returned along with a *GroupError.
+func Scrub(r io.Reader, w io.WriterAt) ([]Repair, error) {
+	pr := NewReader(r)
+	_, readErr := io.Copy(io.Discard, pr)
+
+	if w != nil {
+		for _, repair := range pr.Repairs() {
+			if _, err := w.WriteAt(repair.Data, repair.Offset); err != nil {
+				return pr.Repairs(), err
+			}
+		}
+	}
+
+	return pr.Repairs(), readErr
+}
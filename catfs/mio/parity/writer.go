@@ -0,0 +1,123 @@
+package parity
+
+import (
+	"github.com/klauspost/reedsolomon"
+	"io"
+)
+
+// Writer adds parity shards to the data written to it.
+// Close() has to be called to write the last group.
+type Writer struct {
+	w    io.Writer
+	info *HeaderInfo
+	enc  reedsolomon.Encoder
+
+	// Data of the current group, up to info.groupDataSize() bytes.
+	buf []byte
+
+	headerWritten bool
+}
+
+// NewWriter returns a Writer that writes to `w` and adds `parityShards`
+// parity shards to every `dataShards` shards of data.
+func NewWriter(w io.Writer, dataShards, parityShards int) (*Writer, error) {
+	if err := checkShards(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &HeaderInfo{
+		Version:      version1,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		ShardSize:    defaultShardSize,
+	}
+
+	return &Writer{
+		w:    w,
+		info: info,
+		enc:  enc,
+		buf:  make([]byte, 0, info.groupDataSize()),
+	}, nil
+}
+
+func (pw *Writer) emitHeaderIfNeeded() error {
+	if pw.headerWritten {
+		return nil
+	}
+
+	pw.headerWritten = true
+	header := generateStreamHeader(pw.info)
+	if _, err := pw.w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := pw.w.Write(header)
+	return err
+}
+
+// Write buffers `data` and writes every full group.
+func (pw *Writer) Write(data []byte) (int, error) {
+	if err := pw.emitHeaderIfNeeded(); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for len(data) > 0 {
+		n := copy(pw.buf[len(pw.buf):cap(pw.buf)], data)
+		pw.buf = pw.buf[:len(pw.buf)+n]
+		data = data[n:]
+		written += n
+
+		if len(pw.buf) == cap(pw.buf) {
+			if err := pw.flushGroup(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (pw *Writer) flushGroup() error {
+	if len(pw.buf) == 0 {
+		return nil
+	}
+
+	dataLen := int64(len(pw.buf))
+	shardLen := pw.info.shardLen(dataLen)
+	shards := make([][]byte, pw.info.DataShards+pw.info.ParityShards)
+	for idx := range shards {
+		shards[idx] = make([]byte, shardLen)
+		if idx < pw.info.DataShards && int64(idx)*shardLen < dataLen {
+			copy(shards[idx], pw.buf[int64(idx)*shardLen:])
+		}
+	}
+
+	if err := pw.enc.Encode(shards); err != nil {
+		return err
+	}
+
+	header := generateGroupHeader(pw.info, dataLen, shards)
+	for _, part := range append([][]byte{header, header}, shards...) {
+		if _, err := pw.w.Write(part); err != nil {
+			return err
+		}
+	}
+
+	pw.buf = pw.buf[:0]
+	return nil
+}
+
+// Close writes the last group. It does not close the underlying writer.
+func (pw *Writer) Close() error {
+	if err := pw.emitHeaderIfNeeded(); err != nil {
+		return err
+	}
+
+	return pw.flushGroup()
+}
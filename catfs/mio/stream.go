@@ -1,13 +1,22 @@
 package mio
 
 import (
+	"bufio"
+	"errors"
+	"floo/catfs/mio/blockcache"
 	"floo/catfs/mio/compress"
 	"floo/catfs/mio/encrypt"
+	"floo/catfs/mio/parity"
 	"floo/util"
+	h "floo/util/hashlib"
 	log "github.com/sirupsen/logrus"
 	"io"
 )
 
+// ErrStreamNotFinished is returned by InStream.Result()
+// when the stream was not read until io.EOF.
+var ErrStreamNotFinished = errors.New("stream was not read to the end")
+
 // Stream is a stream coming from the backend.
 type Stream interface {
 	io.Reader
@@ -19,13 +28,76 @@ type Stream interface {
 // NewOutStream creates an OutStream piping data from floo to the outside.
 // `key` is used to decrypt the data. The compression algorithm is read
 // from the stream header.
+//
+// Streams with parity data (see NewParityInStream) are detected and damaged
+// parts are repaired on the fly; use NewOutStreamWithRepairs to learn about it.
 func NewOutStream(r io.ReadSeeker, key []byte) (Stream, error) {
+	return newOutStream(r, key, nil, "", nil)
+}
+
+// NewOutStreamWithRepairs is like NewOutStream, but calls `onRepair` for
+// every damaged part of `r` that was repaired with parity data.
+// The offsets of the repairs are relative to the start of `r`.
+func NewOutStreamWithRepairs(r io.ReadSeeker, key []byte, onRepair func(parity.Repair)) (Stream, error) {
+	return newOutStream(r, key, nil, "", onRepair)
+}
+
+// NewCachedOutStream is like NewOutStream, but the decompressed blocks are
+// looked up in `cache` first, so that repeated random reads of the same
+// data are cheap. The decrypted blocks are not cached as well; they are
+// only needed to fill the decompressed ones and would take half of the
+// cache. `backend` is the backend hash
+// of the data in `r` and identifies it in the cache.
+func NewCachedOutStream(r io.ReadSeeker, key []byte, cache *blockcache.Cache, backend h.Hash) (Stream, error) {
+	return newOutStream(r, key, cache, string(backend), nil)
+}
+
+// openParity returns a reader for the data in `r` without the parity
+// shards, if `r` has any. Otherwise `r` is returned with a nil info.
+func openParity(r io.ReadSeeker, onRepair func(parity.Repair)) (io.ReadSeeker, *parity.HeaderInfo, error) {
+	header := make([]byte, parity.PeekSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	if !parity.IsParityStream(header[:n]) {
+		return r, nil, nil
+	}
+
+	rPar := parity.NewReader(r)
+	if onRepair != nil {
+		rPar.SetRepairHandler(onRepair)
+	}
+
+	info, err := rPar.Info()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rPar, info, nil
+}
+
+func newOutStream(r io.ReadSeeker, key []byte, cache *blockcache.Cache, cacheStream string, onRepair func(parity.Repair)) (Stream, error) {
+	r, _, err := openParity(r, onRepair)
+	if err != nil {
+		return nil, err
+	}
+
 	rEnc, err := encrypt.NewReader(r, key)
 	if err != nil {
 		return nil, err
 	}
 
 	rZip := compress.NewReader(rEnc)
+	if cache != nil {
+		rZip.SetCache(cache, cacheStream)
+	}
+
 	return struct {
 		io.Reader
 		io.Seeker
@@ -39,45 +111,310 @@ func NewOutStream(r io.ReadSeeker, key []byte) (Stream, error) {
 	}, nil
 }
 
+// GuessAlgorithm picks a compression algorithm for the data of `r`,
+// which is stored at `path`. If `r` is an io.ReaderAt and io.Seeker
+// (like *os.File), samples from all over the data are looked at
+// (see compress.GuessAlgorithmSampled); otherwise only its header.
+// The returned reader has to be used instead of `r` afterwards.
+func GuessAlgorithm(path string, r io.Reader) (compress.AlgorithmType, io.Reader, error) {
+	if ra, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		// Only the data that is still to be read counts.
+		curr, err := ra.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return compress.AlgoNone, nil, err
+		}
+
+		size, err := ra.Seek(0, io.SeekEnd)
+		if err != nil {
+			return compress.AlgoNone, nil, err
+		}
+
+		if _, err := ra.Seek(curr, io.SeekStart); err != nil {
+			return compress.AlgoNone, nil, err
+		}
+
+		section := io.NewSectionReader(ra, curr, size-curr)
+		algo, err := compress.GuessAlgorithmSampled(path, section, section.Size())
+		return algo, r, err
+	}
+
+	br := bufio.NewReaderSize(r, compress.HeaderSizeThreshold)
+	header, err := br.Peek(compress.HeaderSizeThreshold)
+	if err != nil && err != io.EOF {
+		return compress.AlgoNone, nil, err
+	}
+
+	algo, err := compress.GuessAlgorithm(path, header)
+	return algo, br, err
+}
+
 // NewInStream creates a new stream that pipes data into ipfs.
 // The data is read from `r`, encrypted with `key` and compressed with `algo`.
 func NewInStream(r io.Reader, key []byte, algo compress.AlgorithmType) (io.Reader, error) {
+	return NewParallelInStream(r, key, algo, 1)
+}
+
+// NewParallelInStream is like NewInStream, but compresses and encrypts
+// on up to `workers` cores. The output can be read like the one of
+// NewInStream, but is not byte-identical since every stream gets a
+// random nonce prefix. Use runtime.NumCPU() to use all cores; small
+// files will not get any faster though.
+func NewParallelInStream(r io.Reader, key []byte, algo compress.AlgorithmType, workers int) (io.Reader, error) {
+	stream, err := newInStream(r, key, algo, inStreamOptions{
+		level:      compress.DefaultLevel,
+		cipherType: encrypt.CipherXChaCha20,
+		workers:    workers,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// InStreamResult describes the data that went through an InStream.
+type InStreamResult struct {
+	// ContentHash is the hash of the plain input data.
+	ContentHash h.Hash
+
+	// Size is the number of bytes of plain input data.
+	Size uint64
+
+	// BackendHash is the hash of the encrypted output, made with
+	// the same algorithm as hashlib.SumWithBackendHash.
+	BackendHash h.Hash
+
+	// EncryptedSize is the number of bytes of encrypted output.
+	EncryptedSize uint64
+}
+
+// InStream is the reader returned by NewHashingInStream.
+type InStream struct {
+	pr io.Reader
+
+	contentHash *h.HashWriter
+	backendHash *h.HashWriter
+	size        uint64
+	encSize     uint64
+
+	// inputDone is closed once all input was read and size is set.
+	inputDone chan struct{}
+	eof       bool
+}
+
+// NewHashingInStream is like NewParallelInStream, but also hashes the plain
+// input and the encrypted output while they pass through. Once the stream
+// was read to the end, Result() returns everything that is needed to stage
+// the data, without reading it a second time.
+func NewHashingInStream(r io.Reader, key []byte, algo compress.AlgorithmType, workers int) (*InStream, error) {
+	return newInStream(r, key, algo, inStreamOptions{
+		level:      compress.DefaultLevel,
+		cipherType: encrypt.CipherXChaCha20,
+		workers:    workers,
+		hashing:    true,
+	})
+}
+
+// NewParityInStream is like NewParallelInStream, but adds `parityShards`
+// Reed-Solomon parity shards to every `dataShards` shards of encrypted
+// data (see package parity). Up to `parityShards` damaged shards per group
+// can be repaired when reading. parity.DefaultDataShards and
+// parity.DefaultParityShards are sane defaults.
+func NewParityInStream(r io.Reader, key []byte, algo compress.AlgorithmType, workers, dataShards, parityShards int) (*InStream, error) {
+	return newInStream(r, key, algo, inStreamOptions{
+		level:        compress.DefaultLevel,
+		cipherType:   encrypt.CipherXChaCha20,
+		workers:      workers,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+	})
+}
+
+func (s *InStream) Read(buf []byte) (int, error) {
+	n, err := s.pr.Read(buf)
+	s.encSize += uint64(n)
+	if s.backendHash != nil {
+		s.backendHash.Write(buf[:n])
+	}
+
+	if err == io.EOF {
+		s.eof = true
+	}
+
+	return n, err
+}
+
+// Result returns the hashes and sizes of the data that went through
+// the stream. It returns ErrStreamNotFinished until Read() returned io.EOF.
+// The hashes are only set if the stream was created by NewHashingInStream.
+func (s *InStream) Result() (*InStreamResult, error) {
+	if !s.eof {
+		return nil, ErrStreamNotFinished
+	}
+
+	<-s.inputDone
+
+	result := &InStreamResult{
+		Size:          s.size,
+		EncryptedSize: s.encSize,
+	}
+
+	if s.contentHash != nil {
+		result.ContentHash = s.contentHash.Finalize()
+		result.BackendHash = s.backendHash.Finalize()
+	}
+
+	return result, nil
+}
+
+// NewRekeyStream returns a reader that yields the data of `r`, which is
+// encrypted with `oldKey`, encrypted with `newKey` and `cipherType` instead.
+// The compression algorithm and level of the stream are kept,
+// and so is its parity data, if any.
+func NewRekeyStream(r io.ReadSeeker, oldKey, newKey []byte, cipherType uint16) (io.Reader, error) {
+	r, parityInfo, err := openParity(r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rEnc, err := encrypt.NewReader(r, oldKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rZip := compress.NewReader(rEnc)
+	algo, level, err := rZip.Algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := inStreamOptions{
+		level:      level,
+		cipherType: cipherType,
+		workers:    1,
+	}
+
+	if parityInfo != nil {
+		opts.dataShards = parityInfo.DataShards
+		opts.parityShards = parityInfo.ParityShards
+	}
+
+	stream, err := newInStream(rZip, newKey, algo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// inStreamOptions configure newInStream.
+type inStreamOptions struct {
+	level      int
+	cipherType uint16
+	workers    int
+
+	// hashing enables the hashes of InStream.Result().
+	hashing bool
+
+	// noncePrefix replaces the random nonce prefix if not nil.
+	noncePrefix []byte
+
+	// Parity shards are only added if parityShards > 0.
+	dataShards   int
+	parityShards int
+}
+
+func newInStream(r io.Reader, key []byte, algo compress.AlgorithmType, opts inStreamOptions) (*InStream, error) {
 	pr, pw := io.Pipe()
+	stream := &InStream{
+		pr:        pr,
+		inputDone: make(chan struct{}),
+	}
+
+	var encOut io.Writer = pw
+	var wPar *parity.Writer
+	if opts.parityShards > 0 {
+		var err error
+		if wPar, err = parity.NewWriter(pw, opts.dataShards, opts.parityShards); err != nil {
+			return nil, err
+		}
+
+		encOut = wPar
+	}
+
+	if opts.hashing {
+		stream.contentHash = h.NewHashWriter()
+		stream.backendHash = h.NewBackendHashWriter()
+		r = io.TeeReader(r, stream.contentHash)
+	}
 
 	// Set up the writer part:
-	wEnc, encErr := encrypt.NewWriter(pw, key)
+	wEnc, encErr := encrypt.NewWriterWithType(encOut, key, opts.cipherType)
 	if encErr != nil {
 		return nil, encErr
 	}
 
-	wZip, zipErr := compress.NewWriter(wEnc, algo)
+	if opts.noncePrefix != nil {
+		if err := wEnc.SetNoncePrefix(opts.noncePrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	wZip, zipErr := compress.NewWriterLevel(wEnc, algo, opts.level)
 	if zipErr != nil {
 		return nil, zipErr
 	}
 
+	wEnc.SetWorkers(opts.workers)
+	wZip.SetWorkers(opts.workers)
+
 	// Suck the reader empty and move it to `wZip`.
 	// Every write to wZip will be available as read in `pr`.
 	go func() {
-		if _, err := io.Copy(wZip, r); err != nil {
+		size, err := io.Copy(wZip, r)
+		stream.size = uint64(size)
+		close(stream.inputDone)
+
+		if err != nil {
 			// Continue closing the fds; no return.
 			log.Warningf("internal write error: %v", err)
 		}
 
-		if err := wZip.Close(); err != nil {
-			// Continue closing the others:
-			log.Warningf("internal close zip layer error: %v", err)
+		// Remember the first error, but close every layer anyways:
+		if zipErr := wZip.Close(); zipErr != nil {
+			log.Warningf("internal close zip layer error: %v", zipErr)
+			if err == nil {
+				err = zipErr
+			}
+		}
+
+		if encErr := wEnc.Close(); encErr != nil {
+			log.Warningf("internal close enc layer error: %v", encErr)
+			if err == nil {
+				err = encErr
+			}
 		}
 
-		if err := wEnc.Close(); err != nil {
-			// Continue closing the others:
-			log.Warningf("internal close enc layer error: %v", err)
+		if wPar != nil {
+			if parErr := wPar.Close(); parErr != nil {
+				log.Warningf("internal close parity layer error: %v", parErr)
+				if err == nil {
+					err = parErr
+				}
+			}
 		}
 
-		if err := pw.Close(); err != nil {
-			log.Warningf("internal close pipe error: %v", err)
+		// The reader of `pr` should not mistake a failed
+		// copy or an unfinished trailer for the end:
+		if pipeErr := pw.CloseWithError(err); pipeErr != nil {
+			log.Warningf("internal close pipe error: %v", pipeErr)
 		}
 	}()
-	return pr, nil
+	return stream, nil
 }
 
 // limitedStream is a small wrapper around stream,
@@ -2,12 +2,19 @@ package mio
 
 import (
 	"bytes"
+	"errors"
+	"floo/catfs/mio/blockcache"
 	"floo/catfs/mio/compress"
+	"floo/catfs/mio/encrypt"
+	"floo/catfs/mio/parity"
+	h "floo/util/hashlib"
 	"floo/util/testutil"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"io"
+	"math/rand"
 	"testing"
+	"testing/iotest"
 )
 
 var TestKey = []byte("01234567890ABCDE01234567890ABCDE")
@@ -82,6 +89,7 @@ func TestWriteAndRead(t *testing.T) {
 		randomData := testutil.CreateRandomDummyBuf(size, 42)
 
 		for algo := range compress.AlgoMap {
+			algo := algo
 			prefix := fmt.Sprintf("%v-size%d-", algo, size)
 			t.Run(prefix+"regular", func(t *testing.T) {
 				t.Parallel()
@@ -233,3 +241,258 @@ func TestStreamSizeBySeek(t *testing.T) {
 }
 
 // TODO: Benchmark
+
+func TestZstdLevels(t *testing.T) {
+	t.Parallel()
+
+	data := testutil.CreateDummyBuf(256 * 1024)
+
+	sizes := []int{}
+	for _, level := range []int{compress.DefaultLevel, 1, 9, 19} {
+		packed, err := compress.PackLevel(data, compress.AlgoZstd, level)
+		require.Nil(t, err)
+		sizes = append(sizes, len(packed))
+
+		r := compress.NewReader(bytes.NewReader(packed))
+		algo, readLevel, err := r.Algorithm()
+		require.Nil(t, err)
+		require.Equal(t, compress.AlgorithmType(compress.AlgoZstd), algo)
+		require.Equal(t, level, readLevel)
+
+		// Seeking into the middle of the stream should still work:
+		_, err = r.Seek(100*1024, io.SeekStart)
+		require.Nil(t, err)
+
+		rest := &bytes.Buffer{}
+		_, err = io.Copy(rest, r)
+		require.Nil(t, err)
+		require.Equal(t, data[100*1024:], rest.Bytes())
+	}
+
+	// Higher levels should not be worse than the fastest one:
+	require.True(t, sizes[3] <= sizes[1], "sizes: %v", sizes)
+
+	_, err := compress.PackLevel(data, compress.AlgoZstd, compress.MaxZstdLevel+1)
+	require.Equal(t, compress.ErrBadLevel, err)
+
+	_, err = compress.PackLevel(data, compress.AlgoSnappy, 5)
+	require.Equal(t, compress.ErrBadLevel, err)
+}
+
+func TestGuessAlgorithmText(t *testing.T) {
+	t.Parallel()
+
+	text := bytes.Repeat([]byte("floo is a distributed file system. "), 100)
+	algo, err := compress.GuessAlgorithm("README.txt", text)
+	require.Nil(t, err)
+	require.Equal(t, compress.AlgorithmType(compress.AlgoZstd), algo)
+}
+
+func readInStream(t testing.TB, data []byte, algo compress.AlgorithmType, workers int) []byte {
+	stream, err := NewParallelInStream(bytes.NewReader(data), TestKey, algo, workers)
+	require.Nil(t, err)
+
+	encrypted, err := io.ReadAll(stream)
+	require.Nil(t, err)
+	return encrypted
+}
+
+func TestParallelInStream(t *testing.T) {
+	t.Parallel()
+
+	s64k := int64(64 * 1024)
+	for _, size := range []int64{0, 1, s64k - 1, s64k, s64k + 1, s64k * 33} {
+		data := testutil.CreateDummyBuf(size)
+		for algo := range compress.AlgoMap {
+			encrypted := readInStream(t, data, algo, 4)
+			stream, err := NewOutStream(bytes.NewReader(encrypted), TestKey)
+			require.Nil(t, err)
+
+			decrypted, err := io.ReadAll(stream)
+			require.Nil(t, err)
+			require.True(
+				t,
+				bytes.Equal(data, decrypted),
+				"output differs for %v with size %d", algo, size,
+			)
+		}
+	}
+}
+
+func TestParallelInStreamIdentical(t *testing.T) {
+	t.Parallel()
+
+	// With a fixed nonce prefix, the number of workers
+	// must not change a single byte of the output:
+	readFixed := func(data []byte, algo compress.AlgorithmType, workers int) []byte {
+		stream, err := newInStream(bytes.NewReader(data), TestKey, algo, inStreamOptions{
+			level:       compress.DefaultLevel,
+			cipherType:  encrypt.CipherXChaCha20,
+			workers:     workers,
+			noncePrefix: make([]byte, 16),
+		})
+		require.Nil(t, err)
+
+		encrypted, err := io.ReadAll(stream)
+		require.Nil(t, err)
+		return encrypted
+	}
+
+	data := testutil.CreateDummyBuf(64*1024*33 + 1)
+	for algo := range compress.AlgoMap {
+		serial := readFixed(data, algo, 1)
+		parallel := readFixed(data, algo, 4)
+		require.True(t, bytes.Equal(serial, parallel), "output differs for %v", algo)
+	}
+}
+
+func TestCachedOutStream(t *testing.T) {
+	t.Parallel()
+
+	data := testutil.CreateRandomDummyBuf(1024*1024+123, 23)
+	for algo := range compress.AlgoMap {
+		encrypted := readInStream(t, data, algo, 1)
+		cache := blockcache.New(64 * 1024 * 1024)
+		backend := h.TestDummy(t, 1)
+
+		// Sequential reads should be served mostly by read-ahead:
+		stream, err := NewCachedOutStream(bytes.NewReader(encrypted), TestKey, cache, backend)
+		require.Nil(t, err)
+
+		decrypted, err := io.ReadAll(stream)
+		require.Nil(t, err)
+		require.Equal(t, data, decrypted)
+		require.True(t, cache.Stats().Prefetched > 0, "no read-ahead for %v", algo)
+
+		// A second stream of the same data finds everything in the cache:
+		stream, err = NewCachedOutStream(bytes.NewReader(encrypted), TestKey, cache, backend)
+		require.Nil(t, err)
+
+		before := cache.Stats()
+		rnd := rand.New(rand.NewSource(42))
+		for idx := 0; idx < 100; idx++ {
+			off := rnd.Int63n(int64(len(data)))
+			buf := make([]byte, rnd.Intn(4096)+1)
+
+			_, err := stream.Seek(off, io.SeekStart)
+			require.Nil(t, err)
+
+			n, err := io.ReadFull(stream, buf)
+			if err != io.ErrUnexpectedEOF {
+				require.Nil(t, err)
+			}
+
+			require.Equal(t, data[off:off+int64(n)], buf[:n], "data differs for %v", algo)
+		}
+
+		after := cache.Stats()
+		require.True(t, after.Hits > before.Hits)
+		require.Equal(t, before.Misses, after.Misses, "misses for %v", algo)
+	}
+}
+
+func TestInStreamError(t *testing.T) {
+	t.Parallel()
+
+	readErr := errors.New("artificial read error")
+	for _, parityShards := range []int{0, 2} {
+		r := io.MultiReader(
+			bytes.NewReader(testutil.CreateDummyBuf(128*1024)),
+			iotest.ErrReader(readErr),
+		)
+
+		stream, err := NewParityInStream(r, TestKey, compress.AlgoSnappy, 2, 4, parityShards)
+		require.Nil(t, err)
+
+		// A failed input must never look like a complete stream:
+		_, err = io.ReadAll(stream)
+		require.Equal(t, readErr, err)
+	}
+}
+
+func TestHashingInStream(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int64{0, 1, 64*1024 + 1, 1024 * 1024} {
+		data := testutil.CreateDummyBuf(size)
+		stream, err := NewHashingInStream(bytes.NewReader(data), TestKey, compress.AlgoSnappy, 2)
+		require.Nil(t, err)
+
+		_, err = stream.Result()
+		require.Equal(t, ErrStreamNotFinished, err)
+
+		encrypted, err := io.ReadAll(stream)
+		require.Nil(t, err)
+
+		result, err := stream.Result()
+		require.Nil(t, err)
+		require.Equal(t, h.Sum(data), result.ContentHash)
+		require.Equal(t, uint64(size), result.Size)
+		require.Equal(t, h.SumWithBackendHash(encrypted), result.BackendHash)
+		require.Equal(t, uint64(len(encrypted)), result.EncryptedSize)
+	}
+}
+
+func TestParityInStream(t *testing.T) {
+	t.Parallel()
+
+	data := testutil.CreateRandomDummyBuf(512*1024, 23)
+	stream, err := NewParityInStream(bytes.NewReader(data), TestKey, compress.AlgoSnappy, 2, 4, 2)
+	require.Nil(t, err)
+
+	encoded, err := io.ReadAll(stream)
+	require.Nil(t, err)
+
+	// Flip bits in different groups; every one would break an encrypted block:
+	for _, off := range []int64{1000, 100000, 300000, int64(len(encoded)) - 10} {
+		encoded[off] ^= 0x01
+	}
+
+	repairs := []parity.Repair{}
+	out, err := NewOutStreamWithRepairs(bytes.NewReader(encoded), TestKey, func(repair parity.Repair) {
+		repairs = append(repairs, repair)
+	})
+	require.Nil(t, err)
+
+	decrypted, err := io.ReadAll(out)
+	require.Nil(t, err)
+	require.Equal(t, data, decrypted)
+	require.Len(t, repairs, 4)
+
+	// Seeking works through the parity layer as well:
+	_, err = out.Seek(200000, io.SeekStart)
+	require.Nil(t, err)
+
+	buf := make([]byte, 1000)
+	_, err = io.ReadFull(out, buf)
+	require.Nil(t, err)
+	require.Equal(t, data[200000:201000], buf)
+
+	// Re-keying keeps the parity data:
+	newKey := bytes.Repeat([]byte{0x42}, 32)
+	rekeyed, err := NewRekeyStream(bytes.NewReader(encoded), TestKey, newKey, encrypt.CipherXChaCha20)
+	require.Nil(t, err)
+
+	rekeyedData, err := io.ReadAll(rekeyed)
+	require.Nil(t, err)
+	require.True(t, parity.IsParityStream(rekeyedData))
+
+	out, err = NewOutStream(bytes.NewReader(rekeyedData), newKey)
+	require.Nil(t, err)
+
+	decrypted, err = io.ReadAll(out)
+	require.Nil(t, err)
+	require.Equal(t, data, decrypted)
+}
+
+func BenchmarkInStream(b *testing.B) {
+	data := testutil.CreateRandomDummyBuf(16*1024*1024, 42)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for idx := 0; idx < b.N; idx++ {
+				readInStream(b, data, compress.AlgoZstd, workers)
+			}
+		})
+	}
+}
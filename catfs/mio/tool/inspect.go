@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"floo/catfs/mio/compress"
+	"floo/catfs/mio/encrypt"
+	"fmt"
+	"io"
+	"os"
+)
+
+// inspectFlags are the flags shared by the info and verify subcommands.
+type inspectFlags struct {
+	input      *string
+	key        *string
+	decrypt    *bool
+	decompress *bool
+}
+
+func parseInspectFlags(name string, args []string) (*inspectFlags, error) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	inspect := &inspectFlags{
+		input:      flags.String("input", "", "input path"),
+		key:        flags.String("key", "", "hex encoded key (needed with -decrypt)"),
+		decrypt:    flags.Bool("decrypt", true, "Is the input encrypted?"),
+		decompress: flags.Bool("decompress", true, "Is the input compressed?"),
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *inspect.input == "" {
+		return nil, errors.New("please specify an input path")
+	}
+
+	// A default key would make a missing key look like a damaged file:
+	if *inspect.decrypt && *inspect.key == "" {
+		return nil, errors.New("please specify a key or pass -decrypt=false")
+	}
+
+	return inspect, nil
+}
+
+func (inspect *inspectFlags) parseKey() ([]byte, error) {
+	if !*inspect.decrypt {
+		return nil, nil
+	}
+
+	return hex.DecodeString(*inspect.key)
+}
+
+// printEncryptInfo prints the header of the encrypted stream in `r`
+// and leaves `r` at the start of the stream.
+func printEncryptInfo(r io.ReadSeeker, key []byte) error {
+	header := make([]byte, encrypt.MaxHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	info, err := encrypt.ParseHeader(header[:n], key)
+	if err != nil {
+		return fmt.Errorf("bad encryption header: %v", err)
+	}
+
+	fmt.Println("Encryption:")
+	fmt.Printf("  Version:     %d\n", info.Version)
+	fmt.Printf("  Cipher:      %s\n", encrypt.CipherName(info.Cipher))
+	fmt.Printf("  Key length:  %d\n", info.Keylen)
+	fmt.Printf("  Block size:  %d\n", info.Blocklen)
+	fmt.Printf("  Header size: %d\n", info.HeaderSize())
+	if info.NoncePrefix != nil {
+		fmt.Printf("  Nonce:       %x\n", info.NoncePrefix)
+	}
+
+	return nil
+}
+
+func printCompressInfo(r io.ReadSeeker) error {
+	info, err := compress.NewReader(r).Info()
+	if err != nil {
+		return fmt.Errorf("bad compression header or trailer: %v", err)
+	}
+
+	fmt.Println("Compression:")
+	fmt.Printf("  Version:     %d\n", info.Version)
+	fmt.Printf("  Algorithm:   %s\n", compress.AlgoToString(info.Algorithm))
+	fmt.Printf("  Level:       %d\n", info.Level)
+	fmt.Printf("  Chunks:      %d\n", len(info.Index)-1)
+	fmt.Println("  Index (raw offset => compressed offset, compressed size):")
+
+	for idx, chunk := range info.Index {
+		zipSize := int64(0)
+		if idx+1 < len(info.Index) {
+			zipSize = info.Index[idx+1].ZipOffset - chunk.ZipOffset
+		}
+
+		fmt.Printf("    %12d => %12d  %8d\n", chunk.RawOffset, chunk.ZipOffset, zipSize)
+	}
+
+	return nil
+}
+
+func info(args []string) error {
+	inspect, err := parseInspectFlags("info", args)
+	if err != nil {
+		return err
+	}
+
+	key, err := inspect.parseKey()
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.Open(*inspect.input)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	r, _, err := openParity(fd)
+	if err != nil {
+		return err
+	}
+
+	if *inspect.decrypt {
+		if err := printEncryptInfo(r, key); err != nil {
+			return err
+		}
+
+		if r, err = encrypt.NewReader(r, key); err != nil {
+			return err
+		}
+	}
+
+	if *inspect.decompress {
+		return printCompressInfo(r)
+	}
+
+	return nil
+}
+
+// verify reads the whole input without writing it anywhere. Every block is
+// authenticated; the first bad one is reported with its offset. The
+// encryption layer is read sequentially first: the compression layer
+// starts reading at the end of the stream, so a bad last block would be
+// reported before any bad block in front of it.
+func verify(args []string) error {
+	inspect, err := parseInspectFlags("verify", args)
+	if err != nil {
+		return err
+	}
+
+	key, err := inspect.parseKey()
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.Open(*inspect.input)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	r, rPar, err := openParity(fd)
+	if err != nil {
+		return err
+	}
+
+	if rPar != nil {
+		defer func() { printRepairs(rPar.Repairs()) }()
+	}
+
+	if *inspect.decrypt {
+		if r, err = encrypt.NewReader(r, key); err != nil {
+			return err
+		}
+
+		n, err := io.Copy(io.Discard, r)
+		if err != nil {
+			blockErr := &encrypt.BlockError{}
+			if errors.As(err, &blockErr) {
+				return fmt.Errorf(
+					"first bad block is #%d at offset %d (%d bytes were fine): %v",
+					blockErr.Block, blockErr.Offset, n, blockErr.Err,
+				)
+			}
+
+			return err
+		}
+
+		fmt.Printf("Encryption OK: %d bytes authenticated.\n", n)
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	if !*inspect.decompress {
+		return nil
+	}
+
+	n, err := io.Copy(io.Discard, compress.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("bad compressed data: %v", err)
+	}
+
+	fmt.Printf("Compression OK: %d bytes decompressed.\n", n)
+	return nil
+}
@@ -54,7 +54,31 @@ func process(r io.ReadSeeker, w io.Writer, readEncrypted, readCompress, writeEnc
 	return nil
 }
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [info|verify|scrub] [flags]\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Without subcommand, the input is converted to the output:")
+	flag.PrintDefaults()
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		subcommands := map[string]func(args []string) error{
+			"info":   info,
+			"verify": verify,
+			"scrub":  scrub,
+		}
+
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			if err := subcommand(os.Args[2:]); err != nil {
+				fmt.Printf("%s failed: %v\n", os.Args[1], err)
+				os.Exit(2)
+			}
+
+			return
+		}
+	}
+
+	flag.Usage = usage
 	inputFlag := flag.String("input", "", "input path")
 	outputFlag := flag.String("output", "", "output path")
 
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"floo/catfs/mio/parity"
+	"fmt"
+	"io"
+	"os"
+)
+
+// openParity wraps `fd` in a parity.Reader if it has parity data.
+// The repairs that were done while reading are printed by printRepairs.
+func openParity(fd io.ReadSeeker) (io.ReadSeeker, *parity.Reader, error) {
+	header := make([]byte, parity.PeekSize)
+	n, err := io.ReadFull(fd, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	if !parity.IsParityStream(header[:n]) {
+		return fd, nil, nil
+	}
+
+	rPar := parity.NewReader(fd)
+	info, err := rPar.Info()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fmt.Println("Parity:")
+	fmt.Printf("  Version:       %d\n", info.Version)
+	fmt.Printf("  Data shards:   %d\n", info.DataShards)
+	fmt.Printf("  Parity shards: %d\n", info.ParityShards)
+	fmt.Printf("  Shard size:    %d\n", info.ShardSize)
+	return rPar, rPar, nil
+}
+
+func printRepairs(repairs []parity.Repair) {
+	for _, repair := range repairs {
+		fmt.Printf("  damaged: %d bytes at offset %d\n", len(repair.Data), repair.Offset)
+	}
+}
+
+// scrub checks all parity groups of the input and optionally
+// writes the repaired parts back to it.
+func scrub(args []string) error {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	input := flags.String("input", "", "input path")
+	repair := flags.Bool("repair", false, "Write repaired data back to the input?")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *input == "" {
+		return errors.New("please specify an input path")
+	}
+
+	mode := os.O_RDONLY
+	if *repair {
+		mode = os.O_RDWR
+	}
+
+	fd, err := os.OpenFile(*input, mode, 0)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	var w io.WriterAt
+	if *repair {
+		w = fd
+	}
+
+	repairs, err := parity.Scrub(fd, w)
+	printRepairs(repairs)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(repairs) == 0:
+		fmt.Println("OK: no damage found.")
+	case *repair:
+		fmt.Printf("Repaired %d damaged parts.\n", len(repairs))
+	default:
+		fmt.Printf("Found %d damaged parts; use -repair to fix them.\n", len(repairs))
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+// Package workpool runs jobs on several goroutines,
+// but hands out their results in the order the jobs were submitted.
+// It is used by the mio writers to process blocks in parallel while
+// producing the same output as a serial writer.
+package workpool
+
+import "sync"
+
+type job[T any] struct {
+	fn   func() (T, error)
+	res  T
+	err  error
+	done chan struct{}
+}
+
+// Pool is a set of workers with an ordered queue of results.
+// It is not safe for concurrent use; one writer is supposed to own it.
+type Pool[T any] struct {
+	jobs    chan *job[T]
+	pending []*job[T]
+	window  int
+	wg      sync.WaitGroup
+}
+
+// New starts `workers` goroutines. At most two results per worker are
+// kept pending, so memory use stays bounded if the consumer is slow.
+func New[T any](workers int) *Pool[T] {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &Pool[T]{
+		jobs:   make(chan *job[T], workers),
+		window: 2 * workers,
+	}
+
+	p.wg.Add(workers)
+	for idx := 0; idx < workers; idx++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *Pool[T]) work() {
+	defer p.wg.Done()
+
+	for jb := range p.jobs {
+		jb.res, jb.err = jb.fn()
+		close(jb.done)
+	}
+}
+
+// Submit queues `fn` to be run by a worker.
+// Results must be fetched with Next() once Full() returns true.
+func (p *Pool[T]) Submit(fn func() (T, error)) {
+	jb := &job[T]{fn: fn, done: make(chan struct{})}
+	p.pending = append(p.pending, jb)
+	p.jobs <- jb
+}
+
+// Full returns true if Next() has to be called before the next Submit().
+func (p *Pool[T]) Full() bool {
+	return len(p.pending) >= p.window
+}
+
+// Pending returns the number of results not fetched by Next() yet.
+func (p *Pool[T]) Pending() int {
+	return len(p.pending)
+}
+
+// Next waits for the oldest pending job and returns its result.
+// It must only be called if Pending() is greater than zero.
+func (p *Pool[T]) Next() (T, error) {
+	jb := p.pending[0]
+	p.pending[0] = nil
+	p.pending = p.pending[1:]
+
+	<-jb.done
+	return jb.res, jb.err
+}
+
+// Close stops all workers after waiting for submitted jobs.
+// Results that were not fetched yet are dropped.
+func (p *Pool[T]) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+	p.pending = nil
+}
@@ -0,0 +1,58 @@
+package workpool
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolOrder(t *testing.T) {
+	pool := New[int](4)
+	defer pool.Close()
+
+	results := []int{}
+	for idx := 0; idx < 100; idx++ {
+		idx := idx
+		pool.Submit(func() (int, error) {
+			// Make later jobs finish earlier every now and then:
+			time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+			return idx, nil
+		})
+
+		for pool.Full() {
+			res, err := pool.Next()
+			require.Nil(t, err)
+			results = append(results, res)
+		}
+	}
+
+	for pool.Pending() > 0 {
+		res, err := pool.Next()
+		require.Nil(t, err)
+		results = append(results, res)
+	}
+
+	require.Len(t, results, 100)
+	for idx, res := range results {
+		require.Equal(t, idx, res)
+	}
+}
+
+func TestPoolError(t *testing.T) {
+	pool := New[int](2)
+	defer pool.Close()
+
+	errBad := errors.New("bad")
+	pool.Submit(func() (int, error) { return 0, errBad })
+	pool.Submit(func() (int, error) { return 1, nil })
+
+	_, err := pool.Next()
+	require.Equal(t, errBad, err)
+
+	res, err := pool.Next()
+	require.Nil(t, err)
+	require.Equal(t, 1, res)
+}
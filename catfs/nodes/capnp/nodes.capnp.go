@@ -432,6 +432,92 @@ func (f Directory_Future) Struct() (Directory, error) {
 	return Directory(p.Struct()), err
 }
 
+// A content defined part of a file's data
+type Chunk capnp.Struct
+
+// Chunk_TypeID is the unique identifier for the type Chunk.
+const Chunk_TypeID = 0xbc5ccb3176996e4c
+
+func NewChunk(s *capnp.Segment) (Chunk, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 1})
+	return Chunk(st), err
+}
+
+func NewRootChunk(s *capnp.Segment) (Chunk, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 1})
+	return Chunk(st), err
+}
+
+func ReadRootChunk(msg *capnp.Message) (Chunk, error) {
+	root, err := msg.Root()
+	return Chunk(root.Struct()), err
+}
+
+func (s Chunk) String() string {
+	str, _ := text.Marshal(0xbc5ccb3176996e4c, capnp.Struct(s))
+	return str
+}
+
+func (s Chunk) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Chunk) DecodeFromPtr(p capnp.Ptr) Chunk {
+	return Chunk(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Chunk) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Chunk) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Chunk) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Chunk) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s Chunk) Hash() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return []byte(p.Data()), err
+}
+
+func (s Chunk) HasHash() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s Chunk) SetHash(v []byte) error {
+	return capnp.Struct(s).SetData(0, v)
+}
+
+func (s Chunk) Size() uint64 {
+	return capnp.Struct(s).Uint64(0)
+}
+
+func (s Chunk) SetSize(v uint64) {
+	capnp.Struct(s).SetUint64(0, v)
+}
+
+// Chunk_List is a list of Chunk.
+type Chunk_List = capnp.StructList[Chunk]
+
+// NewChunk creates a new list of Chunk.
+func NewChunk_List(s *capnp.Segment, sz int32) (Chunk_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 1}, sz)
+	return capnp.StructList[Chunk](l), err
+}
+
+// Chunk_Future is a wrapper for a Chunk promised by a client call.
+type Chunk_Future struct{ *capnp.Future }
+
+func (f Chunk_Future) Struct() (Chunk, error) {
+	p, err := f.Future.Ptr()
+	return Chunk(p.Struct()), err
+}
+
 // A leaf node in the MDAG
 type File capnp.Struct
 
@@ -439,12 +525,12 @@ type File capnp.Struct
 const File_TypeID = 0x8ea7393d37893155
 
 func NewFile(s *capnp.Segment) (File, error) {
-	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 2})
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 5})
 	return File(st), err
 }
 
 func NewRootFile(s *capnp.Segment) (File, error) {
-	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 2})
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 5})
 	return File(st), err
 }
 
@@ -519,12 +605,61 @@ func (s File) SetKey(v []byte) error {
 	return capnp.Struct(s).SetData(1, v)
 }
 
+func (s File) Chunks() (Chunk_List, error) {
+	p, err := capnp.Struct(s).Ptr(2)
+	return Chunk_List(p.List()), err
+}
+
+func (s File) HasChunks() bool {
+	return capnp.Struct(s).HasPtr(2)
+}
+
+func (s File) SetChunks(v Chunk_List) error {
+	return capnp.Struct(s).SetPtr(2, v.ToPtr())
+}
+
+// NewChunks sets the chunks field to a newly
+// allocated Chunk_List, preferring placement in s's segment.
+func (s File) NewChunks(n int32) (Chunk_List, error) {
+	l, err := NewChunk_List(capnp.Struct(s).Segment(), n)
+	if err != nil {
+		return Chunk_List{}, err
+	}
+	err = capnp.Struct(s).SetPtr(2, l.ToPtr())
+	return l, err
+}
+func (s File) KeySalt() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(3)
+	return []byte(p.Data()), err
+}
+
+func (s File) HasKeySalt() bool {
+	return capnp.Struct(s).HasPtr(3)
+}
+
+func (s File) SetKeySalt(v []byte) error {
+	return capnp.Struct(s).SetData(3, v)
+}
+
+func (s File) WrappedKey() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(4)
+	return []byte(p.Data()), err
+}
+
+func (s File) HasWrappedKey() bool {
+	return capnp.Struct(s).HasPtr(4)
+}
+
+func (s File) SetWrappedKey(v []byte) error {
+	return capnp.Struct(s).SetData(4, v)
+}
+
 // File_List is a list of File.
 type File_List = capnp.StructList[File]
 
 // NewFile creates a new list of File.
 func NewFile_List(s *capnp.Segment, sz int32) (File_List, error) {
-	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 2}, sz)
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 5}, sz)
 	return capnp.StructList[File](l), err
 }
 
@@ -1091,86 +1226,95 @@ func (p Node_Future) Ghost() Ghost_Future {
 	return Ghost_Future{Future: p.Future.Field(5, nil)}
 }
 
-const schema_9195d073cb5c5953 = "x\xda\xb4V\xdfo\x14\xd5\x17?\x9f{gwX\xd2" +
-	"~w\xf7;m\xc2\x83\xcd\xde\x00\xc6B*\xb4\x14#" +
-	"\x10\x8c\x14[ik!\xbdl\x1b\xc1\xa0q\xd8\xbd\xed" +
-	"\x8c\xec\xce43\x83u\x8d\x06$\x90\x80\xa6\x06\"&" +
-	"\x92\x94\x88\xa6\xf8#\x91\xe0?`LL0F_\x8c" +
-	"\x0f\x9a\xf8\xa8&\x1aM|V#\x8c\xb9\xb3\xbfJ\x03" +
-	"\x08\x0f\xbe\xed|\xce\x99{\xcf\xf9\x9c\xcf\xf9\xcc\xf6g" +
-	"\xf8.c\xa0\xf3\x01\x83\x98\xecO\xa5\xe3_\xff\xbf\xf8" +
-	"\xcbw\xbd_\x1c'\xb9\x0e,.\x1e<\xf4U\xf8\xf5" +
-	"\x9b\xe7h\x84\x99\x1c\xc6\xe0\x9f\x18\x87\xd5\xc9L\xab\x93" +
-	"\x15\x06\xc7X\x01\x84\xf8b\xe1\x89\xf9\xe7\x7f\xef~\x8d" +
-	"\xf2\xeb\xd0~!\xc5L\xa2A\xc5\x0f\xc3\xaaq\xd3\xaa" +
-	"\xf1\x82u\x99\xcf\x13\xe2\xabOOy\x9f[\x97\x16\xf4" +
-	"\x05\xcb\xf3\xd3:\x1f\xc6~X\xdd\x86iu\x1b\x85\xc1" +
-	"\x11\xe3I}\xfe\xf4\xc0\x99\x87\x1f\xd9\xfe\xfe\xeb+_" +
-	"H.8\x9a\xda\x0d\xebT\xca\xb4N\xa5\x0a\xd6\x95\xd4" +
-	"UB\xfc\xe3_3s\xc7~\xdb\xf0\xde\xca\x0eL\xd3" +
-	"\x8018\x92\xde\x0dk:mZ\xd3\xe9\xc2\xe0\x99\xb4" +
-	"\xcf\x08\xf1\xd2O\x13\xdfg\x97\xfe\xf8\x94\xe4F,+" +
-	"\xb0;m\x82h0\x9f9\x01\x82\xd5\x93\xd1\xd5c\xf1" +
-	"D\xa5\xff\xe0\xc4\x0f+\x8b\xe1\xba\x98Z\xe69X\x0b" +
-	"\x19\xd3Z\xc8\x14\xack\x99\x9fi[<S\xf1\xfd\xcd" +
-	"%;2f\xc2\xcd\x9e_V\xe1\xe6\x92=\xe7\xcd\xd5" +
-	"\x7foJ~\xef\xd8\xe3\xf8aD4\x09H\x03,~" +
-	"\xe6\x8d\xb7\xe5'\xdf\xbez\x8d\xa4\xc10\xd4\x07t\x10" +
-	"\x0d\xe0\x1b\xc4I\x9ep\xbdt\xd9-\xd9\x91\x0aE\xe4" +
-	"\xd8\x91\xb0EI\x05\x91\xedzB\x9f)\xe6\xedP\xd8" +
-	"\x91\x88\x1c7\x14sv\xe4\x08\xdf+A\x11\xc9.n" +
-	"\x10\x19 \xca\xbf\xfc\x14\x91|\x89C\x9ef\x00\xba\xa0" +
-	"\xb1S\xfb\x89\xe4I\x0ey\x96\xa1\x87\xc51\xba\xc0\x88" +
-	"\xf2\x0b;\x88\xe4i\x0ey\x9e\xa1\x87\xdf\xd00'\xca" +
-	"\x9f\xd3\xd9g9\xe4\"C\x8fq]\xc3\x06Q\xfe\xc2" +
-	"F\"y\x9eC^b\x88gu\xb5c\x9eO\xbc\xac" +
-	"\x90!\x86\x0c5\xc0I;\"8\xe8 \x86\x0e\xc2\xa3" +
-	"%\xbfZu#\xe4\xda\xc4\x13\x90#\xc4e7P\xa5" +
-	"\xc8\x0f\x085\xe4\xda\xcc\xd7\xa3\xd9\x19\xb7\xa2\x90k\xab" +
-	"\xa3\xf1\xd2\xdd\x10>\xec\x06#\x9e\x19\x05\xb5[S~" +
-	"_By\x1e_\xc6C\"t\xbd\xd9\x8ab\xa2YK" +
-	"M(/\x0aj\x04\xb9\xaa\xc5\xe7\x06\xdd\xf6z\x0e\xd9" +
-	"\xcf\x90o\x12\xfa\xa0\x06{9\xe4V\x86\xacgWU" +
-	"\xb3\xdf\xacc\x87\x0e:\x89\xa1\xf3.\xcb}L\x13\x84" +
-	"\xe8\xd6\xc5\x8a\x86>\xd6\"N\xf2\"\xe1\xf2P\xd8\"" +
-	"T\x91\xf0gD\xc9\xb1\xbdY-\x15_x\xbeYV" +
-	"!\x91\\\xd3\xaa\xfc\xc2\xda\xf6\xc0Z\x95_\xd43\x7f" +
-	"\x8bC.1\xe4\x19\xab\x0b\xe1\x1d\x0d.r\xc8\x0f\x18" +
-	"\xf2\x9c\xd7epY\xf7x\x89C~\xc4\x00\xa3\xae\x81" +
-	"\x0f\xb7\x10\xc9%\x0e\xf91\x03RX\xb6\\\xf9+[" +
-	"\x88\x99\xd5p\xb65y\xfbh\xe4\xf8A\xebq\xce\x0e" +
-	"\x94\x175\xa9\xc9\x06\xbe\xdfz(\xb8^Y\xbd\x80\x14" +
-	"1\xa4\x08\x85\xaa\x0af\xd5]q\xf7\xb8[Q\xb7\xd9" +
-	"\xac5\x8d1\x7f\x16\x0f\x89\x8a\xb2g\x84\xc7\xf4\x02\xb9" +
-	"\x9e\x88\x1c%\xf6\x0e\x0f\xed!\"\xd9\xd1\"kDw" +
-	"\xbb\x8bCN\xb4\xd7fL\xd32\xcc!'5W\x8d" +
-	"\xa5\xd9\xabY\x1d\xe5\x90S\x0c\xd9\xd0}\xb1%\xfff" +
-	"\x87\x8d\x86\xcd#\xaavOB\xd8\xe7\x97o\xd7\xcc\xfa" +
-	"\x86\x0c\xc6\x11\xefK\xba\x08\x85a\xd7\x1d\xa1\xd1PU" +
-	"\x05G*J\x94\xedY\xad\x0b}\x1dA\xf65\xbb\xb3" +
-	"\xee\xc7F\xa2\xa2\x00G\xb1\x0fm5X\x1b0NT" +
-	"\xec\xd5\xf8V\xb4\x05a\x0d`7Q\xb1O\xe3\xdb\xc0" +
-	"\x80\xba$\xac\x87\xb0\x85\xa8\xd8\xaf\xe1\x9d:\xdd\xe0\x89" +
-	",\xac\xed8LT\xdc\xa6\xf1a\x8d\xa7\x8c.\xa4\x88" +
-	"\xac\xa1\xe4\xda\x9d\x1a\x1f\x05CO:\x8eS]H\x13" +
-	"Y#\xd8AT\xdc\xa5#\x13:b\xde\xd0\x11\x93\xc8" +
-	"\x1a\xc3~\xa2\xe2\xa8\x8eL\xe9\xc8\xaa\xeb:\xb2\x8a\xc8" +
-	"\x92\xc9i\x13:r@G2\x7f\xebH\x86\xc8\x9aN" +
-	"\xea\x9a\xd4\x91C\xfa\xfe\xd5\xe9.\xac&\xb2\x0e&u" +
-	"\x1d\xd0x\x19+65\x8e\x02\xa5F\xed\xd0!\xa2\xe6" +
-	"\x9c\x8eU\xfd\xf2\x94\xdb\xce)\xb8\x9a\xe3\x96\xbf\x95|" +
-	"/R^4J\xe6\xb2%\xcf\x1e\x0dU\xf0\xdf\xd8]" +
-	"!1T\xe4\xda\x9f\xed\xc6a\x87\xed\xd2\x11\xe5\x95o" +
-	".\xa4%\xb2\xd4\xbf\xb9M\xb4)Y1\xd2.\x97\xab" +
-	"\x8fj\x85\xcd\xd5\xa7t\xb3\xcd\xcd\xbb\x91\xd3\xb69e" +
-	"\x97\xefI\xdd\xc3\xba\xff\xac\xf6\xd8[K\xbc\xb7!\xf1" +
-	"w\x11\x0f7\xa8J\xd5\x84f\xdcv\xbdP\xf8\x9e\x12" +
-	"~ \xaa~\xa0Zn\xed\xaaPc3\xaeYI\x9c" +
-	"/\xd7Zf[\xd7}\x88C:\xedeVz\x99\x9f" +
-	"\xe5\x90\x95e\xcb\xec\x8e\x13I\x87C\x9e\xd4\xc6\xc7\xea" +
-	"\xc6\xf7\x8a\x06\x8f\xd7\xbf\x7fw\xda\xf0\xb8\xe4\xb8\x95r" +
-	"\xa0<\xad\xa0\xff\x11&9\x90k\xffa\"h\xb0)" +
-	"\x9a\xf0NI\xff\x04\x00\x00\xff\xff\xe1\x12L("
+const schema_9195d073cb5c5953 = "x\xda\xb4Vmh\x1c[\x19~\x9fsfw\xba!" +
+	"uw\x9d\\\xb8?\x0c{\xec\xad\x98\x94x\x9bt\xaf" +
+	"xo\xb8rob\xea\xcdM\xe3%\xa7\xdbb+Q" +
+	"\x9c\xee\x9c\xcd\x8c\xd9\x9dYf&\x8d\x11Kk\xa9\xd0" +
+	"(\x95\x06+\x18H\xb1\x95\xd4\x0fP\xf4\x87\x7f\x84\x16" +
+	"?\xa0R,\x82\xf8C\xc1\x7f~\x80\xa2(\xf8\xa3\xa0" +
+	"b;rf?\x13\xd3\x1a\x7f\xf8o\xf7y\xdfs\xde" +
+	"\xf7<\xe7y\x9f3\xe3'\xf8\xeb\xc6\xc4\xc1\x12'&" +
+	"\x0fg\xb2\xc9\x9f\xde\xbe\xf5\xc7_\x8d<\xb8D\xf2\x05" +
+	"\xb0\xa4rv\xf1a\xf4\xf3/m\xd0qfr\x18\xe5" +
+	"\x15\xcc\xc1Z\x87i\xad\xa3T\xbe\x8f\x12\x08\xc9\xcd\xd2" +
+	"\x89\xd5\xf3\x7f}\xee\xf3T|\x01\xbd\x05\x19f\x12\x95" +
+	"\x7f\xc3\xce\xc1z\xc4L\xeb\x11+Y\xef\xe4\xab\x84\xe4" +
+	";\x1f=\xe5\xff\xc4\xbauM\x17\xe8\xcf\xcf\xea\xfc\x0b" +
+	"\xfc$\xac\x0dnZ\x1b\xbcT\xfe\x11\xff\xb0\xde\xff\xf4" +
+	"\xc4\xfa\xfb\xde\xff\xca\xd7\xbf\xb0{AF/\xf8\x9b1" +
+	"\x0d\x0b\x19\xd3B\xa6T\x1e\xcd\xa4\x0b~\xf7\xcfZ\xf3" +
+	"\xe2\x9fG\xbf\xb6\xfb\x08\xa6i\xc0(\xafg\xa7am" +
+	"fMk3[*\xff,\x1b0B2\xefo\x9e\x9f" +
+	"x\xb8xww\x09\xe8\x12\xa7ss \xb2T\xaed" +
+	"m\xe4\xf4\x09\xb6\x7f?\xff\xeb\xfc\xf6\xdf\x7f@\xf2\x08" +
+	"\xfa\xce\xf3\\\xd6\x04Q\xf9/\xb9\xcb X\xffHS" +
+	"\xb1u\xb9>~v\xfe\xb7\xbb7\xe6\xe9\xc6\x03\x9f\x80" +
+	"\xe5\x0d\x98\x967P\xb2n\x0f\xfc\x81\x06\x93Z=\x08" +
+	"\x8eV\xed\xd8\xa8EG\xfd\xc0Q\xd1\xd1\xaa\xdd\xf4\x9b" +
+	"\xad\xdf/\xa6\xbf'\xdfp\x83(&Z\x00\xa4\x01\x96" +
+	"|\xec\x8b_\x91\xf7~\xf9\xb9\xfb$\x0d\x86\xa91`" +
+	"\x90h\x02\xbf@\x92\xe6\x09\xcf\xcf:^\xd5\x8eU$" +
+	"b\xd7\x8e\x85-\xaa*\x8cm\xcf\x17zO\xb1jG" +
+	"\xc2\x8eE\xecz\x91h\xda\xb1+\x02\xbf\x0aE$\x87" +
+	"\xb8Ad\x80\xa8x\xe1#D\xf2\xd3\x1c\xf2*\x030" +
+	"\x04\x8d}\xf6$\x91\xbc\xc2!\xaf3\x0c\xb3$\xc1\x10" +
+	"\x18Q\xf1\xda$\x91\xbc\xca!o0\x0c\xf3'\x1a\xe6" +
+	"D\xc5\x0d\x9d}\x9dCn1\x0c\x1b\x8f5l\x10\x15" +
+	"7\x8f\x10\xc9\x1b\x1c\xf2\x16C\xb2\xa4\xbb}\xd3\x0f\x88" +
+	";\x0a9b\xc8Q\x1b\\\xb0c\x82\x8bAb\x18$" +
+	"\xbcV\x0d\x1a\x0d/F\xa1G<\x01\x05B\xe2x\xa1" +
+	"\xaa\xc6AHXC\xa1\xc7|+\x9a\xafyu\x85B" +
+	"OL\xedE\xfb!|\xc6\x0b\x8f\xfbf\x1c\xae\xedM" +
+	"\xf9;R\xca\x8b\xf8i2%\"\xcf_\xaa+&:" +
+	"\xbd\xac\x09\xe5\xc7\xe1\x1aA\x1e\xe8\xf29\xaa\x8f}\x98" +
+	"C\x8e3\x14;\x84\xbeG\x83#\x1c\xf2%\x86\xbco" +
+	"7T\xe7\xbcy\xd7\x8e\\\x1c$\x86\x83\xfbl\xf7\x03" +
+	"\x9a \xc4{7+\xda\xfa8\x84$\xcd\x8b\x85\xc7#" +
+	"a\x8bH\xc5\"\xa8\x89\xaak\xfbKZ*\x81\xf0\x03" +
+	"\xd3Q\x11\x91|\xbe\xdb\xf9\xe6\xa1\xde\x85u;\xbf\xa9" +
+	"\xef\xfc\xcb\x1cr\x9b\xa1\xc8XK\x08\xb75\xb8\xc5!" +
+	"\xbf\xc1P\xe4\xbc%\x83;\xfa\x8c\xb78\xe4\xb7\x18`" +
+	"\xb44\xf0\xcdcDr\x9bC~\x97\x01\x19\xf4\x0dW" +
+	"\xf1\xdb\xc7\x88\x99\x8dh\xa9{\xf3\xf6J\xec\x06a\xf7" +
+	"o\xd3\x0e\x95\x1fw\xa8\xc9\x87A\xd0\xfdS\xf2|G" +
+	"}\x12\x19b\xc8\x10J\x0d\x15.\xa9}q\xf7A\xaf" +
+	"\xae\x9e2Y\xcf\xb7\xaf\xf9\xc7\xc9\x94\xa8+\xbb&|" +
+	"\xa6\x07\xc8\xf3E\xec*\xf1\xa1\x99\xa97h'Y}" +
+	"\xea\xde\x9b\xab\xf6\xd0\xdc>\xd4\xcf\x15#\x14\xefL\xb6" +
+	"\x89\xba\xcbP48\xa1\xf8\xfdi\"\xf9=\x0e\xf9C" +
+	"\x86b\xc6 \x14\xef\xe9\xa9\xbc\xcb!\x1f0\xe4#\xef" +
+	"S\xdd\xa1\xe9\xf0\xd2\xa6\xc9\\Vk\x1dZ^\xab\xba" +
+	"+\xfer\x84\xb7\x11\x168P\xe8\xf9\x1eA\x83\x17\x97" +
+	"\xd5Z\xc5\xaewiLVC\xbb\xd9T\xce\x09\xe2\xbd" +
+	"M\xf6\xc5\xe3[\x81\xf34\x1e\x0f\xb7\x158\x87\xe4\xad" +
+	"\x94\xc0H\x18\xb6\xf0\xfb\xb8l\xa8p\xb9\xae\x84c/" +
+	"iI\xear\x049\xd6!\xd6z\x17\x8e\x10U\x048" +
+	"*c\xe8\x09\xd1\x1a\xc5\x1cQeD\xe3/\xa1\xa7E" +
+	"k\x02\xd3D\x951\x8d\xbf\x0c\x06\xb4\xd4h\xbd\x17\xc7" +
+	"\x88*\xe3\x1a~\x15)\xcf\xa9\"\xadWp\x8e\xa8\xf2" +
+	"\xb2\xc6g\x90\xb2=\x84\x0c\x915\x95\x96}U\xe3\xb3" +
+	"`\x18\xce&If\x08Y\"\xeb8&\x89*\xaf\xeb" +
+	"\xc8\xbc\x8e\x98Ot\xc4$\xb2\xde\xc4I\xa2\xca\xac\x8e" +
+	"\x9c\xd2\x91\x03\x8fu\xe4\x00\x91%\xd3\xdd\xe6u\xe4\x8c" +
+	"\x8e\xe4\xfe\xa5#9\"\xebt\xda\xd7\x82\x8e,\xea\xfa" +
+	"\x03\xd9!\x0c\x10Yg\xd3\xbe\xceh\xdc\xc1.\x93H" +
+	"\xe2P\xa9Y;r\x89\xa8sO\x17\x1b\x81s\xca\xeb" +
+	"\xe5\x94<\xcdq\xd7Z\xab\x81\x1f+?\x9e%\xb3\xcf" +
+	"_\xf2+\x91\x0a\xff?N[J\xbd\x1c\x85\xde\x07F" +
+	"{\xb3svuY\xf9\xce\xceF\xf6gtZ\xcdD" +
+	"\xff\xa91\xa2\x96\xc4\xa6\x91L\x89\xd6A\x8dX8\xaa" +
+	"\xe6\xf9\xca\x11M;L\xbd\xce\x16\xba\xd3wG\xc2\xb1" +
+	"c\x9bR\x83f;\xcc\x19 \xec4\xe6~/\xde1" +
+	"t\xdd~3\xff\xcd\x98\xe3\x17S7J\xeb\x15Z\xd2" +
+	"\xda\xf5\"\xb4T\xb5\xb3\xf0\xaa\x17\xbb\xbd\x17A\xd9\xce" +
+	"\xffD\xd4\x8c\xbe\xaf\xbc~\x8e\xf6\x1e\xc9\x91\xf6H~" +
+	"\x15\xc9L\xfbj3k)q\xb6\xe7G\"\xf0\x95\x08" +
+	"B\xd1\x08B\xd5}\xd8<\x15i\xac\xe6\x99\xf5\xf4\x91" +
+	"(t}\xcf\xd6}/rH\xb7\xe7{J\x1b\xda\xc7" +
+	"9d\xbd\xcf\xf7\xbc9\"\xe9r\xc8+\xa9\xef\xb5\xde" +
+	"\x88\xcfh\xf0R\xebS\xe1Y\xb6\x96T]\xaf\xee\x84" +
+	"\xca'\xa2\x9e\x9fu?E[~\xd6\x11y\xf4\xac\xa4" +
+	"\x7f\x0f\x000\x1e\xa8\x84"
 
 func init() {
 	schemas.Register(schema_9195d073cb5c5953,
@@ -1179,6 +1323,7 @@ func init() {
 		0x8da013c66e545daf,
 		0x8ea7393d37893155,
 		0xa629eb7f7066fae3,
+		0xbc5ccb3176996e4c,
 		0xbff8a40fda4ce4a4,
 		0xe24c59306c829c01)
 }
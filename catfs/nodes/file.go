@@ -2,6 +2,7 @@ package nodes
 
 import (
 	"capnproto.org/go/capnp/v3"
+	"encoding/binary"
 	capnp_model "floo/catfs/nodes/capnp"
 	h "floo/util/hashlib"
 	"fmt"
@@ -9,6 +10,28 @@ import (
 	"time"
 )
 
+// Chunk is a content defined part of a file's data.
+// Chunks with the same hash are only stored once.
+type Chunk struct {
+	// Hash is the content hash of the chunk's (unencrypted) data.
+	Hash h.Hash
+
+	// Size is the size of the chunk's (unencrypted) data.
+	Size uint64
+}
+
+// ChunksHash returns a hash over the hashes and sizes of `chunks`.
+// It serves as backend hash for files that are stored in chunks.
+func ChunksHash(chunks []Chunk) h.Hash {
+	buf := make([]byte, 0, len(chunks)*48)
+	for _, chunk := range chunks {
+		buf = append(buf, chunk.Hash...)
+		buf = binary.BigEndian.AppendUint64(buf, chunk.Size)
+	}
+
+	return h.Sum(buf)
+}
+
 // File represents a single file in the repository.
 // It stores all metadata about it and links to the actual data.
 type File struct {
@@ -16,7 +39,16 @@ type File struct {
 
 	size   uint64
 	parent string
-	key    []byte
+
+	// Only one of key, keySalt and wrappedKey is set. The latter two
+	// need the master key to get the actual key (see core.Linker.FileKey).
+	key        []byte
+	keySalt    []byte
+	wrappedKey []byte
+
+	// chunks is empty if the data is stored as a single object
+	// under the backend hash.
+	chunks []Chunk
 }
 
 // NewEmptyFile returns a newly created file under `parent`, named `name`.
@@ -76,6 +108,30 @@ func (f *File) setFileAttrs(seg *capnp.Segment) (*capnp_model.File, error) {
 		return nil, err
 	}
 
+	if err := capFile.SetKeySalt(f.keySalt); err != nil {
+		return nil, err
+	}
+
+	if err := capFile.SetWrappedKey(f.wrappedKey); err != nil {
+		return nil, err
+	}
+
+	if len(f.chunks) > 0 {
+		chunks, err := capFile.NewChunks(int32(len(f.chunks)))
+		if err != nil {
+			return nil, err
+		}
+
+		for idx, chunk := range f.chunks {
+			capChunk := chunks.At(idx)
+			if err := capChunk.SetHash(chunk.Hash); err != nil {
+				return nil, err
+			}
+
+			capChunk.SetSize(chunk.Size)
+		}
+	}
+
 	capFile.SetSize(f.size)
 	return &capFile, nil
 }
@@ -115,7 +171,40 @@ func (f *File) readFileAttrs(capFile capnp_model.File) error {
 	f.nodeType = NodeTypeFile
 	f.size = capFile.Size()
 	f.key, err = capFile.Key()
-	return err
+	if err != nil {
+		return err
+	}
+
+	f.keySalt, err = capFile.KeySalt()
+	if err != nil {
+		return err
+	}
+
+	f.wrappedKey, err = capFile.WrappedKey()
+	if err != nil {
+		return err
+	}
+
+	chunks, err := capFile.Chunks()
+	if err != nil {
+		return err
+	}
+
+	f.chunks = nil
+	for idx := 0; idx < chunks.Len(); idx++ {
+		capChunk := chunks.At(idx)
+		hash, err := capChunk.Hash()
+		if err != nil {
+			return err
+		}
+
+		f.chunks = append(f.chunks, Chunk{
+			Hash: h.Hash(hash).Clone(),
+			Size: capChunk.Size(),
+		})
+	}
+
+	return nil
 }
 
 ////////////////// METADATA INTERFACE //////////////////
@@ -136,6 +225,26 @@ func (f *File) SetName(n string) { f.name = n }
 // SetKey updates the key to a new value, taking ownership of the value.
 func (f *File) SetKey(k []byte) { f.key = k }
 
+// KeySalt returns the salt the key is derived from, if any.
+func (f *File) KeySalt() []byte { return f.keySalt }
+
+// SetKeySalt updates the key salt, taking ownership of the value.
+func (f *File) SetKeySalt(salt []byte) { f.keySalt = salt }
+
+// WrappedKey returns the encrypted key, if any.
+func (f *File) WrappedKey() []byte { return f.wrappedKey }
+
+// SetWrappedKey updates the encrypted key, taking ownership of the value.
+func (f *File) SetWrappedKey(wrapped []byte) { f.wrappedKey = wrapped }
+
+// Chunks returns the chunks of the file's data in order.
+// It is empty if the data is stored as a single object.
+func (f *File) Chunks() []Chunk { return f.chunks }
+
+// SetChunks updates the chunks of the file, taking ownership of them.
+// The size of the file is not changed.
+func (f *File) SetChunks(chunks []Chunk) { f.chunks = chunks }
+
 // SetSize will update the size of the file and update it's mod time.
 func (f *File) SetSize(s uint64) {
 	f.size = s
@@ -154,11 +263,31 @@ func (f *File) Copy(inode uint64) ModNode {
 		copy(copyKey, f.key)
 	}
 
+	var copyKeySalt, copyWrappedKey []byte
+	if f.keySalt != nil {
+		copyKeySalt = append([]byte(nil), f.keySalt...)
+	}
+
+	if f.wrappedKey != nil {
+		copyWrappedKey = append([]byte(nil), f.wrappedKey...)
+	}
+
+	var copyChunks []Chunk
+	for _, chunk := range f.chunks {
+		copyChunks = append(copyChunks, Chunk{
+			Hash: chunk.Hash.Clone(),
+			Size: chunk.Size,
+		})
+	}
+
 	return &File{
-		Base:   f.Base.copyBase(inode),
-		size:   f.size,
-		parent: f.parent,
-		key:    copyKey,
+		Base:       f.Base.copyBase(inode),
+		size:       f.size,
+		parent:     f.parent,
+		key:        copyKey,
+		keySalt:    copyKeySalt,
+		wrappedKey: copyWrappedKey,
+		chunks:     copyChunks,
 	}
 }
 
@@ -245,6 +374,7 @@ func (f *File) SetParent(_ Linker, parent Node) error {
 }
 
 // Key returns the current key of the file.
+// It is nil if the key is derived or wrapped; use core.Linker.FileKey then.
 func (f *File) Key() []byte {
 	return f.key
 }
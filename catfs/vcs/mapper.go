@@ -8,6 +8,7 @@ import (
 	"fmt"
 	e "github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"path"
 )
 
 // MapPair is a pair of nodes (a file or a directory)
@@ -27,6 +28,10 @@ import (
 //
 // If SrcWasMoved is true, the two nodes were purely moved,
 // but not modified otherwise.
+//
+// RenameCandidates is only set when rename detection is enabled and a
+// removed file could not be paired unambiguously. It then contains all
+// files on src's side that have the same content as the removed file.
 type MapPair struct {
 	Src n.ModNode
 	Dst n.ModNode
@@ -34,6 +39,8 @@ type MapPair struct {
 	SrcWasRemoved bool
 	SrcWasMoved   bool
 	TypeMismatch  bool
+
+	RenameCandidates []n.ModNode
 }
 
 // flags that are set during the mapper run.
@@ -63,6 +70,59 @@ type Mapper struct {
 	dstHead        *n.Commit
 	flagsRoot      *trie.Node
 	fn             func(pair MapPair) error
+
+	// Set if renames should be guessed by content hash.
+	detectRenames bool
+
+	// Ghosts without move partner that might have been renamed.
+	// Only filled when detectRenames is true.
+	removedGhosts []removedGhost
+}
+
+// removedGhost is a ghost on src's side that has no living counterpart,
+// while a file still exists at the same path on dst's side.
+type removedGhost struct {
+	srcGhost *n.Ghost
+	dstFile  *n.File
+}
+
+// NewMapper creates a new mapper object that is capable of finding pairs of
+// nodes between lkrDst and lkrSrc. If `srcHead` or `dstHead` is nil, the
+// respective HEAD commit is used. `srcRoot` is the node in src where the
+// mapping starts; it is usually the root directory of `srcHead`.
+func NewMapper(lkrSrc, lkrDst *c.Linker, srcHead, dstHead *n.Commit, srcRoot n.Node) (*Mapper, error) {
+	var err error
+	if srcHead == nil {
+		srcHead, err = lkrSrc.Head()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dstHead == nil {
+		dstHead, err = lkrDst.Head()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Mapper{
+		lkrSrc:    lkrSrc,
+		lkrDst:    lkrDst,
+		srcHead:   srcHead,
+		dstHead:   dstHead,
+		srcRoot:   srcRoot,
+		flagsRoot: trie.NewNodeWithData(&flags{}),
+	}, nil
+}
+
+// SetRenameDetection enables or disables content-hash based rename detection.
+// When enabled, a file that was removed on the remote side (i.e. a ghost
+// without move partner) is paired with a file that was added on the remote
+// side, if both have the same content hash. This catches moves that were not
+// recorded via move mappings, like re-imports from disk.
+func (ma *Mapper) SetRenameDetection(enabled bool) {
+	ma.detectRenames = enabled
 }
 
 func (ma *Mapper) getFlags(path string) *flags {
@@ -144,9 +204,15 @@ func (ma *Mapper) isDstComplete(nd n.Node) bool {
 // A special case is when a file was moved on one side but, a file exists
 // already on the other side. In this case the already existing files wins.
 //
+// If rename detection is enabled, removed files that have no move mapping are
+// paired with added files of the same content after all ghosts were handled.
+// If more than one pairing is possible, the removal is reported together
+// with all possible candidates and no move is assumed.
+//
 // Some examples of the described behaviours can be found in the tests of Mapper.
 func (ma *Mapper) Map(fn func(pair MapPair) error) error {
 	ma.fn = fn
+	ma.removedGhosts = nil
 	log.Debugf("mapping ghosts")
 	if err := ma.handleGhosts(); err != nil {
 		return err
@@ -218,7 +284,9 @@ func (ma *Mapper) handleGhosts() error {
 		}
 	}
 
-	return nil
+	// Only pair renames after all recorded moves were handled,
+	// so their nodes are already marked as visited.
+	return ma.mapRenames()
 }
 
 type ghostDir struct {
@@ -395,6 +463,27 @@ func (ma *Mapper) handleGhostsWithoutAliveNd(srcNd n.Node) error {
 			return ie.ErrBadNode
 		}
 
+		if ma.detectRenames && dstNd.Type() == n.NodeTypeFile {
+			srcGhost, ok := srcNd.(*n.Ghost)
+			if !ok {
+				return ie.ErrBadNode
+			}
+
+			dstFile, ok := dstNd.(*n.File)
+			if !ok {
+				return ie.ErrBadNode
+			}
+
+			if srcGhost.OldNode().Type() == n.NodeTypeFile {
+				// Defer the decision until we know what files were added.
+				ma.removedGhosts = append(ma.removedGhosts, removedGhost{
+					srcGhost: srcGhost,
+					dstFile:  dstFile,
+				})
+				return nil
+			}
+		}
+
 		// Report that the file is missing on src's side.
 		return ma.report(nil, dstModNd, false, true, false)
 	}
@@ -403,6 +492,100 @@ func (ma *Mapper) handleGhostsWithoutAliveNd(srcNd n.Node) error {
 	return nil
 }
 
+// addedSrcFiles returns all files in src that have no counterpart in dst and
+// were not visited yet. Only files whose content hash is in `contents` are
+// considered. The result is keyed by the b58 content hash.
+func (ma *Mapper) addedSrcFiles(contents map[string]bool) (map[string][]*n.File, error) {
+	added := make(map[string][]*n.File)
+	return added, n.Walk(ma.lkrSrc, ma.srcRoot, true, func(srcNd n.Node) error {
+		if srcNd.Type() != n.NodeTypeFile || ma.isSrcVisited(srcNd) {
+			return nil
+		}
+
+		b58 := srcNd.ContentHash().B58String()
+		if !contents[b58] {
+			return nil
+		}
+
+		dstNd, err := ma.lkrDst.LookupNodeAt(ma.dstHead, srcNd.Path())
+		if err != nil && !ie.IsNoSuchFileError(err) {
+			return err
+		}
+
+		if dstNd != nil && dstNd.Type() != n.NodeTypeGhost {
+			// Something exists at this place already; not an added file.
+			return nil
+		}
+
+		srcFile, ok := srcNd.(*n.File)
+		if !ok {
+			return ie.ErrBadNode
+		}
+
+		added[b58] = append(added[b58], srcFile)
+		return nil
+	})
+}
+
+// mapRenames pairs the removed ghosts collected during handleGhosts()
+// with added files of the same content hash. Pairs are mapped like
+// recorded moves, everything else is reported as removed.
+func (ma *Mapper) mapRenames() error {
+	if len(ma.removedGhosts) == 0 {
+		return nil
+	}
+
+	contents := make(map[string]bool)
+	removedByContent := make(map[string][]removedGhost)
+	for _, removed := range ma.removedGhosts {
+		b58 := removed.srcGhost.OldNode().ContentHash().B58String()
+		contents[b58] = true
+		removedByContent[b58] = append(removedByContent[b58], removed)
+	}
+
+	added, err := ma.addedSrcFiles(contents)
+	if err != nil {
+		return err
+	}
+
+	for _, removed := range ma.removedGhosts {
+		b58 := removed.srcGhost.OldNode().ContentHash().B58String()
+		candidates := added[b58]
+
+		if len(candidates) == 1 && len(removedByContent[b58]) == 1 {
+			// Exactly one removed and one added file with this content.
+			// Treat it like a move that was recorded with a move mapping.
+			debug("rename", removed.srcGhost.Path(), "->", candidates[0].Path())
+			ma.setSrcVisited(removed.srcGhost)
+			if err := ma.mapFile(candidates[0], removed.dstFile.Path()); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if len(candidates) > 0 {
+			log.Warningf(
+				"mapper: ambiguous rename of %s (%d removed, %d added with same content)",
+				removed.srcGhost.Path(),
+				len(removedByContent[b58]),
+				len(candidates),
+			)
+		}
+
+		var candidateNds []n.ModNode
+		for _, candidate := range candidates {
+			candidateNds = append(candidateNds, candidate)
+		}
+
+		if err := ma.report(nil, removed.dstFile, false, true, false, candidateNds...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (ma *Mapper) mapFile(srcCurr *n.File, dstFilePath string) error {
 	// Check if we already visited this file.
 	if ma.isSrcVisited(srcCurr) {
@@ -456,6 +639,193 @@ func (ma *Mapper) mapFile(srcCurr *n.File, dstFilePath string) error {
 	}
 }
 
+// mapDirectory maps `srcCurr` to the directory at `dstPath` in dst.
+// Directories that are equal on both sides are skipped as a whole,
+// otherwise their children are mapped one by one. If `force` is true,
+// the directory is mapped even if it was visited before.
+func (ma *Mapper) mapDirectory(srcCurr *n.Directory, dstPath string, force bool) error {
+	if !force && ma.isSrcVisited(srcCurr) {
+		return nil
+	}
+
+	debug("map dir", srcCurr.Path(), dstPath)
+	ma.setSrcVisited(srcCurr)
+
+	dstCurrNd, err := ma.lkrDst.LookupNodeAt(ma.dstHead, dstPath)
+	if err != nil && !ie.IsNoSuchFileError(err) {
+		return err
+	}
+
+	if dstCurrNd != nil && dstCurrNd.Type() == n.NodeTypeGhost {
+		// The directory might have been moved on our side.
+		aliveDstCurr, err := ma.ghostToAlive(ma.lkrDst, ma.dstHead, dstCurrNd)
+		if err != nil {
+			return err
+		}
+
+		dstCurrNd = nil
+		if aliveDstCurr != nil {
+			dstCurrNd = aliveDstCurr
+		}
+	}
+
+	if dstCurrNd == nil {
+		// We do not have this directory. Empty directories are reported
+		// as a whole, otherwise the children are reported one by one,
+		// since some of them might have been moved from elsewhere.
+		if srcCurr.NChildren() == 0 {
+			return ma.report(srcCurr, nil, false, false, false)
+		}
+
+		return ma.mapDirectoryContents(srcCurr, dstPath)
+	}
+
+	dstCurr, ok := dstCurrNd.(*n.Directory)
+	if !ok {
+		dstModNd, ok := dstCurrNd.(n.ModNode)
+		if !ok {
+			return ie.ErrBadNode
+		}
+
+		// Directory and File don't go well together.
+		return ma.report(srcCurr, dstModNd, true, false, false)
+	}
+
+	if srcCurr.TreeHash().Equal(dstCurr.TreeHash()) {
+		// Both sides are equal, no need to look any further.
+		ma.setSrcHandled(srcCurr)
+		ma.setDstHandled(dstCurr)
+		return nil
+	}
+
+	return ma.mapDirectoryContents(srcCurr, dstCurr.Path())
+}
+
+// mapDirectoryContents maps all children of `srcCurr` to
+// the respective children of the directory at `dstPath`.
+func (ma *Mapper) mapDirectoryContents(srcCurr *n.Directory, dstPath string) error {
+	children, err := srcCurr.ChildrenSorted(ma.lkrSrc)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		childDstPath := path.Join(dstPath, child.Name())
+
+		switch child.Type() {
+		case n.NodeTypeDirectory:
+			childDir, ok := child.(*n.Directory)
+			if !ok {
+				return ie.ErrBadNode
+			}
+
+			if err := ma.mapDirectory(childDir, childDstPath, false); err != nil {
+				return err
+			}
+		case n.NodeTypeFile:
+			childFile, ok := child.(*n.File)
+			if !ok {
+				return ie.ErrBadNode
+			}
+
+			if err := ma.mapFile(childFile, childDstPath); err != nil {
+				return err
+			}
+		case n.NodeTypeGhost:
+			// Ghosts were already handled in handleGhosts().
+		default:
+			return e.Wrapf(ie.ErrBadNode, "Unexpected node type in mapDirectory: %v", child)
+		}
+	}
+
+	return nil
+}
+
+// extractLeftovers reports all nodes below `root` that were not handled yet.
+// If `srcToDst` is true, the nodes are from src and reported as added,
+// otherwise they are from dst and reported as missing on src's side.
+func (ma *Mapper) extractLeftovers(lkr *c.Linker, root *n.Directory, srcToDst bool) error {
+	isHandled := ma.isDstHandled
+	if srcToDst {
+		isHandled = ma.isSrcHandled
+	}
+
+	if isHandled(root) {
+		return nil
+	}
+
+	if root.NChildren() == 0 && !root.IsRoot() {
+		return ma.extractEmptyDirectory(root, srcToDst)
+	}
+
+	children, err := root.ChildrenSorted(lkr)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if isHandled(child) {
+			continue
+		}
+
+		debug("extract", child.Path())
+
+		switch child.Type() {
+		case n.NodeTypeDirectory:
+			dir, ok := child.(*n.Directory)
+			if !ok {
+				return ie.ErrBadNode
+			}
+
+			if err := ma.extractLeftovers(lkr, dir, srcToDst); err != nil {
+				return err
+			}
+		case n.NodeTypeFile:
+			file, ok := child.(*n.File)
+			if !ok {
+				return ie.ErrBadNode
+			}
+
+			if srcToDst {
+				err = ma.report(file, nil, false, false, false)
+			} else {
+				err = ma.report(nil, file, false, false, false)
+			}
+
+			if err != nil {
+				return err
+			}
+		case n.NodeTypeGhost:
+			// Ghosts were already handled in handleGhosts().
+		default:
+			return e.Wrapf(ie.ErrBadNode, "Unexpected node type in extractLeftovers: %v", child)
+		}
+	}
+
+	return nil
+}
+
+// extractEmptyDirectory reports an empty directory that was not handled yet,
+// unless a node exists at the same path on the other side.
+func (ma *Mapper) extractEmptyDirectory(dir *n.Directory, srcToDst bool) error {
+	if srcToDst {
+		return ma.report(dir, nil, false, false, false)
+	}
+
+	srcNd, err := ma.lkrSrc.LookupNodeAt(ma.srcHead, dir.Path())
+	if err != nil && !ie.IsNoSuchFileError(err) {
+		return err
+	}
+
+	if srcNd != nil && srcNd.Type() != n.NodeTypeGhost {
+		// The directory exists on src's side, but has (different) content.
+		// Its children were already reported.
+		return nil
+	}
+
+	return ma.report(nil, dir, false, false, false)
+}
+
 func (ma *Mapper) reportByType(src, dst n.ModNode) error {
 	if src == nil || dst == nil {
 		return ma.report(src, dst, false, false, false)
@@ -480,7 +850,9 @@ func (ma *Mapper) reportByType(src, dst n.ModNode) error {
 	return ma.report(src, dst, isTypeMismatch, false, false)
 }
 
-func (ma *Mapper) report(src, dst n.ModNode, typeMismatch, isRemove, isMove bool) error {
+// report calls the map function with a pair. `candidates` are only
+// given for removals that might have been renames (see mapRenames).
+func (ma *Mapper) report(src, dst n.ModNode, typeMismatch, isRemove, isMove bool, candidates ...n.ModNode) error {
 	if src != nil {
 		ma.setSrcHandled(src)
 	}
@@ -489,12 +861,13 @@ func (ma *Mapper) report(src, dst n.ModNode, typeMismatch, isRemove, isMove bool
 		ma.setDstHandled(dst)
 	}
 
-	debug("=> report", src, dst)
+	debug("=> report", src, dst, candidates)
 	return ma.fn(MapPair{
-		Src:           src,
-		Dst:           dst,
-		TypeMismatch:  typeMismatch,
-		SrcWasRemoved: isRemove,
-		SrcWasMoved:   isMove,
+		Src:              src,
+		Dst:              dst,
+		TypeMismatch:     typeMismatch,
+		SrcWasRemoved:    isRemove,
+		SrcWasMoved:      isMove,
+		RenameCandidates: candidates,
 	})
 }
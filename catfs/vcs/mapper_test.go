@@ -0,0 +1,182 @@
+package vcs
+
+import (
+	"testing"
+
+	c "floo/catfs/core"
+	n "floo/catfs/nodes"
+	"github.com/stretchr/testify/require"
+)
+
+type mapperPair struct {
+	src, dst         string
+	removed, moved   bool
+	candidates       []string
+	typeMismatch     bool
+	srcType, dstType n.NodeType
+}
+
+func mapperPaths(pair MapPair) mapperPair {
+	mp := mapperPair{
+		removed:      pair.SrcWasRemoved,
+		moved:        pair.SrcWasMoved,
+		typeMismatch: pair.TypeMismatch,
+	}
+
+	if pair.Src != nil {
+		mp.src = pair.Src.Path()
+		mp.srcType = pair.Src.Type()
+	}
+
+	if pair.Dst != nil {
+		mp.dst = pair.Dst.Path()
+		mp.dstType = pair.Dst.Type()
+	}
+
+	for _, candidate := range pair.RenameCandidates {
+		mp.candidates = append(mp.candidates, candidate.Path())
+	}
+
+	return mp
+}
+
+// withMapper creates two linkers, lets `setup` fill them and
+// returns everything the mapper reported for src -> dst.
+func withMapper(t *testing.T, detectRenames bool, setup func(lkrSrc, lkrDst *c.Linker)) []mapperPair {
+	pairs := []mapperPair{}
+	c.WithDummyLinker(t, func(lkrSrc *c.Linker) {
+		c.WithDummyLinker(t, func(lkrDst *c.Linker) {
+			setup(lkrSrc, lkrDst)
+
+			srcHead, err := lkrSrc.Head()
+			require.Nil(t, err)
+
+			srcRoot, err := lkrSrc.DirectoryByHash(srcHead.Root())
+			require.Nil(t, err)
+
+			mapper, err := NewMapper(lkrSrc, lkrDst, nil, nil, srcRoot)
+			require.Nil(t, err)
+
+			mapper.SetRenameDetection(detectRenames)
+			require.Nil(t, mapper.Map(func(pair MapPair) error {
+				pairs = append(pairs, mapperPaths(pair))
+				return nil
+			}))
+		})
+	})
+
+	return pairs
+}
+
+func mustRemove(t *testing.T, lkr *c.Linker, path string) {
+	nd, err := lkr.LookupModNode(path)
+	require.Nil(t, err)
+
+	_, _, err = c.Remove(lkr, nd, true, false)
+	require.Nil(t, err)
+}
+
+func mustMkdir(t *testing.T, lkr *c.Linker, path string) {
+	_, err := c.Mkdir(lkr, path, true)
+	require.Nil(t, err)
+}
+
+func TestMapperEqual(t *testing.T) {
+	pairs := withMapper(t, false, func(lkrSrc, lkrDst *c.Linker) {
+		for _, lkr := range []*c.Linker{lkrSrc, lkrDst} {
+			mustMkdir(t, lkr, "/sub")
+			c.MustTouchAndCommit(t, lkr, "/sub/a", 1)
+			c.MustTouchAndCommit(t, lkr, "/b", 2)
+		}
+	})
+
+	require.Empty(t, pairs)
+}
+
+func TestMapperAddedAndMissing(t *testing.T) {
+	pairs := withMapper(t, false, func(lkrSrc, lkrDst *c.Linker) {
+		mustMkdir(t, lkrSrc, "/empty")
+		c.MustTouchAndCommit(t, lkrSrc, "/sub/a", 1)
+		c.MustTouchAndCommit(t, lkrDst, "/b", 2)
+	})
+
+	require.Equal(t, []mapperPair{
+		{src: "/empty", srcType: n.NodeTypeDirectory},
+		{src: "/sub/a", srcType: n.NodeTypeFile},
+		{dst: "/b", dstType: n.NodeTypeFile},
+	}, pairs)
+}
+
+func TestMapperModified(t *testing.T) {
+	pairs := withMapper(t, false, func(lkrSrc, lkrDst *c.Linker) {
+		c.MustTouchAndCommit(t, lkrSrc, "/a", 1)
+		c.MustTouchAndCommit(t, lkrDst, "/a", 2)
+	})
+
+	require.Equal(t, []mapperPair{
+		{src: "/a", dst: "/a", srcType: n.NodeTypeFile, dstType: n.NodeTypeFile},
+	}, pairs)
+}
+
+// setupRename creates `oldPath` on both sides and replaces it on src's side
+// with `newPath` (with content `seed`), without recording a move.
+func setupRename(t *testing.T, oldPath, newPath string, seed byte) func(lkrSrc, lkrDst *c.Linker) {
+	return func(lkrSrc, lkrDst *c.Linker) {
+		for _, lkr := range []*c.Linker{lkrSrc, lkrDst} {
+			mustMkdir(t, lkr, "/x")
+			mustMkdir(t, lkr, "/y")
+			c.MustTouchAndCommit(t, lkr, oldPath, 1)
+		}
+
+		mustRemove(t, lkrSrc, oldPath)
+		c.MustTouchAndCommit(t, lkrSrc, newPath, seed)
+	}
+}
+
+func TestMapperRename(t *testing.T) {
+	pairs := withMapper(t, true, setupRename(t, "/x/a", "/x/b", 1))
+	require.Equal(t, []mapperPair{
+		{src: "/x/b", dst: "/x/a", moved: true, srcType: n.NodeTypeFile, dstType: n.NodeTypeFile},
+	}, pairs)
+
+	// Without rename detection it is a remove and an add:
+	pairs = withMapper(t, false, setupRename(t, "/x/a", "/x/b", 1))
+	require.Equal(t, []mapperPair{
+		{dst: "/x/a", removed: true, dstType: n.NodeTypeFile},
+		{src: "/x/b", srcType: n.NodeTypeFile},
+	}, pairs)
+}
+
+func TestMapperRenameAndModify(t *testing.T) {
+	// The content differs, so there is nothing to pair by:
+	pairs := withMapper(t, true, setupRename(t, "/x/a", "/x/b", 2))
+	require.Equal(t, []mapperPair{
+		{dst: "/x/a", removed: true, dstType: n.NodeTypeFile},
+		{src: "/x/b", srcType: n.NodeTypeFile},
+	}, pairs)
+}
+
+func TestMapperRenameAcrossDirectories(t *testing.T) {
+	pairs := withMapper(t, true, setupRename(t, "/x/a", "/y/a", 1))
+	require.Equal(t, []mapperPair{
+		{src: "/y/a", dst: "/x/a", moved: true, srcType: n.NodeTypeFile, dstType: n.NodeTypeFile},
+	}, pairs)
+}
+
+func TestMapperRenameAmbiguous(t *testing.T) {
+	pairs := withMapper(t, true, func(lkrSrc, lkrDst *c.Linker) {
+		setupRename(t, "/x/a", "/y/a", 1)(lkrSrc, lkrDst)
+		c.MustTouchAndCommit(t, lkrSrc, "/y/b", 1)
+	})
+
+	require.ElementsMatch(t, []mapperPair{
+		{
+			dst:        "/x/a",
+			removed:    true,
+			dstType:    n.NodeTypeFile,
+			candidates: []string{"/y/a", "/y/b"},
+		},
+		{src: "/y/a", srcType: n.NodeTypeFile},
+		{src: "/y/b", srcType: n.NodeTypeFile},
+	}, pairs)
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"floo/catfs/db"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func handleDbMigrate(ctx *cli.Context) error {
+	srcDir, dstDir := ctx.Args().Get(0), ctx.Args().Get(1)
+	srcBackend, dstBackend := ctx.String("from"), ctx.String("to")
+	if dstBackend == "" {
+		return ExitCode{BadArgs, "--to is required"}
+	}
+
+	if dstBackend != "memory" {
+		// Merging into an existing database is most likely a mistake.
+		if entries, err := os.ReadDir(dstDir); err == nil && len(entries) > 0 {
+			return ExitCode{BadArgs, fmt.Sprintf("%s is not empty", dstDir)}
+		}
+
+		if err := os.MkdirAll(dstDir, 0700); err != nil {
+			return err
+		}
+	}
+
+	src, err := db.NewDatabase(srcBackend, srcDir)
+	if err != nil {
+		return ExitCode{BadArgs, fmt.Sprintf("failed to open source: %v", err)}
+	}
+
+	defer src.Close()
+
+	dst, err := db.NewDatabase(dstBackend, dstDir)
+	if err != nil {
+		return ExitCode{BadArgs, fmt.Sprintf("failed to open destination: %v", err)}
+	}
+
+	defer dst.Close()
+
+	logVerbose(ctx, "migrating %s (%s) to %s (%s)", srcDir, srcBackend, dstDir, dstBackend)
+	if err := db.Migrate(dst, src); err != nil {
+		return err
+	}
+
+	keys, err := dst.Keys()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("migrated %d keys to %s", len(keys), dstBackend)
+	return nil
+}
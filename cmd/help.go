@@ -20,6 +20,34 @@ var helpTexts = map[string]helpEntry{
 		ArgsUsage: "<username>",
 		Complete:  completeArgsUsage,
 	},
+	"db": {
+		Usage: "Low-level operations on the metadata database.",
+	},
+	"db.migrate": {
+		Usage:     "Copy the metadata database to another backend.",
+		ArgsUsage: "<src-dir> <dst-dir>",
+		Complete:  completeArgsUsage,
+		Description: `Export all keys of the database in <src-dir> and import them
+   into a new database in <dst-dir>. The source is not modified.
+   Both sides use the backend-neutral dump format, so any backend can be
+   migrated to any other one. <dst-dir> must be empty or not exist yet.
+   Migrating to "memory" only checks that the database can be read.
+
+EXAMPLES:
+
+   $ floo db migrate --from disk --to badger ./metadata ./metadata.badger`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "from,f",
+				Value: "disk",
+				Usage: "Backend of the source database (memory, disk, badger, bolt)",
+			},
+			cli.StringFlag{
+				Name:  "to,t",
+				Usage: "Backend of the new database (memory, disk, badger, bolt)",
+			},
+		},
+	},
 }
 
 func translateHelp(cmds []cli.Command, prefix []string) {
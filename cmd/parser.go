@@ -38,6 +38,15 @@ func RunCmdline(args []string) int {
 			Name:     "init",
 			Category: repoGroup,
 			Action:   handleInit,
+		}, {
+			Name:     "db",
+			Category: repoGroup,
+			Subcommands: []cli.Command{
+				{
+					Name:   "migrate",
+					Action: withArgCheck(needAtLeast(2), handleDbMigrate),
+				},
+			},
 		}, {
 			Name:     "whoami",
 			Aliases:  []string{"id"},
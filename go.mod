@@ -9,6 +9,8 @@ require (
 	github.com/dgraph-io/badger v1.5.4
 	github.com/golang/snappy v0.0.3
 	github.com/ipfs/go-ipfs-util v0.0.2
+	github.com/klauspost/compress v1.15.15
+	github.com/klauspost/reedsolomon v1.9.3
 	github.com/multiformats/go-multihash v0.2.1
 	github.com/pkg/errors v0.9.1
 	github.com/sahib/config v0.2.0
@@ -16,6 +18,7 @@ require (
 	github.com/sirupsen/logrus v1.9.0
 	github.com/stretchr/testify v1.7.0
 	github.com/urfave/cli v1.22.10
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 	zombiezen.com/go/capnproto2 v2.18.2+incompatible
 )
@@ -26,6 +29,7 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgryski/go-farm v0.0.0-20190423205320-6a90982ecee2 // indirect
 	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/klauspost/cpuid v1.3.1 // indirect
 	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/minio/sha256-simd v1.0.0 // indirect
@@ -207,19 +207,31 @@ func TestDummy(t *testing.T, seed byte) Hash {
 // HashWriter is a io.Writer that supports being written to.
 type HashWriter struct {
 	hash hash.Hash
+	code uint64
 }
 
 // NewHashWriter returns a new HashWriter.
-// Currently it is always sha3-256.
+// It uses the internal hashing algorithm, like Sum().
 func NewHashWriter() *HashWriter {
 	b, _ := blake2s.New256(nil)
-	return &HashWriter{hash: b}
+	return &HashWriter{hash: b, code: internalHashAlgo}
+}
+
+// NewBackendHashWriter returns a new HashWriter that uses
+// the same algorithm as SumWithBackendHash().
+func NewBackendHashWriter() *HashWriter {
+	hsh, err := multihash.GetHasher(goipfsutil.DefaultIpfsHash)
+	if err != nil {
+		panic(fmt.Sprintf("no hasher for the backend hash: %v", err))
+	}
+
+	return &HashWriter{hash: hsh, code: goipfsutil.DefaultIpfsHash}
 }
 
 // Finalize returns the final hash of the written data.
 func (hw *HashWriter) Finalize() Hash {
 	sum := hw.hash.Sum(nil)
-	hash, err := multihash.Encode(sum, internalHashAlgo)
+	hash, err := multihash.Encode(sum, hw.code)
 	if err != nil {
 		// If this does not work, there's something serious wrong.
 		panic(fmt.Sprintf("failed to encode final hash: %v", err))
@@ -22,3 +22,19 @@ func TestHashWriter(t *testing.T) {
 		t.Fatalf("hashes differ due to different feed order")
 	}
 }
+
+func TestHashWriterMatchesSum(t *testing.T) {
+	data := []byte("hello world")
+
+	hw := NewHashWriter()
+	hw.Write(data)
+	if !hw.Finalize().Equal(Sum(data)) {
+		t.Fatalf("HashWriter differs from Sum")
+	}
+
+	bhw := NewBackendHashWriter()
+	bhw.Write(data)
+	if !bhw.Finalize().Equal(SumWithBackendHash(data)) {
+		t.Fatalf("backend HashWriter differs from SumWithBackendHash")
+	}
+}